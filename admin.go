@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"network-test/pkg/secrets"
+)
+
+const (
+	maxAdminBodyLen = 1024
+	bearerPrefix    = "Bearer "
+)
+
+var (
+	errBadJSON        = "failed to parse JSON request body"
+	errBadLogLevel    = "unknown log level"
+	errUnauthorized   = "missing or invalid admin token"
+	errNoAdminSecret  = "admin endpoints are disabled because no admin token is configured"
+	errNoEphemeralKey = "no ephemeral key because no attestation metadata is configured"
+	errFailedRotation = "failed to rotate ephemeral key"
+)
+
+// adminAuth returns middleware that only lets through requests that carry
+// the admin token as bearer token in their Authorization header.  The token
+// is either the given static token or, if secretName is set, the secret of
+// that name in the given store, e.g., a token that was decrypted via KMS.  If
+// no token is available, all requests are rejected.
+func adminAuth(token, secretName string, store *secrets.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := []byte(token)
+			if secretName != "" {
+				secret, _ := store.Get(secretName)
+				defer zero(secret)
+				want = secret
+			}
+			if len(want) == 0 {
+				log.Printf("Admin: Rejecting request for %s: %s", r.URL.Path, errNoAdminSecret)
+				http.Error(w, errUnauthorized, http.StatusUnauthorized)
+				return
+			}
+
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, bearerPrefix) ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearerPrefix)), want) != 1 {
+				log.Printf("Admin: Rejecting unauthenticated request for %s from %s.", r.URL.Path, r.RemoteAddr)
+				http.Error(w, errUnauthorized, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// logLevelRequest is the request body of the log level endpoint.
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// logLevelResponse is the response body of the log level endpoint.
+type logLevelResponse struct {
+	Previous string `json:"previous"`
+	Level    string `json:"level"`
+}
+
+// logLevelHandler returns a HandlerFunc that changes the log level at runtime
+// and returns the previous level, which saves operators a redeploy when they
+// need debug logs.
+func logLevelHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req logLevelRequest
+		body := http.MaxBytesReader(w, r.Body, maxAdminBodyLen)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, errBadJSON, http.StatusBadRequest)
+			return
+		}
+		level, err := log.ParseLevel(req.Level)
+		if err != nil {
+			http.Error(w, errBadLogLevel, http.StatusBadRequest)
+			return
+		}
+
+		prev := log.GetLevel()
+		log.SetLevel(level)
+		log.Printf("Changed log level from %s to %s.", prev, level)
+		writeJSON(w, http.StatusOK, logLevelResponse{
+			Previous: prev.String(),
+			Level:    level.String(),
+		})
+	}
+}
+
+// rotateKeyResponse is the response body of the key rotation endpoint.
+type rotateKeyResponse struct {
+	PublicKey     string `json:"public_key"`
+	KeyID         string `json:"key_id"`
+	EncryptionKey string `json:"encryption_key"`
+}
+
+// rotateKeyHandler returns a HandlerFunc that replaces our ephemeral
+// metadata signing key right away, e.g., if operators suspect that it was
+// compromised.  We then ask for a new boot attestation document, so the
+// X-Enclave-Attestation-Digest header refers to a document that binds the
+// new key.  For KeyRotationOverlap, metadata is also signed by the previous
+// key, so clients that verified the previous boot document keep working, and
+// payloads that were sealed to the previous key can still be opened.  The
+// response contains the new public key, its ID, which is the hex-encoded
+// first 8 bytes of the key's SHA-256 digest, and the X25519 key to which
+// clients seal payloads.
+func rotateKeyHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e.meta == nil {
+			http.Error(w, errNoEphemeralKey, http.StatusConflict)
+			return
+		}
+		pub, err := e.meta.rotate()
+		if err != nil {
+			log.Printf("Admin: Failed to rotate ephemeral key: %v", err)
+			http.Error(w, errFailedRotation, http.StatusInternalServerError)
+			return
+		}
+		encKey, err := e.meta.encryptionKey()
+		if err != nil {
+			log.Printf("Admin: Failed to derive encryption key: %v", err)
+			http.Error(w, errFailedRotation, http.StatusInternalServerError)
+			return
+		}
+		sum := sha256.Sum256(pub)
+		keyID := hex.EncodeToString(sum[:8])
+		log.Printf("Rotated ephemeral key; new key ID is %s.", keyID)
+
+		if err := e.renewBootAttestation(); err != nil {
+			log.Warnf("Admin: Failed to renew boot attestation after key rotation: %v", err)
+		}
+
+		writeJSON(w, http.StatusOK, rotateKeyResponse{
+			PublicKey:     base64.StdEncoding.EncodeToString(pub),
+			KeyID:         keyID,
+			EncryptionKey: base64.StdEncoding.EncodeToString(encKey),
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"network-test/pkg/secrets"
+)
+
+// setLogLevel asks the log level endpoint for the given level and returns the
+// response.
+func setLogLevel(t *testing.T, level string) (int, logLevelResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, pathAdminLogLevel, strings.NewReader(`{"level":"`+level+`"}`))
+	logLevelHandler()(w, r)
+	var resp logLevelResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response %q: %v", w.Body, err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	orig := log.GetLevel()
+	defer log.SetLevel(orig)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	log.SetLevel(log.InfoLevel)
+
+	code, resp := setLogLevel(t, "warning")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, code)
+	}
+	if resp.Previous != "info" || resp.Level != "warning" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+	hook.Reset()
+	log.Info("filtered")
+	log.Warn("logged")
+	if entries := hook.AllEntries(); len(entries) != 1 || entries[0].Message != "logged" {
+		t.Errorf("Expected only the warning to be logged but got %d entries.", len(entries))
+	}
+
+	if _, resp = setLogLevel(t, "debug"); resp.Previous != "warning" {
+		t.Errorf("Expected previous level %q but got %q.", "warning", resp.Previous)
+	}
+	hook.Reset()
+	log.Debug("logged")
+	if len(hook.AllEntries()) != 1 {
+		t.Error("Expected debug message to be logged.")
+	}
+
+	for _, body := range []string{`{"level":"loud"}`, `not JSON`} {
+		w := httptest.NewRecorder()
+		logLevelHandler()(w, httptest.NewRequest(http.MethodPost, pathAdminLogLevel, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %q but got %d.", http.StatusBadRequest, body, w.Code)
+		}
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("Expected bad requests to keep the level but got %s.", log.GetLevel())
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	store := secrets.New()
+	store.Put("admin", []byte("from-kms"))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		name       string
+		token      string
+		secretName string
+		auth       string
+		code       int
+	}{
+		{"valid token", "s3cret", "", "Bearer s3cret", http.StatusOK},
+		{"missing token", "s3cret", "", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "", "Bearer guess", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "", "Basic s3cret", http.StatusUnauthorized},
+		{"no token configured", "", "", "Bearer ", http.StatusUnauthorized},
+		{"valid secret", "s3cret", "admin", "Bearer from-kms", http.StatusOK},
+		{"secret takes precedence", "s3cret", "admin", "Bearer s3cret", http.StatusUnauthorized},
+		{"secret not stored", "", "missing", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, pathAdminLogLevel, nil)
+			if c.auth != "" {
+				r.Header.Set("Authorization", c.auth)
+			}
+			adminAuth(c.token, c.secretName, store)(ok).ServeHTTP(w, r)
+			if w.Code != c.code {
+				t.Errorf("Expected status code %d but got %d.", c.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestPublicDecryptCannotReplaceAdminToken(t *testing.T) {
+	useFakeRecipient(t)
+	orig := log.GetLevel()
+	defer log.SetLevel(orig)
+
+	cfg := testConfig()
+	cfg.KMS = &fakeKMS{}
+	cfg.AdminTokenSecret = "admin"
+	e := newTestEnclave(t, cfg)
+
+	// The enclave application decrypts the admin token via the
+	// enclave-internal Web server.
+	rec := postDecrypt(t, e.intSrv.Handler, pathDecrypt+"?name=admin", "s3cret")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, rec.Code)
+	}
+
+	// A requester with a valid attestation token must not replace it.
+	r := httptest.NewRequest(http.MethodPost, pathDecrypt+"?name=admin", strings.NewReader("mine"))
+	token, err := e.tokens.issue(clientIP(r), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(attestationTokenHeader, token)
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusForbidden, w.Code)
+	}
+
+	for token, code := range map[string]int{"s3cret": http.StatusOK, "mine": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, pathAdminLogLevel, strings.NewReader(`{"level":"info"}`))
+		r.Header.Set("Authorization", bearerPrefix+token)
+		e.intSrv.Handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("Expected status code %d for token %q but got %d.", code, token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pathHostDetach is the path at which we ask the proxy on the EC2 host to
+	// drop a stale tunnel of ours, so we can attach again.
+	pathHostDetach = "/detach"
+)
+
+var (
+	// errAlreadyAttached means that the host rejected our tunnel because it
+	// still considers a previous tunnel of ours attached.
+	errAlreadyAttached = errors.New("host considers enclave already attached")
+
+	httpRespPrefix = []byte("HTTP/")
+)
+
+// attachConn is the connection to the host proxy after we asked it to attach
+// our tunnel.  A host that accepts the tunnel starts sending frames right
+// away, without an HTTP response.  A host that rejects it sends an HTTP
+// response instead, which we detect on the first Read.
+type attachConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	err  error
+}
+
+func newAttachConn(c net.Conn) *attachConn {
+	return &attachConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *attachConn) init() {
+	c.once.Do(func() {
+		prefix, err := c.r.Peek(len(httpRespPrefix))
+		if err != nil || !bytes.Equal(prefix, httpRespPrefix) {
+			return
+		}
+		resp, err := http.ReadResponse(c.r, nil)
+		if err != nil {
+			c.err = fmt.Errorf("host rejected tunnel with malformed response: %w", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			c.err = errAlreadyAttached
+			return
+		}
+		c.err = fmt.Errorf("host rejected tunnel: %w", hostStatusError(resp.StatusCode))
+	})
+}
+
+func (c *attachConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// detachFromHost asks the host proxy to drop the tunnel that it still
+// considers attached, so our next attempt to attach succeeds.  Detaching is
+// idempotent.  Hosts that don't track tunnels don't know the detach path, in
+// which case there's nothing to detach.
+func detachFromHost(n *NetConfig) error {
+	_, err := queryHost(n, http.MethodPost, pathHostDetach, 64)
+	var status hostStatusError
+	if errors.As(err, &status) && (status == http.StatusNotFound || status == http.StatusNoContent) {
+		return nil
+	}
+	return err
+}
+
+// recoverAttach handles the given error of a failed networking attempt.  If
+// the host rejected our tunnel because a stale one is still attached, we
+// detach the stale tunnel, so our next attempt can attach.  Callers must
+// only call recoverAttach right before reattaching, i.e., after checking if
+// the enclave is stopping.
+func recoverAttach(n *NetConfig, err error) {
+	if !errors.Is(err, errAlreadyAttached) {
+		return
+	}
+	if err := detachFromHost(n); err != nil {
+		log.Warnf("Failed to detach stale tunnel from host: %v", err)
+		return
+	}
+	metricReattaches.Add(1)
+	log.Println("Detached stale tunnel from host.  Reattaching.")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAttachHost mimics a proxy on the EC2 host that runs with the attach
+// guard: it rejects our tunnel with 409 Conflict while a stale one is still
+// attached, and drops the stale tunnel when we detach.  Accepted tunnels
+// receive frame as their first bytes.
+type fakeAttachHost struct {
+	sync.Mutex
+	attached bool
+	detaches int
+	frame    []byte
+}
+
+// useFakeAttachHost makes dialHost connect to the given fake host for the
+// duration of the test.
+func useFakeAttachHost(t *testing.T, h *fakeAttachHost) {
+	t.Helper()
+	orig := dialHost
+	dialHost = func(endpoint string) (net.Conn, string, error) {
+		i := strings.Index(strings.TrimPrefix(endpoint, "vsock://"), "/")
+		if i < 0 {
+			return nil, "", fmt.Errorf("bad endpoint %q", endpoint)
+		}
+		enclave, host := net.Pipe()
+		go h.serve(host)
+		return enclave, strings.TrimPrefix(endpoint, "vsock://")[i:], nil
+	}
+	t.Cleanup(func() { dialHost = orig })
+}
+
+func (h *fakeAttachHost) serve(c net.Conn) {
+	defer c.Close()
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	switch req.URL.Path {
+	case "/connect":
+		if h.attached {
+			fmt.Fprint(c, "HTTP/1.1 409 Conflict\r\nContent-Length: 17\r\n\r\nalready attached\n")
+			return
+		}
+		h.attached = true
+		_, _ = c.Write(h.frame)
+	case pathHostDetach:
+		h.attached = false
+		h.detaches++
+		fmt.Fprint(c, "HTTP/1.1 204 No Content\r\n\r\n")
+	default:
+		fmt.Fprint(c, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	}
+}
+
+func (h *fakeAttachHost) numDetaches() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.detaches
+}
+
+// attachTo attaches a tunnel to the host like setupNetworking does, and
+// returns the first bytes that the host sent.
+func attachTo(t *testing.T, n *NetConfig) ([]byte, error) {
+	t.Helper()
+	conn, path, err := dialHost(fmt.Sprintf("vsock://%d:%d/connect", n.ParentCID, n.HostProxyPort))
+	if err != nil {
+		t.Fatalf("Failed to connect to host: %v", err)
+	}
+	defer conn.Close()
+	if err := sendHandshake(conn, path, time.Second); err != nil {
+		t.Fatalf("Failed to send handshake: %v", err)
+	}
+	buf := make([]byte, 64)
+	l, err := newAttachConn(conn).Read(buf)
+	return buf[:l], err
+}
+
+func TestReattachAfterDetach(t *testing.T) {
+	host := &fakeAttachHost{attached: true, frame: []byte("frame")}
+	useFakeAttachHost(t, host)
+	n := validNetConfig()
+	before := metricReattaches.Value()
+
+	_, err := attachTo(t, n)
+	if !errors.Is(err, errAlreadyAttached) {
+		t.Fatalf("Expected %v but got %v.", errAlreadyAttached, err)
+	}
+	recoverAttach(n, err)
+	if got := host.numDetaches(); got != 1 {
+		t.Fatalf("Expected 1 detach but got %d.", got)
+	}
+	if got := metricReattaches.Value() - before; got != 1 {
+		t.Errorf("Expected reattach metric to grow by 1 but got %d.", got)
+	}
+
+	frame, err := attachTo(t, n)
+	if err != nil {
+		t.Fatalf("Expected host to accept reattached tunnel but got %v.", err)
+	}
+	if string(frame) != "frame" {
+		t.Fatalf("Expected first frame %q but got %q.", "frame", frame)
+	}
+}
+
+func TestRecoverAttachOtherErrors(t *testing.T) {
+	host := &fakeAttachHost{}
+	useFakeAttachHost(t, host)
+	recoverAttach(validNetConfig(), io.EOF)
+	if got := host.numDetaches(); got != 0 {
+		t.Fatalf("Expected no detach for unrelated error but got %d.", got)
+	}
+}
+
+func TestAttachConn(t *testing.T) {
+	cases := []struct {
+		name     string
+		fromHost string
+		want     string
+		wantErr  error
+	}{
+		{"frames", "\x00\x05frame", "\x00\x05frame", nil},
+		{"conflict", "HTTP/1.1 409 Conflict\r\nContent-Length: 0\r\n\r\n", "", errAlreadyAttached},
+		{"other status", "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n", "", hostStatusError(503)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			enclave, host := net.Pipe()
+			defer enclave.Close()
+			go func() {
+				defer host.Close()
+				fmt.Fprint(host, c.fromHost)
+			}()
+
+			buf := make([]byte, 64)
+			l, err := newAttachConn(enclave).Read(buf)
+			if c.wantErr != nil {
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("Expected %v but got %v.", c.wantErr, err)
+				}
+				return
+			}
+			if err != nil || string(buf[:l]) != c.want {
+				t.Fatalf("Expected %q but got %q and %v.", c.want, buf[:l], err)
+			}
+		})
+	}
+}
+
+func TestDetachFromLegacyHost(t *testing.T) {
+	useFakeHost(t, http.NotFoundHandler())
+	if err := detachFromHost(validNetConfig()); err != nil {
+		t.Fatalf("Expected nothing to detach from legacy host but got %v.", err)
+	}
+}
+
+// useFakeSetup makes runNetworking call the given function to set up
+// networking, and returns a pointer to the number of calls.
+func useFakeSetup(t *testing.T, setup func(call int, stop chan StopReason, ready func()) error) *int {
+	t.Helper()
+	calls := 0
+	orig := setupDevice
+	setupDevice = func(n *NetConfig, stop chan StopReason, _ *frameCapture, ready func()) error {
+		calls++
+		return setup(calls, stop, ready)
+	}
+	t.Cleanup(func() { setupDevice = orig })
+	return &calls
+}
+
+func TestRunNetworkingReattaches(t *testing.T) {
+	host := &fakeAttachHost{attached: true}
+	useFakeAttachHost(t, host)
+	calls := useFakeSetup(t, func(call int, stop chan StopReason, ready func()) error {
+		if call == 1 {
+			return errAlreadyAttached
+		}
+		if got := host.numDetaches(); got != 1 {
+			t.Errorf("Expected stale tunnel to be detached before reattaching but got %d detaches.", got)
+		}
+		ready()
+		<-stop
+		return nil
+	})
+
+	stop := make(chan StopReason)
+	ready := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- runNetworking(validNetConfig(), stop, func() { close(ready) }) }()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected networking to become ready after reattaching.")
+	}
+	stop <- StopSignal
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if *calls != 2 {
+		t.Fatalf("Expected 2 setup attempts but got %d.", *calls)
+	}
+}
+
+func TestRunNetworkingStopsBeforeReattaching(t *testing.T) {
+	host := &fakeAttachHost{attached: true}
+	useFakeAttachHost(t, host)
+	calls := useFakeSetup(t, func(int, chan StopReason, func()) error {
+		return errAlreadyAttached
+	})
+
+	// The enclave is stopping while the host rejects our tunnel.
+	stop := make(chan StopReason, 1)
+	stop <- StopSignal
+	if err := runNetworking(validNetConfig(), stop, func() {}); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("Expected 1 setup attempt but got %d.", *calls)
+	}
+	if got := host.numDetaches(); got != 0 {
+		t.Fatalf("Expected no detach while stopping but got %d.", got)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/hf/nitrite"
 	"github.com/hf/nsm"
@@ -22,33 +24,149 @@ const (
 	maxAttDocLen   = 5000         // A (reasonable?) upper limit for attestation doc lengths.
 	hashPrefix     = "sha256:"
 	hashSeparator  = ";"
+	// defaultAttestationTimeout bounds the time we wait for the NSM to issue
+	// an attestation document if the config doesn't specify a timeout.
+	defaultAttestationTimeout = 5 * time.Second
 )
 
 var (
-	errMethodNotGET      = "only HTTP GET requests are allowed"
-	errBadForm           = "failed to parse POST form data"
-	errNoNonce           = "could not find nonce in URL query parameters"
-	errBadNonceFormat    = fmt.Sprintf("unexpected nonce format; must be %d-digit hex string", nonceNumDigits)
-	errFailedAttestation = "failed to obtain attestation document from hypervisor"
-	nonceRegExp          = fmt.Sprintf("[a-f0-9]{%d}", nonceNumDigits)
+	errMethodNotGET       = "only HTTP GET requests are allowed"
+	errBadForm            = "failed to parse POST form data"
+	errNoNonce            = "could not find nonce in URL query parameters"
+	errBadNonceFormat     = fmt.Sprintf("unexpected nonce format; must be %d-digit hex string", nonceNumDigits)
+	errFailedAttestation  = "failed to obtain attestation document from hypervisor"
+	errTimeoutAttestation = "timed out while waiting for attestation document from hypervisor"
+	errFailedMetadata     = "failed to sign attestation metadata"
+	errReplayedNonce      = "nonce was already used; request a document with a fresh nonce"
+	errTooManyNonces      = "too many recent nonces; try again later"
+	nonceRegExp           = fmt.Sprintf("[a-f0-9]{%d}", nonceNumDigits)
 
 	// getPCRValues is a variable pointing to a function that returns PCR
 	// values.  Using a variable allows us to easily mock the function in our
 	// unit tests.
 	getPCRValues = func() (map[uint][]byte, error) { return _getPCRValues() }
+
+	// newAttester is a variable pointing to a function that returns the
+	// attester of new enclaves.  Using a variable allows us to replace the
+	// NSM in our unit tests.
+	newAttester = func() Attester { return nsmAttester{} }
+
+	ErrAttestationTimeout = errors.New("timed out while waiting for attestation document")
 )
 
+// Attester abstracts the hypervisor that issues attestation documents.  Using
+// an interface allows us to easily mock the hypervisor in our unit tests.
+type Attester interface {
+	Attest(nonce, userData, publicKey []byte) ([]byte, error)
+}
+
+// nsmAttester implements Attester by asking the Nitro Secure Module (NSM) for
+// attestation documents.
+type nsmAttester struct{}
+
+func (nsmAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	return attest(nonce, userData, publicKey)
+}
+
+// timeoutAttester wraps an Attester and gives up on attestation documents
+// that take longer than the given timeout, so a stuck NSM can't tie up our
+// handlers.  Note that the underlying request to the NSM can't be cancelled,
+// so we only allow one request at a time: while a request that we gave up on
+// is still stuck, we fail new requests right away instead of piling up
+// goroutines and NSM sessions behind it.
+type timeoutAttester struct {
+	Attester
+	timeout time.Duration
+	// slot holds a token while a request to the NSM is in flight.
+	slot chan struct{}
+
+	sync.Mutex
+	stuck bool // True while a request that we gave up on is in flight.
+}
+
+func newTimeoutAttester(a Attester, timeout time.Duration) *timeoutAttester {
+	if timeout == 0 {
+		timeout = defaultAttestationTimeout
+	}
+	return &timeoutAttester{Attester: a, timeout: timeout, slot: make(chan struct{}, 1)}
+}
+
+func (a *timeoutAttester) isStuck() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.stuck
+}
+
+func (a *timeoutAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	if a.isStuck() {
+		return nil, ErrAttestationTimeout
+	}
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slot <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrAttestationTimeout
+	}
+
+	type result struct {
+		doc []byte
+		err error
+	}
+	// The channel is buffered, so the goroutine can exit after we gave up.
+	ch := make(chan result, 1)
+	go func() {
+		doc, err := a.Attester.Attest(nonce, userData, publicKey)
+		ch <- result{doc, err}
+		a.Lock()
+		a.stuck = false
+		a.Unlock()
+		<-a.slot
+	}()
+
+	select {
+	case r := <-ch:
+		return r.doc, r.err
+	case <-timer.C:
+	}
+	a.Lock()
+	defer a.Unlock()
+	// The request may have completed while we weren't looking.
+	select {
+	case r := <-ch:
+		return r.doc, r.err
+	default:
+	}
+	a.stuck = true
+	return nil, ErrAttestationTimeout
+}
+
 // AttestationHashes contains hashes over public key material which we embed in
 // the enclave's attestation document for clients to verify.
 type AttestationHashes struct {
+	sync.RWMutex
 	tlsKeyHash [sha256.Size]byte // Always set.
 	appKeyHash [sha256.Size]byte // Sometimes set, depending on application.
 }
 
+// setTLSKeyHash sets the hash over our TLS certificate, and returns true if
+// the hash changed.
+func (a *AttestationHashes) setTLSKeyHash(hash [sha256.Size]byte) bool {
+	a.Lock()
+	defer a.Unlock()
+	if a.tlsKeyHash == hash {
+		return false
+	}
+	a.tlsKeyHash = hash
+	return true
+}
+
 // Serialize returns a byte slice that contains our concatenated hashes.  Note
 // that all hashes are always present.  If a hash was not initialized, it's set
 // to 0-bytes.
 func (a *AttestationHashes) Serialize() []byte {
+	a.RLock()
+	defer a.RUnlock()
 	str := fmt.Sprintf("%s%s%s%s%s",
 		hashPrefix,
 		a.tlsKeyHash,
@@ -58,12 +176,20 @@ func (a *AttestationHashes) Serialize() []byte {
 	return []byte(str)
 }
 
-// attestationHandler takes as input an AttestationHashes struct and returns a
-// HandlerFunc.  This HandlerFunc expects a nonce in the URL query parameters
-// and subsequently asks its hypervisor for an attestation document that
-// contains both the nonce and the hashes in the given struct.  The resulting
-// Base64-encoded attestation document is then returned to the requester.
-func attestationHandler(hashes *AttestationHashes) http.HandlerFunc {
+// attestationHandler takes as input an Attester, an AttestationHashes struct,
+// a token store, a metadata signer, a nonce cache, and an audit log, and
+// returns a HandlerFunc.  This
+// HandlerFunc expects a nonce in the URL query parameters and subsequently
+// asks its hypervisor for an attestation document that contains both the
+// nonce and the hashes in the given struct.  The resulting Base64-encoded
+// attestation document is then returned to the requester, along with an
+// attestation token that grants the requester access to sensitive routes.
+// Requesters that accept JSON get the document in an envelope that also
+// contains signed metadata.  Nonces that were already used within the nonce
+// cache's window are rejected with 409 Conflict; a nonce is only used up if
+// we return a document for it.  Every document that we ask
+// the hypervisor for is recorded in the audit log.
+func attestationHandler(a Attester, hashes *AttestationHashes, tokens *tokenStore, meta *metadataSigner, nonces *nonceCache, audit *auditLog) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, errMethodNotGET, http.StatusMethodNotAllowed)
@@ -93,14 +219,54 @@ func attestationHandler(hashes *AttestationHashes) http.HandlerFunc {
 			http.Error(w, errBadNonceFormat, http.StatusBadRequest)
 			return
 		}
+		if !reserveNonce(w, r, nonces, nonce, "Attestation") {
+			return
+		}
 
-		rawDoc, err := attest(rawNonce, hashes.Serialize(), nil)
+		// The document must bind the key that signs its metadata, even if
+		// the key is rotated in the meantime.
+		meta := meta.current()
+		_, span := startSpan(r.Context(), "attestation")
+		userData := hashes.Serialize()
+		rawDoc, err := a.Attest(rawNonce, userData, meta.publicKey())
+		endSpan(span, err)
+		audit.attestation(clientIP(r), rawNonce, userData, rawDoc, err)
+		if err != nil {
+			// The client never got a document for this nonce, so it may
+			// try again with the same nonce.
+			nonces.release(nonce)
+		}
+		if errors.Is(err, ErrAttestationTimeout) {
+			log.Println("Attestation: Timed out while waiting for attestation document from hypervisor")
+			http.Error(w, errTimeoutAttestation, http.StatusGatewayTimeout)
+			return
+		}
 		if err != nil {
 			log.Println("Attestation: Failed to obtain attestation document from hypervisor:", err)
 			http.Error(w, errFailedAttestation, http.StatusInternalServerError)
 			return
 		}
 		b64Doc := base64.StdEncoding.EncodeToString(rawDoc)
+		// The document contains the client's nonce, so it must not be
+		// served to anyone else.
+		w.Header().Set("Cache-Control", "no-store")
+		if token, err := tokens.issue(clientIP(r), nonce); err != nil {
+			log.Println("Attestation: Failed to issue attestation token:", err)
+		} else {
+			w.Header().Set(attestationTokenHeader, token)
+		}
+		if wantsJSON(r) {
+			env := attestationEnvelope{Document: b64Doc}
+			if env.Metadata, env.MetadataSignature, err = meta.sign(); err != nil {
+				log.Println("Attestation: Failed to sign metadata:", err)
+				nonces.release(nonce)
+				http.Error(w, errFailedMetadata, http.StatusInternalServerError)
+				return
+			}
+			env.PreviousMetadataSignature = meta.signPrevious(env.Metadata)
+			writeJSON(w, http.StatusOK, env)
+			return
+		}
 		fmt.Fprintln(w, b64Doc)
 	}
 }
@@ -113,7 +279,11 @@ func _getPCRValues() (map[uint][]byte, error) {
 		return nil, err
 	}
 
-	res, err := nitrite.Verify(rawAttDoc, nitrite.VerifyOptions{})
+	roots, err := attestationRoots()
+	if err != nil {
+		return nil, err
+	}
+	res, err := nitrite.Verify(rawAttDoc, nitrite.VerifyOptions{Roots: roots})
 	if err != nil {
 		return nil, err
 	}
@@ -169,3 +339,22 @@ func attest(nonce, userData, publicKey []byte) ([]byte, error) {
 
 	return res.Attestation.Document, nil
 }
+
+// reserveNonce reserves the given nonce in the given cache.  If that fails,
+// it responds with 409 Conflict for replayed nonces or 503 Service
+// Unavailable for a full cache, and returns false.
+func reserveNonce(w http.ResponseWriter, r *http.Request, nonces *nonceCache, nonce, handler string) bool {
+	err := nonces.reserve(nonce)
+	switch {
+	case errors.Is(err, errNonceReplayed):
+		log.Printf("%s: Rejecting replayed nonce from %s.", handler, clientIP(r))
+		http.Error(w, errReplayedNonce, http.StatusConflict)
+		return false
+	case errors.Is(err, errNonceCacheFull):
+		log.Printf("%s: Rejecting nonce from %s: %v", handler, clientIP(r), err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errTooManyNonces, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+// WriteAttestation writes the given raw (i.e., CBOR-encoded) attestation
+// document to the given writer.
+func WriteAttestation(w io.Writer, doc []byte) error {
+	if _, err := w.Write(doc); err != nil {
+		return fmt.Errorf("failed to write attestation document: %w", err)
+	}
+	return nil
+}
+
+// DumpAttestationToFile asks the hypervisor for a fresh attestation document
+// and writes it to the file at the given path.  This allows us to archive an
+// enclave's attestation document alongside its release artifacts.
+func DumpAttestationToFile(path string) error {
+	doc, err := nsmAttester{}.Attest(nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to obtain attestation document: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if err = WriteAttestation(f, doc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadAttestation reads a raw attestation document from the given reader.  It
+// refuses to read documents that are larger than maxAttDocLen.
+func ReadAttestation(r io.Reader) ([]byte, error) {
+	doc, err := io.ReadAll(newLimitReader(r, maxAttDocLen))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attestation document: %w", err)
+	}
+	return doc, nil
+}
+
+// VerifyAttestationFile loads the raw attestation document from the file at
+// the given path and verifies it as of the given point in time.  Archived
+// documents are typically verified as of their creation time because the
+// certificates that they contain expire after a few hours.  If the given time
+// is zero, the current time is used.
+func VerifyAttestationFile(path string, at time.Time) (*nitrite.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	doc, err := ReadAttestation(f)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := attestationRoots()
+	if err != nil {
+		return nil, err
+	}
+	return nitrite.Verify(doc, nitrite.VerifyOptions{Roots: roots, CurrentTime: at})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttestationFileRoundTrip(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	useRootFile(t, fixtureRootPath)
+
+	path := filepath.Join(t.TempDir(), "attestation.cbor")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := WriteAttestation(f, doc); err != nil {
+		t.Fatalf("Failed to write attestation document: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+	read, err := ReadAttestation(f)
+	if err != nil {
+		t.Fatalf("Failed to read attestation document: %v", err)
+	}
+	if !bytes.Equal(read, doc) {
+		t.Error("Expected document to survive the round trip unchanged.")
+	}
+
+	res, err := VerifyAttestationFile(path, testEpoch)
+	if err != nil {
+		t.Fatalf("Failed to verify archived document: %v", err)
+	}
+	if !bytes.Equal(res.Document.Nonce, fixtureNonce) {
+		t.Errorf("Expected nonce %q but got %q.", fixtureNonce, res.Document.Nonce)
+	}
+
+	// The document's certificates expire after a few hours, so archived
+	// documents only verify as of their creation time.
+	if _, err := VerifyAttestationFile(path, testEpoch.AddDate(1, 0, 0)); err == nil {
+		t.Error("Expected verification with expired certificates to fail.")
+	}
+}
+
+func TestReadAttestationTooLarge(t *testing.T) {
+	_, err := ReadAttestation(bytes.NewReader(make([]byte, maxAttDocLen+1)))
+	if !errors.Is(err, errTooMuchToRead) {
+		t.Errorf("Expected %v but got %v.", errTooMuchToRead, err)
+	}
+}
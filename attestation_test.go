@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// testNonce is the hex-encoded nonce of our golden attestation requests.
+const testNonce = "0123456789abcdef0123456789abcdef01234567"
+
+// goldenFile compares the given output to the named golden file in testdata.
+// With -update, the golden file is overwritten instead.
+func goldenFile(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("Failed to update golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Output doesn't match %s (run with -update to accept it):\ngot:  %s\nwant: %s", path, got, want)
+	}
+}
+
+// testHashes returns attestation hashes with fixed key hashes.
+func testHashes() *AttestationHashes {
+	h := new(AttestationHashes)
+	copy(h.tlsKeyHash[:], bytes.Repeat([]byte{0x11}, len(h.tlsKeyHash)))
+	copy(h.appKeyHash[:], bytes.Repeat([]byte{0x22}, len(h.appKeyHash)))
+	return h
+}
+
+// testMetadataSigner returns a metadata signer whose key and clock are
+// fixed, so its signatures are reproducible.
+func testMetadataSigner() *metadataSigner {
+	return &metadataSigner{
+		key:    ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x33}, ed25519.SeedSize)),
+		static: map[string]string{"version": "1.2.3"},
+		now:    func() time.Time { return time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC) },
+	}
+}
+
+func requestAttestation(t *testing.T, h http.HandlerFunc, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+testNonce, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	return w
+}
+
+func TestDeterministicAttester(t *testing.T) {
+	a := DeterministicAttester{Seed: []byte("seed")}
+	doc1, err := a.Attest([]byte("nonce"), []byte("user data"), nil)
+	if err != nil {
+		t.Fatalf("Failed to attest: %v", err)
+	}
+	doc2, err := a.Attest([]byte("nonce"), []byte("user data"), nil)
+	if err != nil {
+		t.Fatalf("Failed to attest: %v", err)
+	}
+	if !bytes.Equal(doc1, doc2) {
+		t.Error("Expected identical documents for identical seed and input.")
+	}
+
+	other, err := DeterministicAttester{Seed: []byte("other seed")}.Attest([]byte("nonce"), []byte("user data"), nil)
+	if err != nil {
+		t.Fatalf("Failed to attest: %v", err)
+	}
+	if bytes.Equal(doc1, other) {
+		t.Error("Expected different documents for different seeds.")
+	}
+	if _, err := verifyDocument(doc1, []byte("nonce"), VerifyOptions{}); err == nil {
+		t.Error("Expected deterministic document to fail verification.")
+	}
+}
+
+func TestAttestationGolden(t *testing.T) {
+	h := attestationHandler(
+		DeterministicAttester{Seed: []byte("golden")},
+		testHashes(),
+		newTokenStore(0),
+		testMetadataSigner(),
+		nil,
+		nil,
+	)
+
+	w := requestAttestation(t, h, "")
+	goldenFile(t, "attestation.golden", w.Body.Bytes())
+
+	w = requestAttestation(t, h, "application/json")
+	goldenFile(t, "attestation_envelope.golden", w.Body.Bytes())
+}
+
+// stuckAttester implements Attester like an NSM that hangs until release is
+// closed.
+type stuckAttester struct {
+	release chan struct{}
+}
+
+func (a stuckAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	<-a.release
+	return []byte("too late"), nil
+}
+
+func TestTimeoutAttester(t *testing.T) {
+	stuck := stuckAttester{release: make(chan struct{})}
+	defer close(stuck.release)
+	const timeout = 50 * time.Millisecond
+	a := newTimeoutAttester(stuck, timeout)
+
+	start := time.Now()
+	_, err := a.Attest(nil, nil, nil)
+	if !errors.Is(err, ErrAttestationTimeout) {
+		t.Errorf("Expected %v but got %v.", ErrAttestationTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf("Expected to give up after %s but took %s.", timeout, elapsed)
+	}
+
+	// Attesters that respond in time are unaffected.
+	doc, err := newTimeoutAttester(&fakeAttester{doc: []byte("doc")}, timeout).Attest(nil, nil, nil)
+	if err != nil || string(doc) != "doc" {
+		t.Errorf("Expected document but got %q, %v.", doc, err)
+	}
+	if a := newTimeoutAttester(stuck, 0); a.timeout != defaultAttestationTimeout {
+		t.Errorf("Expected default timeout %s but got %s.", defaultAttestationTimeout, a.timeout)
+	}
+}
+
+func TestTimeoutAttesterDoesNotPileUp(t *testing.T) {
+	stuck := stuckAttester{release: make(chan struct{})}
+	a := newTimeoutAttester(stuck, 10*time.Millisecond)
+	if _, err := a.Attest(nil, nil, nil); !errors.Is(err, ErrAttestationTimeout) {
+		t.Fatalf("Expected %v but got %v.", ErrAttestationTimeout, err)
+	}
+
+	// While the NSM is stuck, further requests fail right away and leave
+	// no goroutines behind.
+	before := runtime.NumGoroutine()
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if _, err := a.Attest(nil, nil, nil); !errors.Is(err, ErrAttestationTimeout) {
+			t.Fatalf("Expected %v but got %v.", ErrAttestationTimeout, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > a.timeout {
+		t.Errorf("Expected requests to fail right away but they took %s.", elapsed)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("Expected at most %d goroutines but got %d.", before, after)
+	}
+
+	// Once the NSM recovers, so do we.
+	close(stuck.release)
+	deadline := time.Now().Add(time.Second)
+	for a.isStuck() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	a.Attester = &fakeAttester{doc: []byte("doc")}
+	if doc, err := a.Attest(nil, nil, nil); err != nil || string(doc) != "doc" {
+		t.Fatalf("Expected document after recovery but got %q, %v.", doc, err)
+	}
+}
+
+func TestAttestationHandlerTimeout(t *testing.T) {
+	stuck := stuckAttester{release: make(chan struct{})}
+	defer close(stuck.release)
+	h := attestationHandler(newTimeoutAttester(stuck, 10*time.Millisecond), testHashes(), newTokenStore(0), nil, nil, newAuditLog(io.Discard))
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+testNonce, nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status code %d but got %d.", http.StatusGatewayTimeout, w.Code)
+	}
+}
+
+func TestAttestationHandlerNoStore(t *testing.T) {
+	h := attestationHandler(&fakeAttester{doc: []byte("doc")}, testHashes(), newTokenStore(0), nil, nil, newAuditLog(io.Discard))
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+testNonce, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	// The document contains the client's nonce, so nobody may cache it.
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Expected Cache-Control no-store but got %q.", got)
+	}
+	if got := w.Header().Get("ETag"); got != "" {
+		t.Errorf("Expected no ETag but got %q.", got)
+	}
+}
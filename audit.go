@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog records every attestation document that we issue, for
+// compliance.  Entries are structured, and nonces and user data are only
+// logged as hashes.  A nil *auditLog records nothing.
+type auditLog struct {
+	logger *log.Logger
+}
+
+// newAuditLog returns an audit log that writes JSON entries to the given
+// writer, e.g., a file.  If the writer is nil, entries go to our regular log.
+func newAuditLog(w io.Writer) *auditLog {
+	if w == nil {
+		return &auditLog{logger: log.StandardLogger()}
+	}
+	l := log.New()
+	l.SetOutput(w)
+	l.SetFormatter(&log.JSONFormatter{})
+	return &auditLog{logger: l}
+}
+
+// attestation records an attestation request by the given client, which
+// resulted in the given document or error.  It also counts the request in
+// our metrics, even if a is nil.
+func (a *auditLog) attestation(client string, nonce, userData, doc []byte, err error) {
+	metricAttestations.Add(1)
+	if err != nil {
+		metricAttestationFailures.Add(1)
+	}
+	if a == nil {
+		return
+	}
+	fields := log.Fields{
+		"audit":            "attestation",
+		"client_ip":        client,
+		"nonce_sha256":     hashHex(nonce),
+		"user_data_sha256": hashHex(userData),
+		"success":          err == nil,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else {
+		fields["document_sha256"] = hashHex(doc)
+	}
+	a.logger.WithFields(fields).Info("Attestation request.")
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
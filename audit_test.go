@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// auditEntries decodes the JSON entries in the given audit log output.
+func auditEntries(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			t.Fatalf("Failed to decode audit entry %q: %v", s.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogAttestation(t *testing.T) {
+	var out bytes.Buffer
+	a := &fakeAttester{doc: []byte("document")}
+	hashes := testHashes()
+	h := attestationHandler(a, hashes, newTokenStore(0), nil, nil, newAuditLog(&out))
+	nonce := strings.Repeat("ab", nonceLen)
+	rawNonce, _ := hex.DecodeString(nonce)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+nonce, nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	h(w, r)
+	a.setErr(errNSMDown)
+	h(httptest.NewRecorder(), r)
+
+	entries := auditEntries(t, &out)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries but got %d.", len(entries))
+	}
+	for _, entry := range entries {
+		if _, err := time.Parse(time.RFC3339, entry["time"].(string)); err != nil {
+			t.Errorf("Expected RFC 3339 timestamp but got %v.", entry["time"])
+		}
+		want := map[string]interface{}{
+			"audit":            "attestation",
+			"client_ip":        "203.0.113.7",
+			"nonce_sha256":     hashHex(rawNonce),
+			"user_data_sha256": hashHex(hashes.Serialize()),
+		}
+		for k, v := range want {
+			if entry[k] != v {
+				t.Errorf("Expected %s %v but got %v.", k, v, entry[k])
+			}
+		}
+	}
+
+	if ok, digest := entries[0]["success"], entries[0]["document_sha256"]; ok != true || digest != hashHex([]byte("document")) {
+		t.Errorf("Expected successful entry with document digest but got %v.", entries[0])
+	}
+	if ok, msg := entries[1]["success"], entries[1]["error"]; ok != false || msg != errNSMDown.Error() {
+		t.Errorf("Expected failed entry with error but got %v.", entries[1])
+	}
+	if _, exists := entries[1]["document_sha256"]; exists {
+		t.Error("Expected no document digest for failed attestation.")
+	}
+	if strings.Contains(out.String(), nonce) {
+		t.Error("Expected raw nonce to be redacted from audit log.")
+	}
+}
+
+func TestAuditLogDefaultsToRegularLog(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	newAuditLog(nil).attestation("203.0.113.7", []byte("nonce"), nil, []byte("document"), nil)
+	entry := hook.LastEntry()
+	if entry == nil || entry.Data["audit"] != "attestation" {
+		t.Fatalf("Expected audit entry in regular log but got %v.", entry)
+	}
+}
+
+func TestAuditLogNil(t *testing.T) {
+	before := metricAttestations.Value()
+	var a *auditLog
+	a.attestation("203.0.113.7", nil, nil, nil, nil)
+	if got := metricAttestations.Value(); got != before+1 {
+		t.Fatalf("Expected nil audit log to count attestations but got %d.", got-before)
+	}
+}
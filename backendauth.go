@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backendSecretHeader is the response header in which the enclave
+// application proves that it's the backend we expect.
+const backendSecretHeader = "X-Nitriding-Backend-Secret"
+
+var errBadBackendSecret = errors.New("backend response lacks the expected backend secret")
+
+// verifyBackend returns a ModifyResponse function for our reverse proxy that
+// makes sure that responses carry the given shared secret in the backend
+// secret header.  This protects against a process that grabbed the
+// application's loopback port, e.g., after the application crashed.  A
+// response without the correct secret makes the reverse proxy return 502 Bad
+// Gateway.  The header is always removed before the response reaches the
+// client.
+func verifyBackend(secret string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		got := resp.Header.Get(backendSecretHeader)
+		resp.Header.Del(backendSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+			metricBackendRejected.Add(1)
+			log.Warnf("Reverse proxy: Rejecting response for %s: %v", resp.Request.URL.Path, errBadBackendSecret)
+			return errBadBackendSecret
+		}
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newProxiedEnclave returns an enclave whose reverse proxy forwards to a
+// backend that sets the given backend secret header, if any.
+func newProxiedEnclave(t *testing.T, secret, backendSends string) *Enclave {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if backendSends != "" {
+			w.Header().Set(backendSecretHeader, backendSends)
+		}
+		w.Write([]byte("hello"))
+	}))
+	t.Cleanup(backend.Close)
+
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	cfg.BackendSecret = secret
+	return newTestEnclave(t, cfg)
+}
+
+func TestVerifyBackend(t *testing.T) {
+	cases := []struct {
+		name         string
+		secret       string
+		backendSends string
+		wantCode     int
+	}{
+		{"correct secret", "s3cret", "s3cret", http.StatusOK},
+		{"wrong secret", "s3cret", "guess", http.StatusBadGateway},
+		{"missing secret", "s3cret", "", http.StatusBadGateway},
+		{"prefix of secret", "s3cret", "s3c", http.StatusBadGateway},
+		{"verification off", "", "", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newProxiedEnclave(t, c.secret, c.backendSends)
+			rejected := metricBackendRejected.Value()
+
+			rec := httptest.NewRecorder()
+			e.pubSrv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/foo", nil))
+			if rec.Code != c.wantCode {
+				t.Fatalf("Expected status code %d but got %d.", c.wantCode, rec.Code)
+			}
+			if got := rec.Header().Get(backendSecretHeader); got != "" {
+				t.Fatalf("Expected backend secret to be stripped but got %q.", got)
+			}
+			wantRejected := rejected
+			if c.wantCode == http.StatusBadGateway {
+				wantRejected++
+			}
+			if got := metricBackendRejected.Value(); got != wantRejected {
+				t.Fatalf("Expected %d rejected responses but got %d.", wantRejected, got)
+			}
+		})
+	}
+}
+
+func TestVerifyBackendPassesBody(t *testing.T) {
+	e := newProxiedEnclave(t, "s3cret", "s3cret")
+	rec := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if rec.Body.String() != "hello" {
+		t.Fatalf("Expected body %q but got %q.", "hello", rec.Body.String())
+	}
+}
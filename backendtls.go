@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errBadBackendCA        = errors.New("AppWebSrvCA contains no PEM-encoded certificate")
+	errInsecureNonLoopback = errors.New("AppWebSrvInsecure requires a loopback AppWebSrv")
+)
+
+// backendTLSConfig returns the TLS configuration that our reverse proxy uses
+// to talk to AppWebSrv, or nil if the default configuration is fine.
+func (c *Config) backendTLSConfig() (*tls.Config, error) {
+	if len(c.AppWebSrvCA) == 0 && !c.AppWebSrvInsecure {
+		return nil, nil
+	}
+	if c.AppWebSrvInsecure {
+		if !isLoopback(c.AppWebSrv) {
+			return nil, errInsecureNonLoopback
+		}
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(c.AppWebSrvCA) {
+		return nil, errBadBackendCA
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// backendTransport returns the transport of our reverse proxy, or nil for
+// http.DefaultTransport.  The config must be valid.
+func (c *Config) backendTransport() http.RoundTripper {
+	tlsConf, err := c.backendTLSConfig()
+	if err != nil || tlsConf == nil {
+		return nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConf
+	return t
+}
+
+// isLoopback returns true if the given URL's host is a loopback address or
+// "localhost".
+func isLoopback(u *url.URL) bool {
+	if u == nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// logBackendTLSError explains why the TLS handshake with AppWebSrv failed, if
+// it did, and returns true in that case.  Certificate errors are otherwise
+// reported as an opaque 502.
+func logBackendTLSError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		log.Errorf("Reverse proxy: AppWebSrv's certificate isn't signed by a trusted CA; set AppWebSrvCA to its CA: %v", err)
+	case errors.As(err, &invalid):
+		log.Errorf("Reverse proxy: AppWebSrv's certificate is invalid: %v", err)
+	case errors.As(err, &hostname):
+		log.Errorf("Reverse proxy: AppWebSrv's certificate doesn't match its URL's host: %v", err)
+	default:
+		return false
+	}
+	return true
+}
+
+// validateBackendTLS makes sure that the TLS settings for AppWebSrv are
+// usable.
+func (c *Config) validateBackendTLS() error {
+	if _, err := c.backendTLSConfig(); err != nil {
+		return fmt.Errorf("invalid TLS settings for AppWebSrv: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// newTLSBackend returns an https backend with a self-signed certificate,
+// along with the PEM-encoded certificate.
+func newTLSBackend(t *testing.T) (*httptest.Server, []byte) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from the backend"))
+	}))
+	t.Cleanup(srv.Close)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	return srv, ca
+}
+
+// proxyGet sends a request through the given enclave's reverse proxy.
+func proxyGet(e *Enclave) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestBackendTLS(t *testing.T) {
+	srv, ca := newTLSBackend(t)
+	for _, c := range []struct {
+		name     string
+		ca       []byte
+		insecure bool
+		wantCode int
+	}{
+		{"trusted CA", ca, false, http.StatusOK},
+		{"insecure loopback", nil, true, http.StatusOK},
+		{"untrusted", nil, false, http.StatusBadGateway},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AppWebSrv = mustParseURL(t, srv.URL)
+			cfg.AppWebSrvCA, cfg.AppWebSrvInsecure = c.ca, c.insecure
+			w := proxyGet(newTestEnclave(t, cfg))
+			if w.Code != c.wantCode {
+				t.Fatalf("Expected status code %d but got %d.", c.wantCode, w.Code)
+			}
+			if c.wantCode == http.StatusOK && w.Body.String() != "hello from the backend" {
+				t.Fatalf("Expected backend's response but got %q.", w.Body)
+			}
+		})
+	}
+}
+
+func TestBackendTLSErrorIsExplained(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	srv, _ := newTLSBackend(t)
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, srv.URL)
+	if w := proxyGet(newTestEnclave(t, cfg)); w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusBadGateway, w.Code)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel && strings.Contains(entry.Message, "AppWebSrvCA") {
+			return
+		}
+	}
+	t.Fatal("Expected an error that tells us to set AppWebSrvCA.")
+}
+
+func TestValidateBackendTLS(t *testing.T) {
+	_, ca := newTLSBackend(t)
+	for _, c := range []struct {
+		name     string
+		url      string
+		ca       []byte
+		insecure bool
+		wantErr  error
+	}{
+		{"defaults", "https://example.com", nil, false, nil},
+		{"valid CA", "https://example.com", ca, false, nil},
+		{"bad CA", "https://example.com", []byte("not a certificate"), false, errBadBackendCA},
+		{"insecure loopback", "https://127.0.0.1:8443", nil, true, nil},
+		{"insecure localhost", "https://localhost:8443", nil, true, nil},
+		{"insecure IPv6 loopback", "https://[::1]:8443", nil, true, nil},
+		{"insecure remote", "https://example.com", nil, true, errInsecureNonLoopback},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.AppWebSrv = mustParseURL(t, c.url)
+			cfg.AppWebSrvCA, cfg.AppWebSrvInsecure = c.ca, c.insecure
+			if err := cfg.validateBackendTLS(); !errors.Is(err, c.wantErr) {
+				t.Fatalf("Expected error %v but got %v.", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBackendTransport(t *testing.T) {
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, "https://example.com")
+	if tr := cfg.backendTransport(); tr != nil {
+		t.Fatalf("Expected default transport but got %v.", tr)
+	}
+	cfg.AppWebSrvInsecure = true
+	if tr := cfg.backendTransport(); tr != nil {
+		t.Fatal("Expected no transport for invalid TLS settings.")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setsockoptString is a variable pointing to a function that sets a socket
+// option with a string value.  Using a variable allows us to easily mock the
+// function in our unit tests.
+var setsockoptString = unix.SetsockoptString
+
+// validBindDevice returns nil if the given network device name can be bound
+// to.  The empty name means that connections aren't bound.
+func validBindDevice(name string) error {
+	if len(name) >= unix.IFNAMSIZ {
+		return fmt.Errorf("bad bind device %q: name longer than %d bytes", name, unix.IFNAMSIZ-1)
+	}
+	return nil
+}
+
+// bindToDevice returns a dialer control function that binds sockets to the
+// network device of the given name via SO_BINDTODEVICE, using the given
+// setsockopt function.  Bound sockets can only send and receive via that
+// device, regardless of the routing table.
+func bindToDevice(name string, setString func(fd, level, opt int, value string) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var optErr error
+		err := c.Control(func(fd uintptr) {
+			optErr = setString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, name)
+		})
+		if err == nil {
+			err = optErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to bind socket to %s: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// bindDialer makes the given dialer bind its connections, including the ones
+// of its DNS lookups, to the network device of the given name.
+func bindDialer(d *net.Dialer, name string) {
+	control := bindToDevice(name, setsockoptString)
+	d.Control = control
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     (&net.Dialer{Timeout: d.Timeout, Control: control}).DialContext,
+	}
+}
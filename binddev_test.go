@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// boundSocket is a socket option that was set via a fake setter.
+type boundSocket struct {
+	level, opt int
+	device     string
+}
+
+// useFakeBind makes dialers record the devices that they bind sockets to,
+// and fail binding with the given error.  It returns the recorded options.
+func useFakeBind(t *testing.T, err error) func() []boundSocket {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		bound []boundSocket
+	)
+	orig := setsockoptString
+	setsockoptString = func(fd, level, opt int, value string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		bound = append(bound, boundSocket{level, opt, value})
+		return err
+	}
+	t.Cleanup(func() { setsockoptString = orig })
+	return func() []boundSocket {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]boundSocket(nil), bound...)
+	}
+}
+
+// newLocalListener returns a TCP listener on the loopback interface that
+// accepts and closes connections.
+func newLocalListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func TestOutboundDialerBindsToDevice(t *testing.T) {
+	bound := useFakeBind(t, nil)
+	l := newLocalListener(t)
+
+	dial := newOutboundDialer(OutboundConfig{BindDevice: "tap0"})
+	c, err := dial(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	c.Close()
+
+	want := boundSocket{unix.SOL_SOCKET, unix.SO_BINDTODEVICE, "tap0"}
+	if got := bound(); len(got) != 1 || got[0] != want {
+		t.Fatalf("Expected socket to be bound via %+v but got %+v.", want, got)
+	}
+}
+
+func TestOutboundDialerWithoutDevice(t *testing.T) {
+	bound := useFakeBind(t, nil)
+	l := newLocalListener(t)
+
+	c, err := newOutboundDialer(OutboundConfig{})(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	c.Close()
+	if got := bound(); len(got) != 0 {
+		t.Fatalf("Expected no bound sockets but got %+v.", got)
+	}
+}
+
+func TestOutboundDialerBindFailure(t *testing.T) {
+	useFakeBind(t, syscall.EPERM)
+	l := newLocalListener(t)
+
+	_, err := newOutboundDialer(OutboundConfig{BindDevice: "tap0"})(context.Background(), "tcp", l.Addr().String())
+	if !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Expected %v but got %v.", syscall.EPERM, err)
+	}
+	if !strings.Contains(err.Error(), "tap0") {
+		t.Errorf("Expected error to name the device but got %q.", err)
+	}
+}
+
+func TestBindDialerBindsLookups(t *testing.T) {
+	bound := useFakeBind(t, nil)
+	d := &net.Dialer{}
+	bindDialer(d, "tap0")
+
+	// Dialing UDP sends nothing, so no DNS server is needed.
+	c, err := d.Resolver.Dial(context.Background(), "udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("Failed to dial resolver: %v", err)
+	}
+	c.Close()
+	if got := bound(); len(got) != 1 || got[0].device != "tap0" {
+		t.Fatalf("Expected lookup socket to be bound to tap0 but got %+v.", got)
+	}
+}
+
+func TestValidBindDevice(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		valid bool
+	}{
+		{"", true},
+		{"tap0", true},
+		{strings.Repeat("a", unix.IFNAMSIZ-1), true},
+		{strings.Repeat("a", unix.IFNAMSIZ), false},
+	} {
+		if err := validBindDevice(c.name); (err == nil) != c.valid {
+			t.Errorf("Expected %q to be valid=%t but got %v.", c.name, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	pathBootAttestation = "/enclave/attestation/boot"
+	// attestationDigestHeader carries the SHA-256 digest of our boot
+	// attestation document in every response of our public Web server.
+	attestationDigestHeader = "X-Enclave-Attestation-Digest"
+	// bootClient identifies the boot document in the audit log.
+	bootClient = "boot"
+)
+
+// bootAttestation holds the attestation document that we request at
+// startup.  It binds our attestation hashes and the public key of our
+// metadata signer, so clients can pin responses to this enclave instance:
+// they verify the boot document once and then compare its digest with the
+// digest in each response.  The digest is computed once, so the header
+// costs next to nothing.
+type bootAttestation struct {
+	cur atomic.Value // Holds a *bootDoc.
+}
+
+// bootDoc is a boot document along with its hex-encoded digest.  It's never
+// modified once stored, so readers always see a document and its own
+// digest.
+type bootDoc struct {
+	doc    []byte
+	digest string
+}
+
+// set stores the given document and its digest.
+func (b *bootAttestation) set(doc []byte) {
+	sum := sha256.Sum256(doc)
+	b.cur.Store(&bootDoc{doc: doc, digest: hex.EncodeToString(sum[:])})
+}
+
+// get returns the current boot document, or nil if we don't have one yet.
+func (b *bootAttestation) get() *bootDoc {
+	d, _ := b.cur.Load().(*bootDoc)
+	return d
+}
+
+// issued returns true if we have a boot document.
+func (b *bootAttestation) issued() bool {
+	return b.get() != nil
+}
+
+// renewBootAttestation asks for a boot document that binds our current
+// attestation hashes and metadata key, e.g., after either of them changed,
+// so the X-Enclave-Attestation-Digest header refers to an up-to-date
+// document.  If the attestation fails, the previous document stays in place.
+func (e *Enclave) renewBootAttestation() error {
+	userData := e.hashes.Serialize()
+	doc, err := e.attester.Attest(nil, userData, e.meta.publicKey())
+	e.audit.attestation(bootClient, nil, userData, doc, err)
+	if err != nil {
+		return err
+	}
+	e.boot.set(doc)
+	return nil
+}
+
+// middleware adds the digest of the boot document to all responses, once we
+// have the document.
+func (b *bootAttestation) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := b.get(); d != nil {
+			w.Header().Set(attestationDigestHeader, d.digest)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bootAttestationHandler returns a HandlerFunc that serves the Base64-encoded
+// boot document, whose digest is in the X-Enclave-Attestation-Digest header.
+// The document has no nonce, so clients judge its freshness by its
+// timestamp.
+func bootAttestationHandler(b *bootAttestation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := b.get()
+		if d == nil {
+			http.Error(w, errFailedAttestation, http.StatusServiceUnavailable)
+			return
+		}
+		// The document may have been renewed since the middleware set the
+		// header, so we set it again for the document that we serve.
+		w.Header().Set(attestationDigestHeader, d.digest)
+		fmt.Fprintln(w, base64.StdEncoding.EncodeToString(d.doc))
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// newBootTestEnclave returns an enclave whose attester produces
+// deterministic documents that depend on the attestation hashes.
+func newBootTestEnclave(t *testing.T) (*Enclave, *countingAttester) {
+	t.Helper()
+	e := newTestEnclave(t, testConfig())
+	a := &countingAttester{Attester: DeterministicAttester{Seed: []byte("boot")}}
+	e.attester = a
+	return e, a
+}
+
+// bootDigest returns the X-Enclave-Attestation-Digest header of a response of
+// the given enclave's public Web server.
+func bootDigest(e *Enclave) string {
+	w := httptest.NewRecorder()
+	e.publicHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Header().Get(attestationDigestHeader)
+}
+
+// bootDocument returns the boot document that the given enclave serves.
+func bootDocument(t *testing.T, e *Enclave) []byte {
+	t.Helper()
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathBootAttestation, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	doc, err := base64.StdEncoding.DecodeString(strings.TrimSpace(w.Body.String()))
+	if err != nil {
+		t.Fatalf("Failed to decode boot document: %v", err)
+	}
+	return doc
+}
+
+func digestOf(doc []byte) string {
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAttestationDigestHeader(t *testing.T) {
+	e, _ := newBootTestEnclave(t)
+	if got := bootDigest(e); got != "" {
+		t.Fatalf("Expected no digest before the boot document exists but got %q.", got)
+	}
+
+	if err := e.renewBootAttestation(); err != nil {
+		t.Fatalf("Failed to get boot attestation: %v", err)
+	}
+	want := digestOf(bootDocument(t, e))
+	// The header is present on every response, including errors.
+	for _, path := range []string{"/", pathBootAttestation, "/does-not-exist"} {
+		w := httptest.NewRecorder()
+		e.publicHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get(attestationDigestHeader); got != want {
+			t.Errorf("Expected digest %s for %s but got %q.", want, path, got)
+		}
+	}
+}
+
+func TestBootAttestationRenewedOnHashChange(t *testing.T) {
+	e, a := newBootTestEnclave(t)
+	first, second := testTLSCertificate(t, "first"), testTLSCertificate(t, "second")
+
+	// Before the boot document exists, Start takes care of it.
+	e.ReloadCertificate(first)
+	if n := a.numCalls(); n != 0 {
+		t.Fatalf("Expected no attestation before the boot document exists but got %d.", n)
+	}
+	if err := e.renewBootAttestation(); err != nil {
+		t.Fatalf("Failed to get boot attestation: %v", err)
+	}
+	oldDigest := bootDigest(e)
+
+	// A new certificate changes our hashes, so the boot document must bind
+	// them.
+	e.ReloadCertificate(second)
+	if n := a.numCalls(); n != 2 {
+		t.Fatalf("Expected boot document to be renewed but got %d attestations.", n)
+	}
+	doc := bootDocument(t, e)
+	if got := bootDigest(e); got == oldDigest || got != digestOf(doc) {
+		t.Fatalf("Expected digest of the renewed document but got %q.", got)
+	}
+	payload, err := decodeUserData(doc)
+	if err != nil {
+		t.Fatalf("Failed to decode boot document: %v", err)
+	}
+	if string(payload) != string(e.hashes.Serialize()) {
+		t.Fatal("Expected renewed boot document to bind our current hashes.")
+	}
+
+	// The same certificate doesn't change our hashes.
+	e.ReloadCertificate(second)
+	if n := a.numCalls(); n != 2 {
+		t.Fatalf("Expected no renewal for an unchanged certificate but got %d attestations.", n)
+	}
+}
+
+func TestBootAttestationRenewalFailure(t *testing.T) {
+	e, _ := newBootTestEnclave(t)
+	if err := e.renewBootAttestation(); err != nil {
+		t.Fatalf("Failed to get boot attestation: %v", err)
+	}
+	want := bootDigest(e)
+
+	e.attester = &fakeAttester{err: errNSMDown}
+	e.ReloadCertificate(testTLSCertificate(t, "new"))
+	if got := bootDigest(e); got != want {
+		t.Fatalf("Expected previous boot document to remain but got digest %q.", got)
+	}
+}
+
+func TestBootAttestationDigestMatchesDocument(t *testing.T) {
+	e, _ := newBootTestEnclave(t)
+	if err := e.renewBootAttestation(); err != nil {
+		t.Fatalf("Failed to get boot attestation: %v", err)
+	}
+
+	// Renew the document while clients fetch it.  Each client must get a
+	// document along with its own digest.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			e.boot.set([]byte(fmt.Sprintf("document %d", i)))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		w := httptest.NewRecorder()
+		e.publicHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathBootAttestation, nil))
+		doc, err := base64.StdEncoding.DecodeString(strings.TrimSpace(w.Body.String()))
+		if err != nil {
+			t.Fatalf("Failed to decode boot document: %v", err)
+		}
+		if got, want := w.Header().Get(attestationDigestHeader), digestOf(doc); got != want {
+			t.Fatalf("Expected digest %s of the served document but got %s.", want, got)
+		}
+	}
+}
+
+// testTLSCertificate returns a self-signed certificate with the given common
+// name.
+func testTLSCertificate(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(testCertificatePEM(t, cn))
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+// decodeUserData returns the user data of the given unverified document.
+func decodeUserData(rawDoc []byte) ([]byte, error) {
+	var outer coseSign1
+	if err := cbor.Unmarshal(rawDoc, &outer); err != nil {
+		return nil, err
+	}
+	var payload struct {
+		UserData []byte `cbor:"user_data"`
+	}
+	if err := cbor.Unmarshal(outer.Payload, &payload); err != nil {
+		return nil, err
+	}
+	return payload.UserData, nil
+}
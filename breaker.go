@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold   = 5
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets requests pass.
+	breakerClosed breakerState = iota
+	// breakerOpen fails requests fast.
+	breakerOpen
+	// breakerHalfOpen lets a single probe request pass to find out if the
+	// upstream has recovered.
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+// BreakerConfig configures the circuit breakers that protect upstream servers
+// from being hammered while they're failing.  Fields that are 0 take on their
+// default value.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed requests after
+	// which an upstream's breaker opens.  A negative value disables circuit
+	// breaking.
+	FailureThreshold int
+	// OpenTimeout determines for how long a breaker stays open before it
+	// lets a probe request pass.
+	OpenTimeout time.Duration
+}
+
+// breaker keeps track of the health of a single upstream.
+type breaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breakerTransport is an http.RoundTripper that wraps another RoundTripper
+// in per-host circuit breakers.  Requests fail with ErrCircuitOpen while a
+// host's breaker is open.  Transport errors and 5xx responses count as
+// failures.
+type breakerTransport struct {
+	sync.Mutex
+	next     http.RoundTripper
+	cfg      BreakerConfig
+	breakers map[string]*breaker
+	now      func() time.Time
+}
+
+func newBreakerTransport(next http.RoundTripper, cfg BreakerConfig) *breakerTransport {
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultBreakerThreshold
+	}
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	return &breakerTransport{
+		next:     next,
+		cfg:      cfg,
+		breakers: make(map[string]*breaker),
+		now:      time.Now,
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !t.allow(host) {
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, host)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	t.record(host, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+// allow returns true if a request to the given host may pass.
+func (t *breakerTransport) allow(host string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	b := t.breaker(host)
+	switch b.state {
+	case breakerOpen:
+		if t.now().Sub(b.openedAt) < t.cfg.OpenTimeout {
+			return false
+		}
+		t.setState(host, b, breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		// Only a single probe may be in flight.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record updates the given host's breaker with the outcome of a request.
+func (t *breakerTransport) record(host string, success bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	b := t.breaker(host)
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			t.setState(host, b, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= t.cfg.FailureThreshold {
+		b.openedAt = t.now()
+		t.setState(host, b, breakerOpen)
+	}
+}
+
+// breaker returns the given host's breaker, creating it if necessary.  The
+// caller must hold the lock.
+func (t *breakerTransport) breaker(host string) *breaker {
+	b, exists := t.breakers[host]
+	if !exists {
+		b = &breaker{state: breakerClosed}
+		t.breakers[host] = b
+		t.setState(host, b, breakerClosed)
+	}
+	return b
+}
+
+// setState transitions the given breaker to the given state and updates our
+// metrics.  The caller must hold the lock.
+func (t *breakerTransport) setState(host string, b *breaker, s breakerState) {
+	b.state = s
+	v := new(expvar.String)
+	v.Set(s.String())
+	metricBreakerState.Set(host, v)
+}
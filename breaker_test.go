@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusTransport implements http.RoundTripper by responding with its status
+// code, or failing with its error if it's set.
+type statusTransport struct {
+	status int
+	err    error
+	calls  int
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &http.Response{
+		StatusCode: t.status,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	const host = "upstream.example.com"
+	next := &statusTransport{status: http.StatusInternalServerError}
+	now := testEpoch
+	b := newBreakerTransport(next, BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	roundTrip := func() error {
+		resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assertState := func(expected breakerState) {
+		t.Helper()
+		b.Lock()
+		state := b.breakers[host].state
+		b.Unlock()
+		if state != expected {
+			t.Errorf("Expected breaker to be %s but it's %s.", expected, state)
+		}
+		if got := metricBreakerState.Get(host).String(); got != `"`+expected.String()+`"` {
+			t.Errorf("Expected metric %q but got %s.", expected, got)
+		}
+	}
+
+	// Closed: failures pass through until the threshold is reached.
+	for i := 0; i < 3; i++ {
+		if err := roundTrip(); err != nil {
+			t.Fatalf("Expected closed breaker to let request pass but got %v.", err)
+		}
+	}
+	assertState(breakerOpen)
+
+	// Open: requests fail fast without reaching the upstream.
+	calls := next.calls
+	if err := roundTrip(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected %v but got %v.", ErrCircuitOpen, err)
+	}
+	if next.calls != calls {
+		t.Error("Expected open breaker to keep requests from the upstream.")
+	}
+
+	// Half-open: after the timeout, a failing probe opens the breaker again.
+	now = now.Add(time.Minute)
+	if err := roundTrip(); err != nil {
+		t.Errorf("Expected probe to pass but got %v.", err)
+	}
+	assertState(breakerOpen)
+	if err := roundTrip(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected %v but got %v.", ErrCircuitOpen, err)
+	}
+
+	// Half-open: a successful probe closes the breaker.
+	now = now.Add(time.Minute)
+	next.status = http.StatusOK
+	if err := roundTrip(); err != nil {
+		t.Errorf("Expected probe to pass but got %v.", err)
+	}
+	assertState(breakerClosed)
+	if err := roundTrip(); err != nil {
+		t.Errorf("Expected closed breaker to let request pass but got %v.", err)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	const host = "probe.example.com"
+	now := testEpoch
+	b := newBreakerTransport(&statusTransport{err: errors.New("connection refused")},
+		BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	if _, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)); errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected transport error but got %v.", err)
+	}
+	now = now.Add(time.Minute)
+	if !b.allow(host) {
+		t.Fatal("Expected breaker to let a probe pass.")
+	}
+	if b.allow(host) {
+		t.Error("Expected breaker to hold back requests while a probe is in flight.")
+	}
+}
+
+func TestBreakerIsPerHost(t *testing.T) {
+	b := newBreakerTransport(&statusTransport{status: http.StatusBadGateway}, BreakerConfig{FailureThreshold: 1})
+	if _, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, "http://a.example.com/", nil)); err != nil {
+		t.Fatalf("Expected request to pass but got %v.", err)
+	}
+	if !b.allow("b.example.com") {
+		t.Error("Expected failures of one host not to affect another.")
+	}
+}
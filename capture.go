@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4 // Microsecond-resolution pcap files.
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	pcapLinkTypeEth  = 1
+	pcapGlobalHdrLen = 24
+	pcapRecordHdrLen = 16
+	// defaultCaptureMaxBytes caps the size of a capture file if the config
+	// doesn't specify a cap.
+	defaultCaptureMaxBytes = 64 * 1024 * 1024
+)
+
+// frameCapture writes the Ethernet frames that traverse the tunnel to a file
+// in pcap format, for offline analysis.  Once the file reaches its maximum
+// size, further frames are discarded.  A nil *frameCapture discards all
+// frames, which lets callers skip nil checks.
+type frameCapture struct {
+	sync.Mutex
+	f       *os.File
+	written int64
+	max     int64
+	full    bool
+}
+
+// newFrameCapture creates a pcap file at the given path that grows up to the
+// given number of bytes.  If max is 0, defaultCaptureMaxBytes is used.
+func newFrameCapture(path string, max int64) (*frameCapture, error) {
+	if max == 0 {
+		max = defaultCaptureMaxBytes
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	hdr := make([]byte, pcapGlobalHdrLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	// Bytes 8 to 16 hold the time zone offset and timestamp accuracy, which
+	// are always 0.
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeEth)
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+
+	return &frameCapture{
+		f:       f,
+		written: pcapGlobalHdrLen,
+		max:     max,
+	}, nil
+}
+
+// write appends the given frame to the capture file.
+func (c *frameCapture) write(frame []byte) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if c.full {
+		return
+	}
+	capLen := len(frame)
+	if capLen > pcapSnapLen {
+		capLen = pcapSnapLen
+	}
+	if c.written+pcapRecordHdrLen+int64(capLen) > c.max {
+		log.Printf("Capture file reached its maximum size of %d bytes.  Discarding frames.", c.max)
+		c.full = true
+		return
+	}
+
+	now := time.Now()
+	hdr := make([]byte, pcapRecordHdrLen)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(capLen))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(frame)))
+	if _, err := c.f.Write(append(hdr, frame[:capLen]...)); err != nil {
+		log.Printf("Failed to write frame to capture file; stopping capture: %v", err)
+		c.full = true
+		return
+	}
+	c.written += pcapRecordHdrLen + int64(capLen)
+}
+
+// Close closes the capture file.
+func (c *frameCapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.f.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// readCapture reads all frames of the given pcap file by means of gopacket's
+// pcap reader.
+func readCapture(t *testing.T, path string) [][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open capture file: %v", err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to parse pcap header: %v", err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("Expected link type Ethernet but got %s.", r.LinkType())
+	}
+
+	var frames [][]byte
+	for {
+		data, ci, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("Failed to read packet: %v", err)
+		}
+		if ci.CaptureLength != len(data) || ci.Length != len(data) {
+			t.Errorf("Unexpected lengths in capture info: %+v", ci)
+		}
+		frames = append(frames, data)
+	}
+}
+
+// testFrames returns Ethernet frames of different sizes.
+func testFrames() [][]byte {
+	return [][]byte{
+		bytes.Repeat([]byte{1}, 60),
+		bytes.Repeat([]byte{2}, 1514),
+		bytes.Repeat([]byte{3}, 342),
+	}
+}
+
+func TestFrameCaptureThroughRx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames.pcap")
+	capture, err := newFrameCapture(path, 0)
+	if err != nil {
+		t.Fatalf("Failed to create capture: %v", err)
+	}
+
+	sent := testFrames()
+	tap := newFakeTap(sent...)
+	errCh := make(chan error, 1)
+	var conn bytes.Buffer
+	rx(&conn, tap, errCh, 1500, prefixLen16, capture, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+	}
+	if err := capture.Close(); err != nil {
+		t.Fatalf("Failed to close capture: %v", err)
+	}
+
+	captured := readCapture(t, path)
+	if len(captured) != len(sent) {
+		t.Fatalf("Expected %d captured frames but got %d.", len(sent), len(captured))
+	}
+	for i := range sent {
+		if !bytes.Equal(captured[i], sent[i]) {
+			t.Errorf("Captured frame %d differs from the frame that was sent.", i)
+		}
+	}
+}
+
+func TestFrameCaptureMaxBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames.pcap")
+	frames := testFrames()
+	// Leave room for the first two frames only.
+	max := int64(pcapGlobalHdrLen + 2*pcapRecordHdrLen + len(frames[0]) + len(frames[1]))
+	capture, err := newFrameCapture(path, max)
+	if err != nil {
+		t.Fatalf("Failed to create capture: %v", err)
+	}
+	for _, f := range frames {
+		capture.write(f)
+	}
+	capture.Close()
+
+	if captured := readCapture(t, path); len(captured) != 2 {
+		t.Errorf("Expected 2 captured frames but got %d.", len(captured))
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() > max {
+		t.Errorf("Expected capture file of at most %d bytes: %v, %v", max, fi.Size(), err)
+	}
+}
+
+func TestNilFrameCapture(t *testing.T) {
+	var c *frameCapture
+	c.write([]byte{1, 2, 3})
+	if err := c.Close(); err != nil {
+		t.Errorf("Expected nil capture to discard frames but got %v.", err)
+	}
+}
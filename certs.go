@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoCertificate = errors.New("no TLS certificate loaded")
+
+// certHolder holds the public Web server's TLS certificate.  The certificate
+// can be swapped atomically while the server is running: new TLS handshakes
+// pick up the new certificate while existing connections are unaffected.
+type certHolder struct {
+	cert atomic.Value // Holds a *tls.Certificate.
+}
+
+// set swaps in the given certificate.
+func (h *certHolder) set(cert *tls.Certificate) {
+	h.cert.Store(cert)
+}
+
+// loaded returns true if a certificate was set.
+func (h *certHolder) loaded() bool {
+	return h.cert.Load() != nil
+}
+
+// getCertificate implements tls.Config's GetCertificate callback.
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := h.cert.Load().(*tls.Certificate)
+	if !ok {
+		return nil, errNoCertificate
+	}
+	return cert, nil
+}
+
+// ReloadCertificate swaps in the given TLS certificate for the public Web
+// server, e.g., after ACME renewed it.  There's no need to restart the
+// server.  If ReloadCertificate is called before Start, the public Web server
+// speaks HTTPS instead of HTTP.  Our attestation documents bind the hash of
+// the certificate, so we renew the boot document if we already have one.
+func (e *Enclave) ReloadCertificate(cert tls.Certificate) {
+	e.certs.set(&cert)
+	log.Println("Loaded new TLS certificate for public Web server.")
+	if len(cert.Certificate) == 0 {
+		return
+	}
+	if e.hashes.setTLSKeyHash(sha256.Sum256(cert.Certificate[0])) && e.boot.issued() {
+		if err := e.renewBootAttestation(); err != nil {
+			log.Warnf("Failed to renew boot attestation after certificate reload: %v", err)
+		}
+	}
+}
+
+// SetTLSFromPEM parses the given PEM-encoded certificate chain and private
+// key, and swaps them in like ReloadCertificate.  This lets the enclave
+// application install a certificate that it decrypted in memory, e.g., via
+// KMS, so the key never touches the enclave's file system.  The given key
+// bytes are zeroed once they're parsed, even if parsing fails.
+func (e *Enclave) SetTLSFromPEM(certPEM, keyPEM []byte) error {
+	defer zero(keyPEM)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate and key: %w", err)
+	}
+	e.ReloadCertificate(cert)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+// presentedCN performs a TLS handshake with the given address and returns the
+// common name of the certificate that the server presents, along with the
+// connection.
+func presentedCN(t *testing.T, addr string) (string, *tls.Conn) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+	if err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName, c
+}
+
+func TestReloadCertificate(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	if err := e.SetTLSFromPEM(testCertificatePEM(t, "first")); err != nil {
+		t.Fatalf("Failed to set certificate: %v", err)
+	}
+	addr := strings.TrimPrefix(serveTLS(t, &e.pubSrv), "https://")
+
+	cn, old := presentedCN(t, addr)
+	defer old.Close()
+	if cn != "first" {
+		t.Fatalf("Expected certificate %q but got %q.", "first", cn)
+	}
+
+	certPEM, keyPEM := testCertificatePEM(t, "second")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	e.ReloadCertificate(cert)
+
+	cn, c := presentedCN(t, addr)
+	defer c.Close()
+	if cn != "second" {
+		t.Errorf("Expected new handshake to present %q but got %q.", "second", cn)
+	}
+	// Existing connections keep their certificate.
+	if cn := old.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "first" {
+		t.Errorf("Expected existing connection to keep %q but got %q.", "first", cn)
+	}
+}
+
+func TestGetCertificateWithoutCertificate(t *testing.T) {
+	if _, err := new(certHolder).getCertificate(nil); err != errNoCertificate {
+		t.Errorf("Expected %v but got %v.", errNoCertificate, err)
+	}
+}
+
+// servedCN returns the common name of the certificate that the given
+// enclave's public Web server would present.
+func servedCN(t *testing.T, e *Enclave) string {
+	t.Helper()
+	cert, err := e.certs.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestSetTLSFromPEM(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	certPEM, keyPEM := testCertificatePEM(t, "in-memory")
+	if err := e.SetTLSFromPEM(certPEM, keyPEM); err != nil {
+		t.Fatalf("Expected valid PEM pair to be installed but got %v.", err)
+	}
+	if cn := servedCN(t, e); cn != "in-memory" {
+		t.Fatalf("Expected certificate %q but got %q.", "in-memory", cn)
+	}
+	if !bytes.Equal(keyPEM, make([]byte, len(keyPEM))) {
+		t.Fatal("Expected key bytes to be zeroed.")
+	}
+}
+
+func TestSetTLSFromPEMInvalid(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	if err := e.SetTLSFromPEM(testCertificatePEM(t, "first")); err != nil {
+		t.Fatalf("Failed to set certificate: %v", err)
+	}
+
+	certPEM, _ := testCertificatePEM(t, "second")
+	_, otherKeyPEM := testCertificatePEM(t, "other")
+	for _, c := range []struct {
+		name    string
+		certPEM []byte
+		keyPEM  []byte
+	}{
+		{"garbage", []byte("not a certificate"), []byte("not a key")},
+		{"no key", certPEM, nil},
+		{"mismatched key", certPEM, otherKeyPEM},
+	} {
+		keyPEM := append([]byte(nil), c.keyPEM...)
+		if err := e.SetTLSFromPEM(c.certPEM, keyPEM); err == nil {
+			t.Errorf("%s: Expected error but got none.", c.name)
+		}
+		if !bytes.Equal(keyPEM, make([]byte, len(keyPEM))) {
+			t.Errorf("%s: Expected key bytes to be zeroed despite the error.", c.name)
+		}
+	}
+	// The previous certificate stays in place.
+	if cn := servedCN(t, e); cn != "first" {
+		t.Fatalf("Expected certificate %q to remain but got %q.", "first", cn)
+	}
+}
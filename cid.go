@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mdlayher/vsock"
+)
+
+var (
+	// localCID and inEnclave are variables, so we can mock the CID source in
+	// our unit tests.
+	localCID  = vsock.ContextID
+	inEnclave = func() bool {
+		_, err := os.Stat("/dev/nsm")
+		return err == nil
+	}
+)
+
+// DetectParentCID determines the CID of the host that we should connect to.
+// Nitro Enclaves always reach their parent EC2 instance at CID 3 while
+// regular VMs reach their hypervisor host at vsock.Host, so we first make sure
+// that VM sockets work at all and then tell the two cases apart by the
+// presence of the Nitro Secure Module.  If detection fails, we return
+// parentCID along with the error.
+func DetectParentCID() (uint32, error) {
+	if _, err := localCID(); err != nil {
+		return parentCID, fmt.Errorf("failed to determine local CID: %w", err)
+	}
+	if inEnclave() {
+		return parentCID, nil
+	}
+	return vsock.Host, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/vsock"
+)
+
+// useFakeCIDSource makes DetectParentCID see the given local CID result and
+// Nitro Secure Module presence.
+func useFakeCIDSource(t *testing.T, cidErr error, enclave bool) {
+	t.Helper()
+	origLocalCID, origInEnclave := localCID, inEnclave
+	t.Cleanup(func() { localCID, inEnclave = origLocalCID, origInEnclave })
+	localCID = func() (uint32, error) { return 16, cidErr }
+	inEnclave = func() bool { return enclave }
+}
+
+func TestDetectParentCID(t *testing.T) {
+	errNoVsock := errors.New("no vsock device")
+	cases := []struct {
+		name    string
+		cidErr  error
+		enclave bool
+		wantCID uint32
+		wantErr bool
+	}{
+		{name: "enclave", enclave: true, wantCID: parentCID},
+		{name: "regular VM", enclave: false, wantCID: vsock.Host},
+		{name: "no vsock", cidErr: errNoVsock, enclave: true, wantCID: parentCID, wantErr: true},
+		{name: "no vsock outside enclave", cidErr: errNoVsock, wantCID: parentCID, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeCIDSource(t, c.cidErr, c.enclave)
+			cid, err := DetectParentCID()
+			if cid != c.wantCID {
+				t.Errorf("Expected CID %d but got %d.", c.wantCID, cid)
+			}
+			if c.wantErr && !errors.Is(err, errNoVsock) {
+				t.Errorf("Expected error %v but got %v.", errNoVsock, err)
+			}
+			if !c.wantErr && err != nil {
+				t.Errorf("Expected no error but got %v.", err)
+			}
+		})
+	}
+}
+
+func TestNetConfigParentCID(t *testing.T) {
+	useFakeCIDSource(t, errors.New("no vsock device"), false)
+	if n := newNetConfig(&Config{}); n.ParentCID != parentCID {
+		t.Errorf("Expected fallback CID %d but got %d.", parentCID, n.ParentCID)
+	}
+
+	useFakeCIDSource(t, nil, false)
+	if n := newNetConfig(&Config{}); n.ParentCID != vsock.Host {
+		t.Errorf("Expected detected CID %d but got %d.", vsock.Host, n.ParentCID)
+	}
+	if n := newNetConfig(&Config{ParentCID: 7}); n.ParentCID != 7 {
+		t.Errorf("Expected configured CID 7 but got %d.", n.ParentCID)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultOutboundTimeout     = 30 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// OutboundConfig configures the HTTP client that the enclave uses to talk to
+// upstream servers.  All outbound connections traverse the tunnel to the EC2
+// host, so we keep idle connections around for reuse.  Fields that are 0 take
+// on their default value.
+type OutboundConfig struct {
+	// Timeout bounds the duration of an entire outbound request, unless
+	// HostTimeouts overrides it for the request's host.
+	Timeout time.Duration
+	// HostTimeouts maps host names, without port, to the timeout of
+	// requests to that host, e.g., to give a slow batch API more time than
+	// the rest.  Host names are case-insensitive.  Requests that the
+	// enclave application sends through the forward proxy aren't subject
+	// to these timeouts.
+	HostTimeouts map[string]time.Duration
+	// MaxIdleConns caps the number of idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps the number of idle connections per host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout determines for how long an idle connection is kept
+	// before it's closed.
+	IdleConnTimeout time.Duration
+	// Breaker configures the per-host circuit breakers that protect
+	// upstream servers while they're failing.
+	Breaker BreakerConfig
+	// SourcePorts constrains the local port of outbound connections.  If
+	// unset, the kernel picks an ephemeral port.
+	SourcePorts PortRange
+	// BindDevice is the name of the network device, e.g., "tap0", that
+	// outbound connections and their DNS lookups are bound to via
+	// SO_BINDTODEVICE, so traffic can't escape via loopback or another
+	// interface because of a routing mistake.  If BindDevice is empty,
+	// connections follow the routing table.
+	BindDevice string
+}
+
+// withDefaults returns a copy of the config in which all unset fields are set
+// to their default value.
+func (c OutboundConfig) withDefaults() OutboundConfig {
+	if c.Timeout == 0 {
+		c.Timeout = defaultOutboundTimeout
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = defaultMaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout == 0 {
+		c.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	return c
+}
+
+// newOutboundClient returns an HTTP client for outbound requests that's
+// configured according to the given config.  The client accounts for the
+// bytes it exchanges with upstream hosts in the given egress stats.
+func newOutboundClient(cfg OutboundConfig, stats *egressStats) *http.Client {
+	cfg = cfg.withDefaults()
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           stats.wrapDial(newOutboundDialer(cfg)),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if cfg.Breaker.FailureThreshold >= 0 {
+		transport = newBreakerTransport(transport, cfg.Breaker)
+	}
+	// The client's timeout would cap per-host timeouts that exceed the
+	// default, so the transport enforces all timeouts instead.
+	if len(cfg.HostTimeouts) > 0 {
+		return &http.Client{
+			Transport: newHostTimeoutTransport(transport, cfg.Timeout, cfg.HostTimeouts),
+		}
+	}
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}
+}
+
+// newOutboundDialer returns the dial function for outbound connections, which
+// honors the config's source port range and bind device.
+func newOutboundDialer(cfg OutboundConfig) dialFunc {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.BindDevice != "" {
+		bindDialer(dialer, cfg.BindDevice)
+	}
+	if !cfg.SourcePorts.isSet() {
+		return dialer.DialContext
+	}
+	d := &portRangeDialer{dialer: dialer, ports: cfg.SourcePorts}
+	return d.DialContext
+}
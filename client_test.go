@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newCountingServer returns a test server that counts the connections it
+// accepts.
+func newCountingServer(t *testing.T, h http.Handler) (*httptest.Server, *int64) {
+	t.Helper()
+	var conns int64
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func TestOutboundClientReusesConnections(t *testing.T) {
+	srv, conns := newCountingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	c := newOutboundClient(OutboundConfig{}, newEgressStats())
+
+	const numRequests = 5
+	for i := 0; i < numRequests; i++ {
+		if code, body := get(t, c, srv.URL); code != http.StatusOK || body != "hello" {
+			t.Fatalf("Unexpected response %d: %q", code, body)
+		}
+	}
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("Expected %d sequential requests to share 1 connection but got %d.", numRequests, n)
+	}
+}
+
+func TestOutboundClientWithoutIdleConns(t *testing.T) {
+	srv, conns := newCountingServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	// A negative number disables idle connections in http.Transport.
+	c := newOutboundClient(OutboundConfig{MaxIdleConnsPerHost: -1}, newEgressStats())
+
+	const numRequests = 3
+	for i := 0; i < numRequests; i++ {
+		get(t, c, srv.URL)
+	}
+	if n := atomic.LoadInt64(conns); n != numRequests {
+		t.Errorf("Expected %d connections without idle connections but got %d.", numRequests, n)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxClockSkew is the clock skew that we tolerate without a warning
+// if the config doesn't specify a threshold.
+const defaultMaxClockSkew = 5 * time.Second
+
+var errNoDocTimestamp = errors.New("attestation document carries no timestamp")
+
+// clockOffset is the number of nanoseconds by which our clock is ahead of the
+// NSM's clock.  It's only set if the config asks us to correct clock skew,
+// and the verifier subtracts it from the local time.
+var clockOffset int64
+
+// coseSign1 is the outer structure of an attestation document.
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Payload     []byte
+	Signature   []byte
+}
+
+// docPayload holds the fields of an attestation document's payload that we
+// read without verifying the document.
+type docPayload struct {
+	Timestamp   uint64 `cbor:"timestamp"`
+	Certificate []byte `cbor:"certificate"`
+}
+
+// decodePayload decodes the payload of the given raw attestation document,
+// without verifying the document.
+func decodePayload(rawDoc []byte) (*docPayload, error) {
+	var outer coseSign1
+	if err := cbor.Unmarshal(rawDoc, &outer); err != nil {
+		return nil, fmt.Errorf("failed to decode document: %w", err)
+	}
+	var payload docPayload
+	if err := cbor.Unmarshal(outer.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode document payload: %w", err)
+	}
+	return &payload, nil
+}
+
+// docTimestamp returns the creation time of the given raw attestation
+// document, without verifying the document.
+func docTimestamp(rawDoc []byte) (time.Time, error) {
+	payload, err := decodePayload(rawDoc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if payload.Timestamp == 0 {
+		return time.Time{}, errNoDocTimestamp
+	}
+	return time.UnixMilli(int64(payload.Timestamp)), nil
+}
+
+// clockSkew returns by how much our clock is ahead of the clock that
+// timestamped the given document, which was requested between before and
+// after.  We compare against the midpoint, so the attestation's latency
+// doesn't count as skew.
+func clockSkew(rawDoc []byte, before, after time.Time) (time.Duration, error) {
+	created, err := docTimestamp(rawDoc)
+	if err != nil {
+		return 0, err
+	}
+	local := before.Add(after.Sub(before) / 2)
+	return local.Sub(created), nil
+}
+
+// checkClock requests a fresh attestation document with the given user data
+// and public key, and compares its timestamp, which the NSM sets, with our
+// clock.  Enclaves lack a reliable real-time clock, and skew breaks
+// certificate validity checks.  We log a warning if the skew exceeds the
+// given threshold, and remember the skew as clockOffset if correct is set.
+// A threshold of 0 means defaultMaxClockSkew.  The document is returned, so
+// callers can keep it.
+func checkClock(a Attester, userData, publicKey []byte, threshold time.Duration, correct bool) ([]byte, error) {
+	if threshold == 0 {
+		threshold = defaultMaxClockSkew
+	}
+	before := time.Now()
+	doc, err := a.Attest(nil, userData, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	skew, err := clockSkew(doc, before, time.Now())
+	if err != nil {
+		log.Warnf("Failed to check clock skew: %v", err)
+		return doc, nil
+	}
+	metricClockSkew.Set(skew.Milliseconds())
+	if skew > threshold || skew < -threshold {
+		log.Warnf("Our clock is off by %s compared to the attestation document's timestamp.", skew)
+	}
+	if correct {
+		atomic.StoreInt64(&clockOffset, int64(skew))
+	}
+	return doc, nil
+}
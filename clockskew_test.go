@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// timestampedDoc returns an unsigned attestation document whose payload
+// carries the given timestamp.  A zero time results in no timestamp.
+func timestampedDoc(t *testing.T, ts time.Time) []byte {
+	t.Helper()
+	var payload docPayload
+	if !ts.IsZero() {
+		payload.Timestamp = uint64(ts.UnixMilli())
+	}
+	rawPayload, err := cbor.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Failed to encode payload: %v", err)
+	}
+	doc, err := cbor.Marshal(coseSign1{
+		Protected:   []byte{},
+		Unprotected: cbor.RawMessage{0xa0}, // Empty map.
+		Payload:     rawPayload,
+		Signature:   []byte{},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode document: %v", err)
+	}
+	return doc
+}
+
+// resetClockOffset restores clockOffset once the test is done.
+func resetClockOffset(t *testing.T) {
+	t.Helper()
+	orig := atomic.LoadInt64(&clockOffset)
+	t.Cleanup(func() { atomic.StoreInt64(&clockOffset, orig) })
+}
+
+// skewWarnings returns the logged warnings about clock skew.
+func skewWarnings(hook *logtest.Hook) []string {
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "clock") {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	return warnings
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Now()
+	doc := timestampedDoc(t, now.Add(-time.Hour))
+	skew, err := clockSkew(doc, now.Add(-time.Second), now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	// We compare against the midpoint of before and after.
+	if diff := skew - time.Hour; diff < -time.Millisecond || diff > time.Millisecond {
+		t.Fatalf("Expected skew of %s but got %s.", time.Hour, skew)
+	}
+
+	if _, err := clockSkew(timestampedDoc(t, time.Time{}), now, now); err != errNoDocTimestamp {
+		t.Fatalf("Expected %v but got %v.", errNoDocTimestamp, err)
+	}
+	if _, err := clockSkew([]byte("garbage"), now, now); err == nil {
+		t.Fatal("Expected undecodable document to fail.")
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		offset   time.Duration
+		wantWarn bool
+	}{
+		{"in sync", 0, false},
+		{"within threshold", -2 * time.Second, false},
+		{"behind", time.Hour, true},
+		{"ahead", -time.Hour, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resetClockOffset(t)
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			// The NSM's clock is test.offset ahead of ours.
+			want := timestampedDoc(t, time.Now().Add(test.offset))
+			doc, err := checkClock(&fakeAttester{doc: want}, nil, nil, 0, false)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v.", err)
+			}
+			if string(doc) != string(want) {
+				t.Fatal("Expected checkClock to return the attestation document.")
+			}
+			if warned := len(skewWarnings(hook)) > 0; warned != test.wantWarn {
+				t.Fatalf("Expected warning to be %t but got %t.", test.wantWarn, warned)
+			}
+			wantMs := -test.offset.Milliseconds()
+			if got := metricClockSkew.Value(); got < wantMs-1000 || got > wantMs+1000 {
+				t.Fatalf("Expected skew metric of about %d ms but got %d.", wantMs, got)
+			}
+			if got := atomic.LoadInt64(&clockOffset); got != 0 {
+				t.Fatalf("Expected no clock correction but got %s.", time.Duration(got))
+			}
+		})
+	}
+}
+
+func TestCheckClockThreshold(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	doc := timestampedDoc(t, time.Now().Add(-time.Minute))
+	if _, err := checkClock(&fakeAttester{doc: doc}, nil, nil, time.Hour, false); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if warnings := skewWarnings(hook); len(warnings) != 0 {
+		t.Fatalf("Expected no warning within custom threshold but got %q.", warnings)
+	}
+}
+
+func TestCheckClockCorrects(t *testing.T) {
+	resetClockOffset(t)
+
+	doc := timestampedDoc(t, time.Now().Add(-time.Hour))
+	if _, err := checkClock(&fakeAttester{doc: doc}, nil, nil, 0, true); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	// Our verifier's clock should now follow the NSM's clock.
+	got := new(VerifyOptions).now()
+	if diff := got.Sub(time.Now().Add(-time.Hour)); diff < -time.Second || diff > time.Second {
+		t.Fatalf("Expected verifier clock to be corrected by an hour but it's off by %s.", diff)
+	}
+	// A pinned clock is left alone.
+	pinned := testEpoch
+	if got := (&VerifyOptions{Now: func() time.Time { return pinned }}).now(); !got.Equal(pinned) {
+		t.Fatalf("Expected pinned time %s but got %s.", pinned, got)
+	}
+}
+
+func TestCheckClockAttesterError(t *testing.T) {
+	if _, err := checkClock(&fakeAttester{err: errNSMDown}, nil, nil, 0, false); err != errNSMDown {
+		t.Fatalf("Expected %v but got %v.", errNSMDown, err)
+	}
+}
+
+func TestCheckClockNoTimestamp(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	doc, err := checkClock(&fakeAttester{doc: timestampedDoc(t, time.Time{})}, nil, nil, 0, false)
+	if err != nil || doc == nil {
+		t.Fatalf("Expected document despite missing timestamp but got %v.", err)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Level != log.WarnLevel {
+		t.Fatal("Expected a warning about the missing timestamp.")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultCloudWatchInterval determines how often we push metrics if the
+	// config doesn't specify an interval.
+	defaultCloudWatchInterval = time.Minute
+	// maxDatumsPerCall is the number of datums that we send per
+	// PutMetricData call, which stays within CloudWatch's limits.
+	maxDatumsPerCall  = 20
+	cloudWatchTimeout = 10 * time.Second
+)
+
+// MetricDatum is a single CloudWatch metric value.
+type MetricDatum struct {
+	Name       string
+	Value      float64
+	Unit       string
+	Dimensions map[string]string
+	Timestamp  time.Time
+}
+
+// CloudWatchClient abstracts CloudWatch's PutMetricData, so we don't depend
+// on the AWS SDK.  Embedding applications supply an implementation, typically
+// a thin wrapper around the SDK's cloudwatch.Client.  Its requests traverse
+// the tunnel to the EC2 host like all other outbound traffic.
+type CloudWatchClient interface {
+	PutMetricData(ctx context.Context, namespace string, data []MetricDatum) error
+}
+
+// CloudWatchConfig configures the periodic export of our key metrics to
+// CloudWatch.  The export is off if Client is nil.
+type CloudWatchConfig struct {
+	Client CloudWatchClient
+	// Namespace is the CloudWatch namespace of our metrics.
+	Namespace string
+	// Dimensions are added to every metric, e.g., to identify the enclave.
+	Dimensions map[string]string
+	// Interval determines how often we push metrics.  If Interval is 0,
+	// defaultCloudWatchInterval is used.
+	Interval time.Duration
+}
+
+// metricCounters is a snapshot of the counters that we derive rates from.
+type metricCounters struct {
+	attestations        int64
+	attestationFailures int64
+	bytesToHost         int64
+	bytesFromHost       int64
+}
+
+func readCounters() metricCounters {
+	return metricCounters{
+		attestations:        metricAttestations.Value(),
+		attestationFailures: metricAttestationFailures.Value(),
+		bytesToHost:         metricTunnelBytesOut.Value(),
+		bytesFromHost:       metricTunnelBytesIn.Value(),
+	}
+}
+
+// cloudWatchExporter pushes our key metrics to CloudWatch: whether
+// networking is up, the attestation success rate, and the tunnel's
+// throughput.  Rates are computed over each interval.
+type cloudWatchExporter struct {
+	cfg  CloudWatchConfig
+	now  func() time.Time
+	last metricCounters
+}
+
+func newCloudWatchExporter(cfg CloudWatchConfig) *cloudWatchExporter {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultCloudWatchInterval
+	}
+	return &cloudWatchExporter{cfg: cfg, now: time.Now, last: readCounters()}
+}
+
+// run pushes metrics at the configured interval until the given channel is
+// closed.
+func (x *cloudWatchExporter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(x.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := x.push(x.collect(readCounters())); err != nil {
+				log.Warnf("Failed to push metrics to CloudWatch: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// collect turns the given counters into datums, relative to the previous
+// snapshot.
+func (x *cloudWatchExporter) collect(cur metricCounters) []MetricDatum {
+	now := x.now()
+	secs := x.cfg.Interval.Seconds()
+	datum := func(name string, value float64, unit string) MetricDatum {
+		return MetricDatum{
+			Name:       name,
+			Value:      value,
+			Unit:       unit,
+			Dimensions: x.cfg.Dimensions,
+			Timestamp:  now,
+		}
+	}
+
+	data := []MetricDatum{
+		datum("NetworkingUp", float64(metricNetworkingUp.Value()), "None"),
+		datum("Attestations", float64(cur.attestations-x.last.attestations), "Count"),
+		datum("BytesToHost", float64(cur.bytesToHost-x.last.bytesToHost)/secs, "Bytes/Second"),
+		datum("BytesFromHost", float64(cur.bytesFromHost-x.last.bytesFromHost)/secs, "Bytes/Second"),
+	}
+	// A success rate is meaningless without attestations.
+	if total := cur.attestations - x.last.attestations; total > 0 {
+		failed := cur.attestationFailures - x.last.attestationFailures
+		data = append(data, datum("AttestationSuccessRate",
+			100*float64(total-failed)/float64(total), "Percent"))
+	}
+	x.last = cur
+	return data
+}
+
+// push sends the given datums in batches of maxDatumsPerCall.
+func (x *cloudWatchExporter) push(data []MetricDatum) error {
+	var errs []error
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxDatumsPerCall {
+			n = maxDatumsPerCall
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cloudWatchTimeout)
+		errs = append(errs, x.cfg.Client.PutMetricData(ctx, x.cfg.Namespace, data[:n]))
+		cancel()
+		data = data[n:]
+	}
+	return joinErrors(errs...)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCloudWatch records the batches that it receives, and fails with the
+// given error.
+type fakeCloudWatch struct {
+	sync.Mutex
+	err        error
+	namespaces []string
+	batches    [][]MetricDatum
+	pushed     chan struct{}
+}
+
+func newFakeCloudWatch() *fakeCloudWatch {
+	return &fakeCloudWatch{pushed: make(chan struct{}, 100)}
+}
+
+func (c *fakeCloudWatch) PutMetricData(ctx context.Context, namespace string, data []MetricDatum) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("expected deadline")
+	}
+	c.namespaces = append(c.namespaces, namespace)
+	c.batches = append(c.batches, append([]MetricDatum(nil), data...))
+	select {
+	case c.pushed <- struct{}{}:
+	default:
+	}
+	return c.err
+}
+
+func (c *fakeCloudWatch) numBatches() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.batches)
+}
+
+// datumByName returns the datum with the given name, if any.
+func datumByName(data []MetricDatum, name string) (MetricDatum, bool) {
+	for _, d := range data {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return MetricDatum{}, false
+}
+
+func TestCloudWatchOffByDefault(t *testing.T) {
+	if testConfig().CloudWatch.Client != nil {
+		t.Fatal("Expected CloudWatch export to be off by default.")
+	}
+}
+
+func TestCloudWatchExporterPushesAtInterval(t *testing.T) {
+	cw := newFakeCloudWatch()
+	x := newCloudWatchExporter(CloudWatchConfig{
+		Client:     cw,
+		Namespace:  "Nitriding",
+		Dimensions: map[string]string{"Enclave": "test"},
+		Interval:   20 * time.Millisecond,
+	})
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	start := time.Now()
+	go func() {
+		x.run(done)
+		close(stopped)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cw.pushed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected push %d within the interval.", i+1)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 3*x.cfg.Interval {
+		t.Errorf("Expected pushes to be spaced by the interval but got 3 within %s.", elapsed)
+	}
+	close(done)
+	<-stopped
+
+	cw.Lock()
+	defer cw.Unlock()
+	for i, batch := range cw.batches {
+		if cw.namespaces[i] != "Nitriding" {
+			t.Errorf("Expected namespace Nitriding but got %q.", cw.namespaces[i])
+		}
+		if _, ok := datumByName(batch, "NetworkingUp"); !ok {
+			t.Errorf("Expected batch %d to contain NetworkingUp.", i)
+		}
+		for _, d := range batch {
+			if d.Dimensions["Enclave"] != "test" {
+				t.Errorf("Expected dimension Enclave=test on %s but got %v.", d.Name, d.Dimensions)
+			}
+		}
+	}
+}
+
+func TestCloudWatchCollect(t *testing.T) {
+	x := newCloudWatchExporter(CloudWatchConfig{Client: newFakeCloudWatch(), Interval: 10 * time.Second})
+	x.now = func() time.Time { return testEpoch }
+	x.last = metricCounters{}
+
+	data := x.collect(metricCounters{attestations: 4, attestationFailures: 1, bytesToHost: 1000, bytesFromHost: 500})
+	for name, want := range map[string]float64{
+		"Attestations":           4,
+		"AttestationSuccessRate": 75,
+		"BytesToHost":            100,
+		"BytesFromHost":          50,
+	} {
+		d, ok := datumByName(data, name)
+		if !ok {
+			t.Fatalf("Expected datum %s.", name)
+		}
+		if d.Value != want || !d.Timestamp.Equal(testEpoch) {
+			t.Errorf("Expected %s %v at %s but got %v at %s.", name, want, testEpoch, d.Value, d.Timestamp)
+		}
+	}
+
+	// Without new attestations, there's no success rate.
+	data = x.collect(metricCounters{attestations: 4, attestationFailures: 1, bytesToHost: 1000, bytesFromHost: 500})
+	if _, ok := datumByName(data, "AttestationSuccessRate"); ok {
+		t.Error("Expected no success rate without attestations.")
+	}
+	if d, _ := datumByName(data, "BytesToHost"); d.Value != 0 {
+		t.Errorf("Expected no throughput but got %v.", d.Value)
+	}
+}
+
+func TestCloudWatchPushBatches(t *testing.T) {
+	cw := newFakeCloudWatch()
+	x := newCloudWatchExporter(CloudWatchConfig{Client: cw, Namespace: "Nitriding"})
+	data := make([]MetricDatum, 2*maxDatumsPerCall+5)
+	if err := x.push(data); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+
+	cw.Lock()
+	defer cw.Unlock()
+	if len(cw.batches) != 3 {
+		t.Fatalf("Expected 3 batches but got %d.", len(cw.batches))
+	}
+	for i, want := range []int{maxDatumsPerCall, maxDatumsPerCall, 5} {
+		if len(cw.batches[i]) != want {
+			t.Errorf("Expected batch %d to have %d datums but got %d.", i, want, len(cw.batches[i]))
+		}
+	}
+}
+
+func TestCloudWatchPushError(t *testing.T) {
+	errThrottled := errors.New("throttled")
+	cw := newFakeCloudWatch()
+	cw.err = errThrottled
+	x := newCloudWatchExporter(CloudWatchConfig{Client: cw})
+	if err := x.push(make([]MetricDatum, maxDatumsPerCall+1)); !errors.Is(err, errThrottled) {
+		t.Fatalf("Expected error to wrap %v but got %v.", errThrottled, err)
+	}
+	// A failed batch doesn't keep us from sending the rest.
+	if n := cw.numBatches(); n != 2 {
+		t.Fatalf("Expected 2 batches but got %d.", n)
+	}
+}
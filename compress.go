@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const defaultCompressMinSize = 1024
+
+// defaultUncompressedTypes lists the content types (or type prefixes) that we
+// don't compress by default because they're compressed already or don't
+// compress well.
+var defaultUncompressedTypes = []string{
+	"application/cbor",
+	"application/gzip",
+	"application/zip",
+	"image/",
+	"video/",
+}
+
+// CompressionConfig configures gzip compression of the public Web server's
+// responses.
+type CompressionConfig struct {
+	// Enabled enables compression for clients that accept gzip.
+	Enabled bool
+	// MinSize is the minimum size in bytes of a response body that we
+	// compress.  If MinSize is 0, defaultCompressMinSize is used.
+	MinSize int
+	// ExcludedTypes lists content types, or prefixes thereof, that we never
+	// compress.  If ExcludedTypes is nil, defaultUncompressedTypes is used.
+	ExcludedTypes []string
+}
+
+// compressMiddleware returns middleware that gzips response bodies of at
+// least the configured minimum size if the client accepts gzip.
+func compressMiddleware(cfg CompressionConfig) func(http.Handler) http.Handler {
+	if cfg.MinSize == 0 {
+		cfg.MinSize = defaultCompressMinSize
+	}
+	if cfg.ExcludedTypes == nil {
+		cfg.ExcludedTypes = defaultUncompressedTypes
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{
+				ResponseWriter: w,
+				cfg:            &cfg,
+				status:         http.StatusOK,
+			}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// acceptsGzip returns true if the given request's Accept-Encoding header
+// contains gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, _, _ = strings.Cut(strings.TrimSpace(enc), ";")
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the beginning of a response body until it knows
+// if the response is large enough to be compressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	cfg     *CompressionConfig
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.cfg.MinSize {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		_ = w.decide()
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so protocol upgrades like WebSocket work
+// through our middleware.  Hijacked connections are never compressed.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		// The handler owns the connection now, so we must not write
+		// anything once it returns.
+		w.decided, w.buf = true, nil
+	}
+	return conn, rw, err
+}
+
+// decide determines if the response gets compressed, writes the header, and
+// flushes the buffered part of the body.
+func (w *gzipResponseWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if len(w.buf) >= w.cfg.MinSize && w.compressible() {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.gz.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// compressible returns true if the response's status, encoding, and content
+// type permit compression.
+func (w *gzipResponseWriter) compressible() bool {
+	if w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := w.Header().Get("Content-Type")
+	for _, t := range w.cfg.ExcludedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// close completes the response.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		_ = w.decide()
+	}
+	if w.gz != nil {
+		_ = w.gz.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getCompressed requests the given URL with the given Accept-Encoding header
+// and returns the response along with its decompressed body.
+func getCompressed(t *testing.T, url, acceptEncoding string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	// Setting Accept-Encoding ourselves keeps the transport from
+	// decompressing transparently.
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to create gzip reader: %v", err)
+		}
+		body = gz
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	return resp, string(b)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	large := strings.Repeat("compress me ", 1000)
+	m := http.NewServeMux()
+	m.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, large) })
+	m.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, "small") })
+	m.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, large)
+	})
+	srv := httptest.NewServer(compressMiddleware(CompressionConfig{Enabled: true})(m))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		path, acceptEncoding string
+		compressed           bool
+		body                 string
+	}{
+		{"/large", "gzip", true, large},
+		{"/large", "br, gzip;q=0.5", true, large},
+		{"/large", "identity", false, large},
+		{"/small", "gzip", false, "small"},
+		{"/image", "gzip", false, large},
+	} {
+		resp, body := getCompressed(t, srv.URL+test.path, test.acceptEncoding)
+		if compressed := resp.Header.Get("Content-Encoding") == "gzip"; compressed != test.compressed {
+			t.Errorf("%s with %q: expected compressed=%v but got %v.", test.path, test.acceptEncoding, test.compressed, compressed)
+		}
+		if body != test.body {
+			t.Errorf("%s with %q: unexpected body of length %d.", test.path, test.acceptEncoding, len(body))
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary header.", test.path)
+		}
+	}
+}
+
+func TestCompressMiddlewareUpgrade(t *testing.T) {
+	// The handler upgrades the connection like a WebSocket server and then
+	// echoes a line.
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		line, _ := rw.ReadString('\n')
+		fmt.Fprint(rw, "echo: "+line)
+		_ = rw.Flush()
+	})
+	srv := httptest.NewServer(compressMiddleware(CompressionConfig{Enabled: true})(h))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	fmt.Fprint(conn, "hello\n")
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if line != "echo: hello\n" {
+		t.Errorf("Unexpected echo %q.", line)
+	}
+}
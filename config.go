@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/brave/nitriding"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config extends nitriding's configuration with settings that are specific to
+// this enclave application.
+type Config struct {
+	nitriding.Config
+
+	// UseHTTP2 enables HTTP/2 on the public Web server.  If the server has a
+	// TLS configuration, HTTP/2 is negotiated via ALPN; otherwise, the server
+	// speaks cleartext HTTP/2 (h2c) in addition to HTTP/1.1.
+	UseHTTP2 bool
+
+	// MaxPublicConns caps the number of concurrent connections that the
+	// public Web server accepts.  Connections beyond the cap are closed right
+	// away.  If MaxPublicConns is 0, the number of connections is unlimited.
+	MaxPublicConns int
+
+	// Internal configures the timeouts and the connection limit of the
+	// enclave-internal Web server.  Only the enclave application can reach
+	// the server, so its defaults are more relaxed than what we'd pick for
+	// a public server.
+	Internal InternalServerConfig
+
+	// Compression configures gzip compression of the public Web server's
+	// responses.
+	Compression CompressionConfig
+
+	// RateLimit caps the request rate of each client of the public Web
+	// server, so a single client can't monopolize the enclave.
+	RateLimit RateLimitConfig
+
+	// StartupTimeout bounds the duration of Start.  If StartupTimeout is 0,
+	// defaultStartupTimeout is used.
+	StartupTimeout time.Duration
+
+	// DrainPeriod is how long the enclave keeps serving after it received a
+	// termination signal, while /ready reports that it's draining, so load
+	// balancers can deregister it before it stops.  If DrainPeriod is 0, the
+	// enclave stops right away.
+	DrainPeriod time.Duration
+
+	// AttestationTimeout bounds the time we wait for the NSM to issue an
+	// attestation document.  If AttestationTimeout is 0,
+	// defaultAttestationTimeout is used.
+	AttestationTimeout time.Duration
+
+	// KMS is the KMS client that the enclave uses to decrypt secrets.  If KMS
+	// is nil, the decryption endpoints are disabled.  Otherwise, the
+	// enclave-internal Web server also speaks h2c, which streamed decryption
+	// requires.
+	KMS KMSClient
+
+	// EgressAllowlist lists the hosts that the enclave application may reach
+	// via the forward proxy on the enclave-internal Web server.  Entries are
+	// host names or wildcards like "*.example.com", optionally followed by
+	// a port, e.g., "example.com:443".  Entries without a port allow all
+	// ports.  If EgressAllowlist is empty, the forward proxy is disabled.
+	EgressAllowlist []string
+
+	// AttestationTokenTTL determines for how long the attestation tokens
+	// that we issue along with attestation documents remain valid.  Sensitive
+	// routes like the decryption endpoint require such a token.  If
+	// AttestationTokenTTL is 0, defaultTokenTTL is used.
+	AttestationTokenTTL time.Duration
+
+	// AuditLog receives a JSON entry for every attestation document that we
+	// issue, e.g., a file that's shipped to a compliance archive.  Entries
+	// contain hashes of the nonce, the user data, and the document, never
+	// the raw nonce.  If AuditLog is nil, entries go to our regular log.
+	AuditLog io.Writer
+
+	// NonceReplayWindow makes us remember the nonces of attestation
+	// requests for the given window.  A nonce that's used again within the
+	// window is rejected with 409 Conflict.  If NonceReplayWindow is 0,
+	// nonces aren't checked.
+	NonceReplayWindow time.Duration
+	// DecryptNonceWindow makes our decrypt endpoint require a nonce in each
+	// request, and reject nonces that were already used within the window
+	// with 409 Conflict.  The nonce must be the nonce of the attestation
+	// request that issued the request's attestation token, and it ends up in
+	// the user data of the attestation documents that we send to KMS.  If
+	// DecryptNonceWindow is 0, decrypt requests need no nonce.
+	DecryptNonceWindow time.Duration
+
+	// MaxClockSkew is the difference between our clock and the timestamp of
+	// a fresh attestation document that we tolerate at startup without a
+	// warning.  The NSM sets the timestamp, so it's a better reference than
+	// our own clock.  If MaxClockSkew is 0, defaultMaxClockSkew is used.
+	MaxClockSkew time.Duration
+	// CorrectClockSkew makes our verifier compensate for the clock skew that
+	// we measure at startup when it decides if certificates are valid and
+	// documents are fresh.
+	CorrectClockSkew bool
+	// MaxDocumentValidity is the longest validity window of a signing
+	// certificate that we accept when we verify other enclaves' documents
+	// on our verification endpoint; see VerifyOptions.MaxValidity.  If
+	// MaxDocumentValidity is 0, defaultMaxDocumentValidity is used.  If it's
+	// negative, the window isn't checked.
+	MaxDocumentValidity time.Duration
+	// InternalVerify moves the verification endpoint from the public Web
+	// server to the enclave-internal one, for deployments whose audit
+	// tooling runs inside the enclave.  On the public Web server, the
+	// endpoint is subject to RateLimit, or to defaultVerifyRateLimit if
+	// RateLimit is off, because verification is CPU-heavy.
+	InternalVerify bool
+
+	// SharedAttestationInterval enables an endpoint that serves one
+	// attestation document per rotation window of the given length, with a
+	// nonce that's shared by all clients in the window.  This amortizes the
+	// cost of attestation over large fleets of clients that don't need a
+	// nonce of their own.  If SharedAttestationInterval is 0, the endpoint is
+	// disabled.
+	SharedAttestationInterval time.Duration
+
+	// ExpectedPCR0 is the hex-encoded PCR0 that we expect the running EIF to
+	// have.  At startup, we compare it to the actual PCR0 and warn loudly if
+	// they differ.  If ExpectedPCR0 is empty, the build-time value of
+	// expectedPCR0 is used.
+	ExpectedPCR0 string
+
+	// Outbound configures the HTTP client that enclave code uses to talk to
+	// upstream servers.
+	Outbound OutboundConfig
+
+	// GoMaxProcs determines GOMAXPROCS.  If GoMaxProcs is positive, it's used
+	// as is.  If it's 0, GOMAXPROCS is set to the number of vCPUs that were
+	// allocated to the enclave.  If it's negative, Go's default is kept.
+	GoMaxProcs int
+
+	// MaxNetworkingFailures is the number of consecutive failures to set up
+	// networking after which the enclave stops.  If MaxNetworkingFailures is
+	// 0, we keep trying forever.
+	MaxNetworkingFailures int
+
+	// CaptureFile is the path of a pcap file to which we write all Ethernet
+	// frames that traverse the tunnel to the EC2 host.  Capturing is off if
+	// CaptureFile is empty, which is the default because capturing is slow.
+	CaptureFile string
+	// CaptureMaxBytes caps the size of the capture file.  Frames beyond the
+	// cap are discarded.  If CaptureMaxBytes is 0, defaultCaptureMaxBytes is
+	// used.
+	CaptureMaxBytes int64
+
+	// FramePrefixLen is the length in bytes of the little-endian length
+	// prefix of each Ethernet frame that we exchange with the EC2 host.  It's
+	// either 2, which caps frames at 65535 bytes and is what gvisor-tap-vsock
+	// speaks, or 4, which allows for larger frames.  The 4-byte prefix
+	// requires NegotiateProtocol, and is only used if the host supports it.
+	// Note that the host's virtual network still caps frames at 65535 bytes.
+	// If FramePrefixLen is 0, the 2-byte prefix is used.
+	FramePrefixLen int
+	// NegotiateProtocol makes us ask the proxy on the EC2 host which framing
+	// features it supports before we connect, and only use FramePrefixLen if
+	// the host supports it.  Hosts that don't answer get the legacy protocol
+	// with its 2-byte prefix.  If NegotiateProtocol is false, we trust that
+	// the host matches our config.
+	NegotiateProtocol bool
+	// FrameCompression compresses the Ethernet frames that we exchange with
+	// the EC2 host, which trades CPU time for bandwidth on the vsock link.
+	// The only supported value is "gzip".  Frames that don't get smaller,
+	// e.g., because their payload is already compressed, are sent as is.
+	// Compression requires NegotiateProtocol, and is only used if the host
+	// supports it.  If FrameCompression is empty, frames aren't compressed.
+	FrameCompression string
+
+	// DropTapWriteErrors makes us drop frames from the host whose write to
+	// the TAP device fails with a transient error, e.g., because the kernel
+	// is short of buffers, and count them in the tap_write_drops metric.  We
+	// warn at most once per second about drops.  By default, such a failure
+	// tears down networking, which is then set up again.  Persistent errors
+	// are always fatal.
+	DropTapWriteErrors bool
+
+	// LogSampling configures the sampling of high-frequency debug log
+	// statements in the networking layer, so debug mode remains usable under
+	// load.
+	LogSampling LogSamplingConfig
+
+	// Socket configures the vsock connection to the EC2 host, e.g., its
+	// buffer size.  By default, the kernel's defaults are used.
+	Socket SocketOptions
+
+	// FrameFlush configures the buffering of frames that we send to the
+	// host.  By default, frames aren't buffered.
+	FrameFlush FrameFlushConfig
+
+	// AllowInvalidRoot lets the enclave start even if the embedded
+	// attestation root certificate is missing or invalid.  Attestation
+	// documents still fail verification in that case.  AllowInvalidRoot is
+	// meant for development only; by default, Start fails.
+	AllowInvalidRoot bool
+	// AttestationRootFile is the path of a file with PEM-encoded root
+	// certificates that replace the embedded AWS Nitro Enclaves root for
+	// verification.  The file is read when the enclave is created, which
+	// fails if the file is unreadable or contains no valid certificate.  If
+	// AttestationRootFile is empty, the embedded root is used.
+	AttestationRootFile string
+
+	// MAC is the MAC address of our TAP interface, in any format that
+	// net.ParseMAC understands.  It must be a 48-bit unicast address.  If MAC
+	// is empty, defaultMAC is used.
+	MAC string
+
+	// IntIface is the interface whose address the enclave-internal Web
+	// server binds to.  It's either "lo", which makes the server reachable
+	// from within the enclave only, or "tap0", which also makes it reachable
+	// from the EC2 host.  If IntIface is empty, "lo" is used.
+	IntIface string
+
+	// DNSCanary is a host name that we resolve as part of our readiness
+	// check, to catch a broken resolver before traffic is routed to the
+	// enclave.  A canary that doesn't resolve doesn't fail Start; /ready
+	// reports not ready instead until it resolves.  If DNSCanary is empty,
+	// DNS isn't checked.
+	DNSCanary string
+
+	// DemoRoutes exposes the demo endpoints /hello-world and
+	// /enclave/test-attestation on the public Web server.  They make outbound
+	// requests and may terminate the enclave, so they're off by default.
+	// Debug mode turns them on regardless of DemoRoutes.
+	DemoRoutes bool
+
+	// AttestationMetadata is contextual information, e.g., the enclave's
+	// version, that we attach to JSON attestation responses along with a
+	// timestamp.  The metadata is signed by a key that's bound in the
+	// attestation document.  If AttestationMetadata is empty, no metadata is
+	// attached.
+	AttestationMetadata map[string]string
+	// KeyRotationOverlap determines for how long we keep signing metadata
+	// with the previous key after the key was rotated, so clients that still
+	// hold a document that binds the previous key can verify the metadata.
+	// For as long, payloads that were sealed to the previous key can still
+	// be opened.  If KeyRotationOverlap is 0, defaultKeyOverlap is used.
+	KeyRotationOverlap time.Duration
+
+	// RPCPort is the TCP port of our gRPC server, which offers the same
+	// attestation as our HTTP API via the Attest RPC; see AttestRPC.  The
+	// server is started and stopped along with the enclave.  It's subject to
+	// the same RateLimit and NonceReplayWindow as our HTTP API.  If RPCPort
+	// is 0, no gRPC server is started.
+	RPCPort uint16
+
+	// MaxProxiedRequests caps the number of concurrent requests that we
+	// proxy to the enclave application's Web server (AppWebSrv), to protect
+	// it independent of MaxPublicConns.  If MaxProxiedRequests is 0, the
+	// number of requests is unlimited.
+	MaxProxiedRequests int
+	// ProxyQueueTimeout is how long a request waits for a slot once
+	// MaxProxiedRequests is reached.  Requests that don't get a slot in time
+	// are rejected with 503 Service Unavailable.  If ProxyQueueTimeout is 0,
+	// they're rejected right away.
+	ProxyQueueTimeout time.Duration
+
+	// ParentCID is the CID of the host that runs our networking proxy.  If
+	// ParentCID is 0, it's detected by DetectParentCID.
+	ParentCID uint32
+
+	// HandshakeTimeout bounds the time we wait for the proxy on the EC2 host
+	// to accept our connection request.  On timeout, networking is set up
+	// again.  If HandshakeTimeout is 0, defaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// ProxyProtocol makes the public Web server expect a PROXY protocol (v1
+	// or v2) header on every connection, as sent by load balancers like
+	// AWS's NLB, and use the header's client address as the request's
+	// remote address.  Connections without a header are rejected, so only
+	// enable ProxyProtocol if all traffic passes through such a load
+	// balancer.
+	ProxyProtocol bool
+
+	// ExtraTaps configures additional TAP devices, each with its own tunnel
+	// to a proxy on the EC2 host, e.g., to keep control-plane traffic apart
+	// from data-plane traffic.  By default, there's a single TAP device.
+	ExtraTaps []TapConfig
+
+	// SingleQueueTap makes us create a single-queue TAP device.  By default,
+	// we prefer a multi-queue device and only fall back to a single queue if
+	// the kernel doesn't support multiple queues.
+	SingleQueueTap bool
+
+	// DiscoverMTU makes us ask the proxy on the EC2 host for the MTU of its
+	// default route's interface, and use it for our TAP interface.  If the
+	// host can't tell us, we use the default MTU.
+	DiscoverMTU bool
+
+	// ProxyDirector customizes requests before our reverse proxy forwards
+	// them to AppWebSrv, e.g., to rewrite paths or headers.  It runs after
+	// our default director, which points the request at AppWebSrv and adds
+	// our Via entry, so it sees, and may change, the outgoing URL.
+	ProxyDirector func(*http.Request)
+	// ProxyModifyResponse inspects or modifies responses of AppWebSrv
+	// before they reach clients.  It runs after our backend verification
+	// (see BackendSecret), so it never sees the backend secret header.  If
+	// it returns an error, the client gets 502 Bad Gateway.
+	ProxyModifyResponse func(*http.Response) error
+
+	// BackendSecret is a shared secret that the enclave application must set
+	// in the X-Nitriding-Backend-Secret header of all its responses.  Our
+	// reverse proxy returns 502 Bad Gateway for responses that lack the
+	// secret, and strips the header from all responses.  If BackendSecret is
+	// empty, responses aren't checked.
+	BackendSecret string
+
+	// StripRequestHeaders lists the headers that our reverse proxy removes
+	// from client requests before forwarding them to AppWebSrv.  A name
+	// that ends in "*" matches all headers with that prefix.  If
+	// StripRequestHeaders is nil, X-Forwarded-*, Forwarded, and X-Real-Ip
+	// are removed, so clients can't spoof them.  Set it to an empty slice to
+	// forward all headers.
+	StripRequestHeaders []string
+	// StripResponseHeaders lists the headers that our reverse proxy removes
+	// from AppWebSrv's responses, before ProxyModifyResponse runs.  If
+	// StripResponseHeaders is nil, our internal X-Nitriding-* headers are
+	// removed.  Set it to an empty slice to keep all headers.
+	StripResponseHeaders []string
+
+	// AppWebSrvCA holds PEM-encoded CA certificates that our reverse proxy
+	// trusts when AppWebSrv is an https URL, e.g., an internal server's
+	// self-signed certificate.  If AppWebSrvCA is empty, the system's roots
+	// are used.
+	AppWebSrvCA []byte
+	// AppWebSrvInsecure makes our reverse proxy skip the verification of
+	// AppWebSrv's certificate.  It's only allowed if AppWebSrv is a loopback
+	// address, where the enclave's own kernel routes the traffic.
+	AppWebSrvInsecure bool
+
+	// Maintenance configures the response that our reverse proxy sends
+	// while AppWebSrv is unavailable.  By default, clients get a bare 502 Bad
+	// Gateway.
+	Maintenance MaintenanceConfig
+
+	// CloudWatch configures the periodic export of our key metrics to
+	// CloudWatch.  It's off by default.
+	CloudWatch CloudWatchConfig
+
+	// Registry configures the periodic publication of our attestation
+	// document to a registry, which peers use to discover the enclave.  It's
+	// off by default.
+	Registry RegistryConfig
+
+	// GoroutineWarnThreshold makes us log a warning whenever the number of
+	// goroutines exceeds the given threshold, which hints at a leak.  If
+	// GoroutineWarnThreshold is 0, the number of goroutines isn't watched.
+	GoroutineWarnThreshold int
+
+	// AdminToken is the bearer token that requests for the admin endpoints
+	// under /enclave/admin/ must carry.  If AdminTokenSecret is set, it takes
+	// precedence.  If neither is set, admin endpoints reject all requests.
+	AdminToken string
+	// AdminTokenSecret is the name of the secret in the enclave's secret
+	// store, e.g., one that was decrypted via KMS, that holds the admin
+	// token.  The public decryption endpoint refuses to write this secret,
+	// so the enclave application must decrypt it via the enclave-internal
+	// decryption endpoint.
+	AdminTokenSecret string
+
+	// TracingEndpoint is the address (host:port) of an OpenTelemetry
+	// collector, e.g., one that's reachable over the tunnel.  If it's set, we
+	// trace inbound HTTP requests, attestation, KMS calls, and the setup of
+	// networking, and export the spans via OTLP over gRPC.  If
+	// TracingEndpoint is empty, tracing is off.
+	TracingEndpoint string
+	// TracingInsecure makes us export spans to TracingEndpoint without TLS.
+	TracingInsecure bool
+	// TracerProvider lets embedding applications that already run the
+	// OpenTelemetry SDK supply their own tracer provider.  It takes
+	// precedence over TracingEndpoint, and the application remains
+	// responsible for shutting it down.
+	TracerProvider trace.TracerProvider
+}
+
+const (
+	// defaultIntReadTimeout and defaultIntWriteTimeout are the timeouts of
+	// the enclave-internal Web server if the config doesn't specify any.
+	// They only guard against stuck clients.
+	defaultIntReadTimeout  = 10 * time.Minute
+	defaultIntWriteTimeout = 10 * time.Minute
+)
+
+// InternalServerConfig configures the enclave-internal Web server.  Timeouts
+// that are 0 take on their default value, and negative timeouts disable the
+// timeout altogether.
+type InternalServerConfig struct {
+	// ReadTimeout bounds the time it takes to read a request, including its
+	// body.  If ReadTimeout is 0, defaultIntReadTimeout is used.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the time it takes to write a response, which
+	// must accommodate streamed decryption of large payloads.  If
+	// WriteTimeout is 0, defaultIntWriteTimeout is used.
+	WriteTimeout time.Duration
+	// MaxConns caps the number of concurrent connections.  If MaxConns is
+	// 0, the number of connections is unlimited.
+	MaxConns int
+}
+
+// timeouts returns the server's read and write timeouts, with defaults
+// filled in.  A timeout of 0 means that there's no timeout, as in
+// http.Server.
+func (c InternalServerConfig) timeouts() (read, write time.Duration) {
+	read, write = c.ReadTimeout, c.WriteTimeout
+	if read == 0 {
+		read = defaultIntReadTimeout
+	}
+	if write == 0 {
+		write = defaultIntWriteTimeout
+	}
+	if read < 0 {
+		read = 0
+	}
+	if write < 0 {
+		write = 0
+	}
+	return read, write
+}
+
+// Validate returns an error if required fields in the config are not set or
+// if fields are set to unsupported values.
+func (c *Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if c.IntIface != "" && c.IntIface != ifaceLo && c.IntIface != ifaceTap {
+		return fmt.Errorf("unsupported interface for internal Web server: %q", c.IntIface)
+	}
+	if c.FramePrefixLen != 0 {
+		if err := validPrefixLen(c.FramePrefixLen); err != nil {
+			return err
+		}
+	}
+	if c.FramePrefixLen == prefixLen32 && !c.NegotiateProtocol {
+		return errWidePrefixNeedsNegotiation
+	}
+	if err := validFrameCompression(c.FrameCompression); err != nil {
+		return err
+	}
+	if c.FrameCompression != "" && !c.NegotiateProtocol {
+		return errCompressionNeedsNegotiation
+	}
+	if c.FrameFlush.Batch && !c.NegotiateProtocol {
+		return errBatchNeedsNegotiation
+	}
+	if err := c.FrameFlush.validate(); err != nil {
+		return err
+	}
+	if c.MAC != "" {
+		if _, err := parseMAC(c.MAC); err != nil {
+			return err
+		}
+	}
+	if err := c.Outbound.SourcePorts.validate(); err != nil {
+		return err
+	}
+	if err := validBindDevice(c.Outbound.BindDevice); err != nil {
+		return err
+	}
+	if err := validateHostTimeouts(c.Outbound.HostTimeouts); err != nil {
+		return err
+	}
+	if err := c.validateBackendTLS(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := c.Registry.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// intHost returns the IP address that the enclave-internal Web server binds
+// to.
+func (c *Config) intHost() string {
+	addr := addrLo
+	if c.IntIface == ifaceTap {
+		addr = addrTap
+	}
+	ip, _, _ := net.ParseCIDR(addr)
+	return ip.String()
+}
+
+// mac returns the MAC address of our TAP interface.  The config must be
+// valid.
+func (c *Config) mac() net.HardwareAddr {
+	s := c.MAC
+	if s == "" {
+		s = defaultMAC
+	}
+	hw, _ := parseMAC(s)
+	return hw
+}
+
+func (c *Config) demoRoutes() bool {
+	return c.DemoRoutes || c.Debug
+}
+
+func (c *Config) framePrefixLen() int {
+	if c.FramePrefixLen == 0 {
+		return prefixLen16
+	}
+	return c.FramePrefixLen
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// redacted replaces secrets in the config view.
+const redacted = "[redacted]"
+
+// configView is the JSON representation of the enclave's effective
+// configuration, as served by the config endpoint.  It's an explicit
+// allowlist of fields, so fields that are added to Config later don't leak
+// by accident.  Secrets are redacted, and hooks like the KMS client or the
+// tracer are only reported as present or absent.
+type configView struct {
+	FQDN          string `json:"fqdn"`
+	ExtPort       uint16 `json:"ext_port"`
+	IntPort       uint16 `json:"int_port"`
+	IntIface      string `json:"int_iface"`
+	HostProxyPort uint32 `json:"host_proxy_port"`
+	ParentCID     uint32 `json:"parent_cid"`
+	RPCPort       uint16 `json:"rpc_port,omitempty"`
+	AppWebSrv     string `json:"app_web_srv,omitempty"`
+	AppURL        string `json:"app_url,omitempty"`
+
+	Network networkView  `json:"network"`
+	Flags   featureFlags `json:"flags"`
+
+	StartupTimeout            string `json:"startup_timeout"`
+	HandshakeTimeout          string `json:"handshake_timeout"`
+	AttestationTimeout        string `json:"attestation_timeout"`
+	AttestationTokenTTL       string `json:"attestation_token_ttl"`
+	NonceReplayWindow         string `json:"nonce_replay_window"`
+	DecryptNonceWindow        string `json:"decrypt_nonce_window"`
+	SharedAttestationInterval string `json:"shared_attestation_interval"`
+	DrainPeriod               string `json:"drain_period"`
+	OutboundTimeout           string `json:"outbound_timeout"`
+	OutboundBindDevice        string `json:"outbound_bind_device,omitempty"`
+	ProxyQueueTimeout         string `json:"proxy_queue_timeout"`
+	KeyRotationOverlap        string `json:"key_rotation_overlap"`
+	MaxDocumentValidity       string `json:"max_document_validity"`
+
+	MaxPublicConns     int     `json:"max_public_conns"`
+	MaxProxiedRequests int     `json:"max_proxied_requests"`
+	RateLimit          float64 `json:"rate_limit"`
+	RateLimitBurst     int     `json:"rate_limit_burst"`
+	RateLimitClients   int     `json:"rate_limit_clients"`
+	FdCur              uint64  `json:"fd_cur"`
+	FdMax              uint64  `json:"fd_max"`
+	GoMaxProcs         int     `json:"gomaxprocs"`
+
+	ExpectedPCR0        string            `json:"expected_pcr0,omitempty"`
+	AttestationMetadata map[string]string `json:"attestation_metadata,omitempty"`
+	EgressAllowlist     []string          `json:"egress_allowlist,omitempty"`
+	RegistryURL         string            `json:"registry_url,omitempty"`
+
+	AdminToken       string `json:"admin_token,omitempty"`
+	AdminTokenSecret string `json:"admin_token_secret,omitempty"`
+	BackendSecret    string `json:"backend_secret,omitempty"`
+}
+
+// networkView describes the effective networking configuration.
+type networkView struct {
+	TapName        string   `json:"tap_name"`
+	TapAddr        string   `json:"tap_addr"`
+	MAC            string   `json:"mac"`
+	MTU            int      `json:"mtu"`
+	LinkMTU        int64    `json:"link_mtu"`
+	FramePrefixLen int      `json:"frame_prefix_len"`
+	Compression    string   `json:"frame_compression,omitempty"`
+	ExtraTaps      []string `json:"extra_taps,omitempty"`
+}
+
+// featureFlags lists which optional features are on.
+type featureFlags struct {
+	Debug             bool `json:"debug"`
+	UseACME           bool `json:"use_acme"`
+	UseHTTP2          bool `json:"use_http2"`
+	ProxyProtocol     bool `json:"proxy_protocol"`
+	DiscoverMTU       bool `json:"discover_mtu"`
+	NegotiateProtocol bool `json:"negotiate_protocol"`
+	MultiQueueTap     bool `json:"multi_queue_tap"`
+	Compression       bool `json:"compression"`
+	KMS               bool `json:"kms"`
+	CloudWatch        bool `json:"cloudwatch"`
+	Tracing           bool `json:"tracing"`
+	AuditLog          bool `json:"audit_log"`
+	RPCServer         bool `json:"rpc_server"`
+	AllowInvalidRoot  bool `json:"allow_invalid_root"`
+	CorrectClockSkew  bool `json:"correct_clock_skew"`
+	DropTapWriteErrs  bool `json:"drop_tap_write_errors"`
+	InternalVerify    bool `json:"internal_verify"`
+}
+
+// newConfigView returns the redacted view of the given configuration.
+func newConfigView(c *Config, n *NetConfig) configView {
+	v := configView{
+		FQDN:          c.FQDN,
+		ExtPort:       c.ExtPort,
+		IntPort:       c.IntPort,
+		IntIface:      c.IntIface,
+		HostProxyPort: c.HostProxyPort,
+		ParentCID:     n.ParentCID,
+		RPCPort:       c.RPCPort,
+		AppWebSrv:     redactURL(c.AppWebSrv),
+		AppURL:        redactURL(c.AppURL),
+		Network: networkView{
+			TapName:        n.TapName,
+			TapAddr:        n.TapAddr,
+			MAC:            n.MAC.String(),
+			MTU:            n.MTU,
+			LinkMTU:        metricLinkMTU.Value(),
+			FramePrefixLen: n.FramePrefixLen,
+			Compression:    n.FrameCompression,
+		},
+		Flags: featureFlags{
+			Debug:             c.Debug,
+			UseACME:           c.UseACME,
+			UseHTTP2:          c.UseHTTP2,
+			ProxyProtocol:     c.ProxyProtocol,
+			DiscoverMTU:       c.DiscoverMTU,
+			NegotiateProtocol: c.NegotiateProtocol,
+			MultiQueueTap:     n.MultiQueue,
+			Compression:       c.Compression.Enabled,
+			KMS:               c.KMS != nil,
+			CloudWatch:        c.CloudWatch.Client != nil,
+			Tracing:           c.TracingEndpoint != "" || c.TracerProvider != nil,
+			AuditLog:          c.AuditLog != nil,
+			RPCServer:         c.RPCPort != 0,
+			AllowInvalidRoot:  c.AllowInvalidRoot,
+			CorrectClockSkew:  c.CorrectClockSkew,
+			DropTapWriteErrs:  c.DropTapWriteErrors,
+			InternalVerify:    c.InternalVerify,
+		},
+		StartupTimeout:            c.StartupTimeout.String(),
+		HandshakeTimeout:          n.HandshakeTimeout.String(),
+		AttestationTimeout:        c.AttestationTimeout.String(),
+		AttestationTokenTTL:       c.AttestationTokenTTL.String(),
+		NonceReplayWindow:         c.NonceReplayWindow.String(),
+		DecryptNonceWindow:        c.DecryptNonceWindow.String(),
+		SharedAttestationInterval: c.SharedAttestationInterval.String(),
+		DrainPeriod:               c.DrainPeriod.String(),
+		OutboundTimeout:           c.Outbound.withDefaults().Timeout.String(),
+		OutboundBindDevice:        c.Outbound.BindDevice,
+		ProxyQueueTimeout:         c.ProxyQueueTimeout.String(),
+		KeyRotationOverlap:        c.KeyRotationOverlap.String(),
+		MaxDocumentValidity:       c.MaxDocumentValidity.String(),
+		MaxPublicConns:            c.MaxPublicConns,
+		MaxProxiedRequests:        c.MaxProxiedRequests,
+		RateLimit:                 c.RateLimit.Rate,
+		RateLimitBurst:            c.RateLimit.Burst,
+		RateLimitClients:          c.RateLimit.MaxClients,
+		FdCur:                     c.FdCur,
+		FdMax:                     c.FdMax,
+		GoMaxProcs:                c.GoMaxProcs,
+		ExpectedPCR0:              c.ExpectedPCR0,
+		AttestationMetadata:       c.AttestationMetadata,
+		EgressAllowlist:           c.EgressAllowlist,
+		RegistryURL:               redactURL(parseURL(c.Registry.URL)),
+		AdminToken:                redact(c.AdminToken),
+		AdminTokenSecret:          c.AdminTokenSecret,
+		BackendSecret:             redact(c.BackendSecret),
+	}
+	if c.StartupTimeout == 0 {
+		v.StartupTimeout = defaultStartupTimeout.String()
+	}
+	if c.KeyRotationOverlap == 0 {
+		v.KeyRotationOverlap = defaultKeyOverlap.String()
+	}
+	if c.MaxDocumentValidity == 0 {
+		v.MaxDocumentValidity = defaultMaxDocumentValidity.String()
+	}
+	for _, t := range n.ExtraTaps {
+		v.Network.ExtraTaps = append(v.Network.ExtraTaps, t.Name)
+	}
+	return v
+}
+
+// redact returns a placeholder if the given secret is set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL returns the given URL without its user info and query, either
+// of which may carry credentials.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	c := *u
+	if c.User != nil {
+		c.User = url.User(redacted)
+	}
+	if c.RawQuery != "" {
+		c.RawQuery = redacted
+	}
+	return c.String()
+}
+
+func parseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil || s == "" {
+		return nil
+	}
+	return u
+}
+
+// configHandler returns a HandlerFunc that reports the enclave's effective
+// configuration with all secrets redacted, so operators can spot config
+// drift across deployments.
+func configHandler(c *Config, n *NetConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newConfigView(c, n))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// requestTimeoutHeader lets clients tell us how long they're willing to
+	// wait for a proxied request, either as Go duration like "1.5s" or as
+	// number of seconds like "1.5".
+	requestTimeoutHeader = "X-Request-Timeout"
+	// maxRequestTimeout caps client-supplied timeouts.
+	maxRequestTimeout = 5 * time.Minute
+	errBadTimeout     = "malformed or non-positive X-Request-Timeout"
+	// statusClientClosedRequest is the non-standard status code that we log
+	// for proxied requests whose client went away, as nginx does.
+	statusClientClosedRequest = 499
+)
+
+// parseRequestTimeout parses the value of an X-Request-Timeout header.
+func parseRequestTimeout(v string) (time.Duration, bool) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	if d > maxRequestTimeout {
+		d = maxRequestTimeout
+	}
+	return d, true
+}
+
+// withRequestTimeout returns middleware that turns a client's
+// X-Request-Timeout into a deadline on the request's context.  The reverse
+// proxy derives its backend request from that context, so the backend call
+// is cancelled once the deadline passes, just like it's cancelled when the
+// client disconnects.
+func withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.Header.Get(requestTimeoutHeader)
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d, ok := parseRequestTimeout(v)
+		if !ok {
+			http.Error(w, errBadTimeout, http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// proxyErrorHandler returns the error handler of our reverse proxy.  A
+// missed deadline results in 504 Gateway Timeout instead of 502 Bad Gateway.
+// A client that went away can't read our response, but we still write 499,
+// so access logs and metrics don't count the request as 200 OK.  A
+// cancellation that didn't come from the client results in 502.  If the
+// given maintenance page isn't nil, it replaces the 502 that's sent while the
+// backend is unavailable.
+func proxyErrorHandler(page *maintenancePage) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		switch {
+		case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+			log.Debugf("Reverse proxy: Client cancelled request for %s.", r.URL.Path)
+			w.WriteHeader(statusClientClosedRequest)
+		case errors.Is(err, context.DeadlineExceeded):
+			log.Printf("Reverse proxy: Request for %s exceeded its deadline.", r.URL.Path)
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			if !logBackendTLSError(err) {
+				log.Printf("Reverse proxy: Request for %s failed: %v", r.URL.Path, err)
+			}
+			if page != nil {
+				page.write(w)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"1.5s", 1500 * time.Millisecond, true},
+		{"2", 2 * time.Second, true},
+		{"0.25", 250 * time.Millisecond, true},
+		{"1h", maxRequestTimeout, true},
+		{"0", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	} {
+		got, ok := parseRequestTimeout(test.value)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("Expected %q to parse to %s (%v) but got %s (%v).", test.value, test.want, test.wantOK, got, ok)
+		}
+	}
+}
+
+func TestWithRequestTimeout(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	h := withRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if hasDeadline {
+		t.Error("Expected no deadline without X-Request-Timeout.")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(requestTimeoutHeader, "30s")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !hasDeadline || time.Until(deadline) > 30*time.Second {
+		t.Errorf("Expected deadline within 30s but got %s (%v).", deadline, hasDeadline)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(requestTimeoutHeader, "never")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestProxyErrorHandler(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	page := &maintenancePage{status: http.StatusServiceUnavailable, contentType: "text/plain", body: []byte("brb")}
+
+	for _, test := range []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		page     *maintenancePage
+		wantCode int
+	}{
+		{"client went away", cancelled, context.Canceled, nil, statusClientClosedRequest},
+		{"cancelled elsewhere", context.Background(), context.Canceled, nil, http.StatusBadGateway},
+		{"deadline", context.Background(), context.DeadlineExceeded, nil, http.StatusGatewayTimeout},
+		{"backend down", context.Background(), errors.New("connection refused"), nil, http.StatusBadGateway},
+		{"maintenance page", context.Background(), errors.New("connection refused"), page, http.StatusServiceUnavailable},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/foo", nil).WithContext(test.ctx)
+			proxyErrorHandler(test.page)(w, r, test.err)
+			if w.Code != test.wantCode {
+				t.Fatalf("Expected status code %d but got %d.", test.wantCode, w.Code)
+			}
+		})
+	}
+}
+
+// newBlockingBackend returns an enclave whose reverse proxy forwards to a
+// backend that blocks until its request is cancelled.  The returned channel
+// is closed once that happens.
+func newBlockingBackend(t *testing.T) (*Enclave, <-chan struct{}) {
+	t.Helper()
+	backendCancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(backendCancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(backend.Close)
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	return newTestEnclave(t, cfg), backendCancelled
+}
+
+func TestProxyCancelsBackendWhenClientCancels(t *testing.T) {
+	e, backendCancelled := newBlockingBackend(t)
+	srv := httptest.NewServer(e.publicHandler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/slow", nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected client request to be cancelled but got %v.", err)
+	}
+	select {
+	case <-backendCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected backend request context to be cancelled.")
+	}
+}
+
+func TestProxyCancelsBackendAfterRequestTimeout(t *testing.T) {
+	e, backendCancelled := newBlockingBackend(t)
+	r := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	r.Header.Set(requestTimeoutHeader, "50ms")
+	w := httptest.NewRecorder()
+	e.publicHandler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusGatewayTimeout, w.Code)
+	}
+	select {
+	case <-backendCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected backend request context to be cancelled.")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDecryptNonceEnclave returns an enclave whose decrypt endpoint requires
+// nonces, backed by the given KMS.
+func newDecryptNonceEnclave(t *testing.T, kms *fakeKMS) *Enclave {
+	t.Helper()
+	useFakeRecipient(t)
+	orig := newAttester
+	newAttester = func() Attester { return DeterministicAttester{Seed: []byte("decrypt")} }
+	t.Cleanup(func() { newAttester = orig })
+
+	cfg := testConfig()
+	cfg.KMS = kms
+	cfg.DecryptNonceWindow = time.Minute
+	return newTestEnclave(t, cfg)
+}
+
+// attestationToken completes the attestation handshake with the given
+// enclave for the given nonce, and returns the attestation token.
+func attestationToken(t *testing.T, e *Enclave, nonce string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+nonce, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	token := w.Header().Get(attestationTokenHeader)
+	if token == "" {
+		t.Fatal("Expected attestation token.")
+	}
+	return token
+}
+
+// decryptWithNonce posts the given ciphertext with the given nonce and
+// attestation token to the given enclave's decrypt endpoint, and returns the
+// status code.
+func decryptWithNonce(e *Enclave, token, nonce, body string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, pathDecrypt+"?name=db&nonce="+nonce, strings.NewReader(body))
+	r.Header.Set(attestationTokenHeader, token)
+	e.pubSrv.Handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func testDecryptNonce(i int) string {
+	return fmt.Sprintf("%040x", i)
+}
+
+func TestDecryptNonceReplay(t *testing.T) {
+	kms := &fakeKMS{}
+	e := newDecryptNonceEnclave(t, kms)
+	first, second := testDecryptNonce(1), testDecryptNonce(2)
+
+	if code := decryptWithNonce(e, attestationToken(t, e, first), first, "hunter2"); code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, code)
+	}
+	// Our fake recipient's documents consist of their user data.
+	raw, _ := hex.DecodeString(first)
+	if doc := kms.docs[0]; !bytes.HasSuffix(doc, raw) {
+		t.Fatalf("Expected KMS document to contain nonce %s but got %x.", first, doc)
+	}
+	// A replayed request comes with a fresh token for the same nonce.
+	if code := decryptWithNonce(e, attestationToken(t, e, first), first, "hunter2"); code != http.StatusConflict {
+		t.Fatalf("Expected status code %d for replayed nonce but got %d.", http.StatusConflict, code)
+	}
+	if code := decryptWithNonce(e, attestationToken(t, e, second), second, "hunter3"); code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d for fresh nonce but got %d.", http.StatusNoContent, code)
+	}
+	if got, _ := e.secrets.Get("db"); string(got) != "hunter3" {
+		t.Fatalf("Expected stored secret %q but got %q.", "hunter3", got)
+	}
+}
+
+func TestDecryptNonceBoundToToken(t *testing.T) {
+	e := newDecryptNonceEnclave(t, &fakeKMS{})
+	nonce, other := testDecryptNonce(1), testDecryptNonce(2)
+
+	if code := decryptWithNonce(e, attestationToken(t, e, other), nonce, "hunter2"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d for unbound nonce but got %d.", http.StatusUnauthorized, code)
+	}
+	if code := decryptWithNonce(e, attestationToken(t, e, nonce), "", "hunter2"); code != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d without nonce but got %d.", http.StatusBadRequest, code)
+	}
+	// The rejected requests didn't use up the nonce.
+	if code := decryptWithNonce(e, attestationToken(t, e, nonce), nonce, "hunter2"); code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, code)
+	}
+}
+
+func TestDecryptNonceRecordedOnlyOnSuccess(t *testing.T) {
+	e := newDecryptNonceEnclave(t, &fakeKMS{errs: []error{errors.New("denied")}})
+	nonce := testDecryptNonce(1)
+	tooLong := strings.Repeat("a", maxCiphertextLen+1)
+
+	for _, c := range []struct {
+		name string
+		body string
+		code int
+	}{
+		{"malformed", tooLong, http.StatusBadRequest},
+		{"kms failure", "hunter2", http.StatusInternalServerError},
+		{"success", "hunter2", http.StatusNoContent},
+		{"replay", "hunter2", http.StatusConflict},
+	} {
+		if code := decryptWithNonce(e, attestationToken(t, e, nonce), nonce, c.body); code != c.code {
+			t.Fatalf("%s: Expected status code %d but got %d.", c.name, c.code, code)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// hasRoute returns true if the given router serves the given path via GET.
+func hasRoute(h http.Handler, path string) bool {
+	return h.(*chi.Mux).Match(chi.NewRouteContext(), http.MethodGet, path)
+}
+
+func TestDemoRoutes(t *testing.T) {
+	cases := []struct {
+		name       string
+		demoRoutes bool
+		debug      bool
+		present    bool
+	}{
+		{"off by default", false, false, false},
+		{"on via flag", true, false, true},
+		{"on in debug mode", false, true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DemoRoutes, cfg.Debug = c.demoRoutes, c.debug
+			e := newTestEnclave(t, cfg)
+			for _, path := range []string{pathHelloWorld, autoAttestation} {
+				if got := hasRoute(e.pubSrv.Handler, path); got != c.present {
+					t.Errorf("Expected %s to be present=%v but got %v.", path, c.present, got)
+				}
+			}
+			// The hardened attestation endpoint is always there.
+			if !hasRoute(e.pubSrv.Handler, pathAttestation) {
+				t.Errorf("Expected %s to be present.", pathAttestation)
+			}
+		})
+	}
+}
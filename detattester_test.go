@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hf/nitrite"
+)
+
+const (
+	// detTimestamp is the creation time of all deterministic documents, in
+	// milliseconds since the epoch: 2023-01-01T00:00:00Z.
+	detTimestamp = 1672531200000
+	// detNumPCRs is the number of PCRs in deterministic documents, which
+	// matches the NSM.
+	detNumPCRs = 16
+)
+
+// DeterministicAttester implements Attester by producing reproducible
+// documents, so we can compare attestation responses to golden files.
+// Documents that are created from the same seed and input are byte-for-byte
+// identical.  They're shaped like the NSM's COSE_Sign1 documents, but they
+// carry no certificate chain and their signature is an HMAC keyed with the
+// seed, so they never pass verification.
+type DeterministicAttester struct {
+	Seed []byte
+}
+
+// PCRs returns the PCRs of the attester's documents: PCR i is the SHA-384
+// of the seed followed by the byte i.
+func (a DeterministicAttester) PCRs() map[uint][]byte {
+	pcrs := make(map[uint][]byte, detNumPCRs)
+	for i := uint(0); i < detNumPCRs; i++ {
+		h := sha512.New384()
+		h.Write(a.Seed)
+		h.Write([]byte{byte(i)})
+		pcrs[i] = h.Sum(nil)
+	}
+	return pcrs
+}
+
+func (a DeterministicAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	enc, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := enc.Marshal(nitrite.Document{
+		ModuleID:    fmt.Sprintf("i-deterministic-enc%016x", seedID(a.Seed)),
+		Timestamp:   detTimestamp,
+		Digest:      "SHA384",
+		PCRs:        a.PCRs(),
+		Certificate: []byte{},
+		CABundle:    [][]byte{},
+		PublicKey:   publicKey,
+		UserData:    userData,
+		Nonce:       nonce,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+
+	// The protected header only names the algorithm: ES384, like the NSM's.
+	protected, err := enc.Marshal(map[int]int{1: -35})
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha512.New384, a.Seed)
+	mac.Write(protected)
+	mac.Write(payload)
+
+	return enc.Marshal([]any{protected, map[int]any{}, payload, mac.Sum(nil)})
+}
+
+// seedID derives a short, stable identifier from the given seed.
+func seedID(seed []byte) uint64 {
+	sum := sha512.Sum384(seed)
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dnsProbeTTL determines for how long we cache the result of a DNS probe.
+	dnsProbeTTL = 10 * time.Second
+	// dnsProbeTimeout bounds the time we wait for the resolver.
+	dnsProbeTimeout = 3 * time.Second
+)
+
+// hostResolver resolves host names.  It's satisfied by *net.Resolver.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsProbe checks if the enclave's resolver is able to resolve a canary host
+// name end-to-end, i.e., via resolv.conf, the TAP interface, and the EC2
+// host.  The result of the most recent check is cached for the given TTL.
+type dnsProbe struct {
+	sync.Mutex
+	resolver  hostResolver
+	canary    string
+	ttl       time.Duration
+	lastCheck time.Time
+	lastErr   error
+}
+
+func newDNSProbe(r hostResolver, canary string, ttl time.Duration) *dnsProbe {
+	return &dnsProbe{
+		resolver: r,
+		canary:   canary,
+		ttl:      ttl,
+	}
+}
+
+// check returns nil if the canary host name resolves, and an error otherwise.
+// A nil *dnsProbe always succeeds, which is the case if no canary is
+// configured.
+func (p *dnsProbe) check() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if time.Since(p.lastCheck) < p.ttl {
+		return p.lastErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsProbeTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupHost(ctx, p.canary)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", p.canary)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to resolve DNS canary: %w", err)
+	}
+	p.lastErr = err
+	p.lastCheck = time.Now()
+	return p.lastErr
+}
+
+// dnsHealthHandler returns a HandlerFunc that reports if DNS resolution works.
+func dnsHealthHandler(p *dnsProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := p.check(); err != nil {
+			log.Printf("Health: DNS probe failed: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"dns": statusDown})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"dns": statusOK})
+	}
+}
+
+// newEnclaveDNSProbe returns a DNS probe for the given canary host name that
+// uses the system's resolver, or nil if no canary is given.
+func newEnclaveDNSProbe(canary string) *dnsProbe {
+	if canary == "" {
+		return nil
+	}
+	return newDNSProbe(net.DefaultResolver, canary, dnsProbeTTL)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+func TestDNSHealthAndReadinessToggle(t *testing.T) {
+	r := &fakeResolver{addrs: []string{"192.0.2.1"}}
+	e := newTestEnclave(t, testConfig())
+	e.dns = newDNSProbe(r, "example.com", 0)
+	e.markLive()
+	health, ready := dnsHealthHandler(e.dns), readyHandler(e)
+
+	for _, c := range []struct {
+		err    error
+		code   int
+		status string
+	}{
+		{nil, http.StatusOK, statusOK},
+		{errNoSuchHost, http.StatusServiceUnavailable, statusDNSDown},
+		{nil, http.StatusOK, statusOK},
+	} {
+		r.setErr(c.err)
+		if code, body := getJSON(t, health, pathHealthDNS); code != c.code {
+			t.Errorf("Expected DNS health status code %d but got %d: %v", c.code, code, body)
+		}
+		code, body := getJSON(t, ready, pathReady)
+		if code != c.code || body["status"] != c.status {
+			t.Errorf("Expected readiness %d %q but got %d %v.", c.code, c.status, code, body["status"])
+		}
+	}
+}
+
+func TestDNSProbe(t *testing.T) {
+	var p *dnsProbe
+	if err := p.check(); err != nil {
+		t.Errorf("Expected nil probe to succeed but got %v.", err)
+	}
+	if p = newEnclaveDNSProbe(""); p != nil {
+		t.Error("Expected no probe without a canary.")
+	}
+
+	p = newDNSProbe(&fakeResolver{}, "example.com", 0)
+	if err := p.check(); err == nil || !strings.Contains(err.Error(), "no addresses") {
+		t.Errorf("Expected error for empty answer but got %v.", err)
+	}
+}
+
+func TestDNSProbeCache(t *testing.T) {
+	r := &fakeResolver{addrs: []string{"192.0.2.1"}}
+	p := newDNSProbe(r, "example.com", time.Hour)
+	if err := p.check(); err != nil {
+		t.Fatalf("Expected working DNS but got %v.", err)
+	}
+	// Within the TTL, we keep reporting the cached result.
+	r.setErr(errNoSuchHost)
+	if err := p.check(); err != nil {
+		t.Fatalf("Expected cached result but got %v.", err)
+	}
+}
+
+func TestStartWithBrokenDNS(t *testing.T) {
+	useFakeNetworking(t, nil)
+	useFakeLoIface(t)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	cfg := testConfig()
+	cfg.ExtPort, cfg.IntPort = freePort(t), freePort(t)
+	e := newTestEnclave(t, cfg)
+	r := &fakeResolver{err: errNoSuchHost}
+	e.dns = newDNSProbe(r, "example.com", 0)
+	e.attester = &fakeAttester{doc: []byte("document")}
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	if err := e.Start(); err != nil {
+		t.Fatalf("Expected broken DNS to not fail Start but got %v.", err)
+	}
+	var warned bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "DNS isn't working") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("Expected a warning about DNS.")
+	}
+
+	if code, body := getJSON(t, readyHandler(e), pathReady); code != http.StatusServiceUnavailable || body["status"] != statusDNSDown {
+		t.Errorf("Expected not ready because of DNS but got %d %v.", code, body["status"])
+	}
+	r.setErr(nil)
+	r.Lock()
+	r.addrs = []string{"192.0.2.1"}
+	r.Unlock()
+	if code, body := getJSON(t, readyHandler(e), pathReady); code != http.StatusOK {
+		t.Errorf("Expected ready once DNS works but got %d %v.", code, body["status"])
+	}
+}
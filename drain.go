@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statusStarting = "starting"
+	statusDraining = "draining"
+	statusDNSDown  = "dns unavailable"
+)
+
+// Drain marks the enclave as not ready, so load balancers that poll /ready
+// deregister it, while our Web servers keep serving in-flight and new
+// requests.  Call Stop once the load balancer had time to react.  Drain
+// can't be undone.
+func (e *Enclave) Drain() {
+	e.Lock()
+	defer e.Unlock()
+	if e.draining {
+		return
+	}
+	e.draining = true
+	log.Info("Enclave draining; /ready now reports not ready.")
+}
+
+// markLive marks the enclave as ready once Start has succeeded.
+func (e *Enclave) markLive() {
+	e.Lock()
+	defer e.Unlock()
+	e.live = true
+}
+
+// readiness returns our readiness status.  Once we're live, we're only ready
+// if DNS resolution works, provided that a DNS canary is configured.
+func (e *Enclave) readiness() string {
+	e.RLock()
+	draining, live := e.draining, e.live
+	e.RUnlock()
+	switch {
+	case draining:
+		return statusDraining
+	case !live:
+		return statusStarting
+	case e.dns.check() != nil:
+		return statusDNSDown
+	default:
+		return statusOK
+	}
+}
+
+// readyHandler returns a HandlerFunc for load balancer health checks.  It
+// responds with 200 OK once the enclave has started, and with 503 Service
+// Unavailable while it's starting, draining, or unable to resolve DNS.
+func readyHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := e.readiness()
+		code := http.StatusOK
+		if status != statusOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]string{"status": status})
+	}
+}
+
+// DrainAndStop drains the enclave for the given period and then stops it for
+// the given reason.  It returns early if the enclave stops on its own.
+func (e *Enclave) DrainAndStop(period time.Duration, reason StopReason) error {
+	if period > 0 {
+		e.Drain()
+		timer := time.NewTimer(period)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-e.Done():
+		}
+	}
+	return e.Stop(reason)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getReady queries the given handler's readiness endpoint, and returns the
+// status code and the reported status.
+func getReady(t *testing.T, h http.Handler) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathReady, nil))
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	return w.Code, body.Status
+}
+
+func TestDrain(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	e.MountApp("/app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "app")
+	}))
+	h := e.publicHandler()
+
+	if code, status := getReady(t, h); code != http.StatusServiceUnavailable || status != statusStarting {
+		t.Fatalf("Expected 503 while starting but got %d (%s).", code, status)
+	}
+	e.markLive()
+	if code, status := getReady(t, h); code != http.StatusOK || status != statusOK {
+		t.Fatalf("Expected 200 once live but got %d (%s).", code, status)
+	}
+
+	e.Drain()
+	e.Drain()
+	if code, status := getReady(t, h); code != http.StatusServiceUnavailable || status != statusDraining {
+		t.Fatalf("Expected 503 while draining but got %d (%s).", code, status)
+	}
+	// Requests other than readiness checks keep working.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app/foo", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "app" {
+		t.Errorf("Expected app to be served while draining but got %d.", w.Code)
+	}
+}
+
+func TestDrainAndStop(t *testing.T) {
+	cfg := testConfig()
+	cfg.ExtPort, cfg.IntPort = freePort(t), freePort(t)
+	e := newTestEnclave(t, cfg)
+	if err := startWebServers(e); err != nil {
+		t.Fatalf("Failed to start Web servers: %v", err)
+	}
+	e.markLive()
+
+	const period = 200 * time.Millisecond
+	start := time.Now()
+	stopped := make(chan error, 1)
+	go func() { stopped <- e.DrainAndStop(period, StopSignal) }()
+
+	// While draining, the server is still up but not ready.
+	readyURL := fmt.Sprintf("http://127.0.0.1:%d%s", cfg.ExtPort, pathReady)
+	deadline := time.Now().Add(period / 2)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(readyURL)
+		if err != nil {
+			t.Fatalf("Expected server to keep serving while draining but got %v.", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if code, status := getReady(t, e.publicHandler()); code != http.StatusServiceUnavailable || status != statusDraining {
+		t.Fatalf("Expected draining enclave to be not ready but got %d (%s).", code, status)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected enclave to stop after the drain period.")
+	}
+	if elapsed := time.Since(start); elapsed < period {
+		t.Errorf("Expected enclave to drain for %s but it stopped after %s.", period, elapsed)
+	}
+	if _, err := http.Get(readyURL); err == nil {
+		t.Error("Expected server to be gone after stopping.")
+	}
+}
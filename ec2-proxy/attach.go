@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// pathDetach is the path at which the enclave asks us to drop its stale
+// tunnel, so it can attach again.
+const pathDetach = "/detach"
+
+// attachments keeps track of the tunnels that are attached to our virtual
+// network, by peer.  A peer is the remote address without its port, i.e.,
+// the enclave's CID, so each enclave attaches at most one tunnel.
+type attachments struct {
+	sync.Mutex
+	tunnels map[string]*tunnel
+}
+
+// tunnel is an attached tunnel.  Its connection is nil until our virtual
+// network hijacks it.
+type tunnel struct {
+	conn net.Conn
+}
+
+// withAttachGuard wraps the given handler, which serves our virtual
+// network's connect path, and rejects a peer's tunnel with 409 Conflict
+// while its previous tunnel is still attached.  A peer drops its stale
+// tunnel via the detach path, which is idempotent.  Enclaves that predate
+// the detach path would be rejected until their stale tunnel times out, so
+// the guard is only enabled by the -attach-guard flag.
+func withAttachGuard(h http.Handler) http.Handler {
+	a := &attachments{tunnels: make(map[string]*tunnel)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case types.ConnectPath:
+			a.connect(h, w, r)
+		case pathDetach:
+			a.detach(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (a *attachments) connect(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	peer := peerOf(r.RemoteAddr)
+	t := &tunnel{}
+	a.Lock()
+	if _, ok := a.tunnels[peer]; ok {
+		a.Unlock()
+		log.Warnf("Rejecting tunnel of %s because it's already attached.", peer)
+		http.Error(w, "already attached", http.StatusConflict)
+		return
+	}
+	a.tunnels[peer] = t
+	a.Unlock()
+
+	defer func() {
+		a.Lock()
+		// The peer may have detached us and attached a new tunnel already.
+		if a.tunnels[peer] == t {
+			delete(a.tunnels, peer)
+		}
+		a.Unlock()
+	}()
+	h.ServeHTTP(&hijackRecorder{ResponseWriter: w, onHijack: func(c net.Conn) {
+		a.Lock()
+		t.conn = c
+		a.Unlock()
+	}}, r)
+}
+
+func (a *attachments) detach(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	peer := peerOf(r.RemoteAddr)
+	var c net.Conn
+	a.Lock()
+	t, ok := a.tunnels[peer]
+	if ok {
+		c = t.conn
+		delete(a.tunnels, peer)
+	}
+	a.Unlock()
+	if ok {
+		log.Infof("Detaching stale tunnel of %s.", peer)
+	}
+	if c != nil {
+		c.Close()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// peerOf returns the given remote address without its port.
+func peerOf(addr string) string {
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		return addr[:i]
+	}
+	return addr
+}
+
+// hijackRecorder passes the connection that the wrapped handler hijacks to
+// onHijack.
+type hijackRecorder struct {
+	http.ResponseWriter
+	onHijack func(net.Conn)
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c, rw, err := h.Hijack()
+	if err == nil {
+		w.onHijack(c)
+	}
+	return c, rw, err
+}
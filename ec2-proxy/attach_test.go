@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+// tunnelHandler mimics our virtual network's connect path: it hijacks the
+// connection and holds on to it until the peer or a detach closes it.
+var tunnelHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != types.ConnectPath {
+		fmt.Fprint(w, "passed through")
+		return
+	}
+	c, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	_, _ = io.Copy(io.Discard, c)
+})
+
+// connect attaches a tunnel to the given server, and returns the connection
+// along with the status code that the server rejected the tunnel with, or 0
+// if it accepted the tunnel.
+func connect(t *testing.T, srv *httptest.Server) (net.Conn, int) {
+	t.Helper()
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	fmt.Fprintf(c, "POST %s HTTP/1.1\r\nHost: host\r\n\r\n", types.ConnectPath)
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	_ = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		// An accepted tunnel gets no response.
+		return c, 0
+	}
+	resp.Body.Close()
+	return c, resp.StatusCode
+}
+
+func detach(t *testing.T, srv *httptest.Server, method string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+pathDetach, nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to detach: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAttachGuard(t *testing.T) {
+	srv := httptest.NewServer(withAttachGuard(tunnelHandler))
+	defer srv.Close()
+
+	stale, code := connect(t, srv)
+	defer stale.Close()
+	if code != 0 {
+		t.Fatalf("Expected first tunnel to be accepted but got status code %d.", code)
+	}
+	if _, code = connect(t, srv); code != http.StatusConflict {
+		t.Fatalf("Expected status code %d for second tunnel but got %d.", http.StatusConflict, code)
+	}
+
+	if code := detach(t, srv, http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusMethodNotAllowed, code)
+	}
+	if code := detach(t, srv, http.MethodPost); code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, code)
+	}
+	// Detaching closed the stale tunnel.
+	_ = stale.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stale.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected stale tunnel to be closed but got %v.", err)
+	}
+	// Detaching is idempotent.
+	if code := detach(t, srv, http.MethodPost); code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, code)
+	}
+
+	fresh, code := connect(t, srv)
+	defer fresh.Close()
+	if code != 0 {
+		t.Fatalf("Expected tunnel to be accepted after detaching but got status code %d.", code)
+	}
+}
+
+func TestAttachGuardPassesThrough(t *testing.T) {
+	srv := httptest.NewServer(withAttachGuard(tunnelHandler))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + pathMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "passed through" {
+		t.Fatalf("Expected request to pass through but got %q.", body)
+	}
+}
+
+func TestPeerOf(t *testing.T) {
+	for addr, want := range map[string]string{
+		"3:1024":         "3",
+		"127.0.0.1:4242": "127.0.0.1",
+		"[::1]:4242":     "[::1]",
+		"noport":         "noport",
+	} {
+		if got := peerOf(addr); got != want {
+			t.Errorf("Expected peer %q for %q but got %q.", want, addr, got)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// batchPrefixLen is the length of the little-endian length prefix of
+	// each batch that an enclave sends in the batch format.
+	batchPrefixLen = 4
+	// maxBatchBytes is the size of the largest batch that we accept.  It
+	// must match the enclave's maxBatchBytes.
+	maxBatchBytes = 1 << 20
+)
+
+var errBatchTooLarge = errors.New("batch too large")
+
+// withBatching wraps the given handler, which serves our virtual network's
+// connect path, and unpacks the batches of tunnels that ask for the batch
+// format in the "batch" query parameter.  A batch is a 4-byte little-endian
+// length prefix followed by whole frames, each with its own length prefix.
+// We read each batch with a single read, and hand its frames to our virtual
+// network one by one.  Only the enclave batches frames; we still send ours
+// one by one.  Tunnels that don't ask for batches are left untouched.
+func withBatching(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := r.URL.Query().Get("batch")
+		if r.URL.Path != types.ConnectPath || b == "" || b == "0" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if b != "1" {
+			log.Warnf("Rejecting tunnel with unsupported batch format %q.", b)
+			http.Error(w, "unsupported batch format", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(&batchHijacker{ResponseWriter: w}, r)
+	})
+}
+
+// batchHijacker hands out connections that unpack batches when the wrapped
+// handler hijacks the connection.
+type batchHijacker struct {
+	http.ResponseWriter
+}
+
+func (w *batchHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The enclave may have sent batches right after its request, which the
+	// HTTP server already buffered.
+	bc := newBatchConn(c, rw.Reader)
+	return bc, bufio.NewReadWriter(bufio.NewReader(bc), bufio.NewWriter(bc)), nil
+}
+
+// batchConn is a tunnel connection whose peer sends batches of frames, while
+// its user reads the frames of the batches back to back.  Writes go to the
+// peer untouched.  Reads must not be concurrent.
+type batchConn struct {
+	net.Conn
+	r       io.Reader
+	sizeBuf []byte
+	batch   []byte
+	unread  []byte // The part of batch that our user didn't read yet.
+}
+
+func newBatchConn(c net.Conn, r io.Reader) *batchConn {
+	return &batchConn{
+		Conn:    c,
+		r:       r,
+		sizeBuf: make([]byte, batchPrefixLen),
+	}
+}
+
+func (c *batchConn) Read(b []byte) (int, error) {
+	for len(c.unread) == 0 {
+		if _, err := io.ReadFull(c.r, c.sizeBuf); err != nil {
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(c.sizeBuf)
+		if size > maxBatchBytes {
+			return 0, fmt.Errorf("%w: %d bytes", errBatchTooLarge, size)
+		}
+		if cap(c.batch) < int(size) {
+			c.batch = make([]byte, size)
+		}
+		c.batch = c.batch[:size]
+		if _, err := io.ReadFull(c.r, c.batch); err != nil {
+			return 0, err
+		}
+		c.unread = c.batch
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// writeBatch writes the given frames to w as a single batch, like an enclave
+// that negotiated batches does.
+func writeBatch(t *testing.T, w io.Writer, frames [][]byte) {
+	t.Helper()
+	batch := make([]byte, batchPrefixLen)
+	for _, frame := range frames {
+		prefix := make([]byte, framePrefixLen)
+		binary.LittleEndian.PutUint16(prefix, uint16(len(frame)))
+		batch = append(append(batch, prefix...), frame...)
+	}
+	binary.LittleEndian.PutUint32(batch, uint32(len(batch)-batchPrefixLen))
+	if _, err := w.Write(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+}
+
+// batchFrames returns small frames, followed by a large one.
+func batchFrames() [][]byte {
+	var frames [][]byte
+	for i := 0; i < 20; i++ {
+		frames = append(frames, bytes.Repeat([]byte{byte(i)}, 40))
+	}
+	return append(frames, bytes.Repeat([]byte{0xff}, 1500))
+}
+
+func TestBatchConnUnpacks(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	conn := newBatchConn(host, host)
+	defer conn.Close()
+
+	frames := batchFrames()
+	go func() {
+		writeBatch(t, enclave, frames[:5])
+		writeBatch(t, enclave, nil)
+		writeBatch(t, enclave, frames[5:])
+	}()
+	// Our virtual network reads the frames in order, one by one.
+	for i, want := range frames {
+		if got := readRaw(t, conn); !bytes.Equal(got, want) {
+			t.Fatalf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+
+	// Our frames reach the enclave untouched.
+	go func() {
+		if err := writeRaw(conn, frames[0]); err != nil {
+			t.Errorf("Failed to write frame: %v", err)
+		}
+	}()
+	if got := readRaw(t, enclave); !bytes.Equal(got, frames[0]) {
+		t.Fatal("Frame to the enclave differs from the frame that was sent.")
+	}
+}
+
+func TestBatchConnRejectsLargeBatches(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	go func() {
+		prefix := make([]byte, batchPrefixLen)
+		binary.LittleEndian.PutUint32(prefix, maxBatchBytes+1)
+		_, _ = enclave.Write(prefix)
+	}()
+	if _, err := newBatchConn(host, host).Read(make([]byte, 64)); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("Expected %v but got %v.", errBatchTooLarge, err)
+	}
+}
+
+func TestWithBatching(t *testing.T) {
+	srv := httptest.NewServer(withBatching(echoTunnel))
+	defer srv.Close()
+
+	t.Run("batched", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?batch=1")
+		defer c.Close()
+		frames := batchFrames()
+		writeBatch(t, c, frames)
+		for i, frame := range frames {
+			if got := readRaw(t, c); !bytes.Equal(got, frame) {
+				t.Fatalf("Frame %d differs after the round trip.", i)
+			}
+		}
+	})
+
+	t.Run("unbatched", func(t *testing.T) {
+		c := dialTunnel(t, srv, "")
+		defer c.Close()
+		frame := batchFrames()[0]
+		if err := writeRaw(c, frame); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+		if got := readRaw(t, c); !bytes.Equal(got, frame) {
+			t.Fatal("Frame differs after the round trip.")
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?batch=2")
+		defer c.Close()
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status code %d but got %d.", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestBatchedWideCompressedTunnel(t *testing.T) {
+	srv := httptest.NewServer(withBatching(withWidePrefix(withFrameCompression(echoTunnel))))
+	defer srv.Close()
+	c := dialTunnel(t, srv, "?batch=1&compression=gzip&prefix_len=4")
+	defer c.Close()
+
+	// Batches carry the frames as they'd otherwise go on the wire, i.e.,
+	// encoded and with 4-byte prefixes.
+	codec := newFrameCodec()
+	var batch bytes.Buffer
+	frames := testFrames()
+	for _, frame := range frames {
+		encoded, err := codec.encode(frame)
+		if err != nil {
+			t.Fatalf("Failed to encode frame: %v", err)
+		}
+		writeWide(t, &batch, encoded)
+	}
+	prefix := make([]byte, batchPrefixLen)
+	binary.LittleEndian.PutUint32(prefix, uint32(batch.Len()))
+	if _, err := c.Write(append(prefix, batch.Bytes()...)); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	for i, frame := range frames {
+		got := make([]byte, len(frame))
+		n, err := codec.decode(got, readWide(t, c))
+		if err != nil {
+			t.Fatalf("Failed to decode frame: %v", err)
+		}
+		if !bytes.Equal(got[:n], frame) {
+			t.Fatalf("Frame %d differs after the round trip.", i)
+		}
+	}
+}
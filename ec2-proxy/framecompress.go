@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// frameCompressionGzip compresses frames with gzip.
+	frameCompressionGzip = "gzip"
+
+	// Each compressed frame starts with one of the following encoding bytes.
+	frameEncRaw  = 0
+	frameEncGzip = 1
+	// frameEncLen is the length of the encoding byte.
+	frameEncLen = 1
+)
+
+var errBadFrameEncoding = errors.New("malformed compressed frame")
+
+// withFrameCompression wraps the given handler, which serves our virtual
+// network's connect path, and decodes the frames of tunnels that ask for
+// compression in the "compression" query parameter.  Our virtual network
+// only speaks raw frames, so we translate between the two on the tunnel's
+// connection.  Tunnels that don't ask for compression are left untouched.
+func withFrameCompression(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != types.ConnectPath || r.URL.Query().Get("compression") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c := r.URL.Query().Get("compression"); c != frameCompressionGzip {
+			log.Warnf("Rejecting tunnel with unsupported frame compression %q.", c)
+			http.Error(w, "unsupported frame compression", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(&codecHijacker{ResponseWriter: w}, r)
+	})
+}
+
+// codecHijacker hands out connections that decode and encode compressed
+// frames when the wrapped handler hijacks the connection.
+type codecHijacker struct {
+	http.ResponseWriter
+}
+
+func (w *codecHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The enclave may have sent frames right after its request, which the
+	// HTTP server already buffered.
+	cc := newCodecConn(c, rw.Reader)
+	return cc, bufio.NewReadWriter(bufio.NewReader(cc), bufio.NewWriter(cc)), nil
+}
+
+// codecConn is a tunnel connection whose peer sends and expects compressed
+// frames, while its user reads and writes raw frames, each with its length
+// prefix.  Reads must not be concurrent, and neither must writes.
+type codecConn struct {
+	net.Conn
+	r       io.Reader
+	codec   *frameCodec
+	sizeBuf []byte
+	in      []byte // An encoded frame from the peer.
+	frame   []byte // A decoded frame, with its prefix.
+	unread  []byte // The part of frame that our user didn't read yet.
+	pending []byte // Raw frames from our user that aren't complete yet.
+	out     []byte // An encoded frame for the peer, with its prefix.
+}
+
+func newCodecConn(c net.Conn, r io.Reader) *codecConn {
+	return &codecConn{
+		Conn:    c,
+		r:       r,
+		codec:   newFrameCodec(),
+		sizeBuf: make([]byte, framePrefixLen),
+		in:      make([]byte, math.MaxUint16),
+		frame:   make([]byte, framePrefixLen+math.MaxUint16),
+	}
+}
+
+// Read returns the peer's frames after decoding them.
+func (c *codecConn) Read(b []byte) (int, error) {
+	if len(c.unread) == 0 {
+		if _, err := io.ReadFull(c.r, c.sizeBuf); err != nil {
+			return 0, err
+		}
+		size := int(binary.LittleEndian.Uint16(c.sizeBuf))
+		if _, err := io.ReadFull(c.r, c.in[:size]); err != nil {
+			return 0, err
+		}
+		n, err := c.codec.decode(c.frame[framePrefixLen:], c.in[:size])
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint16(c.frame, uint16(n))
+		c.unread = c.frame[:framePrefixLen+n]
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// Write encodes our user's frames for the peer.  Our virtual network writes
+// a frame's prefix and the frame itself separately, so we collect writes
+// until a frame is complete.
+func (c *codecConn) Write(b []byte) (int, error) {
+	c.pending = append(c.pending, b...)
+	for len(c.pending) >= framePrefixLen {
+		size := int(binary.LittleEndian.Uint16(c.pending))
+		if len(c.pending) < framePrefixLen+size {
+			break
+		}
+		encoded, err := c.codec.encode(c.pending[framePrefixLen : framePrefixLen+size])
+		if err != nil {
+			return 0, err
+		}
+		if len(encoded) > math.MaxUint16 {
+			return 0, fmt.Errorf("%w: %d-byte frame too large", errBadFrameEncoding, len(encoded))
+		}
+		c.out = append(c.out[:0], make([]byte, framePrefixLen)...)
+		binary.LittleEndian.PutUint16(c.out, uint16(len(encoded)))
+		c.out = append(c.out, encoded...)
+		if _, err := c.Conn.Write(c.out); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[framePrefixLen+size:]
+	}
+	// Don't hold on to the buffer of a large frame forever.
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return len(b), nil
+}
+
+// frameCodec compresses and decompresses frames.  It must match the
+// enclave's frameCodec: each frame starts with an encoding byte, followed by
+// the raw or the gzip-compressed frame.  Frames that don't get smaller are
+// sent raw.  A frameCodec must not be shared by goroutines.
+type frameCodec struct {
+	buf bytes.Buffer
+	w   *gzip.Writer
+	r   *gzip.Reader
+	in  bytes.Reader
+}
+
+func newFrameCodec() *frameCodec {
+	c := &frameCodec{}
+	c.w, _ = gzip.NewWriterLevel(&c.buf, gzip.BestSpeed)
+	return c
+}
+
+// encode returns the encoded frame.  The returned slice is only valid until
+// the next call to encode.
+func (c *frameCodec) encode(frame []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.buf.WriteByte(frameEncGzip)
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	if c.buf.Len() < frameEncLen+len(frame) {
+		return c.buf.Bytes(), nil
+	}
+
+	c.buf.Reset()
+	c.buf.WriteByte(frameEncRaw)
+	c.buf.Write(frame)
+	return c.buf.Bytes(), nil
+}
+
+// decode decodes the given encoded frame into dst and returns the length of
+// the decoded frame.  Frames that don't fit into dst are rejected.
+func (c *frameCodec) decode(dst, encoded []byte) (int, error) {
+	if len(encoded) < frameEncLen {
+		return 0, fmt.Errorf("%w: missing encoding", errBadFrameEncoding)
+	}
+	enc, payload := encoded[0], encoded[frameEncLen:]
+	switch enc {
+	case frameEncRaw:
+		if len(payload) > len(dst) {
+			return 0, fmt.Errorf("%w: %d-byte frame too large", errBadFrameEncoding, len(payload))
+		}
+		return copy(dst, payload), nil
+	case frameEncGzip:
+	default:
+		return 0, fmt.Errorf("%w: unknown encoding %d", errBadFrameEncoding, enc)
+	}
+
+	c.in.Reset(payload)
+	var err error
+	if c.r == nil {
+		c.r, err = gzip.NewReader(&c.in)
+	} else {
+		err = c.r.Reset(&c.in)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+	}
+	// Reading up to io.EOF makes gzip verify the frame's checksum.
+	n := 0
+	for {
+		if n == len(dst) {
+			// The frame must end here.
+			m, err := c.r.Read(make([]byte, 1))
+			if m > 0 {
+				return 0, fmt.Errorf("%w: frame too large", errBadFrameEncoding)
+			}
+			if err != io.EOF {
+				return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+			}
+			break
+		}
+		m, err := c.r.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("%w: empty frame", errBadFrameEncoding)
+	}
+	return n, nil
+}
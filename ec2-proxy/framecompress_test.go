@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testFrames returns a compressible and an incompressible frame.
+func testFrames() [][]byte {
+	random := make([]byte, 1500)
+	rand.New(rand.NewSource(1)).Read(random)
+	return [][]byte{bytes.Repeat([]byte("frame"), 300), random}
+}
+
+// writeEncoded writes the given frame to w like a compressing enclave does.
+func writeEncoded(t *testing.T, w io.Writer, codec *frameCodec, frame []byte) {
+	t.Helper()
+	encoded, err := codec.encode(frame)
+	if err != nil {
+		t.Fatalf("Failed to encode frame: %v", err)
+	}
+	prefix := make([]byte, framePrefixLen)
+	binary.LittleEndian.PutUint16(prefix, uint16(len(encoded)))
+	if _, err := w.Write(append(prefix, encoded...)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+}
+
+// readEncoded reads a frame from r like a compressing enclave does.
+func readEncoded(t *testing.T, r io.Reader, codec *frameCodec) []byte {
+	t.Helper()
+	prefix := make([]byte, framePrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		t.Fatalf("Failed to read frame size: %v", err)
+	}
+	encoded := make([]byte, binary.LittleEndian.Uint16(prefix))
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	frame := make([]byte, 65535)
+	n, err := codec.decode(frame, encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode frame: %v", err)
+	}
+	return frame[:n]
+}
+
+func TestCodecConnRoundTrip(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	conn := newCodecConn(host, host)
+	defer conn.Close()
+	codec := newFrameCodec()
+
+	// The enclave's frames reach our virtual network decoded.
+	go func() {
+		for _, frame := range testFrames() {
+			writeEncoded(t, enclave, codec, frame)
+		}
+	}()
+	for i, want := range testFrames() {
+		if got := readRaw(t, conn); !bytes.Equal(got, want) {
+			t.Fatalf("Frame %d from the enclave differs from the frame that was sent.", i)
+		}
+	}
+
+	// Our virtual network's frames reach the enclave encoded.
+	go func() {
+		for _, frame := range testFrames() {
+			if err := writeRaw(conn, frame); err != nil {
+				t.Errorf("Failed to write frame: %v", err)
+			}
+		}
+	}()
+	for i, want := range testFrames() {
+		if got := readEncoded(t, enclave, codec); !bytes.Equal(got, want) {
+			t.Fatalf("Frame %d to the enclave differs from the frame that was sent.", i)
+		}
+	}
+}
+
+func TestCodecConnRejectsMalformedFrames(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	go func() { _, _ = enclave.Write([]byte{2, 0, 9, 9}) }()
+	if _, err := newCodecConn(host, host).Read(make([]byte, 64)); !errors.Is(err, errBadFrameEncoding) {
+		t.Fatalf("Expected %v but got %v.", errBadFrameEncoding, err)
+	}
+}
+
+func TestWithFrameCompression(t *testing.T) {
+	srv := httptest.NewServer(withFrameCompression(echoTunnel))
+	defer srv.Close()
+
+	t.Run("compressed", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?compression=gzip")
+		defer c.Close()
+		codec := newFrameCodec()
+		for i, frame := range testFrames() {
+			writeEncoded(t, c, codec, frame)
+			if got := readEncoded(t, c, codec); !bytes.Equal(got, frame) {
+				t.Fatalf("Frame %d differs after the round trip.", i)
+			}
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		c := dialTunnel(t, srv, "")
+		defer c.Close()
+		for i, frame := range testFrames() {
+			if err := writeRaw(c, frame); err != nil {
+				t.Fatalf("Failed to write frame: %v", err)
+			}
+			if got := readRaw(t, c); !bytes.Equal(got, frame) {
+				t.Fatalf("Frame %d differs after the round trip.", i)
+			}
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?compression=zstd")
+		defer c.Close()
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status code %d but got %d.", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestWideCompressedTunnel(t *testing.T) {
+	srv := httptest.NewServer(withWidePrefix(withFrameCompression(echoTunnel)))
+	defer srv.Close()
+	c := dialTunnel(t, srv, "?compression=gzip&prefix_len=4")
+	defer c.Close()
+
+	codec := newFrameCodec()
+	for i, frame := range testFrames() {
+		encoded, err := codec.encode(frame)
+		if err != nil {
+			t.Fatalf("Failed to encode frame: %v", err)
+		}
+		writeWide(t, c, encoded)
+		got := make([]byte, len(frame))
+		n, err := codec.decode(got, readWide(t, c))
+		if err != nil {
+			t.Fatalf("Failed to decode frame: %v", err)
+		}
+		if !bytes.Equal(got[:n], frame) {
+			t.Fatalf("Frame %d differs after the round trip.", i)
+		}
+	}
+}
+
+func TestFrameCodecDecodeErrors(t *testing.T) {
+	codec := newFrameCodec()
+	big, err := codec.encode(bytes.Repeat([]byte{0}, 2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big = append([]byte(nil), big...)
+	for name, encoded := range map[string][]byte{
+		"empty":            nil,
+		"unknown encoding": {7, 1, 2, 3},
+		"raw too large":    append([]byte{frameEncRaw}, make([]byte, 1001)...),
+		"gzip too large":   big,
+		"corrupt gzip":     {frameEncGzip, 1, 2, 3},
+	} {
+		if _, err := codec.decode(make([]byte, 1000), encoded); !errors.Is(err, errBadFrameEncoding) {
+			t.Errorf("%s: Expected %v but got %v.", name, errBadFrameEncoding, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMTU = 1500
+	routeFile  = "/proc/net/route"
+	// pathMTU is the path at which we tell the enclave our MTU, so it can
+	// configure its TAP interface to match.
+	pathMTU = "/mtu"
+)
+
+var (
+	errNoDefaultRoute = errors.New("no default route")
+
+	// interfaceByName is a variable pointing to the function that looks up
+	// network interfaces.  Using a variable allows us to easily mock the
+	// interface table in our unit tests.
+	interfaceByName = net.InterfaceByName
+)
+
+// hostMTU returns the MTU of the interface that carries our default route,
+// e.g., an EC2 instance's primary ENI, which often has jumbo frames enabled.
+// If the MTU can't be determined, the given fallback is returned.
+func hostMTU(fallback int) int {
+	f, err := os.Open(routeFile)
+	if err != nil {
+		log.Warnf("Failed to read routing table; using MTU %d: %v", fallback, err)
+		return fallback
+	}
+	defer f.Close()
+
+	mtu, err := discoverMTU(f)
+	if err != nil {
+		log.Warnf("Failed to discover host MTU; using MTU %d: %v", fallback, err)
+		return fallback
+	}
+	log.Infof("Discovered host MTU %d.", mtu)
+	return mtu
+}
+
+// discoverMTU looks up the default route in the given routing table, which
+// has the format of /proc/net/route, and returns the MTU of the route's
+// interface.
+func discoverMTU(routes io.Reader) (int, error) {
+	name, err := defaultRouteIface(routes)
+	if err != nil {
+		return 0, err
+	}
+	iface, err := interfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up interface %q: %w", name, err)
+	}
+	if iface.MTU <= 0 {
+		return 0, fmt.Errorf("interface %q has bad MTU %d", name, iface.MTU)
+	}
+	return iface.MTU, nil
+}
+
+// defaultRouteIface returns the name of the interface that carries the
+// default route, i.e., the route whose destination and mask are 0.
+func defaultRouteIface(routes io.Reader) (string, error) {
+	s := bufio.NewScanner(routes)
+	s.Scan() // Skip the header.
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[1] == "00000000" && fields[7] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errNoDefaultRoute
+}
+
+// mtuHandler returns a HandlerFunc that tells the enclave our MTU.
+func mtuHandler(mtu int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, mtu)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const routeHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+// useFakeInterfaces replaces the host's interface table with the given one
+// for the duration of the test.
+func useFakeInterfaces(t *testing.T, ifaces map[string]int) {
+	t.Helper()
+	orig := interfaceByName
+	interfaceByName = func(name string) (*net.Interface, error) {
+		mtu, ok := ifaces[name]
+		if !ok {
+			return nil, errors.New("no such network interface")
+		}
+		return &net.Interface{Name: name, MTU: mtu}, nil
+	}
+	t.Cleanup(func() { interfaceByName = orig })
+}
+
+func TestDiscoverMTU(t *testing.T) {
+	useFakeInterfaces(t, map[string]int{
+		"eth0":    9001,
+		"docker0": 1500,
+		"broken":  0,
+	})
+
+	cases := []struct {
+		name    string
+		routes  string
+		wantMTU int
+		wantErr bool
+	}{
+		{
+			name: "default route",
+			routes: routeHeader +
+				"docker0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t0100A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			wantMTU: 9001,
+		},
+		{
+			name: "no default route",
+			routes: routeHeader +
+				"docker0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown interface",
+			routes:  routeHeader + "wlan0\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad MTU",
+			routes:  routeHeader + "broken\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			wantErr: true,
+		},
+		{
+			name:    "truncated line",
+			routes:  routeHeader + "eth0\t00000000\t0100A8C0\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty table",
+			routes:  "",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mtu, err := discoverMTU(strings.NewReader(c.routes))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error but got MTU %d.", mtu)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v.", err)
+			}
+			if mtu != c.wantMTU {
+				t.Fatalf("Expected MTU %d but got %d.", c.wantMTU, mtu)
+			}
+		})
+	}
+}
+
+func TestDefaultRouteIfaceNoRoute(t *testing.T) {
+	_, err := defaultRouteIface(strings.NewReader(routeHeader))
+	if !errors.Is(err, errNoDefaultRoute) {
+		t.Fatalf("Expected %v but got %v.", errNoDefaultRoute, err)
+	}
+}
+
+func TestMTUHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	mtuHandler(defaultMTU)(rec, httptest.NewRequest("GET", pathMTU, nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "1500" {
+		t.Fatalf("Expected MTU 1500 but got %q.", got)
+	}
+}
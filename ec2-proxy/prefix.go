@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// framePrefixLen is the length of the frame length prefix that our
+	// virtual network speaks.  It caps frames at 65535 bytes.
+	framePrefixLen = 2
+	// widePrefixLen is the length of the wide frame length prefix that
+	// enclaves may ask for.
+	widePrefixLen = 4
+)
+
+var errWideFrameTooLarge = errors.New("frame too large for our virtual network")
+
+// withWidePrefix wraps the given handler, which serves our virtual network's
+// connect path, and translates the 4-byte frame length prefixes of tunnels
+// that ask for them in the "prefix_len" query parameter.  Our virtual
+// network only speaks the 2-byte prefix, so it still caps frames at 65535
+// bytes.  Tunnels that don't ask for the 4-byte prefix are left untouched.
+func withWidePrefix(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := r.URL.Query().Get("prefix_len")
+		if r.URL.Path != types.ConnectPath || l == "" || l == strconv.Itoa(framePrefixLen) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if l != strconv.Itoa(widePrefixLen) {
+			log.Warnf("Rejecting tunnel with unsupported frame length prefix %q.", l)
+			http.Error(w, "unsupported frame length prefix", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(&prefixHijacker{ResponseWriter: w}, r)
+	})
+}
+
+// prefixHijacker hands out connections that translate 4-byte frame length
+// prefixes when the wrapped handler hijacks the connection.
+type prefixHijacker struct {
+	http.ResponseWriter
+}
+
+func (w *prefixHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The enclave may have sent frames right after its request, which the
+	// HTTP server already buffered.
+	pc := newPrefixConn(c, rw.Reader)
+	return pc, bufio.NewReadWriter(bufio.NewReader(pc), bufio.NewWriter(pc)), nil
+}
+
+// prefixConn is a tunnel connection whose peer sends and expects frames with
+// 4-byte length prefixes, while its user reads and writes frames with 2-byte
+// length prefixes.  Reads must not be concurrent, and neither must writes.
+type prefixConn struct {
+	net.Conn
+	r       io.Reader
+	sizeBuf []byte
+	frame   []byte // A frame from the peer, with its 2-byte prefix.
+	unread  []byte // The part of frame that our user didn't read yet.
+	pending []byte // Frames from our user that aren't complete yet.
+	out     []byte // A frame for the peer, with its 4-byte prefix.
+}
+
+func newPrefixConn(c net.Conn, r io.Reader) *prefixConn {
+	return &prefixConn{
+		Conn:    c,
+		r:       r,
+		sizeBuf: make([]byte, widePrefixLen),
+		frame:   make([]byte, framePrefixLen+math.MaxUint16),
+	}
+}
+
+// Read returns the peer's frames with 2-byte prefixes.  Frames that don't
+// fit a 2-byte prefix can't enter our virtual network, so they end the
+// tunnel.
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.unread) == 0 {
+		if _, err := io.ReadFull(c.r, c.sizeBuf); err != nil {
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(c.sizeBuf)
+		if size > math.MaxUint16 {
+			return 0, fmt.Errorf("%w: %d bytes", errWideFrameTooLarge, size)
+		}
+		if _, err := io.ReadFull(c.r, c.frame[framePrefixLen:framePrefixLen+size]); err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint16(c.frame, uint16(size))
+		c.unread = c.frame[:framePrefixLen+size]
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// Write sends our user's frames with 4-byte prefixes.  Our virtual network
+// writes a frame's prefix and the frame itself separately, so we collect
+// writes until a frame is complete.
+func (c *prefixConn) Write(b []byte) (int, error) {
+	c.pending = append(c.pending, b...)
+	for len(c.pending) >= framePrefixLen {
+		size := int(binary.LittleEndian.Uint16(c.pending))
+		if len(c.pending) < framePrefixLen+size {
+			break
+		}
+		c.out = append(c.out[:0], make([]byte, widePrefixLen)...)
+		binary.LittleEndian.PutUint32(c.out, uint32(size))
+		c.out = append(c.out, c.pending[framePrefixLen:framePrefixLen+size]...)
+		if _, err := c.Conn.Write(c.out); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[framePrefixLen+size:]
+	}
+	// Don't hold on to the buffer of a large frame forever.
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return len(b), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+// readRaw reads a raw frame with its length prefix from r, like our virtual
+// network does.
+func readRaw(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	prefix := make([]byte, framePrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		t.Fatalf("Failed to read frame size: %v", err)
+	}
+	frame := make([]byte, binary.LittleEndian.Uint16(prefix))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	return frame
+}
+
+// writeRaw writes a raw frame to w like our virtual network does: the prefix
+// and the frame in separate writes.
+func writeRaw(w io.Writer, frame []byte) error {
+	prefix := make([]byte, framePrefixLen)
+	binary.LittleEndian.PutUint16(prefix, uint16(len(frame)))
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeWide writes the given frame to w with a 4-byte length prefix, like an
+// enclave that negotiated the wide prefix does.
+func writeWide(t *testing.T, w io.Writer, frame []byte) {
+	t.Helper()
+	prefix := make([]byte, widePrefixLen)
+	binary.LittleEndian.PutUint32(prefix, uint32(len(frame)))
+	if _, err := w.Write(append(prefix, frame...)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+}
+
+// readWide reads a frame with a 4-byte length prefix from r.
+func readWide(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	prefix := make([]byte, widePrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		t.Fatalf("Failed to read frame size: %v", err)
+	}
+	frame := make([]byte, binary.LittleEndian.Uint32(prefix))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	return frame
+}
+
+// echoTunnel mimics our virtual network's connect path: it hijacks the
+// connection and sends every frame back.
+var echoTunnel = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	c, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	prefix := make([]byte, framePrefixLen)
+	for {
+		if _, err := io.ReadFull(rw, prefix); err != nil {
+			return
+		}
+		frame := make([]byte, binary.LittleEndian.Uint16(prefix))
+		if _, err := io.ReadFull(rw, frame); err != nil {
+			return
+		}
+		if err := writeRaw(c, frame); err != nil {
+			return
+		}
+	}
+})
+
+// dialTunnel attaches a tunnel with the given query to the given server.
+func dialTunnel(t *testing.T, srv *httptest.Server, query string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	fmt.Fprintf(c, "POST %s%s HTTP/1.1\r\nHost: host\r\n\r\n", types.ConnectPath, query)
+	return c
+}
+
+// prefixFrames returns frames of various sizes up to the largest one that
+// our virtual network carries.
+func prefixFrames() [][]byte {
+	return [][]byte{
+		[]byte("frame"),
+		bytes.Repeat([]byte{1}, 1500),
+		bytes.Repeat([]byte{2}, math.MaxUint16),
+	}
+}
+
+func TestPrefixConnRoundTrip(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	conn := newPrefixConn(host, host)
+	defer conn.Close()
+
+	// The enclave's frames reach our virtual network with 2-byte prefixes.
+	go func() {
+		for _, frame := range prefixFrames() {
+			writeWide(t, enclave, frame)
+		}
+	}()
+	for i, want := range prefixFrames() {
+		if got := readRaw(t, conn); !bytes.Equal(got, want) {
+			t.Fatalf("Frame %d from the enclave differs from the frame that was sent.", i)
+		}
+	}
+
+	// Our virtual network's frames reach the enclave with 4-byte prefixes.
+	go func() {
+		for _, frame := range prefixFrames() {
+			if err := writeRaw(conn, frame); err != nil {
+				t.Errorf("Failed to write frame: %v", err)
+			}
+		}
+	}()
+	for i, want := range prefixFrames() {
+		if got := readWide(t, enclave); !bytes.Equal(got, want) {
+			t.Fatalf("Frame %d to the enclave differs from the frame that was sent.", i)
+		}
+	}
+}
+
+func TestPrefixConnRejectsLargeFrames(t *testing.T) {
+	enclave, host := net.Pipe()
+	defer enclave.Close()
+	go func() { _, _ = enclave.Write([]byte{0, 0, 1, 0}) }()
+	if _, err := newPrefixConn(host, host).Read(make([]byte, 64)); !errors.Is(err, errWideFrameTooLarge) {
+		t.Fatalf("Expected %v but got %v.", errWideFrameTooLarge, err)
+	}
+}
+
+func TestWithWidePrefix(t *testing.T) {
+	srv := httptest.NewServer(withWidePrefix(echoTunnel))
+	defer srv.Close()
+
+	t.Run("wide", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?prefix_len=4")
+		defer c.Close()
+		for i, frame := range prefixFrames() {
+			writeWide(t, c, frame)
+			if got := readWide(t, c); !bytes.Equal(got, frame) {
+				t.Fatalf("Frame %d differs after the round trip.", i)
+			}
+		}
+	})
+
+	for name, query := range map[string]string{"default": "", "explicit legacy": "?prefix_len=2"} {
+		t.Run(name, func(t *testing.T) {
+			c := dialTunnel(t, srv, query)
+			defer c.Close()
+			frame := prefixFrames()[1]
+			if err := writeRaw(c, frame); err != nil {
+				t.Fatalf("Failed to write frame: %v", err)
+			}
+			if got := readRaw(t, c); !bytes.Equal(got, frame) {
+				t.Fatal("Frame differs after the round trip.")
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		c := dialTunnel(t, srv, "?prefix_len=8")
+		defer c.Close()
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status code %d but got %d.", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
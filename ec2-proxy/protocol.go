@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// pathProtocol is the path at which we tell the enclave which framing
+	// protocol features we support.
+	pathProtocol = "/protocol"
+	// protocolVersion is the framing protocol version that we speak.
+	protocolVersion = 1
+)
+
+// protocolCaps is the JSON representation of the framing protocol features
+// that we support.  It must match the enclave's protocolCaps.
+type protocolCaps struct {
+	Version     int      `json:"version"`
+	PrefixLens  []int    `json:"prefix_lens"`
+	Compression []string `json:"compression,omitempty"`
+	Batching    bool     `json:"batching,omitempty"`
+}
+
+// protocolHandler returns a HandlerFunc that tells the enclave which framing
+// protocol features we support.  Our tunnel is gvisor-tap-vsock's, which
+// only speaks the 2-byte length prefix and doesn't know compression.
+// Tunnels that ask for the 4-byte prefix, for compression, or for batches get
+// their frames translated by withWidePrefix, withFrameCompression, and
+// withBatching.
+func protocolHandler() http.HandlerFunc {
+	caps := protocolCaps{
+		Version:     protocolVersion,
+		PrefixLens:  []int{framePrefixLen, widePrefixLen},
+		Compression: []string{frameCompressionGzip},
+		Batching:    true,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(caps)
+	}
+}
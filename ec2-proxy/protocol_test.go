@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProtocolHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	protocolHandler()(w, httptest.NewRequest(http.MethodGet, pathProtocol, nil))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Expected JSON but got %q.", got)
+	}
+	var caps protocolCaps
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+		t.Fatalf("Failed to decode capabilities: %v", err)
+	}
+	if caps.Version != protocolVersion {
+		t.Fatalf("Expected version %d but got %d.", protocolVersion, caps.Version)
+	}
+	// withWidePrefix translates the 4-byte prefix.
+	if len(caps.PrefixLens) != 2 || caps.PrefixLens[0] != 2 || caps.PrefixLens[1] != 4 {
+		t.Fatalf("Expected the 2- and 4-byte prefixes but got %v.", caps.PrefixLens)
+	}
+	// withFrameCompression decodes gzip-compressed frames.
+	if len(caps.Compression) != 1 || caps.Compression[0] != frameCompressionGzip {
+		t.Fatalf("Expected gzip compression but got %v.", caps.Compression)
+	}
+	// withBatching unpacks batches.
+	if !caps.Batching {
+		t.Fatal("Expected batches to be supported.")
+	}
+}
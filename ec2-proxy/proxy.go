@@ -30,6 +30,8 @@ import (
 var (
 	debug           bool
 	mtu             int
+	autoMTU         bool
+	attachGuard     bool
 	endpoints       arrayFlags
 	forwardSocket   arrayFlags
 	forwardDest     arrayFlags
@@ -48,7 +50,9 @@ const (
 func main() {
 	flag.Var(&endpoints, "listen", "control endpoint")
 	flag.BoolVar(&debug, "debug", false, "Print debug info")
-	flag.IntVar(&mtu, "mtu", 1500, "Set the MTU")
+	flag.IntVar(&mtu, "mtu", defaultMTU, "Set the MTU")
+	flag.BoolVar(&autoMTU, "discover-mtu", false, "Use the MTU of the default route's interface instead of -mtu")
+	flag.BoolVar(&attachGuard, "attach-guard", false, "Reject a second tunnel of an enclave until it detaches the stale one; enclaves must know how to detach")
 	flag.IntVar(&sshPort, "ssh-port", 1024, "Port to access the guest virtual machine. Must be between 1024 and 65535")
 	flag.Var(&forwardSocket, "forward-sock", "Forwards a unix socket to the guest virtual machine over SSH")
 	flag.Var(&forwardDest, "forward-dest", "Forwards a unix socket to the guest virtual machine over SSH")
@@ -68,6 +72,9 @@ func main() {
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	if autoMTU {
+		mtu = hostMTU(mtu)
+	}
 
 	// If the given port is not between the privileged ports
 	// and the oft considered maximum port, return an error.
@@ -210,7 +217,13 @@ func run(ctx context.Context, g *errgroup.Group, configuration *types.Configurat
 		if err != nil {
 			return errors.Wrap(err, "cannot listen")
 		}
-		httpServe(ctx, g, ln, withProfiler(vn))
+		// A tunnel's batches are unpacked first, then its frames get
+		// their 4-byte prefixes translated before they're decompressed.
+		h := withBatching(withWidePrefix(withFrameCompression(withProfiler(vn))))
+		if attachGuard {
+			h = withAttachGuard(h)
+		}
+		httpServe(ctx, g, ln, h)
 	}
 
 	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", gatewayIP))
@@ -319,6 +332,8 @@ func httpServe(ctx context.Context, g *errgroup.Group, ln net.Listener, mux http
 
 func withProfiler(vn *virtualnetwork.VirtualNetwork) http.Handler {
 	mux := vn.Mux()
+	mux.HandleFunc(pathMTU, mtuHandler(mtu))
+	mux.HandleFunc(pathProtocol, protocolHandler())
 	if debug {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
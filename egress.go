@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// dialFunc is the signature of net.Dialer's DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// hostTally counts the bytes that we exchanged with a single upstream host.
+type hostTally struct {
+	sent, received uint64
+}
+
+// hostTallyJSON is the JSON representation of a hostTally.
+type hostTallyJSON struct {
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+// egressStats keeps track of how many bytes the enclave sent to and received
+// from each upstream host, for cost and security auditing.
+type egressStats struct {
+	sync.Mutex
+	hosts map[string]*hostTally
+}
+
+func newEgressStats() *egressStats {
+	return &egressStats{hosts: make(map[string]*hostTally)}
+}
+
+// tally returns the given host's tally, creating it if necessary.
+func (s *egressStats) tally(host string) *hostTally {
+	s.Lock()
+	defer s.Unlock()
+
+	t, exists := s.hosts[host]
+	if !exists {
+		t = new(hostTally)
+		s.hosts[host] = t
+	}
+	return t
+}
+
+// snapshot returns the current tallies.  If reset is true, the tallies are
+// cleared.
+func (s *egressStats) snapshot(reset bool) map[string]hostTallyJSON {
+	s.Lock()
+	defer s.Unlock()
+
+	snap := make(map[string]hostTallyJSON, len(s.hosts))
+	for host, t := range s.hosts {
+		snap[host] = hostTallyJSON{
+			BytesSent:     atomic.LoadUint64(&t.sent),
+			BytesReceived: atomic.LoadUint64(&t.received),
+		}
+	}
+	if reset {
+		s.hosts = make(map[string]*hostTally)
+	}
+	return snap
+}
+
+// wrapDial wraps the given dial function, so that all connections that it
+// establishes are accounted for.
+func (s *egressStats) wrapDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		return &countingConn{Conn: c, tally: s.tally(host)}, nil
+	}
+}
+
+// countingConn is a net.Conn that adds the bytes it reads and writes to a
+// host's tally.
+type countingConn struct {
+	net.Conn
+	tally *hostTally
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.tally.received, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.tally.sent, uint64(n))
+	return n, err
+}
+
+// egressStatsHandler returns a HandlerFunc that reports the bytes exchanged
+// with each upstream host, keyed by host under "hosts".  The tallies are
+// cleared if the URL query parameter "reset" is true.
+func egressStatsHandler(s *egressStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reset, _ := strconv.ParseBool(r.URL.Query().Get("reset"))
+		writeJSON(w, http.StatusOK, map[string]any{"hosts": s.snapshot(reset)})
+	}
+}
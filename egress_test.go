@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEgressStatsPerHost(t *testing.T) {
+	small := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("small"))
+	}))
+	defer small.Close()
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("large", 1000)))
+	}))
+	defer large.Close()
+
+	stats := newEgressStats()
+	c := newOutboundClient(OutboundConfig{}, stats)
+	// Both servers listen on 127.0.0.1, so we reach one of them by name to
+	// get two distinct hosts.
+	get(t, c, small.URL)
+	get(t, c, strings.Replace(large.URL, "127.0.0.1", "localhost", 1))
+
+	w := httptest.NewRecorder()
+	egressStatsHandler(stats)(w, httptest.NewRequest(http.MethodGet, pathEgress+"?reset=true", nil))
+	var resp struct {
+		Hosts map[string]hostTallyJSON `json:"hosts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", w.Body, err)
+	}
+	if len(resp.Hosts) != 2 {
+		t.Fatalf("Expected tallies for 2 hosts but got %v.", resp.Hosts)
+	}
+	smallTally, largeTally := resp.Hosts["127.0.0.1"], resp.Hosts["localhost"]
+	if smallTally.BytesSent == 0 || largeTally.BytesSent == 0 {
+		t.Errorf("Expected both hosts to have sent bytes: %v", resp.Hosts)
+	}
+	if smallTally.BytesReceived < 5 || largeTally.BytesReceived < 5000 ||
+		smallTally.BytesReceived >= largeTally.BytesReceived {
+		t.Errorf("Expected distinct received bytes per host: %v", resp.Hosts)
+	}
+
+	// The tallies were reset.
+	if snap := stats.snapshot(false); len(snap) != 0 {
+		t.Errorf("Expected tallies to be reset but got %v.", snap)
+	}
+}
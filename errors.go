@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// multiError aggregates several errors.  It mirrors errors.Join, which our
+// minimum Go version (1.18) doesn't have yet.  Before Go 1.20, errors.Is and
+// errors.As don't look at Unwrap() []error, so multiError implements Is and
+// As itself.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is returns true if any of the aggregated errors matches the given target.
+func (m multiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the aggregated errors that matches the given target,
+// and if so, sets the target to that error and returns true.
+func (m multiError) As(target any) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinErrors returns an error that aggregates the given non-nil errors, or
+// nil if all errors are nil.
+func joinErrors(errs ...error) error {
+	var m multiError
+	for _, err := range errs {
+		if err != nil {
+			m = append(m, err)
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
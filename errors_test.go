@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestJoinErrors(t *testing.T) {
+	if err := joinErrors(); err != nil {
+		t.Errorf("Expected nil but got %v.", err)
+	}
+	if err := joinErrors(nil, nil); err != nil {
+		t.Errorf("Expected nil but got %v.", err)
+	}
+
+	errA, errB := errors.New("a"), errors.New("b")
+	err := joinErrors(errA, nil, errB)
+	if err.Error() != "a\nb" {
+		t.Errorf("Expected %q but got %q.", "a\nb", err.Error())
+	}
+}
+
+func TestMultiErrorIs(t *testing.T) {
+	errA := errors.New("a")
+	err := joinErrors(errA, &os.PathError{Op: "open", Path: "/x", Err: fs.ErrNotExist})
+
+	for _, target := range []error{errA, fs.ErrNotExist} {
+		if !errors.Is(err, target) {
+			t.Errorf("Expected %v to match %v.", err, target)
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		t.Errorf("Expected %v to not match %v.", err, io.EOF)
+	}
+	// Matching also works through further wrapping.
+	if !errors.Is(joinErrors(joinErrors(errA)), errA) {
+		t.Error("Expected nested multiError to match.")
+	}
+}
+
+func TestMultiErrorAs(t *testing.T) {
+	pathErr := &os.PathError{Op: "open", Path: "/x", Err: fs.ErrNotExist}
+	err := joinErrors(errors.New("a"), pathErr)
+
+	var target *os.PathError
+	if !errors.As(err, &target) || target != pathErr {
+		t.Errorf("Expected to find %v in %v.", pathErr, err)
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		t.Errorf("Expected to not find a link error in %v.", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFlushBytes is the size of the write buffer for frames that we
+	// send to the host if the config enables buffering but doesn't specify a
+	// size.
+	defaultFlushBytes = 64 * 1024
+	// defaultMaxBatchedFrame is the size of the largest frame that we batch
+	// if the config doesn't specify a size.  It's large enough for TCP ACKs,
+	// DNS, and other small packets that dominate high packet rates.
+	defaultMaxBatchedFrame = 1024
+
+	// batchPrefixLen is the length of the little-endian length prefix of
+	// each batch in the batch format.
+	batchPrefixLen = 4
+	// maxBatchBytes is the size of the largest batch that the host accepts.
+	maxBatchBytes = 1 << 20
+)
+
+var (
+	// errBatchNeedsNegotiation means that the batch format is configured
+	// without protocol negotiation, which tells us if the host supports it.
+	errBatchNeedsNegotiation = errors.New("frame batching requires protocol negotiation")
+	errBatchTooLarge         = fmt.Errorf("frame flush buffer exceeds largest batch of %d bytes", maxBatchBytes)
+)
+
+// FrameFlushConfig configures how frames that we send to the host are
+// buffered.  By default, every frame -- length prefix and payload -- is sent
+// in a single write as soon as it's read from the TAP device.  Buffering
+// coalesces bursts of small frames into fewer writes, at the cost of up to
+// Interval of added latency.  Coalescing requires no protocol support from
+// the host: each frame keeps its length prefix, so several frames simply
+// arrive back to back on the stream.  Hosts that support the batch format
+// additionally learn where each write ends, and read it at once.
+type FrameFlushConfig struct {
+	// Interval bounds the time that a frame may sit in the write buffer.
+	// If Interval is 0, frames aren't buffered and are flushed one by one.
+	Interval time.Duration
+	// Bytes is the size of the write buffer.  The buffer is flushed as soon
+	// as it's full.  If Bytes is 0, defaultFlushBytes is used.
+	Bytes int
+	// MaxBatchedFrame is the size in bytes of the largest frame, including
+	// its length prefix, that waits in the buffer.  Larger frames already
+	// amortize the cost of a write, so they're flushed right away, along
+	// with the frames that were buffered before them.  If MaxBatchedFrame is
+	// 0, defaultMaxBatchedFrame is used.
+	MaxBatchedFrame int
+	// Batch sends each write to the host as a batch, i.e., the frames of
+	// the write behind a 4-byte little-endian length prefix, which lets the
+	// host read all of them with a single read instead of two reads per
+	// frame.  Batch requires NegotiateProtocol, and is only used if the host
+	// supports it.  If Interval is 0, each frame is a batch of its own.
+	// Bytes must not exceed maxBatchBytes.
+	Batch bool
+}
+
+// validate returns an error if the config asks for batches that the host
+// won't accept.
+func (c FrameFlushConfig) validate() error {
+	if c.Batch && c.Bytes > maxBatchBytes {
+		return errBatchTooLarge
+	}
+	return nil
+}
+
+// frameWriter buffers frames and flushes them once the buffer is full, or
+// once the oldest buffered frame is older than the flush interval, whichever
+// comes first.  Errors that occur while flushing in the background are
+// returned by the next call to Write.
+type frameWriter struct {
+	sync.Mutex
+	w        *bufio.Writer
+	interval time.Duration
+	maxFrame int
+	batch    bool
+	timer    *time.Timer
+	err      error
+}
+
+// newFrameWriter returns a writer that buffers frames according to the given
+// config, or the given writer itself if buffering and batching are off.
+func newFrameWriter(w io.Writer, cfg FrameFlushConfig) io.Writer {
+	if cfg.Batch {
+		w = &batchWriter{w: w}
+	}
+	if cfg.Interval <= 0 {
+		return w
+	}
+	size := cfg.Bytes
+	if size <= 0 {
+		size = defaultFlushBytes
+	}
+	maxFrame := cfg.MaxBatchedFrame
+	if maxFrame <= 0 {
+		maxFrame = defaultMaxBatchedFrame
+	}
+	return &frameWriter{
+		w:        bufio.NewWriterSize(w, size),
+		interval: cfg.Interval,
+		maxFrame: maxFrame,
+		batch:    cfg.Batch,
+	}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	// Don't split a frame across two batches, so each batch carries whole
+	// frames.
+	var err error
+	if f.batch && len(p) > f.w.Available() && f.w.Buffered() > 0 {
+		err = f.w.Flush()
+	}
+	n := 0
+	if err == nil {
+		n, err = f.w.Write(p)
+	}
+	if err == nil && len(p) > f.maxFrame {
+		err = f.w.Flush()
+	}
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+	if f.w.Buffered() > 0 && f.timer == nil {
+		f.timer = time.AfterFunc(f.interval, f.flush)
+	}
+	return n, nil
+}
+
+func (f *frameWriter) flush() {
+	f.Lock()
+	defer f.Unlock()
+	f.timer = nil
+	if f.err == nil {
+		f.err = f.w.Flush()
+	}
+}
+
+// Close stops the flush timer.  Frames that are still buffered are dropped,
+// like frames that are in flight when the connection goes away.
+func (f *frameWriter) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	return nil
+}
+
+// batchWriter sends each write as a batch: a 4-byte little-endian length
+// prefix, followed by the frames of the write.  A batch goes out in a single
+// write.
+type batchWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (b *batchWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b.buf = append(b.buf[:0], make([]byte, batchPrefixLen)...)
+	binary.LittleEndian.PutUint32(b.buf, uint32(len(p)))
+	b.buf = append(b.buf, p...)
+	if _, err := b.w.Write(b.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
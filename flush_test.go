@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeRecorder records every write, which lets us count the writes, i.e.,
+// the syscalls, that reach the connection to the host.
+type writeRecorder struct {
+	sync.Mutex
+	writes [][]byte
+	err    error
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (w *writeRecorder) numWrites() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.writes)
+}
+
+func (w *writeRecorder) bytes() []byte {
+	w.Lock()
+	defer w.Unlock()
+	return bytes.Join(w.writes, nil)
+}
+
+// waitForWrites waits until the given recorder saw n writes.
+func waitForWrites(t *testing.T, w *writeRecorder, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.numWrites() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d writes but got %d.", n, w.numWrites())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// smallFrames returns n distinct frames of the given size.
+func smallFrames(n, size int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i] = bytes.Repeat([]byte{byte(i)}, size)
+	}
+	return frames
+}
+
+func TestNewFrameWriterOff(t *testing.T) {
+	w := new(writeRecorder)
+	if got := newFrameWriter(w, FrameFlushConfig{}); got != io.Writer(w) {
+		t.Fatal("Expected unbuffered writer if the flush interval is 0.")
+	}
+}
+
+func TestFrameWriterCoalesces(t *testing.T) {
+	w := new(writeRecorder)
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: 20 * time.Millisecond}).(*frameWriter)
+	defer fw.Close()
+
+	for _, f := range smallFrames(10, 64) {
+		if _, err := fw.Write(f); err != nil {
+			t.Fatalf("Expected no error but got %v.", err)
+		}
+	}
+	if n := w.numWrites(); n != 0 {
+		t.Fatalf("Expected frames to wait in the buffer but got %d writes.", n)
+	}
+	waitForWrites(t, w, 1)
+	if n := w.numWrites(); n != 1 {
+		t.Fatalf("Expected 1 coalesced write but got %d.", n)
+	}
+	if !bytes.Equal(w.bytes(), bytes.Join(smallFrames(10, 64), nil)) {
+		t.Fatal("Expected coalesced write to contain all frames in order.")
+	}
+}
+
+func TestFrameWriterFlushesLargeFrames(t *testing.T) {
+	w := new(writeRecorder)
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: time.Hour, MaxBatchedFrame: 100}).(*frameWriter)
+	defer fw.Close()
+
+	_, _ = fw.Write(make([]byte, 50))
+	_, _ = fw.Write(make([]byte, 101))
+	if got := len(w.bytes()); got != 151 {
+		t.Fatalf("Expected large frame to flush 151 bytes but got %d.", got)
+	}
+}
+
+func TestFrameWriterFlushesFullBuffer(t *testing.T) {
+	w := new(writeRecorder)
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: time.Hour, Bytes: 100}).(*frameWriter)
+	defer fw.Close()
+
+	for _, f := range smallFrames(3, 40) {
+		_, _ = fw.Write(f)
+	}
+	if got := len(w.bytes()); got != 100 {
+		t.Fatalf("Expected full buffer to flush 100 bytes but got %d.", got)
+	}
+}
+
+func TestFrameWriterReturnsFlushError(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	w := &writeRecorder{err: errBroken}
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: time.Millisecond}).(*frameWriter)
+	defer fw.Close()
+
+	if _, err := fw.Write([]byte("frame")); err != nil {
+		t.Fatalf("Expected buffered write to succeed but got %v.", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := fw.Write([]byte("frame")); errors.Is(err, errBroken) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected background flush error to be returned by Write.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRxFramesIntactWithBuffering(t *testing.T) {
+	const mtu = 1500
+	sent := append(smallFrames(100, 60), smallFrames(3, 1400)...)
+	sent = append(sent, smallFrames(5, 60)...)
+
+	w := new(writeRecorder)
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: 5 * time.Millisecond}).(*frameWriter)
+	defer fw.Close()
+	errCh := make(chan error, 1)
+	rx(fw, newFakeTap(sent...), errCh, mtu, prefixLen16, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+	}
+	// Wait for the timer to flush the trailing small frames.
+	wantLen := 0
+	for _, f := range sent {
+		wantLen += int(prefixLen16) + len(f)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.bytes()) < wantLen {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d bytes on the wire but got %d.", wantLen, len(w.bytes()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := w.numWrites(); n >= len(sent) {
+		t.Fatalf("Expected fewer than %d writes but got %d.", len(sent), n)
+	}
+
+	received := decodeFrames(t, w.bytes(), mtu, prefixLen16)
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Fatalf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+}
+
+// decodeFrames decodes the given wire data like tx does on the host's side.
+func decodeFrames(t *testing.T, wire []byte, mtu int, prefix int) [][]byte {
+	t.Helper()
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	go func() {
+		_, _ = hostConn.Write(wire)
+		hostConn.Close()
+	}()
+	errCh := make(chan error, 1)
+	tap := newFakeTap()
+	tx(enclaveConn, tap, errCh, mtu, prefix, nil, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected tx to stop at the end of the stream but got %v.", err)
+	}
+	return tap.frames()
+}
+
+func TestBatchedFramesRoundTrip(t *testing.T) {
+	const mtu = 1500
+	small, large := smallFrames(10, 40), smallFrames(1, 1000)
+	sent := append(append(append([][]byte{}, small...), large...), small[:3]...)
+
+	w := new(writeRecorder)
+	// The timer never fires, so only large frames trigger flushes.
+	fw := newFrameWriter(w, FrameFlushConfig{Interval: time.Hour, MaxBatchedFrame: 100}).(*frameWriter)
+	defer fw.Close()
+	errCh := make(chan error, 1)
+	rx(fw, newFakeTap(sent...), errCh, mtu, prefixLen16, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+	}
+	// The small frames were batched together with the large frame that
+	// followed them, and the trailing small frames wait for the timer.
+	if n := w.numWrites(); n != 1 {
+		t.Fatalf("Expected 1 batched write but got %d.", n)
+	}
+	fw.flush()
+	if n := w.numWrites(); n != 2 {
+		t.Fatalf("Expected trailing batch to be flushed by the timer but got %d writes.", n)
+	}
+
+	received := decodeFrames(t, w.bytes(), mtu, prefixLen16)
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Fatalf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+}
+
+// unbatch checks that each of the given writes is a single batch of whole
+// frames, and returns the frames of all batches like the host does.
+func unbatch(t *testing.T, writes [][]byte, mtu int) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for i, w := range writes {
+		if len(w) < batchPrefixLen || int(binary.LittleEndian.Uint32(w)) != len(w)-batchPrefixLen {
+			t.Fatalf("Expected write %d to be a single batch.", i)
+		}
+		frames = append(frames, decodeFrames(t, w[batchPrefixLen:], mtu, prefixLen16)...)
+	}
+	return frames
+}
+
+func TestBatchedFramesRoundTripInBatchFormat(t *testing.T) {
+	const mtu = 1500
+	sent := append(smallFrames(30, 40), smallFrames(2, 1400)...)
+	sent = append(sent, smallFrames(5, 40)...)
+
+	for name, cfg := range map[string]FrameFlushConfig{
+		"buffered":   {Interval: time.Hour, Bytes: 1000, MaxBatchedFrame: 100, Batch: true},
+		"unbuffered": {Batch: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := new(writeRecorder)
+			out := newFrameWriter(w, cfg)
+			errCh := make(chan error, 1)
+			rx(out, newFakeTap(sent...), errCh, mtu, prefixLen16, nil, nil, nil)
+			if err := <-errCh; !errors.Is(err, io.EOF) {
+				t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+			}
+			if fw, ok := out.(*frameWriter); ok {
+				fw.flush()
+				fw.Close()
+			}
+
+			received := unbatch(t, w.writes, mtu)
+			if len(received) != len(sent) {
+				t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+			}
+			for i := range sent {
+				if !bytes.Equal(received[i], sent[i]) {
+					t.Fatalf("Frame %d differs from the frame that was sent.", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateBatching(t *testing.T) {
+	batchHost := &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}, Batching: true}
+	if got := negotiate(prefixLen16, "", true, batchHost); !got.Batching {
+		t.Fatal("Expected batches with a host that supports them.")
+	}
+	if got := negotiate(prefixLen16, "", false, batchHost); got.Batching {
+		t.Fatal("Expected no batches unless we ask for them.")
+	}
+	plainHost := &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}}
+	if got := negotiate(prefixLen16, "", true, plainHost); got.Batching {
+		t.Fatal("Expected no batches with a host that doesn't support them.")
+	}
+
+	n := validNetConfig()
+	n.FrameFlush.Batch = true
+	if got, want := connectPath("/connect", n), "/connect?batch=1"; got != want {
+		t.Fatalf("Expected %q but got %q.", want, got)
+	}
+}
+
+func TestValidateFrameBatching(t *testing.T) {
+	for _, c := range []struct {
+		flush     FrameFlushConfig
+		negotiate bool
+		wantErr   error
+	}{
+		{FrameFlushConfig{Batch: true}, true, nil},
+		{FrameFlushConfig{Batch: true}, false, errBatchNeedsNegotiation},
+		{FrameFlushConfig{Batch: true, Bytes: maxBatchBytes + 1}, true, errBatchTooLarge},
+		{FrameFlushConfig{Bytes: maxBatchBytes + 1}, false, nil},
+	} {
+		cfg := testConfig()
+		cfg.FrameFlush = c.flush
+		cfg.NegotiateProtocol = c.negotiate
+		if err := cfg.Validate(); !errors.Is(err, c.wantErr) {
+			t.Errorf("Expected %v for %+v but got %v.", c.wantErr, c.flush, err)
+		}
+	}
+}
+
+// BenchmarkRxWrites reports the number of writes, i.e., syscalls, per frame
+// that rx issues for bursts of small frames, with and without buffering.
+func BenchmarkRxWrites(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		cfg  FrameFlushConfig
+	}{
+		{"per-frame", FrameFlushConfig{}},
+		{"buffered", FrameFlushConfig{Interval: time.Millisecond}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			frames := smallFrames(b.N, 64)
+			w := new(writeRecorder)
+			out := newFrameWriter(w, bc.cfg)
+			if fw, ok := out.(*frameWriter); ok {
+				defer fw.Close()
+			}
+			errCh := make(chan error, 1)
+			b.ResetTimer()
+			rx(out, newFakeTap(frames...), errCh, 1500, prefixLen16, nil, nil, nil)
+			<-errCh
+			b.StopTimer()
+			b.ReportMetric(float64(w.numWrites())/float64(b.N), "writes/frame")
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errEgressDenied = "destination is not in the egress allowlist"
+
+// hostAllowed returns true if the given host and port match an entry of the
+// given allowlist.  Entries are either host names or wildcards like
+// "*.example.com", which match all subdomains of example.com.  Entries may
+// carry a port, e.g., "example.com:443", in which case they only match that
+// port.  Entries without a port match all ports.
+func hostAllowed(allowlist []string, host, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range allowlist {
+		entry = strings.ToLower(entry)
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyTarget returns the host and port that the given proxy request is
+// for.  If an absolute URL carries no port, the scheme's default port is
+// returned.
+func proxyTarget(r *http.Request) (string, string) {
+	host, port := r.URL.Hostname(), r.URL.Port()
+	if port == "" {
+		switch r.URL.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return host, port
+}
+
+// forwardProxy is an HTTP forward proxy that the enclave application can use
+// via HTTP_PROXY and HTTPS_PROXY.  It centralizes the enclave's egress in one
+// auditable place: only hosts on the allowlist are reachable, and each request
+// is logged and counted.
+type forwardProxy struct {
+	allowlist []string
+	dial      dialFunc
+	revProxy  *httputil.ReverseProxy
+}
+
+func newForwardProxy(allowlist []string, transport http.RoundTripper, dial dialFunc, stats *egressStats) *forwardProxy {
+	return &forwardProxy{
+		allowlist: allowlist,
+		dial:      stats.wrapDial(dial),
+		revProxy: &httputil.ReverseProxy{
+			// Proxy requests already contain an absolute URL, so there's
+			// nothing to rewrite.
+			Director:  func(*http.Request) {},
+			Transport: transport,
+		},
+	}
+}
+
+// middleware returns middleware that serves proxy requests, i.e., CONNECT
+// requests and requests for absolute URLs, and passes all other requests on
+// to the given handler.
+func (p *forwardProxy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host, port := proxyTarget(r)
+		if !hostAllowed(p.allowlist, host, port) {
+			log.Printf("Forward proxy: Denied %s request to %s.", r.Method, r.Host)
+			metricFwdProxyDenied.Add(host, 1)
+			http.Error(w, errEgressDenied, http.StatusForbidden)
+			return
+		}
+		log.Printf("Forward proxy: Allowed %s request to %s.", r.Method, r.Host)
+		metricFwdProxyAllowed.Add(host, 1)
+
+		if r.Method == http.MethodConnect {
+			p.tunnel(w, r)
+			return
+		}
+		p.revProxy.ServeHTTP(w, r)
+	})
+}
+
+// tunnel serves a CONNECT request by connecting to the requested host and
+// shoveling bytes back and forth.
+func (p *forwardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	upstream, err := p.dial(ctx, "tcp", r.Host)
+	if err != nil {
+		log.Printf("Forward proxy: Failed to connect to %s: %v", r.Host, err)
+		http.Error(w, "failed to connect to upstream", http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "connection does not support hijacking", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Printf("Forward proxy: Failed to hijack connection: %v", err)
+		return
+	}
+	// The server's read and write deadlines outlive the hijack, and they
+	// must not cut long-lived tunnels short.
+	_ = client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	shovel := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		// Unblock the other direction.
+		dst.Close()
+		src.Close()
+	}
+	go shovel(upstream, client)
+	go shovel(client, upstream)
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allowlist := []string{"example.com", "*.example.org", "api.example.net:443", "*.example.io:8443"}
+	cases := []struct {
+		host    string
+		port    string
+		allowed bool
+	}{
+		{"example.com", "443", true},
+		{"EXAMPLE.com.", "80", true},
+		{"sub.example.com", "443", false},
+		{"api.example.org", "443", true},
+		{"example.org", "443", false},
+		{"evilexample.org", "443", false},
+		{"api.example.net", "443", true},
+		{"api.example.net", "22", false},
+		{"a.example.io", "8443", true},
+		{"a.example.io", "443", false},
+		{"example.net", "443", false},
+	}
+	for _, c := range cases {
+		if got := hostAllowed(allowlist, c.host, c.port); got != c.allowed {
+			t.Errorf("Expected %s:%s to be allowed=%v but got %v.", c.host, c.port, c.allowed, got)
+		}
+	}
+}
+
+// newTestForwardProxy returns a Web server that runs a forward proxy with
+// the given allowlist, and a client that uses it.
+func newTestForwardProxy(t *testing.T, allowlist []string, transport http.RoundTripper) *http.Client {
+	t.Helper()
+	p := newForwardProxy(allowlist, transport, newOutboundDialer(OutboundConfig{}), newEgressStats())
+	notProxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not a proxy request", http.StatusTeapot)
+	})
+	srv := httptest.NewServer(p.middleware(notProxy))
+	t.Cleanup(srv.Close)
+
+	proxyURL := mustParseURL(t, srv.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	port := mustParseURL(t, upstream.URL).Port()
+
+	c := newTestForwardProxy(t, []string{"127.0.0.1:" + port}, http.DefaultTransport)
+	code, body := get(t, c, upstream.URL)
+	if code != http.StatusOK || body != "upstream" {
+		t.Fatalf("Expected allowed host to pass but got %d: %q.", code, body)
+	}
+
+	// Same host, but a port that's not on the allowlist.
+	code, _ = get(t, c, "http://127.0.0.1:1/")
+	if code != http.StatusForbidden {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusForbidden, code)
+	}
+	// A host that's not on the allowlist.
+	code, body = get(t, c, strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1))
+	if code != http.StatusForbidden || !strings.Contains(body, errEgressDenied) {
+		t.Fatalf("Expected status code %d but got %d: %q.", http.StatusForbidden, code, body)
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	port := mustParseURL(t, upstream.URL).Port()
+
+	c := newTestForwardProxy(t, []string{"127.0.0.1:" + port}, http.DefaultTransport)
+	c.Transport.(*http.Transport).TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+
+	resp, err := c.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected allowed CONNECT to pass but got %v.", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream" {
+		t.Fatalf("Expected %q but got %q.", "upstream", body)
+	}
+
+	// The transport surfaces a failed CONNECT as an error that contains
+	// the proxy's status.
+	_, err = c.Get(strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1))
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Fatalf("Expected denied CONNECT to fail with 403 but got %v.", err)
+	}
+}
+
+func TestForwardProxyPassesOnOtherRequests(t *testing.T) {
+	p := newForwardProxy([]string{"example.com"}, http.DefaultTransport, newOutboundDialer(OutboundConfig{}), newEgressStats())
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	rec := httptest.NewRecorder()
+	p.middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/enclave/ready", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusTeapot, rec.Code)
+	}
+}
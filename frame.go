@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// prefixLen16 is the length in bytes of the frame length prefix that
+	// gvisor-tap-vsock speaks.  It caps frames at 65535 bytes.
+	prefixLen16 = 2
+	// prefixLen32 is the length in bytes of the wide frame length prefix,
+	// which allows for frames larger than 65535 bytes, e.g., jumbo frames.
+	prefixLen32 = 4
+)
+
+var (
+	errFrameTooLarge  = errors.New("frame too large for length prefix")
+	errBadPrefixLen   = errors.New("unsupported frame length prefix")
+	errFrameSizeRange = errors.New("frame size out of range")
+	// errWidePrefixNeedsNegotiation means that the 4-byte prefix is
+	// configured without protocol negotiation, which tells us if the host
+	// speaks it.
+	errWidePrefixNeedsNegotiation = errors.New("4-byte frame length prefix requires protocol negotiation")
+)
+
+// validPrefixLen returns nil if the given frame length prefix is supported.
+func validPrefixLen(prefixLen int) error {
+	if prefixLen != prefixLen16 && prefixLen != prefixLen32 {
+		return fmt.Errorf("%w: %d bytes", errBadPrefixLen, prefixLen)
+	}
+	return nil
+}
+
+// wireFrame encodes the size of the given frame as little-endian length
+// prefix of the given length, and returns the prefix followed by the frame,
+// ready to be written to the host.  The returned slice reuses buf if it's
+// large enough.  Frames that don't fit the prefix are rejected with
+// errFrameTooLarge.
+func wireFrame(buf, frame []byte, prefixLen int) ([]byte, error) {
+	n := len(frame)
+	if cap(buf) < prefixLen+n {
+		buf = make([]byte, prefixLen+n)
+	}
+	buf = buf[:prefixLen+n]
+
+	switch prefixLen {
+	case prefixLen16:
+		if n > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, n)
+		}
+		binary.LittleEndian.PutUint16(buf, uint16(n))
+	case prefixLen32:
+		if uint64(n) > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, n)
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(n))
+	default:
+		return nil, fmt.Errorf("%w: %d bytes", errBadPrefixLen, prefixLen)
+	}
+	copy(buf[prefixLen:], frame)
+	return buf, nil
+}
+
+// frameSize decodes the given little-endian length prefix and makes sure that
+// the frame size is within (0, max].
+func frameSize(prefix []byte, max int) (int, error) {
+	var size uint64
+	switch len(prefix) {
+	case prefixLen16:
+		size = uint64(binary.LittleEndian.Uint16(prefix))
+	case prefixLen32:
+		size = uint64(binary.LittleEndian.Uint32(prefix))
+	default:
+		return 0, fmt.Errorf("%w: %d bytes", errBadPrefixLen, len(prefix))
+	}
+	if size == 0 || size > uint64(max) {
+		return 0, fmt.Errorf("%w: %d bytes (max %d)", errFrameSizeRange, size, max)
+	}
+	return int(size), nil
+}
+
+// readFrame reads the next length-prefixed frame from the given reader, which
+// is fed by the host, into buf.  The length of sizeBuf determines the length
+// of the prefix.  It returns the frame's size.  The host isn't trusted: a
+// prefix that's 0 or exceeds len(buf) is rejected before we read the frame,
+// so we never allocate based on the prefix, and a stream that ends mid-frame
+// results in io.ErrUnexpectedEOF.
+func readFrame(r io.Reader, sizeBuf, buf []byte) (int, error) {
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		return 0, fmt.Errorf("failed to read frame size from connection: %w", err)
+	}
+	size, err := frameSize(sizeBuf, len(buf))
+	if err != nil {
+		return 0, fmt.Errorf("received bad frame size: %w", err)
+	}
+	if _, err = io.ReadFull(r, buf[:size]); err != nil {
+		return 0, fmt.Errorf("failed to read frame from connection: %w", err)
+	}
+	return size, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+)
+
+// jumboFrames returns frames that only fit a 4-byte length prefix.
+func jumboFrames() [][]byte {
+	return [][]byte{
+		bytes.Repeat([]byte{4}, math.MaxUint16+1),
+		bytes.Repeat([]byte{5}, 100000),
+	}
+}
+
+func TestWireFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		prefixLen int
+		size      int
+	}{
+		{prefixLen16, 1},
+		{prefixLen16, 1514},
+		{prefixLen16, math.MaxUint16},
+		{prefixLen32, 1},
+		{prefixLen32, math.MaxUint16 + 1},
+		{prefixLen32, 100000},
+	}
+	for _, c := range cases {
+		frame := bytes.Repeat([]byte{0xaa}, c.size)
+		wire, err := wireFrame(nil, frame, c.prefixLen)
+		if err != nil {
+			t.Fatalf("Failed to encode %d-byte frame with %d-byte prefix: %v", c.size, c.prefixLen, err)
+		}
+		if len(wire) != c.prefixLen+c.size {
+			t.Fatalf("Expected %d bytes on the wire but got %d.", c.prefixLen+c.size, len(wire))
+		}
+
+		buf := make([]byte, c.size)
+		size, err := readFrame(bytes.NewReader(wire), make([]byte, c.prefixLen), buf)
+		if err != nil {
+			t.Fatalf("Failed to decode %d-byte frame with %d-byte prefix: %v", c.size, c.prefixLen, err)
+		}
+		if size != c.size || !bytes.Equal(buf[:size], frame) {
+			t.Fatalf("Decoded frame differs from %d-byte frame with %d-byte prefix.", c.size, c.prefixLen)
+		}
+	}
+}
+
+func TestWireFrameReusesBuffer(t *testing.T) {
+	buf := make([]byte, 0, 2048)
+	wire, err := wireFrame(buf, make([]byte, 1514), prefixLen16)
+	if err != nil {
+		t.Fatalf("Failed to encode frame: %v", err)
+	}
+	if &wire[0] != &buf[:1][0] {
+		t.Error("Expected wireFrame to reuse the given buffer.")
+	}
+}
+
+func TestWireFrameRejects(t *testing.T) {
+	if _, err := wireFrame(nil, jumboFrames()[0], prefixLen16); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("Expected error %v but got %v.", errFrameTooLarge, err)
+	}
+	if _, err := wireFrame(nil, []byte{1}, 3); !errors.Is(err, errBadPrefixLen) {
+		t.Errorf("Expected error %v but got %v.", errBadPrefixLen, err)
+	}
+}
+
+func TestReadFrameRejects(t *testing.T) {
+	cases := []struct {
+		name    string
+		wire    []byte
+		prefix  int
+		bufLen  int
+		wantErr error
+	}{
+		{"empty frame", []byte{0, 0}, prefixLen16, 1514, errFrameSizeRange},
+		{"oversized 2-byte", []byte{0xff, 0xff}, prefixLen16, 1514, errFrameSizeRange},
+		{"oversized 4-byte", []byte{0, 0, 0, 1}, prefixLen32, 100000, errFrameSizeRange},
+		{"truncated prefix", []byte{1}, prefixLen16, 1514, io.ErrUnexpectedEOF},
+		{"truncated frame", []byte{10, 0, 1, 2}, prefixLen16, 1514, io.ErrUnexpectedEOF},
+		{"bad prefix", []byte{1, 0, 0}, 3, 1514, errBadPrefixLen},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := readFrame(bytes.NewReader(c.wire), make([]byte, c.prefix), make([]byte, c.bufLen))
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("Expected error %v but got %v.", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRxTxJumboFrames(t *testing.T) {
+	const mtu = 100000
+	sent := jumboFrames()
+
+	// rx encodes the application's frames for the host.
+	errCh := make(chan error, 1)
+	var wire bytes.Buffer
+	rx(&wire, newFakeTap(sent...), errCh, mtu, prefixLen32, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+	}
+
+	// tx decodes the host's frames for the application.
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	go func() {
+		_, _ = hostConn.Write(wire.Bytes())
+		hostConn.Close()
+	}()
+	tap := newFakeTap()
+	tx(enclaveConn, tap, errCh, mtu, prefixLen32, nil, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected tx to stop at the end of the stream but got %v.", err)
+	}
+
+	received := tap.frames()
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Errorf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+}
+
+func TestRxRejectsJumboFramesWith2BytePrefix(t *testing.T) {
+	errCh := make(chan error, 1)
+	var wire bytes.Buffer
+	rx(&wire, newFakeTap(jumboFrames()[0]), errCh, 100000, prefixLen16, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("Expected error %v but got %v.", errFrameTooLarge, err)
+	}
+	if wire.Len() != 0 {
+		t.Fatalf("Expected nothing on the wire but got %d bytes.", wire.Len())
+	}
+}
+
+// FuzzTxFrameParsing feeds arbitrary byte streams from the host into the
+// frame parser that tx uses.  The parser must never panic, must only return
+// frames within (0, mtu], and must stop with a clean error on malformed
+// input.  Every frame that it returns must re-encode to exactly the bytes
+// that it consumed.
+func FuzzTxFrameParsing(f *testing.F) {
+	const mtu = 1514
+	valid, _ := wireFrame(nil, bytes.Repeat([]byte{0xaa}, 60), prefixLen16)
+	valid32, _ := wireFrame(nil, bytes.Repeat([]byte{0xbb}, mtu), prefixLen32)
+	for _, seed := range [][]byte{
+		{},
+		{0x01},                            // Truncated 2-byte prefix.
+		{0x01, 0x00, 0x00},                // Truncated 4-byte prefix.
+		{0x00, 0x00},                      // Empty frame.
+		{0xff, 0xff},                      // Oversized 2-byte frame.
+		{0xff, 0xff, 0xff, 0xff},          // Oversized 4-byte frame.
+		{0xeb, 0x05},                      // MTU-sized frame without payload.
+		{0x0a, 0x00, 0x01, 0x02},          // Truncated frame.
+		append(valid, valid...),           // Back-to-back frames.
+		append(valid32, 0xff, 0xff, 0xff), // Frame followed by garbage.
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, prefixLen := range []int{prefixLen16, prefixLen32} {
+			r := bytes.NewReader(data)
+			sizeBuf, buf := make([]byte, prefixLen), make([]byte, mtu)
+			consumed := 0
+			for {
+				size, err := readFrame(r, sizeBuf, buf)
+				if err != nil {
+					if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errFrameSizeRange) {
+						t.Fatalf("Unexpected error for %d-byte prefix: %v", prefixLen, err)
+					}
+					break
+				}
+				if size <= 0 || size > mtu {
+					t.Fatalf("Expected frame size within (0, %d] but got %d.", mtu, size)
+				}
+				wire, err := wireFrame(nil, buf[:size], prefixLen)
+				if err != nil {
+					t.Fatalf("Failed to re-encode frame: %v", err)
+				}
+				if !bytes.Equal(wire, data[consumed:consumed+len(wire)]) {
+					t.Fatal("Re-encoded frame differs from the bytes on the wire.")
+				}
+				consumed += len(wire)
+			}
+			if consumed > len(data) {
+				t.Fatalf("Consumed %d bytes of a %d-byte stream.", consumed, len(data))
+			}
+		}
+	})
+}
+
+func TestValidateWidePrefix(t *testing.T) {
+	for _, c := range []struct {
+		prefixLen int
+		negotiate bool
+		wantErr   error
+	}{
+		{0, false, nil},
+		{prefixLen16, false, nil},
+		{prefixLen32, true, nil},
+		{prefixLen32, false, errWidePrefixNeedsNegotiation},
+		{3, true, errBadPrefixLen},
+	} {
+		cfg := testConfig()
+		cfg.FramePrefixLen = c.prefixLen
+		cfg.NegotiateProtocol = c.negotiate
+		if err := cfg.Validate(); !errors.Is(err, c.wantErr) {
+			t.Errorf("Expected %v for %d-byte prefix but got %v.", c.wantErr, c.prefixLen, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// frameCompressionGzip compresses frames with gzip.
+	frameCompressionGzip = "gzip"
+
+	// Each compressed frame starts with one of the following encoding bytes.
+	frameEncRaw  = 0
+	frameEncGzip = 1
+	// frameEncLen is the length of the encoding byte.
+	frameEncLen = 1
+)
+
+var (
+	errBadFrameCompression = errors.New("unsupported frame compression")
+	errBadFrameEncoding    = errors.New("malformed compressed frame")
+	// errCompressionNeedsNegotiation means that frame compression is
+	// configured without protocol negotiation, which tells us if the host
+	// supports compression.
+	errCompressionNeedsNegotiation = errors.New("frame compression requires protocol negotiation")
+)
+
+// validFrameCompression returns nil if the given frame compression is
+// supported.  The empty string means no compression.
+func validFrameCompression(c string) error {
+	if c != "" && c != frameCompressionGzip {
+		return fmt.Errorf("%w: %q", errBadFrameCompression, c)
+	}
+	return nil
+}
+
+// frameCodec compresses frames before they're written to the host, and
+// decompresses frames that are read from the host.  Each frame starts with an
+// encoding byte, followed by the raw or the compressed frame.  Frames whose
+// compression doesn't make them smaller, e.g., because their payload is
+// already compressed, are sent raw, so a compressed frame is never longer
+// than the raw frame plus the encoding byte.  A nil *frameCodec leaves
+// frames untouched.  A frameCodec must not be shared by goroutines.
+type frameCodec struct {
+	buf bytes.Buffer
+	w   *gzip.Writer
+	r   *gzip.Reader
+	in  bytes.Reader
+}
+
+// newFrameCodec returns a codec for the given compression, or nil if
+// compression is off.
+func newFrameCodec(compression string) *frameCodec {
+	if compression == "" {
+		return nil
+	}
+	c := &frameCodec{}
+	c.w, _ = gzip.NewWriterLevel(&c.buf, gzip.BestSpeed)
+	return c
+}
+
+// overhead returns the number of bytes that encoding adds to a frame at
+// most.
+func (c *frameCodec) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return frameEncLen
+}
+
+// encode returns the encoded frame.  The returned slice is only valid until
+// the next call to encode.
+func (c *frameCodec) encode(frame []byte) ([]byte, error) {
+	if c == nil {
+		return frame, nil
+	}
+	c.buf.Reset()
+	c.buf.WriteByte(frameEncGzip)
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	if c.buf.Len() < frameEncLen+len(frame) {
+		return c.buf.Bytes(), nil
+	}
+
+	c.buf.Reset()
+	c.buf.WriteByte(frameEncRaw)
+	c.buf.Write(frame)
+	return c.buf.Bytes(), nil
+}
+
+// decode decodes the given encoded frame into dst and returns the length of
+// the decoded frame.  The host isn't trusted: frames that don't fit into dst
+// are rejected, so a small compressed frame can't make us allocate.
+func (c *frameCodec) decode(dst, encoded []byte) (int, error) {
+	if c == nil {
+		return copy(dst, encoded), nil
+	}
+	if len(encoded) < frameEncLen {
+		return 0, fmt.Errorf("%w: missing encoding", errBadFrameEncoding)
+	}
+	enc, payload := encoded[0], encoded[frameEncLen:]
+	switch enc {
+	case frameEncRaw:
+		if len(payload) > len(dst) {
+			return 0, fmt.Errorf("%w: %d-byte frame too large", errBadFrameEncoding, len(payload))
+		}
+		return copy(dst, payload), nil
+	case frameEncGzip:
+	default:
+		return 0, fmt.Errorf("%w: unknown encoding %d", errBadFrameEncoding, enc)
+	}
+
+	c.in.Reset(payload)
+	var err error
+	if c.r == nil {
+		c.r, err = gzip.NewReader(&c.in)
+	} else {
+		err = c.r.Reset(&c.in)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+	}
+	// Reading up to io.EOF makes gzip verify the frame's checksum.
+	n := 0
+	for {
+		if n == len(dst) {
+			// The frame must end here.
+			m, err := c.r.Read(make([]byte, 1))
+			if m > 0 {
+				return 0, fmt.Errorf("%w: frame too large", errBadFrameEncoding)
+			}
+			if err != io.EOF {
+				return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+			}
+			break
+		}
+		m, err := c.r.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errBadFrameEncoding, err)
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("%w: empty frame", errBadFrameEncoding)
+	}
+	return n, nil
+}
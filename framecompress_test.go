@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// compressionFrames returns a compressible and an incompressible frame.
+func compressionFrames() [][]byte {
+	random := make([]byte, 1500)
+	rand.New(rand.NewSource(1)).Read(random)
+	return [][]byte{bytes.Repeat([]byte("frame"), 300), random}
+}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	codec := newFrameCodec(frameCompressionGzip)
+	for i, frame := range compressionFrames() {
+		encoded, err := codec.encode(frame)
+		if err != nil {
+			t.Fatalf("Failed to encode frame %d: %v", i, err)
+		}
+		if len(encoded) > len(frame)+codec.overhead() {
+			t.Fatalf("Expected frame %d to grow by at most %d bytes but got %d bytes.",
+				i, codec.overhead(), len(encoded)-len(frame))
+		}
+		dst := make([]byte, len(frame))
+		n, err := codec.decode(dst, encoded)
+		if err != nil {
+			t.Fatalf("Failed to decode frame %d: %v", i, err)
+		}
+		if !bytes.Equal(dst[:n], frame) {
+			t.Fatalf("Frame %d differs after the round trip.", i)
+		}
+	}
+}
+
+func TestFrameCodecEncoding(t *testing.T) {
+	codec := newFrameCodec(frameCompressionGzip)
+	frames := compressionFrames()
+	compressible, err := codec.encode(frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressible[0] != frameEncGzip || len(compressible) >= len(frames[0]) {
+		t.Fatalf("Expected compressed frame but got encoding %d and %d bytes.", compressible[0], len(compressible))
+	}
+	// Frames that don't get smaller are sent raw.
+	random, err := codec.encode(frames[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if random[0] != frameEncRaw || !bytes.Equal(random[frameEncLen:], frames[1]) {
+		t.Fatalf("Expected raw frame but got encoding %d.", random[0])
+	}
+}
+
+func TestFrameCodecDecodeErrors(t *testing.T) {
+	codec := newFrameCodec(frameCompressionGzip)
+	big, err := codec.encode(bytes.Repeat([]byte{0}, 2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big = append([]byte(nil), big...)
+	for name, encoded := range map[string][]byte{
+		"empty":            nil,
+		"unknown encoding": {7, 1, 2, 3},
+		"raw too large":    append([]byte{frameEncRaw}, make([]byte, 1001)...),
+		"gzip too large":   big,
+		"corrupt gzip":     {frameEncGzip, 1, 2, 3},
+	} {
+		if _, err := codec.decode(make([]byte, 1000), encoded); !errors.Is(err, errBadFrameEncoding) {
+			t.Errorf("%s: Expected %v but got %v.", name, errBadFrameEncoding, err)
+		}
+	}
+}
+
+func TestNilFrameCodec(t *testing.T) {
+	codec := newFrameCodec("")
+	if codec != nil {
+		t.Fatalf("Expected no codec without compression but got %v.", codec)
+	}
+	frame := []byte("frame")
+	if encoded, _ := codec.encode(frame); !bytes.Equal(encoded, frame) {
+		t.Fatalf("Expected frame to be left untouched but got %q.", encoded)
+	}
+	if codec.overhead() != 0 {
+		t.Fatalf("Expected no overhead but got %d.", codec.overhead())
+	}
+}
+
+func TestRxTxCompressedFrames(t *testing.T) {
+	const mtu = 1500
+	sent := compressionFrames()
+
+	// rx compresses the application's frames for the host.
+	errCh := make(chan error, 1)
+	var wire bytes.Buffer
+	rx(&wire, newFakeTap(sent...), errCh, mtu, prefixLen16, nil, nil, newFrameCodec(frameCompressionGzip))
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to stop at the end of the frames but got %v.", err)
+	}
+	if raw := 2*prefixLen16 + len(sent[0]) + len(sent[1]); wire.Len() >= raw {
+		t.Fatalf("Expected fewer than %d bytes on the wire but got %d.", raw, wire.Len())
+	}
+
+	// tx decompresses the host's frames for the application.
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	go func() {
+		_, _ = hostConn.Write(wire.Bytes())
+		hostConn.Close()
+	}()
+	tap := newFakeTap()
+	tx(enclaveConn, tap, errCh, mtu, prefixLen16, nil, nil, nil, newFrameCodec(frameCompressionGzip))
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected tx to stop at the end of the stream but got %v.", err)
+	}
+
+	received := tap.frames()
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Errorf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	gzipHost := &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}, Compression: []string{frameCompressionGzip}}
+	if got := negotiate(prefixLen16, frameCompressionGzip, false, gzipHost); got.Compression != frameCompressionGzip {
+		t.Fatalf("Expected %s compression but got %q.", frameCompressionGzip, got.Compression)
+	}
+	if got := negotiate(prefixLen16, "", false, gzipHost); got.Compression != "" {
+		t.Fatalf("Expected no compression unless we ask for it but got %q.", got.Compression)
+	}
+	plainHost := &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}}
+	if got := negotiate(prefixLen16, frameCompressionGzip, false, plainHost); got.Compression != "" {
+		t.Fatalf("Expected no compression with a host that doesn't support it but got %q.", got.Compression)
+	}
+}
+
+func TestValidateFrameCompression(t *testing.T) {
+	for _, c := range []struct {
+		compression string
+		negotiate   bool
+		wantErr     error
+	}{
+		{"", false, nil},
+		{frameCompressionGzip, true, nil},
+		{frameCompressionGzip, false, errCompressionNeedsNegotiation},
+		{"zstd", true, errBadFrameCompression},
+	} {
+		cfg := testConfig()
+		cfg.FrameCompression = c.compression
+		cfg.NegotiateProtocol = c.negotiate
+		if err := cfg.Validate(); !errors.Is(err, c.wantErr) {
+			t.Errorf("Expected %v for %q but got %v.", c.wantErr, c.compression, err)
+		}
+	}
+}
+
+// BenchmarkFrameCodec reports the cost of encoding and decoding a frame,
+// along with the number of bytes that the frame takes up on the wire.
+func BenchmarkFrameCodec(b *testing.B) {
+	frames := compressionFrames()
+	for _, bc := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"compressible", frames[0]},
+		{"incompressible", frames[1]},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			codec := newFrameCodec(frameCompressionGzip)
+			dst := make([]byte, len(bc.frame))
+			var wire int
+			b.SetBytes(int64(len(bc.frame)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, err := codec.encode(bc.frame)
+				if err != nil {
+					b.Fatal(err)
+				}
+				wire = len(encoded)
+				if _, err := codec.decode(dst, encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(wire), "wire-bytes/frame")
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// goroutineCheckInterval determines how often we compare the number of
+	// goroutines to the configured threshold.
+	goroutineCheckInterval = time.Minute
+	// maxStackDumpLen caps the size of the stack dump that we return.
+	maxStackDumpLen = 8 * 1024 * 1024
+)
+
+// numGoroutines is a variable pointing to a function that returns the number
+// of goroutines.  Using a variable allows us to easily mock the function in
+// our unit tests.
+var numGoroutines = runtime.NumGoroutine
+
+// goroutineInfo is the response body of the goroutines endpoint.
+type goroutineInfo struct {
+	Count  int    `json:"count"`
+	Stacks string `json:"stacks,omitempty"`
+}
+
+// goroutinesHandler returns a HandlerFunc that reports the current number of
+// goroutines.  In debug mode, the response also contains the stack traces of
+// all goroutines, which helps with tracking down leaks.
+func goroutinesHandler(debug bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := goroutineInfo{Count: numGoroutines()}
+		if debug {
+			info.Stacks = stackDump()
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// stackDump returns the stack traces of all goroutines.  The buffer grows
+// until the dump fits or until it reaches maxStackDumpLen, in which case the
+// dump is truncated.
+func stackDump() string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDumpLen {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// checkGoroutines logs a warning and returns true if the current number of
+// goroutines exceeds the given threshold.
+func checkGoroutines(threshold int) bool {
+	n := numGoroutines()
+	metricGoroutines.Set(int64(n))
+	if n <= threshold {
+		return false
+	}
+	log.Warnf("%d goroutines are running, which exceeds the threshold of %d; "+
+		"we may be leaking goroutines.", n, threshold)
+	return true
+}
+
+// watchGoroutines periodically checks the number of goroutines against the
+// given threshold until the given channel is closed.
+func watchGoroutines(threshold int, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			checkGoroutines(threshold)
+		case <-done:
+			return
+		}
+	}
+}
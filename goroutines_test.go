@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// useFakeNumGoroutines makes numGoroutines return the given count.
+func useFakeNumGoroutines(t *testing.T, n int) {
+	t.Helper()
+	orig := numGoroutines
+	numGoroutines = func() int { return n }
+	t.Cleanup(func() { numGoroutines = orig })
+}
+
+// getGoroutines queries the goroutines endpoint of the given enclave's
+// internal Web server.
+func getGoroutines(t *testing.T, e *Enclave) goroutineInfo {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.intSrv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pathGoroutines, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, rec.Code)
+	}
+	var info goroutineInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return info
+}
+
+func TestGoroutinesCountsSpawned(t *testing.T) {
+	const spawned = 50
+	e := newTestEnclave(t, testConfig())
+	before := getGoroutines(t, e).Count
+
+	var started sync.WaitGroup
+	release := make(chan struct{})
+	started.Add(spawned)
+	for i := 0; i < spawned; i++ {
+		go func() {
+			started.Done()
+			<-release
+		}()
+	}
+	started.Wait()
+	defer close(release)
+
+	// Goroutines left behind by earlier tests may exit meanwhile, so we
+	// allow for some slack.
+	const slack = 10
+	if after := getGoroutines(t, e).Count; after < before+spawned-slack {
+		t.Fatalf("Expected at least %d goroutines but got %d.", before+spawned-slack, after)
+	}
+}
+
+func TestGoroutinesStacks(t *testing.T) {
+	useFakeNumGoroutines(t, 42)
+
+	cfg := testConfig()
+	info := getGoroutines(t, newTestEnclave(t, cfg))
+	if info.Count != 42 {
+		t.Fatalf("Expected 42 goroutines but got %d.", info.Count)
+	}
+	if info.Stacks != "" {
+		t.Fatal("Expected no stack dump outside of debug mode.")
+	}
+
+	cfg.Debug = true
+	info = getGoroutines(t, newTestEnclave(t, cfg))
+	if !strings.Contains(info.Stacks, "goroutine ") {
+		t.Fatalf("Expected stack dump in debug mode but got %q.", info.Stacks)
+	}
+}
+
+func TestCheckGoroutines(t *testing.T) {
+	cases := []struct {
+		name     string
+		count    int
+		wantWarn bool
+	}{
+		{"below threshold", 99, false},
+		{"at threshold", 100, false},
+		{"past threshold", 101, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeNumGoroutines(t, c.count)
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			if got := checkGoroutines(100); got != c.wantWarn {
+				t.Fatalf("Expected %v but got %v.", c.wantWarn, got)
+			}
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel {
+					warned = true
+				}
+			}
+			if warned != c.wantWarn {
+				t.Fatalf("Expected warning %v but got %v.", c.wantWarn, warned)
+			}
+			if got := metricGoroutines.Value(); got != int64(c.count) {
+				t.Fatalf("Expected goroutines metric %d but got %d.", c.count, got)
+			}
+		})
+	}
+}
+
+func TestWatchGoroutines(t *testing.T) {
+	useFakeNumGoroutines(t, 1000)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchGoroutines(10, time.Millisecond, done)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hook.LastEntry() == nil || hook.LastEntry().Level != log.WarnLevel {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected periodic check to warn about goroutines.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected watcher to stop after closing done channel.")
+	}
+}
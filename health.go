@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// apiVersion is the version of the shape of our JSON responses.  Bump it
+	// whenever a response's shape changes in an incompatible way.
+	apiVersion = 1
+	// nsmProbeTTL determines for how long we cache the result of an NSM
+	// probe, so health checks can't be used to hammer the NSM.
+	nsmProbeTTL = 5 * time.Second
+	statusOK    = "ok"
+	statusDown  = "unavailable"
+)
+
+// nsmProbe checks if the Nitro Secure Module is able to issue attestation
+// documents.  The result of the most recent check is cached for the given TTL.
+type nsmProbe struct {
+	sync.Mutex
+	attester  Attester
+	ttl       time.Duration
+	lastCheck time.Time
+	lastErr   error
+}
+
+func newNSMProbe(a Attester, ttl time.Duration) *nsmProbe {
+	return &nsmProbe{
+		attester: a,
+		ttl:      ttl,
+	}
+}
+
+// check returns nil if the NSM is available, and an error otherwise.
+func (p *nsmProbe) check() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if time.Since(p.lastCheck) < p.ttl {
+		return p.lastErr
+	}
+	// Attesting an empty nonce is the cheapest request that the NSM serves.
+	_, p.lastErr = p.attester.Attest(nil, nil, nil)
+	p.lastCheck = time.Now()
+	return p.lastErr
+}
+
+// nsmHealthHandler returns a HandlerFunc that reports if the NSM is available,
+// independent of the enclave's general health.
+func nsmHealthHandler(p *nsmProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := p.check(); err != nil {
+			log.Printf("Health: NSM probe failed: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"nsm": statusDown})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"nsm": statusOK})
+	}
+}
+
+// writeJSON writes the given value as JSON-encoded response body, along with
+// the given status code.  If the value is encoded as JSON object, the object
+// gets an "api_version" field, so clients can detect changes to the shape of
+// our responses.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := versionedJSON(v)
+	if err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// versionedJSON encodes the given value as JSON and adds our API version if
+// the result is a JSON object.
+func versionedJSON(v any) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+		return raw, nil
+	}
+	obj["api_version"] = json.RawMessage(strconv.Itoa(apiVersion))
+	return json.Marshal(obj)
+}
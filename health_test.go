@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+var errNSMDown = errors.New("NSM unavailable")
+
+// fakeAttester implements Attester.  It fails with err if err is set, and
+// returns doc otherwise.
+type fakeAttester struct {
+	sync.Mutex
+	err   error
+	doc   []byte
+	calls int
+}
+
+func (a *fakeAttester) setErr(err error) {
+	a.Lock()
+	defer a.Unlock()
+	a.err = err
+}
+
+func (a *fakeAttester) numCalls() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.calls
+}
+
+func (a *fakeAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return a.doc, nil
+}
+
+// fakeResolver implements hostResolver.  It fails with err if err is set,
+// and returns addrs otherwise.
+type fakeResolver struct {
+	sync.Mutex
+	addrs []string
+	err   error
+}
+
+func (r *fakeResolver) setErr(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.err = err
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.addrs, r.err
+}
+
+// getJSON sends a GET request for the given path to the given handler and
+// returns the response's status code and its decoded JSON body.
+func getJSON(t *testing.T, h http.Handler, path string) (int, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode JSON response %q: %v", w.Body, err)
+	}
+	return w.Code, body
+}
+
+func TestNSMHealth(t *testing.T) {
+	a := &fakeAttester{doc: []byte("document")}
+	h := nsmHealthHandler(newNSMProbe(a, 0))
+
+	code, body := getJSON(t, h, pathHealthNSM)
+	if code != http.StatusOK || body["nsm"] != statusOK {
+		t.Errorf("Expected healthy NSM but got %d: %v", code, body)
+	}
+
+	a.setErr(errNSMDown)
+	code, body = getJSON(t, h, pathHealthNSM)
+	if code != http.StatusServiceUnavailable || body["nsm"] != statusDown {
+		t.Errorf("Expected unavailable NSM but got %d: %v", code, body)
+	}
+
+	a.setErr(nil)
+	if code, _ = getJSON(t, h, pathHealthNSM); code != http.StatusOK {
+		t.Errorf("Expected NSM to recover but got %d.", code)
+	}
+}
+
+func TestNSMHealthIsIndependentOfNetworking(t *testing.T) {
+	a := &fakeAttester{err: errNSMDown}
+	m := http.NewServeMux()
+	m.Handle(pathHealthNSM, nsmHealthHandler(newNSMProbe(a, 0)))
+	m.Handle(pathHealthDNS, dnsHealthHandler(newDNSProbe(&fakeResolver{addrs: []string{"192.0.2.1"}}, "example.com", 0)))
+
+	if code, _ := getJSON(t, m, pathHealthNSM); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected NSM to be unavailable but got %d.", code)
+	}
+	if code, _ := getJSON(t, m, pathHealthDNS); code != http.StatusOK {
+		t.Errorf("Expected DNS to be healthy but got %d.", code)
+	}
+}
+
+func TestNSMProbeCache(t *testing.T) {
+	a := &fakeAttester{doc: []byte("document")}
+	p := newNSMProbe(a, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := p.check(); err != nil {
+			t.Fatalf("Expected healthy NSM but got %v.", err)
+		}
+	}
+	if a.numCalls() != 1 {
+		t.Errorf("Expected 1 probe within the TTL but got %d.", a.numCalls())
+	}
+	// Within the TTL, we keep reporting the cached result.
+	a.setErr(errNSMDown)
+	if err := p.check(); err != nil {
+		t.Errorf("Expected cached result but got %v.", err)
+	}
+}
+
+// hasAPIVersion returns true if the given body is a JSON object that carries
+// our API version.
+func hasAPIVersion(body []byte) bool {
+	var obj struct {
+		APIVersion *int `json:"api_version"`
+	}
+	return json.Unmarshal(body, &obj) == nil && obj.APIVersion != nil && *obj.APIVersion == apiVersion
+}
+
+func TestJSONResponsesCarryAPIVersion(t *testing.T) {
+	cfg := testConfig()
+	cfg.KMS = &fakeKMS{}
+	cfg.AdminToken = "s3cret"
+	e := newTestEnclave(t, cfg)
+
+	// Request every route of both Web servers and check all JSON
+	// responses.
+	var jsonRoutes []string
+	for _, h := range []http.Handler{e.pubSrv.Handler, e.intSrv.Handler} {
+		walk := func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			// Stopping the enclave would interfere with other tests.
+			if route == pathAdminStop || (route == pathMetrics && method != http.MethodGet) {
+				return nil
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, route, strings.NewReader("{}"))
+			r.Header.Set("Authorization", bearerPrefix+cfg.AdminToken)
+			h.ServeHTTP(w, r)
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				return nil
+			}
+			jsonRoutes = append(jsonRoutes, route)
+			if !hasAPIVersion(w.Body.Bytes()) {
+				t.Errorf("Expected %s %s to carry API version %d but got %s", method, route, apiVersion, w.Body)
+			}
+			return nil
+		}
+		if err := chi.Walk(h.(*chi.Mux), walk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, route := range []string{pathReady, pathVerify, pathConfig, pathEgress, pathGoroutines, pathMeasure, pathMetrics, pathRuntime, pathTopology} {
+		if !contains(jsonRoutes, route) {
+			t.Errorf("Expected %s to return JSON.", route)
+		}
+	}
+
+	// Some handlers only return JSON for valid requests, or aren't
+	// registered by default.
+	nonce := strings.Repeat("ab", nonceLen)
+	a := &fakeAttester{doc: []byte("document")}
+	envReq := httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+nonce, nil)
+	envReq.Header.Set("Accept", "application/json")
+	for name, c := range map[string]struct {
+		h http.Handler
+		r *http.Request
+	}{
+		"attestation envelope": {
+			attestationHandler(a, testHashes(), newTokenStore(0), testMetadataSigner(), nil, newAuditLog(nil)),
+			envReq,
+		},
+		"log level": {
+			logLevelHandler(),
+			httptest.NewRequest(http.MethodPost, pathAdminLogLevel, strings.NewReader(`{"level":"`+log.GetLevel().String()+`"}`)),
+		},
+		"shared attestation": {
+			sharedAttestationHandler(newSharedAttester(a, testHashes(), newAuditLog(nil), time.Minute)),
+			httptest.NewRequest(http.MethodGet, "/", nil),
+		},
+	} {
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, c.r)
+		if w.Code != http.StatusOK || !hasAPIVersion(w.Body.Bytes()) {
+			t.Errorf("Expected %s to carry API version %d but got %d: %s", name, apiVersion, w.Code, w.Body)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
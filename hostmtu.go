@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pathHostMTU is the path at which the proxy on the EC2 host tells us
+	// the MTU of its default route's interface.
+	pathHostMTU = "/mtu"
+	// maxLinkMTU is the largest MTU that we accept from the host, which
+	// matches the jumbo frames of EC2 instances.
+	maxLinkMTU = 9001
+)
+
+// dialHost is a variable pointing to the function that connects to the proxy
+// on the EC2 host.  Using a variable allows us to easily mock the host in our
+// unit tests.
+var dialHost = transport.Dial
+
+// linkMTU returns the MTU for our TAP interface.  If MTU discovery is on, we
+// ask the host for the MTU of its default route's interface, so our TAP
+// interface matches it.  If the host can't tell us, we fall back to the
+// configured MTU.
+func linkMTU(n *NetConfig) int {
+	if !n.DiscoverMTU {
+		return n.MTU
+	}
+	mtu, err := queryHostMTU(n)
+	if err != nil {
+		log.Warnf("Failed to discover host MTU; using MTU %d: %v", n.MTU, err)
+		return n.MTU
+	}
+	log.Printf("Discovered host MTU %d.", mtu)
+	return mtu
+}
+
+// queryHostMTU asks the proxy on the EC2 host for its MTU.
+func queryHostMTU(n *NetConfig) (int, error) {
+	body, err := queryHost(n, http.MethodGet, pathHostMTU, 16)
+	if err != nil {
+		return 0, err
+	}
+	mtu, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0, fmt.Errorf("host returned bad MTU: %w", err)
+	}
+	if mtu <= 0 || mtu > maxLinkMTU {
+		return 0, fmt.Errorf("host returned MTU %d outside of 1-%d", mtu, maxLinkMTU)
+	}
+	return mtu, nil
+}
+
+// queryHost sends a request with the given method and path to the proxy on
+// the EC2 host, and returns up to maxLen bytes of the response body.  The
+// exchange is bounded by the handshake timeout.  If the host doesn't respond
+// with 200 OK, the error is a hostStatusError.
+func queryHost(n *NetConfig, method, path string, maxLen int) ([]byte, error) {
+	endpoint := fmt.Sprintf("vsock://%d:%d%s", n.ParentCID, n.HostProxyPort, path)
+	conn, path, err := dialHost(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to host: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(n.HandshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, hostStatusError(resp.StatusCode)
+	}
+	return io.ReadAll(newLimitReader(resp.Body, maxLen))
+}
+
+// hostStatusError is the unexpected status code of a response by the proxy
+// on the EC2 host.
+type hostStatusError int
+
+func (e hostStatusError) Error() string {
+	return fmt.Sprintf("host returned status code %d", int(e))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useFakeHost makes queryHost talk to the given handler instead of the proxy
+// on the EC2 host.  Each dial serves exactly one request.
+func useFakeHost(t *testing.T, h http.Handler) {
+	t.Helper()
+	orig := dialHost
+	dialHost = func(endpoint string) (net.Conn, string, error) {
+		i := strings.Index(strings.TrimPrefix(endpoint, "vsock://"), "/")
+		if i < 0 {
+			return nil, "", fmt.Errorf("bad endpoint %q", endpoint)
+		}
+		path := strings.TrimPrefix(endpoint, "vsock://")[i:]
+		enclave, host := net.Pipe()
+		go func() {
+			defer host.Close()
+			req, err := http.ReadRequest(bufio.NewReader(host))
+			if err != nil {
+				return
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			_ = rec.Result().Write(host)
+		}()
+		return enclave, path, nil
+	}
+	t.Cleanup(func() { dialHost = orig })
+}
+
+// hostMTUHandler returns a handler that responds to MTU queries like the
+// proxy on the EC2 host does.
+func hostMTUHandler(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != pathHostMTU {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, body)
+	}
+}
+
+func TestLinkMTUDiscoveryOff(t *testing.T) {
+	useFakeHost(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no query to the host when MTU discovery is off.")
+	}))
+	n := validNetConfig()
+	if mtu := linkMTU(n); mtu != n.MTU {
+		t.Fatalf("Expected configured MTU %d but got %d.", n.MTU, mtu)
+	}
+}
+
+func TestLinkMTU(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.Handler
+		wantMTU int
+	}{
+		{"jumbo frames", hostMTUHandler("9001"), 9001},
+		{"standard frames", hostMTUHandler("1500"), 1500},
+		{"garbage", hostMTUHandler("lots"), defaultLinkMTU},
+		{"too large", hostMTUHandler("65536"), defaultLinkMTU},
+		{"zero", hostMTUHandler("0"), defaultLinkMTU},
+		{"old host", http.NotFoundHandler(), defaultLinkMTU},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeHost(t, c.handler)
+			n := validNetConfig()
+			n.DiscoverMTU = true
+			if mtu := linkMTU(n); mtu != c.wantMTU {
+				t.Fatalf("Expected MTU %d but got %d.", c.wantMTU, mtu)
+			}
+		})
+	}
+}
+
+func TestQueryHostStatusError(t *testing.T) {
+	useFakeHost(t, http.NotFoundHandler())
+	_, err := queryHostMTU(validNetConfig())
+	var statusErr hostStatusError
+	if !errors.As(err, &statusErr) || int(statusErr) != http.StatusNotFound {
+		t.Fatalf("Expected host status error 404 but got %v.", err)
+	}
+}
+
+func TestQueryHostUnreachable(t *testing.T) {
+	orig := dialHost
+	dialHost = func(string) (net.Conn, string, error) {
+		return nil, "", errors.New("connection refused")
+	}
+	t.Cleanup(func() { dialHost = orig })
+
+	n := validNetConfig()
+	n.DiscoverMTU = true
+	if mtu := linkMTU(n); mtu != n.MTU {
+		t.Fatalf("Expected fallback MTU %d but got %d.", n.MTU, mtu)
+	}
+}
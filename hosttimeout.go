@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// validateHostTimeouts returns an error if any of the given per-host timeout
+// overrides is malformed.
+func validateHostTimeouts(timeouts map[string]time.Duration) error {
+	for host, timeout := range timeouts {
+		if host == "" || strings.ContainsAny(host, ":/") {
+			return fmt.Errorf("invalid host %q in outbound timeouts; must be a bare host name", host)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid outbound timeout %s for host %q", timeout, host)
+		}
+	}
+	return nil
+}
+
+// hostTimeoutTransport bounds each request by the timeout of its destination
+// host, or by the default timeout if the host has no override.  Like
+// http.Client's timeout, it covers reading the response body.
+type hostTimeoutTransport struct {
+	next     http.RoundTripper
+	fallback time.Duration
+	timeouts map[string]time.Duration
+}
+
+func newHostTimeoutTransport(next http.RoundTripper, fallback time.Duration, timeouts map[string]time.Duration) *hostTimeoutTransport {
+	lower := make(map[string]time.Duration, len(timeouts))
+	for host, timeout := range timeouts {
+		lower[strings.ToLower(host)] = timeout
+	}
+	return &hostTimeoutTransport{next: next, fallback: fallback, timeouts: lower}
+}
+
+// withoutHostTimeouts returns the given transport of an outbound client
+// without its per-host timeouts, if it has any.
+func withoutHostTimeouts(transport http.RoundTripper) http.RoundTripper {
+	if t, ok := transport.(*hostTimeoutTransport); ok {
+		return t.next
+	}
+	return transport
+}
+
+// timeout returns the timeout for requests to the given host.
+func (t *hostTimeoutTransport) timeout(host string) time.Duration {
+	if timeout, ok := t.timeouts[strings.ToLower(host)]; ok {
+		return timeout
+	}
+	return t.fallback
+}
+
+func (t *hostTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout(req.URL.Hostname()))
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels a request's context once its response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
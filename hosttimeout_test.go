@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSlowServer returns a test server that takes the given delay to respond.
+func newSlowServer(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			_, _ = io.WriteString(w, "slow")
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fetch sends a GET request for the given URL via the given client and reads
+// the entire response body.
+func fetch(c *http.Client, url string) error {
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	return err
+}
+
+func TestHostTimeouts(t *testing.T) {
+	srv := newSlowServer(t, 200*time.Millisecond)
+	// Both host names reach the same server, but with different timeouts.
+	fastURL := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	slowURL := srv.URL
+
+	c := newOutboundClient(OutboundConfig{
+		Timeout: 50 * time.Millisecond,
+		HostTimeouts: map[string]time.Duration{
+			"LocalHost": 100 * time.Millisecond,
+			"127.0.0.1": 5 * time.Second,
+		},
+	}, newEgressStats())
+
+	start := time.Now()
+	if err := fetch(c, fastURL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected request to localhost to time out but got %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Expected localhost's timeout of 100ms but request failed after %s.", elapsed)
+	}
+	// The override exceeds the default timeout.
+	if err := fetch(c, slowURL); err != nil {
+		t.Fatalf("Expected request to 127.0.0.1 to succeed within its timeout but got %v.", err)
+	}
+}
+
+func TestHostTimeoutsFallback(t *testing.T) {
+	srv := newSlowServer(t, 200*time.Millisecond)
+	c := newOutboundClient(OutboundConfig{
+		Timeout:      50 * time.Millisecond,
+		HostTimeouts: map[string]time.Duration{"example.com": time.Minute},
+	}, newEgressStats())
+	if err := fetch(c, srv.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected host without override to get the default timeout but got %v.", err)
+	}
+}
+
+func TestHostTimeoutCoversBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	c := newOutboundClient(OutboundConfig{
+		HostTimeouts: map[string]time.Duration{"127.0.0.1": 50 * time.Millisecond},
+	}, newEgressStats())
+	if err := fetch(c, srv.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected reading a stalled body to time out but got %v.", err)
+	}
+}
+
+func TestValidateHostTimeouts(t *testing.T) {
+	for _, c := range []struct {
+		timeouts map[string]time.Duration
+		valid    bool
+	}{
+		{nil, true},
+		{map[string]time.Duration{"api.example.com": time.Second}, true},
+		{map[string]time.Duration{"": time.Second}, false},
+		{map[string]time.Duration{"api.example.com:443": time.Second}, false},
+		{map[string]time.Duration{"https://api.example.com": time.Second}, false},
+		{map[string]time.Duration{"api.example.com": 0}, false},
+		{map[string]time.Duration{"api.example.com": -time.Second}, false},
+	} {
+		if err := validateHostTimeouts(c.timeouts); (err == nil) != c.valid {
+			t.Errorf("Expected %v to be valid=%t but got %v.", c.timeouts, c.valid, err)
+		}
+	}
+}
+
+func TestForwardProxyIgnoresHostTimeouts(t *testing.T) {
+	upstream := newSlowServer(t, 200*time.Millisecond)
+	cfg := testConfig()
+	cfg.EgressAllowlist = []string{"127.0.0.1:" + mustParseURL(t, upstream.URL).Port()}
+	cfg.Outbound.HostTimeouts = map[string]time.Duration{"127.0.0.1": 50 * time.Millisecond}
+	e := newTestEnclave(t, cfg)
+
+	// The enclave's own client is bound by the host's timeout...
+	if err := fetch(e.client, upstream.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected outbound client to time out but got %v.", err)
+	}
+	// ...but the enclave application's requests through the forward proxy
+	// aren't.
+	proxy := httptest.NewServer(e.intSrv.Handler)
+	defer proxy.Close()
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(mustParseURL(t, proxy.URL))}}
+	if code, body := get(t, c, upstream.URL); code != http.StatusOK || body != "slow" {
+		t.Fatalf("Expected forward proxy to relay the slow response but got %d: %q.", code, body)
+	}
+}
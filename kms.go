@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	enclave "github.com/edgebitio/nitro-enclaves-sdk-go"
+	log "github.com/sirupsen/logrus"
+
+	"network-test/pkg/secrets"
+)
+
+const (
+	// maxCiphertextLen caps the size of ciphertexts that we decrypt.  KMS
+	// itself doesn't decrypt ciphertexts larger than 6 KiB.
+	maxCiphertextLen = 6 * 1024
+	kmsTimeout       = 10 * time.Second
+	// maxKMSAttempts caps the number of times we ask KMS to decrypt a
+	// ciphertext, each time with a fresh attestation document.
+	maxKMSAttempts = 2
+)
+
+var (
+	errNoSecretName   = "could not find secret name in URL query parameters"
+	errBadCiphertext  = fmt.Sprintf("ciphertext must not exceed %d bytes", maxCiphertextLen)
+	errFailedDecrypt  = "failed to decrypt ciphertext"
+	errReservedSecret = "secret name is reserved"
+	errUnboundNonce   = "nonce doesn't match the nonce of the attestation token"
+	errNoKMSRecipient = errors.New("KMS did not return a ciphertext for our enclave")
+
+	// ErrKMSAttestationExpired must be wrapped by KMSClient implementations
+	// if KMS rejects a request because its attestation document expired.
+	ErrKMSAttestationExpired = errors.New("KMS rejected expired attestation document")
+)
+
+// KMSClient abstracts the subset of the AWS KMS API that we need, so we don't
+// depend on the AWS SDK.  Embedding applications supply an implementation,
+// typically a thin wrapper around the SDK's kms.Client.
+type KMSClient interface {
+	// Decrypt asks KMS to decrypt the given ciphertext for the enclave that's
+	// described by the given attestation document.  It returns KMS's
+	// CiphertextForRecipient, i.e., the plaintext enveloped to the public key
+	// in the attestation document.  If KMS considers the attestation document
+	// expired, the returned error must wrap ErrKMSAttestationExpired.
+	Decrypt(ctx context.Context, ciphertext, attestationDoc []byte) ([]byte, error)
+}
+
+// kmsRecipient abstracts the enclave handle that attests to its key pair and
+// decrypts KMS's enveloped responses with its private key.  Using an
+// interface allows us to easily mock the handle in our unit tests.
+type kmsRecipient interface {
+	Attest(enclave.AttestationOptions) ([]byte, error)
+	DecryptKMSEnvelopedKey(content []byte) ([]byte, error)
+}
+
+// getKMSRecipient returns the enclave handle that talks to KMS.  Using a
+// variable allows us to easily mock the handle in our unit tests.
+var getKMSRecipient = func() (kmsRecipient, error) {
+	return enclave.GetOrInitializeHandle()
+}
+
+// kmsDecrypt decrypts the given ciphertext via KMS.  KMS only releases the
+// plaintext to an attested enclave, enveloped to the enclave's public key.
+// The attestation documents contain the given user data, e.g., the nonce of
+// the decrypt request.  If KMS rejects our attestation document as expired,
+// e.g., because of clock skew or a slow request, we retry with a fresh
+// document, up to maxKMSAttempts times in total.
+func kmsDecrypt(ctx context.Context, kms KMSClient, r kmsRecipient, ciphertext, userData []byte) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "kms.decrypt")
+	defer func() { endSpan(span, err) }()
+
+	var enveloped []byte
+	for attempt := 1; ; attempt++ {
+		doc, err := r.Attest(enclave.AttestationOptions{UserData: userData})
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain attestation document: %w", err)
+		}
+		enveloped, err = kms.Decrypt(ctx, ciphertext, doc)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrKMSAttestationExpired) || attempt >= maxKMSAttempts {
+			return nil, fmt.Errorf("KMS failed to decrypt: %w", err)
+		}
+		log.Printf("KMS rejected expired attestation document; retrying with a fresh one.")
+	}
+	if len(enveloped) == 0 {
+		return nil, errNoKMSRecipient
+	}
+	plaintext, err := r.DecryptKMSEnvelopedKey(enveloped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open KMS envelope: %w", err)
+	}
+	return plaintext, nil
+}
+
+// decryptHandler returns a HandlerFunc that decrypts the ciphertext in the
+// request body via KMS and stashes the plaintext in the given secret store,
+// under the name that's given in the URL query parameters.  The plaintext is
+// never returned to the requester.  If the given nonce cache isn't nil,
+// requests must carry a fresh nonce in the "nonce" URL query parameter,
+// which ends up in the user data of the attestation documents that we send
+// to KMS.  The nonce must be the one that the request's attestation token was
+// issued for, so it's tied to an attestation handshake that we completed.  A
+// nonce that's used again within the cache's window is rejected with 409
+// Conflict, so captured requests can't be replayed.  We only record a nonce
+// once we accepted its request, and only use it up if we store the secret, so
+// malformed or failed requests don't burn nonces.  Requests for
+// any of the given reserved names are rejected with 403 Forbidden, so
+// requesters can't overwrite secrets that we rely on, e.g., the admin token.
+func decryptHandler(kms KMSClient, store *secrets.Store, nonces *nonceCache, reserved []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, errNoSecretName, http.StatusBadRequest)
+			return
+		}
+		for _, res := range reserved {
+			if name == res {
+				http.Error(w, errReservedSecret, http.StatusForbidden)
+				return
+			}
+		}
+		var nonce string
+		var rawNonce []byte
+		if nonces != nil {
+			nonce = r.URL.Query().Get("nonce")
+			if valid, _ := regexp.MatchString("^"+nonceRegExp+"$", nonce); !valid {
+				http.Error(w, errBadNonceFormat, http.StatusBadRequest)
+				return
+			}
+			if nonce != tokenNonce(r.Context()) {
+				log.Printf("Decrypt: Rejecting nonce from %s that doesn't match its attestation token.", clientIP(r))
+				http.Error(w, errUnboundNonce, http.StatusUnauthorized)
+				return
+			}
+			rawNonce, _ = hex.DecodeString(nonce)
+		}
+		ciphertext, err := io.ReadAll(newLimitReader(r.Body, maxCiphertextLen))
+		if err != nil {
+			http.Error(w, errBadCiphertext, http.StatusBadRequest)
+			return
+		}
+
+		if nonces != nil && !reserveNonce(w, r, nonces, nonce, "Decrypt") {
+			return
+		}
+		// Only nonces of requests whose secret we store are used up.
+		stored := false
+		defer func() {
+			if !stored {
+				nonces.release(nonce)
+			}
+		}()
+
+		handle, err := getKMSRecipient()
+		if err != nil {
+			log.Printf("Decrypt: Failed to initialize enclave handle: %v", err)
+			http.Error(w, errFailedDecrypt, http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), kmsTimeout)
+		defer cancel()
+		plaintext, err := kmsDecrypt(ctx, kms, handle, ciphertext, rawNonce)
+		if err != nil {
+			log.Printf("Decrypt: %v", err)
+			http.Error(w, errFailedDecrypt, http.StatusInternalServerError)
+			return
+		}
+		store.Put(name, plaintext)
+		zero(plaintext)
+		stored = true
+
+		log.Printf("Decrypt: Stored secret %q.", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
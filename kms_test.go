@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	enclave "github.com/edgebitio/nitro-enclaves-sdk-go"
+
+	"network-test/pkg/secrets"
+)
+
+// envelopePrefix is what fakeKMS prepends to "encrypted" plaintexts, and what
+// fakeRecipient strips again.
+var envelopePrefix = []byte("enveloped:")
+
+// fakeKMS implements KMSClient.  It "decrypts" ciphertexts by returning
+// them enveloped, and records the attestation documents that it's given.
+type fakeKMS struct {
+	sync.Mutex
+	errs []error
+	docs [][]byte
+}
+
+func (k *fakeKMS) Decrypt(_ context.Context, ciphertext, attestationDoc []byte) ([]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+	k.docs = append(k.docs, attestationDoc)
+	if len(k.errs) > 0 {
+		err := k.errs[0]
+		k.errs = k.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(append([]byte(nil), envelopePrefix...), ciphertext...), nil
+}
+
+func (k *fakeKMS) numCalls() int {
+	k.Lock()
+	defer k.Unlock()
+	return len(k.docs)
+}
+
+// fakeRecipient implements kmsRecipient.  Its attestation documents consist
+// of the user data that they were requested with.
+type fakeRecipient struct{}
+
+func (fakeRecipient) Attest(opts enclave.AttestationOptions) ([]byte, error) {
+	return append([]byte("doc:"), opts.UserData...), nil
+}
+
+func (fakeRecipient) DecryptKMSEnvelopedKey(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, envelopePrefix) {
+		return nil, errors.New("not enveloped")
+	}
+	return append([]byte(nil), content[len(envelopePrefix):]...), nil
+}
+
+// useFakeRecipient makes the KMS handlers use fakeRecipient for the duration
+// of the test.
+func useFakeRecipient(t *testing.T) {
+	t.Helper()
+	orig := getKMSRecipient
+	getKMSRecipient = func() (kmsRecipient, error) { return fakeRecipient{}, nil }
+	t.Cleanup(func() { getKMSRecipient = orig })
+}
+
+// postDecrypt posts the given body to the given handler and returns the
+// response.
+func postDecrypt(t *testing.T, h http.Handler, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestDecryptHandlerStoresSecret(t *testing.T) {
+	useFakeRecipient(t)
+	store := secrets.New()
+	h := decryptHandler(&fakeKMS{}, store, nil, nil)
+
+	rec := postDecrypt(t, h, pathDecrypt+"?name=db", "hunter2")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusNoContent, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatal("Expected plaintext to not be returned to the requester.")
+	}
+	got, exists := store.Get("db")
+	if !exists || string(got) != "hunter2" {
+		t.Fatalf("Expected stored secret %q but got %q.", "hunter2", got)
+	}
+}
+
+func TestDecryptHandlerErrors(t *testing.T) {
+	useFakeRecipient(t)
+	tooLong := strings.Repeat("a", maxCiphertextLen+1)
+	cases := []struct {
+		name   string
+		target string
+		body   string
+		kmsErr error
+		code   int
+	}{
+		{"no name", pathDecrypt, "hunter2", nil, http.StatusBadRequest},
+		{"too long", pathDecrypt + "?name=db", tooLong, nil, http.StatusBadRequest},
+		{"kms failure", pathDecrypt + "?name=db", "hunter2", errors.New("denied"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := secrets.New()
+			h := decryptHandler(&fakeKMS{errs: []error{c.kmsErr}}, store, nil, nil)
+			if rec := postDecrypt(t, h, c.target, c.body); rec.Code != c.code {
+				t.Fatalf("Expected status code %d but got %d.", c.code, rec.Code)
+			}
+			if _, exists := store.Get("db"); exists {
+				t.Fatal("Expected no secret to be stored.")
+			}
+		})
+	}
+}
+
+// freshRecipient is a fakeRecipient whose attestation documents differ on
+// every call, like the NSM's.
+type freshRecipient struct {
+	fakeRecipient
+	calls int
+}
+
+func (r *freshRecipient) Attest(opts enclave.AttestationOptions) ([]byte, error) {
+	r.calls++
+	return []byte(fmt.Sprintf("doc %d", r.calls)), nil
+}
+
+func TestKMSDecryptRetriesExpiredDocument(t *testing.T) {
+	kms := &fakeKMS{errs: []error{ErrKMSAttestationExpired}}
+	plaintext, err := kmsDecrypt(context.Background(), kms, &freshRecipient{}, []byte("hunter2"), nil)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if string(plaintext) != "hunter2" {
+		t.Fatalf("Expected %q but got %q.", "hunter2", plaintext)
+	}
+	if n := kms.numCalls(); n != 2 {
+		t.Fatalf("Expected 2 KMS calls but got %d.", n)
+	}
+	if bytes.Equal(kms.docs[0], kms.docs[1]) {
+		t.Error("Expected retry to use a fresh attestation document.")
+	}
+}
+
+func TestKMSDecryptRetryLimit(t *testing.T) {
+	errDenied := errors.New("access denied")
+	cases := []struct {
+		name  string
+		errs  []error
+		err   error
+		calls int
+	}{
+		{"persistent expiry", []error{ErrKMSAttestationExpired, ErrKMSAttestationExpired, nil}, ErrKMSAttestationExpired, maxKMSAttempts},
+		{"other error", []error{errDenied, nil}, errDenied, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			kms := &fakeKMS{errs: c.errs}
+			_, err := kmsDecrypt(context.Background(), kms, &freshRecipient{}, []byte("hunter2"), nil)
+			if !errors.Is(err, c.err) {
+				t.Errorf("Expected error %v but got %v.", c.err, err)
+			}
+			if n := kms.numCalls(); n != c.calls {
+				t.Errorf("Expected %d KMS calls but got %d.", c.calls, n)
+			}
+		})
+	}
+}
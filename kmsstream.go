@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// streamChunkLen is the maximum plaintext length of a single chunk of a
+	// streamed payload.
+	streamChunkLen = 64 * 1024
+	// maxStreamLen caps the total plaintext length of a streamed payload.
+	maxStreamLen = 64 * 1024 * 1024
+	// maxStreamBodyLen caps the request body of a streamed payload, which
+	// includes per-chunk overhead on top of the plaintext.
+	maxStreamBodyLen = maxStreamLen + maxStreamLen/streamChunkLen*32 + maxCiphertextLen + 64
+	// streamKeyLen is the length of the AES-256 data key.
+	streamKeyLen = 32
+	// decryptStatusTrailer tells clients if the entire stream was decrypted.
+	// Chunks are written as they're decrypted, so a failure late in the
+	// stream can't change the response's status code anymore.
+	decryptStatusTrailer = "X-Decrypt-Status"
+	errStreamNeedsHTTP2  = "streamed decryption requires HTTP/2 (h2c)"
+)
+
+var (
+	errStreamTruncated = errors.New("stream ended before its final chunk")
+	errStreamTooLarge  = fmt.Errorf("stream exceeds %d bytes", maxStreamLen)
+	errBadChunk        = errors.New("malformed stream chunk")
+	errBadDataKey      = errors.New("data key has unexpected length")
+)
+
+// decryptStream decrypts the payload that's read from src and writes the
+// plaintext to dst, one chunk at a time, so large payloads are never held in
+// memory in their entirety.  The payload is envelope-encrypted with an
+// AES-256-GCM data key, which is itself encrypted by KMS.  Its format is:
+//
+//	uint16 length | KMS-encrypted data key
+//	uint32 length | sealed chunk 0
+//	uint32 length | sealed chunk 1
+//	...
+//
+// All integers are big-endian.  Each chunk holds up to streamChunkLen bytes of
+// plaintext.  Chunk i is sealed with a nonce that consists of the 8-byte
+// big-endian i, followed by the 4-byte big-endian value 1 for the final
+// chunk and 0 for all others.  Chunks therefore can't be reordered, and a
+// truncated stream is detected.  Plaintext buffers are zeroed once they're
+// written.
+func decryptStream(dst io.Writer, src io.Reader, openKey func([]byte) ([]byte, error)) error {
+	var keyLen uint16
+	if err := binary.Read(src, binary.BigEndian, &keyLen); err != nil {
+		return fmt.Errorf("failed to read data key length: %w", err)
+	}
+	if int(keyLen) > maxCiphertextLen {
+		return fmt.Errorf("%w: data key too large", errBadChunk)
+	}
+	encKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(src, encKey); err != nil {
+		return fmt.Errorf("failed to read data key: %w", err)
+	}
+	key, err := openKey(encKey)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+	if len(key) != streamKeyLen {
+		return errBadDataKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, streamChunkLen+aead.Overhead())
+	plain := make([]byte, 0, streamChunkLen)
+	defer zero(plain[:cap(plain)])
+	nonce := make([]byte, aead.NonceSize())
+	var total int64
+	for i := uint64(0); ; i++ {
+		var sealedLen uint32
+		if err := binary.Read(src, binary.BigEndian, &sealedLen); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errStreamTruncated
+			}
+			return fmt.Errorf("failed to read chunk length: %w", err)
+		}
+		if sealedLen < uint32(aead.Overhead()) || sealedLen > uint32(len(sealed)) {
+			return fmt.Errorf("%w: chunk %d has length %d", errBadChunk, i, sealedLen)
+		}
+		if _, err := io.ReadFull(src, sealed[:sealedLen]); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %w", i, err)
+		}
+
+		// We don't know if this is the final chunk until we try to open it.
+		binary.BigEndian.PutUint64(nonce, i)
+		binary.BigEndian.PutUint32(nonce[8:], 0)
+		final := false
+		out, err := aead.Open(plain[:0], nonce, sealed[:sealedLen], nil)
+		if err != nil {
+			binary.BigEndian.PutUint32(nonce[8:], 1)
+			if out, err = aead.Open(plain[:0], nonce, sealed[:sealedLen], nil); err != nil {
+				return fmt.Errorf("%w: chunk %d failed authentication", errBadChunk, i)
+			}
+			final = true
+		}
+
+		if total += int64(len(out)); total > maxStreamLen {
+			zero(out)
+			return errStreamTooLarge
+		}
+		_, err = dst.Write(out)
+		zero(out)
+		if err != nil {
+			return fmt.Errorf("failed to write chunk %d: %w", i, err)
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// decryptStreamHandler returns a HandlerFunc that decrypts the streamed
+// payload in the request body (see decryptStream) and streams the plaintext
+// back.  It's meant for the enclave-internal Web server, so the plaintext
+// never leaves the enclave.  Clients must check the X-Decrypt-Status trailer:
+// only "ok" means that the entire payload was decrypted.
+//
+// We write plaintext while we're still reading ciphertext.  HTTP/1.x servers
+// stop reading the request body once the response is written to, so clients
+// must use HTTP/2, which the enclave-internal Web server offers via h2c.
+func decryptStreamHandler(kms KMSClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 2 {
+			http.Error(w, errStreamNeedsHTTP2, http.StatusHTTPVersionNotSupported)
+			return
+		}
+		handle, err := getKMSRecipient()
+		if err != nil {
+			log.Printf("Decrypt stream: Failed to initialize enclave handle: %v", err)
+			http.Error(w, errFailedDecrypt, http.StatusInternalServerError)
+			return
+		}
+		openKey := func(encKey []byte) ([]byte, error) {
+			ctx, cancel := context.WithTimeout(r.Context(), kmsTimeout)
+			defer cancel()
+			return kmsDecrypt(ctx, kms, handle, encKey, nil)
+		}
+
+		w.Header().Set("Trailer", decryptStatusTrailer)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		cw := &countingWriter{w: w}
+		if err := decryptStream(cw, newLimitReader(r.Body, maxStreamBodyLen), openKey); err != nil {
+			log.Printf("Decrypt stream: %v", err)
+			if cw.n == 0 {
+				w.Header().Del("Trailer")
+				http.Error(w, errFailedDecrypt, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set(decryptStatusTrailer, "failed")
+			return
+		}
+		w.Header().Set(decryptStatusTrailer, "ok")
+	}
+}
+
+// countingWriter counts the bytes that are written to the underlying writer.
+// If the underlying writer is an http.Flusher, each write is flushed, so
+// clients receive every chunk as soon as it's decrypted.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if f, ok := c.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// testStreamKey is the data key of our test streams.  Our fake KMS returns
+// ciphertext as plaintext, so the encrypted data key is the data key itself.
+var testStreamKey = bytes.Repeat([]byte{0x07}, streamKeyLen)
+
+// openTestKey implements decryptStream's openKey for testStreamKey.
+func openTestKey(encKey []byte) ([]byte, error) {
+	return append([]byte(nil), encKey...), nil
+}
+
+// sealChunk seals the given plaintext as chunk i of a stream.
+func sealChunk(t testing.TB, aead cipher.AEAD, i uint64, final bool, plain []byte) []byte {
+	t.Helper()
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, i)
+	if final {
+		binary.BigEndian.PutUint32(nonce[8:], 1)
+	}
+	sealed := aead.Seal(nil, nonce, plain, nil)
+	chunk := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(chunk, uint32(len(sealed)))
+	return append(chunk, sealed...)
+}
+
+// sealStream returns the data key header and the sealed chunks of the given
+// plaintext, in the format that decryptStream expects.
+func sealStream(t testing.TB, plain []byte) (header []byte, chunks [][]byte) {
+	t.Helper()
+	block, err := aes.NewCipher(testStreamKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header = keyHeader(testStreamKey)
+	for i := uint64(0); ; i++ {
+		n := len(plain)
+		if n > streamChunkLen {
+			n = streamChunkLen
+		}
+		final := n == len(plain)
+		chunks = append(chunks, sealChunk(t, aead, i, final, plain[:n]))
+		plain = plain[n:]
+		if final {
+			return header, chunks
+		}
+	}
+}
+
+// keyHeader returns the data key header for the given encrypted data key.
+func keyHeader(encKey []byte) []byte {
+	header := make([]byte, 2, 2+len(encKey))
+	binary.BigEndian.PutUint16(header, uint16(len(encKey)))
+	return append(header, encKey...)
+}
+
+func joinStream(header []byte, chunks [][]byte) []byte {
+	return append(append([]byte(nil), header...), bytes.Join(chunks, nil)...)
+}
+
+// testPayload returns n bytes of deterministic plaintext.
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestDecryptStream(t *testing.T) {
+	for _, n := range []int{0, 1, streamChunkLen, 3*streamChunkLen + 123} {
+		plain := testPayload(n)
+		var out bytes.Buffer
+		if err := decryptStream(&out, bytes.NewReader(joinStream(sealStream(t, plain))), openTestKey); err != nil {
+			t.Fatalf("Expected no error for %d bytes but got %v.", n, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("Expected %d bytes of plaintext but got %d different ones.", n, out.Len())
+		}
+	}
+}
+
+func TestDecryptStreamRejects(t *testing.T) {
+	header, chunks := sealStream(t, testPayload(3*streamChunkLen+1))
+	tampered := append([]byte(nil), chunks[1]...)
+	tampered[len(tampered)-1] ^= 1
+	badKey := keyHeader(make([]byte, 16))
+
+	cases := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"truncated", joinStream(header, chunks[:2]), errStreamTruncated},
+		{"reordered", joinStream(header, [][]byte{chunks[1], chunks[0], chunks[2], chunks[3]}), errBadChunk},
+		{"tampered", joinStream(header, [][]byte{chunks[0], tampered, chunks[2], chunks[3]}), errBadChunk},
+		{"oversized chunk", joinStream(header, [][]byte{{0xff, 0xff, 0xff, 0xff}}), errBadChunk},
+		{"bad data key", joinStream(badKey, chunks), errBadDataKey},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := decryptStream(io.Discard, bytes.NewReader(c.stream), openTestKey)
+			if !errors.Is(err, c.err) {
+				t.Errorf("Expected error %v but got %v.", c.err, err)
+			}
+		})
+	}
+}
+
+func TestDecryptStreamBoundedMemory(t *testing.T) {
+	const payloadLen = 16 << 20
+	stream := joinStream(sealStream(t, testPayload(payloadLen)))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := decryptStream(io.Discard, bytes.NewReader(stream), openTestKey); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// We hold one sealed and one plaintext chunk at a time.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Expected to allocate at most 1 MiB for %d bytes but allocated %d.", payloadLen, alloc)
+	}
+}
+
+// newH2CClient returns a client that speaks cleartext HTTP/2.
+func newH2CClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+}
+
+func TestDecryptStreamHandler(t *testing.T) {
+	useFakeRecipient(t)
+	srv := httptest.NewUnstartedServer(decryptStreamHandler(&fakeKMS{}))
+	if err := configureHTTP2(srv.Config); err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	defer srv.Close()
+
+	plain := testPayload(3*streamChunkLen + 123)
+	header, chunks := sealStream(t, plain)
+	pr, pw := io.Pipe()
+	sentFirst := make(chan struct{})
+	go func() {
+		// Hold back the rest of the body until the first chunk's
+		// plaintext arrived.
+		_, _ = pw.Write(joinStream(header, chunks[:1]))
+		<-sentFirst
+		_, _ = pw.Write(bytes.Join(chunks[1:], nil))
+		pw.Close()
+	}()
+
+	resp, err := newH2CClient().Post(srv.URL, "application/octet-stream", pr)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, resp.StatusCode)
+	}
+
+	// The first chunk's plaintext must arrive while we're still holding
+	// back the rest of the request body.
+	first := make([]byte, streamChunkLen)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatalf("Expected first chunk but got %v.", err)
+	}
+	close(sentFirst)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if got := append(first, rest...); !bytes.Equal(got, plain) {
+		t.Errorf("Expected %d bytes of plaintext but got %d different ones.", len(plain), len(got))
+	}
+	if got := resp.Trailer.Get(decryptStatusTrailer); got != "ok" {
+		t.Errorf("Expected trailer %q but got %q.", "ok", got)
+	}
+}
+
+func TestDecryptStreamHandlerRequiresHTTP2(t *testing.T) {
+	useFakeRecipient(t)
+	rec := postDecrypt(t, decryptStreamHandler(&fakeKMS{}), pathDecryptStream, "")
+	if rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("Expected status code %d but got %d.", http.StatusHTTPVersionNotSupported, rec.Code)
+	}
+}
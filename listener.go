@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// limitListener wraps a net.Listener and caps the number of concurrent
+// connections.  Connections beyond the limit are accepted and immediately
+// closed, which protects the memory-constrained enclave from connection
+// floods.
+type limitListener struct {
+	net.Listener
+	max    int64
+	active int64
+	// metricActive and metricRejected count active and rejected
+	// connections, so each server has its own metrics.
+	metricActive   *expvar.Int
+	metricRejected *expvar.Int
+}
+
+// newLimitListener returns a listener that accepts at most max concurrent
+// connections from the given listener, and accounts for them in the given
+// metrics.
+func newLimitListener(l net.Listener, max int, active, rejected *expvar.Int) *limitListener {
+	return &limitListener{
+		Listener:       l,
+		max:            int64(max),
+		metricActive:   active,
+		metricRejected: rejected,
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(&l.active, 1) > l.max {
+			atomic.AddInt64(&l.active, -1)
+			l.metricRejected.Add(1)
+			c.Close()
+			continue
+		}
+		l.metricActive.Add(1)
+		return &limitConn{Conn: c, release: l.release}, nil
+	}
+}
+
+func (l *limitListener) release() {
+	atomic.AddInt64(&l.active, -1)
+	l.metricActive.Add(-1)
+}
+
+// limitConn is a connection handed out by limitListener.  Closing it frees up
+// its slot in the listener.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	const max = 2
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	active, rejected := new(expvar.Int), new(expvar.Int)
+	ll := newLimitListener(l, max, active, rejected)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		return c
+	}
+	// isClosed returns true if the server closed the given client
+	// connection.
+	isClosed := func(c net.Conn) bool {
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		return errors.Is(err, io.EOF)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		defer dial().Close()
+		conns = append(conns, <-accepted)
+	}
+	if active.Value() != max {
+		t.Errorf("Expected %d active connections but got %d.", max, active.Value())
+	}
+
+	// Connection N+1 must be rejected.
+	c := dial()
+	defer c.Close()
+	if !isClosed(c) {
+		t.Error("Expected connection beyond the limit to be closed.")
+	}
+	if rejected.Value() != 1 {
+		t.Errorf("Expected 1 rejected connection but got %d.", rejected.Value())
+	}
+
+	// Once a connection is closed, there's room for a new one.
+	conns[0].Close()
+	conns[0].Close() // Closing twice must not free up two slots.
+	if active.Value() != max-1 {
+		t.Errorf("Expected %d active connections but got %d.", max-1, active.Value())
+	}
+	defer dial().Close()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Expected connection to be accepted after a slot was freed.")
+	}
+	c = dial()
+	defer c.Close()
+	if !isClosed(c) {
+		t.Error("Expected connection beyond the limit to be closed.")
+	}
+}
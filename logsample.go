@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLogEvery is the sampling rate of high-frequency log statements
+	// if the config doesn't specify one.
+	defaultLogEvery = 1000
+	// defaultLogPerSecond caps the number of sampled log statements per
+	// second if the config doesn't specify a cap.
+	defaultLogPerSecond = 10
+)
+
+// LogSamplingConfig configures the sampling of high-frequency log statements
+// in the networking layer, e.g., one statement per forwarded frame.  Errors
+// are never sampled.
+type LogSamplingConfig struct {
+	// Every determines that only every Every-th statement is logged.  The
+	// first statement is always logged.  If Every is 0, defaultLogEvery is
+	// used.  If Every is negative, every statement passes this check.
+	Every int
+	// PerSecond caps the number of statements that are logged per second.
+	// If PerSecond is 0, defaultLogPerSecond is used.  If PerSecond is
+	// negative, there's no cap.
+	PerSecond int
+}
+
+// logSampler decides which high-frequency log statements are emitted.  A nil
+// *logSampler emits all statements.
+type logSampler struct {
+	sync.Mutex
+	every     uint64
+	perSecond int
+	seen      uint64
+	window    time.Time
+	inWindow  int
+	now       func() time.Time
+}
+
+func newLogSampler(cfg LogSamplingConfig) *logSampler {
+	s := &logSampler{
+		every:     1,
+		perSecond: cfg.PerSecond,
+		now:       time.Now,
+	}
+	switch {
+	case cfg.Every == 0:
+		s.every = defaultLogEvery
+	case cfg.Every > 0:
+		s.every = uint64(cfg.Every)
+	}
+	if s.perSecond == 0 {
+		s.perSecond = defaultLogPerSecond
+	}
+	return s
+}
+
+// allow returns true if the current log statement should be emitted.
+func (s *logSampler) allow() bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	s.seen++
+	if (s.seen-1)%s.every != 0 {
+		return false
+	}
+	if s.perSecond < 0 {
+		return true
+	}
+	if now := s.now(); now.Sub(s.window) >= time.Second {
+		s.window = now
+		s.inWindow = 0
+	}
+	if s.inWindow >= s.perSecond {
+		return false
+	}
+	s.inWindow++
+	return true
+}
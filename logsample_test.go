@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// newTestLogSampler returns a sampler for the given config whose clock is
+// controlled by the returned testClock.
+func newTestLogSampler(cfg LogSamplingConfig) (*logSampler, *testClock) {
+	clock := &testClock{t: testEpoch}
+	s := newLogSampler(cfg)
+	s.now = clock.now
+	return s, clock
+}
+
+// allowed returns the indices of the statements among the next n that the
+// given sampler allows.
+func allowed(s *logSampler, n int) []int {
+	var idx []int
+	for i := 0; i < n; i++ {
+		if s.allow() {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+func TestLogSamplerEvery(t *testing.T) {
+	s, _ := newTestLogSampler(LogSamplingConfig{Every: 10, PerSecond: -1})
+	got := allowed(s, 35)
+	want := []int{0, 10, 20, 30}
+	if !equalInts(got, want) {
+		t.Fatalf("Expected statements %v to be allowed but got %v.", want, got)
+	}
+}
+
+func TestLogSamplerPerSecond(t *testing.T) {
+	s, clock := newTestLogSampler(LogSamplingConfig{Every: -1, PerSecond: 3})
+	if got := allowed(s, 100); !equalInts(got, []int{0, 1, 2}) {
+		t.Fatalf("Expected the first 3 statements to be allowed but got %v.", got)
+	}
+	clock.advance(500 * time.Millisecond)
+	if got := allowed(s, 100); len(got) != 0 {
+		t.Fatalf("Expected no statements to be allowed within the same second but got %v.", got)
+	}
+	clock.advance(500 * time.Millisecond)
+	if got := allowed(s, 100); !equalInts(got, []int{0, 1, 2}) {
+		t.Fatalf("Expected 3 statements to be allowed in the next second but got %v.", got)
+	}
+}
+
+func TestLogSamplerDefaults(t *testing.T) {
+	s, _ := newTestLogSampler(LogSamplingConfig{})
+	got := allowed(s, 100*defaultLogEvery)
+	if len(got) != defaultLogPerSecond || got[0] != 0 || got[1] != defaultLogEvery {
+		t.Fatalf("Expected every %d-th statement up to %d per second but got %v.",
+			defaultLogEvery, defaultLogPerSecond, got)
+	}
+
+	var nilSampler *logSampler
+	if got := allowed(nilSampler, 10); len(got) != 10 {
+		t.Fatalf("Expected nil sampler to allow all statements but got %v.", got)
+	}
+}
+
+func TestLogSamplerInRx(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	var frames [][]byte
+	for i := 0; i < 10; i++ {
+		frames = append(frames, bytes.Repeat([]byte{byte(i)}, 60))
+	}
+	s, _ := newTestLogSampler(LogSamplingConfig{Every: 4, PerSecond: -1})
+	errCh := make(chan error, 1)
+	var wire bytes.Buffer
+	rx(&wire, newFakeTap(frames...), errCh, 1500, prefixLen16, nil, s, nil)
+	<-errCh
+
+	var forwarded int
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Forwarded ") {
+			forwarded++
+		}
+	}
+	// Frames 0, 4, and 8 are logged.
+	if forwarded != 3 {
+		t.Fatalf("Expected 3 sampled log statements but got %d.", forwarded)
+	}
+	// All frames were forwarded regardless.
+	if want := len(frames) * (prefixLen16 + 60); wire.Len() != want {
+		t.Fatalf("Expected %d bytes on the wire but got %d.", want, wire.Len())
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
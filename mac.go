@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// parseMAC parses the given MAC address and makes sure that it's usable for
+// our TAP interface, i.e., a 48-bit unicast address other than all zeros.
+// Unlike net.ParseMAC, it rejects EUI-64 and InfiniBand addresses, which
+// the kernel wouldn't accept for an Ethernet device.
+func parseMAC(s string) (net.HardwareAddr, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed MAC address %q: %w", s, err)
+	}
+	if err := validMAC(hw); err != nil {
+		return nil, fmt.Errorf("unusable MAC address %q: %w", s, err)
+	}
+	return hw, nil
+}
+
+// validMAC returns an error if the given address isn't a 48-bit unicast
+// address other than all zeros.
+func validMAC(hw net.HardwareAddr) error {
+	if len(hw) != 6 {
+		return fmt.Errorf("must be 6 bytes long, not %d", len(hw))
+	}
+	if hw[0]&1 == 1 {
+		return fmt.Errorf("must be a unicast address")
+	}
+	if bytes.Equal(hw, make(net.HardwareAddr, 6)) {
+		return fmt.Errorf("must not be all zeros")
+	}
+	return nil
+}
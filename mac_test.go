@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMAC(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"02:00:00:00:00:01", "02:00:00:00:00:01", ""},
+		{"02-00-00-00-00-01", "02:00:00:00:00:01", ""},
+		{"0200.0000.0001", "02:00:00:00:00:01", ""},
+		{"BA:AA:AD:C0:FF:EE", "ba:aa:ad:c0:ff:ee", ""},
+		{"", "", "malformed"},
+		{"02:00:00:00:00", "", "malformed"},
+		{"02:00:00:00:00:zz", "", "malformed"},
+		{"01:00:5e:00:00:01", "", "unicast"},
+		{"00:00:00:00:00:00", "", "all zeros"},
+		{"02:00:00:00:00:00:00:01", "", "6 bytes"},
+	} {
+		hw, err := parseMAC(c.in)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("Expected error containing %q for %q but got %v.", c.wantErr, c.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to be valid but got %v.", c.in, err)
+			continue
+		}
+		if hw.String() != c.want {
+			t.Errorf("Expected %q to be normalized to %s but got %s.", c.in, c.want, hw)
+		}
+	}
+}
+
+func TestConfigMAC(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		mac     string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", defaultMAC, false},
+		{"valid", "02-00-00-00-00-01", "02:00:00:00:00:01", false},
+		{"malformed", "not a MAC", "", true},
+		{"multicast", "01:00:5e:00:00:01", "", true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.MAC = c.mac
+			err := cfg.Validate()
+			if c.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "MAC address") {
+					t.Fatalf("Expected MAC address error but got %v.", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected valid config but got %v.", err)
+			}
+			// The parsed address is what the TAP interface gets.
+			if got := newNetConfig(cfg).MAC.String(); got != c.want {
+				t.Fatalf("Expected MAC %s but got %s.", c.want, got)
+			}
+		})
+	}
+}
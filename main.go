@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/brave/nitriding"
@@ -16,6 +25,10 @@ import (
 	"github.com/hf/nitrite"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"network-test/pkg/secrets"
 )
 
 const (
@@ -28,6 +41,25 @@ const (
 	pathHelloWorld  = "/hello-world"
 	pathAttestation = "/enclave/attestation"
 	autoAttestation = "/enclave/test-attestation"
+	pathHealthNSM   = "/healthz/attestation"
+	pathHealthDNS   = "/healthz/dns"
+	pathReady       = "/ready"
+	pathDecrypt     = "/enclave/decrypt"
+	// The following paths are handled by our enclave-internal Web server.
+	pathMetrics       = "/enclave/metrics"
+	pathVerify        = "/verify"
+	pathRuntime       = "/enclave/runtime"
+	pathEgress        = "/enclave/egress-stats"
+	pathMeasure       = "/enclave/measurements"
+	pathGoroutines    = "/enclave/goroutines"
+	pathTopology      = "/enclave/topology"
+	pathConfig        = "/enclave/config"
+	pathDecryptStream = "/enclave/decrypt-stream"
+	pathOpenPayload   = "/enclave/open"
+	// The following paths are reserved for operators.
+	pathAdminLogLevel  = "/enclave/admin/loglevel"
+	pathAdminRotateKey = "/enclave/admin/rotate-key"
+	pathAdminStop      = "/enclave/admin/stop"
 
 	pathProxy = "/*"
 )
@@ -63,13 +95,16 @@ func connectDB() (*sql.DB, error) {
 */
 
 func main() {
-	c := &nitriding.Config{
-		FQDN:          "localhost",
-		ExtPort:       uint16(8443),
-		IntPort:       uint16(8444),
-		HostProxyPort: uint32(1024),
-		UseACME:       false,
-		AppWebSrv:     nil,
+	c := defaultConfig()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(c, os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: selftest <enclave URL>")
+			os.Exit(2)
+		}
+		os.Exit(runSelfTest(os.Args[2], os.Stdout))
 	}
 
 	enclave, err := NewEnclave(c)
@@ -98,8 +133,33 @@ func main() {
 		log.Printf("Found in DB: %d", count)
 
 	*/
-	// Block on this read forever.
-	<-make(chan struct{})
+	// Block until we're asked to terminate, or until the enclave stops on
+	// its own, e.g., because networking failed for good.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigs:
+		enclave.DrainAndStop(c.DrainPeriod, StopSignal)
+	case <-enclave.Done():
+	}
+}
+
+// defaultConfig returns the config that this binary runs with.
+func defaultConfig() *Config {
+	return &Config{
+		Config: nitriding.Config{
+			FQDN:          "localhost",
+			ExtPort:       uint16(8443),
+			IntPort:       uint16(8444),
+			HostProxyPort: uint32(1024),
+			UseACME:       false,
+			AppWebSrv:     nil,
+		},
+		UseHTTP2:       true,
+		MaxPublicConns: 512,
+		// This binary is a network test, so we expose the demo routes.
+		DemoRoutes: true,
+	}
 }
 
 // proxyHandler returns an HTTP handler that proxies HTTP requests to the
@@ -111,99 +171,478 @@ func proxyHandler(e *Enclave) http.HandlerFunc {
 }
 
 // NewEnclave creates and returns a new enclave with the given config.
-func NewEnclave(cfg *nitriding.Config) (*Enclave, error) {
+func NewEnclave(cfg *Config) (*Enclave, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to create enclave: %w", err)
 	}
+	netCfg := newNetConfig(cfg)
+	if err := netCfg.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to create enclave: %w", err)
+	}
+	if cfg.AttestationRootFile != "" {
+		if err := loadRootFile(cfg.AttestationRootFile); err != nil {
+			return nil, fmt.Errorf("failed to create enclave: %w", err)
+		}
+	}
 
 	e := &Enclave{
-		cfg: cfg,
+		cfg:    cfg,
+		netCfg: netCfg,
 		pubSrv: http.Server{
 			Addr:    fmt.Sprintf(":%d", cfg.ExtPort),
 			Handler: chi.NewRouter(),
 		},
-		hashes: new(AttestationHashes),
-		stop:   make(chan bool),
-		ready:  make(chan bool),
+		certs: new(certHolder),
+		intSrv: http.Server{
+			Addr:    net.JoinHostPort(cfg.intHost(), strconv.Itoa(int(cfg.IntPort))),
+			Handler: chi.NewRouter(),
+		},
+		hashes:   new(AttestationHashes),
+		attester: newTimeoutAttester(newAttester(), cfg.AttestationTimeout),
+		egress:   newEgressStats(),
+		secrets:  secrets.New(),
+		tokens:   newTokenStore(cfg.AttestationTokenTTL),
+		limiter:  newRateLimiter(cfg.RateLimit),
+		nonces:   newNonceCache(cfg.NonceReplayWindow),
+		measure:  new(measurements),
+		dns:      newEnclaveDNSProbe(cfg.DNSCanary),
+		audit:    newAuditLog(cfg.AuditLog),
+		boot:     new(bootAttestation),
+		stop:     make(chan StopReason, 1),
+		stopped:  make(chan struct{}),
+		ready:    make(chan struct{}),
 	}
+	e.pubSrv.TLSConfig = &tls.Config{GetCertificate: e.certs.getCertificate}
+	e.intSrv.ReadTimeout, e.intSrv.WriteTimeout = cfg.Internal.timeouts()
+	var err error
+	if e.meta, err = newMetadataSigner(cfg.AttestationMetadata, cfg.KeyRotationOverlap); err != nil {
+		return nil, fmt.Errorf("failed to create enclave: %w", err)
+	}
+	e.client = newOutboundClient(cfg.Outbound, e.egress)
 
+	tp, shutdownTracing, err := newTracerProvider(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create enclave: %w", err)
+	}
+	if tp != nil {
+		tracer := tp.Tracer(tracerName)
+		e.netCfg.Tracer = tracer
+		e.pubSrv.Handler.(*chi.Mux).Use(tracingMiddleware(tracer))
+		e.intSrv.Handler.(*chi.Mux).Use(tracingMiddleware(tracer))
+	}
+	if shutdownTracing != nil {
+		e.OnShutdown(shutdownTracing)
+	}
 	if cfg.Debug {
 		e.pubSrv.Handler.(*chi.Mux).Use(middleware.Logger)
 	}
+	if e.limiter != nil {
+		e.pubSrv.Handler.(*chi.Mux).Use(e.limiter.middleware)
+	}
+	if cfg.Compression.Enabled {
+		e.pubSrv.Handler.(*chi.Mux).Use(compressMiddleware(cfg.Compression))
+	}
 
 	// Register public HTTP API.
 	m := e.pubSrv.Handler.(*chi.Mux)
-	m.Get(pathHelloWorld, helloWorld(e))
-	m.Get(pathAttestation, attestationHandler(e.hashes))
-	m.Get(autoAttestation, AutoAttestationHandler())
+	m.Get(pathAttestation, attestationHandler(e.attester, e.hashes, e.tokens, e.meta, e.nonces, e.audit))
+	if cfg.SharedAttestationInterval > 0 {
+		shared := newSharedAttester(e.attester, e.hashes, e.audit, cfg.SharedAttestationInterval)
+		m.Get(pathSharedAttestation, sharedAttestationHandler(shared))
+	}
+	if cfg.demoRoutes() {
+		m.Get(pathHelloWorld, helloWorld(e))
+		m.Get(autoAttestation, AutoAttestationHandler())
+	}
+	m.Get(pathReady, readyHandler(e))
+	if !cfg.InternalVerify {
+		// Verification is CPU-heavy, so it's always rate-limited.  If the
+		// public API's rate limit is on, it already covers verification.
+		r := chi.Router(m)
+		if e.limiter == nil {
+			r = m.With(newRateLimiter(RateLimitConfig{Rate: defaultVerifyRateLimit}).middleware)
+		}
+		r.Post(pathVerify, verifyHandler(cfg.MaxDocumentValidity))
+	}
+	m.Get(pathBootAttestation, bootAttestationHandler(e.boot))
+	m.Get(pathHealthNSM, nsmHealthHandler(newNSMProbe(e.attester, nsmProbeTTL)))
+	if e.dns != nil {
+		m.Get(pathHealthDNS, dnsHealthHandler(e.dns))
+	}
+	if cfg.KMS != nil {
+		nonces := newNonceCache(cfg.DecryptNonceWindow)
+		// Nobody outside the enclave gets to replace our admin token.
+		var reserved []string
+		if cfg.AdminTokenSecret != "" {
+			reserved = []string{cfg.AdminTokenSecret}
+		}
+		m.With(e.tokens.middleware).Post(pathDecrypt, decryptHandler(cfg.KMS, e.secrets, nonces, reserved))
+	}
+
+	// Register enclave-internal HTTP API.
+	m = e.intSrv.Handler.(*chi.Mux)
+	if len(cfg.EgressAllowlist) > 0 {
+		// The forward proxy relays the enclave application's requests,
+		// which bring their own deadlines, so our per-host timeouts don't
+		// apply.
+		transport := withoutHostTimeouts(e.client.Transport)
+		p := newForwardProxy(cfg.EgressAllowlist, transport, newOutboundDialer(cfg.Outbound), e.egress)
+		m.Use(p.middleware)
+	}
+	m.Handle(pathMetrics, expvar.Handler())
+	m.Get(pathRuntime, runtimeHandler(cfg))
+	m.Get(pathEgress, egressStatsHandler(e.egress))
+	m.Get(pathMeasure, measurementsHandler(e.measure))
+	m.Get(pathGoroutines, goroutinesHandler(cfg.Debug))
+	m.Get(pathTopology, topologyHandler(e.netCfg))
+	m.Get(pathConfig, configHandler(cfg, e.netCfg))
+	if cfg.InternalVerify {
+		m.Post(pathVerify, verifyHandler(cfg.MaxDocumentValidity))
+	}
+	m.Post(pathOpenPayload, openPayloadHandler(e.meta))
+	m.Group(func(r chi.Router) {
+		r.Use(adminAuth(cfg.AdminToken, cfg.AdminTokenSecret, e.secrets))
+		r.Post(pathAdminLogLevel, logLevelHandler())
+		r.Post(pathAdminRotateKey, rotateKeyHandler(e))
+		r.Post(pathAdminStop, stopHandler(e))
+	})
+	if cfg.KMS != nil {
+		m.Post(pathDecrypt, decryptHandler(cfg.KMS, e.secrets, nil, nil))
+		m.Post(pathDecryptStream, decryptStreamHandler(cfg.KMS))
+	}
 
 	// Configure our reverse proxy if the enclave application exposes an HTTP
 	// server.
 	if cfg.AppWebSrv != nil {
-		e.revProxy = httputil.NewSingleHostReverseProxy(cfg.AppWebSrv)
-		e.pubSrv.Handler.(*chi.Mux).Handle(pathProxy, proxyHandler(e))
+		page, err := cfg.Maintenance.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create enclave: %w", err)
+		}
+		e.revProxy = newReverseProxy(cfg, page)
+		limiter := newProxyLimiter(cfg.MaxProxiedRequests, cfg.ProxyQueueTimeout)
+		e.pubSrv.Handler.(*chi.Mux).Handle(pathProxy, withRequestTimeout(limiter.limit(proxyHandler(e))))
 	}
 
 	return e, nil
 }
 
+// newReverseProxy returns the reverse proxy for AppWebSrv.  It adds our
+// entry to the Via header of requests and responses, so the enclave shows up
+// in chains of proxies.  The config's proxy hooks run after our own Director
+// and ModifyResponse.
+func newReverseProxy(cfg *Config, page *maintenancePage) *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(cfg.AppWebSrv)
+	if t := cfg.backendTransport(); t != nil {
+		p.Transport = t
+	}
+	director := p.Director
+	stripReq := orDefault(cfg.StripRequestHeaders, defaultStripRequestHeaders)
+	p.Director = func(r *http.Request) {
+		director(r)
+		stripHeaders(r.Header, stripReq)
+		appendVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+		if cfg.ProxyDirector != nil {
+			cfg.ProxyDirector(r)
+		}
+	}
+
+	var modifiers []func(*http.Response) error
+	if cfg.BackendSecret != "" {
+		modifiers = append(modifiers, verifyBackend(cfg.BackendSecret))
+	}
+	stripResp := orDefault(cfg.StripResponseHeaders, defaultStripResponseHeaders)
+	modifiers = append(modifiers, func(resp *http.Response) error {
+		stripHeaders(resp.Header, stripResp)
+		appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		return nil
+	})
+	if cfg.ProxyModifyResponse != nil {
+		modifiers = append(modifiers, cfg.ProxyModifyResponse)
+	}
+	p.ModifyResponse = func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p.ErrorHandler = proxyErrorHandler(page)
+	return p
+}
+
+// MountApp registers the given handler under the given prefix of our public
+// Web server, which lets simple enclave applications run in-process instead of
+// behind our reverse proxy.  MountApp must be called before Start, and it
+// does nothing if an external application Web server (AppWebSrv) is
+// configured because the reverse proxy already claims the proxy path.
+func (e *Enclave) MountApp(prefix string, h http.Handler) {
+	if e.cfg.AppWebSrv != nil {
+		log.Printf("Not mounting in-process app at %s because AppWebSrv is set.", prefix)
+		return
+	}
+	e.pubSrv.Handler.(*chi.Mux).Mount(prefix, h)
+}
+
+// Use adds the given middleware to our public Web server, e.g., for
+// authentication or logging.  Middleware runs in the order in which it was
+// added, before our built-in middleware and before routing, so it applies to
+// all public routes, including the reverse proxy and mounted apps.  Use must
+// be called before Start, and it panics otherwise.
+func (e *Enclave) Use(mw func(http.Handler) http.Handler) {
+	e.Lock()
+	defer e.Unlock()
+	if e.serving {
+		panic("enclave: middleware must be added before Start")
+	}
+	e.middleware = append(e.middleware, mw)
+}
+
+// publicHandler wraps our public router in the middleware that was added via
+// Use.  After publicHandler returns, no more middleware can be added.
+func (e *Enclave) publicHandler() http.Handler {
+	e.Lock()
+	defer e.Unlock()
+	e.serving = true
+
+	h := e.boot.middleware(e.pubSrv.Handler)
+	for i := len(e.middleware) - 1; i >= 0; i-- {
+		h = e.middleware[i](h)
+	}
+	return h
+}
+
 type Enclave struct {
 	sync.RWMutex
-	cfg         *nitriding.Config
-	pubSrv      http.Server
-	revProxy    *httputil.ReverseProxy
-	hashes      *AttestationHashes
-	keyMaterial any
-	ready, stop chan bool
+	cfg           *Config
+	netCfg        *NetConfig
+	pubSrv        http.Server
+	intSrv        http.Server
+	certs         *certHolder
+	revProxy      *httputil.ReverseProxy
+	hashes        *AttestationHashes
+	attester      Attester
+	client        *http.Client
+	egress        *egressStats
+	secrets       *secrets.Store
+	tokens        *tokenStore
+	limiter       *rateLimiter
+	nonces        *nonceCache
+	measure       *measurements
+	dns           *dnsProbe
+	meta          *metadataSigner
+	audit         *auditLog
+	boot          *bootAttestation
+	keyMaterial   any
+	middleware    []func(http.Handler) http.Handler
+	serving       bool
+	live          bool
+	draining      bool
+	shutdownHooks []func(context.Context) error
+	ready         chan struct{}
+	stop          chan StopReason
+	stopped       chan struct{}
+	stopOnce      sync.Once
+	stopErr       error
+	started       time.Time
 }
 
+// Start starts the enclave: it sets up networking and starts our servers.
+// Problems that don't prevent the enclave from running are logged as
+// warnings.  If Start fails, the returned error also contains all warnings
+// that came up until then, to speed up diagnosis.
 func (e *Enclave) Start() error {
+	if err := e.start(new(startupReport)); err != nil {
+		return fmt.Errorf("failed to start Nitro Enclave: %w", err)
+	}
+	return nil
+}
+
+func (e *Enclave) start(report *startupReport) error {
 	var err error
-	errPrefix := "failed to start Nitro Enclave"
 
+	e.started = time.Now()
+	if _, err = attestationRoots(); err != nil {
+		if !e.cfg.AllowInvalidRoot {
+			return report.finish(err)
+		}
+		report.warn(fmt.Errorf("failed to load attestation root; verification will fail: %w", err))
+	}
+	setGoMaxProcs(e.cfg.GoMaxProcs)
 	if err = setFdLimit(e.cfg.FdCur, e.cfg.FdMax); err != nil {
-		log.Printf("Failed to set new file descriptor limit: %s", err)
+		report.warn(fmt.Errorf("failed to set new file descriptor limit: %w", err))
 	}
 	if err = configureLoIface(); err != nil {
-		return fmt.Errorf("%s: %w", errPrefix, err)
+		return report.finish(err)
+	}
+	if e.cfg.GoroutineWarnThreshold > 0 {
+		go watchGoroutines(e.cfg.GoroutineWarnThreshold, goroutineCheckInterval, e.stopped)
+	}
+	if e.cfg.CloudWatch.Client != nil {
+		go newCloudWatchExporter(e.cfg.CloudWatch).run(e.stopped)
 	}
 
-	// Start enclave-internal HTTP server.
-	go runNetworking(e.cfg, e.stop)
-
-	// sleep until networking is setup, we can change this later for goroutines
-	time.Sleep(3 * time.Second)
+	// Set up networking in the background.  The networking goroutine closes
+	// e.ready once all TAP interfaces are up.
+	go e.runNetworking()
 
+	timeout := e.cfg.StartupTimeout
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	err = runPhases(timeout, []startupPhase{
+		{"networking", func(ctx context.Context) error {
+			select {
+			case <-e.ready:
+				return nil
+			case <-e.stopped:
+				return errors.New("enclave stopped")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}},
+		{"servers", func(context.Context) error {
+			if err := startWebServers(e); err != nil {
+				return err
+			}
+			return startRPCServer(e)
+		}},
+		{"readiness", func(context.Context) error {
+			// Run all checks, so we report all that fail.
+			userData := e.hashes.Serialize()
+			doc, attErr := checkClock(e.attester, userData, e.meta.publicKey(), e.cfg.MaxClockSkew, e.cfg.CorrectClockSkew)
+			e.audit.attestation(bootClient, nil, userData, doc, attErr)
+			if attErr == nil {
+				e.boot.set(doc)
+			}
+			// A broken resolver doesn't prevent us from serving, and it
+			// may recover, so we only report it via /ready and the DNS
+			// health check.
+			if err := e.dns.check(); err != nil {
+				report.warn(fmt.Errorf("DNS isn't working; /ready reports not ready until it does: %w", err))
+			}
+			return attErr
+		}},
+	})
 	if err != nil {
-		return fmt.Errorf("%s: failed to create certificate: %w", errPrefix, err)
+		return report.finish(err)
 	}
 
-	if err = startWebServers(e); err != nil {
-		return fmt.Errorf("%s: %w", errPrefix, err)
+	expected := e.cfg.ExpectedPCR0
+	if expected == "" {
+		expected = expectedPCR0
 	}
+	e.measure.check(expected)
 
-	return nil
+	// Networking is up, so we can reach the registry.
+	if e.cfg.Registry.URL != "" {
+		go newRegistryPublisher(e.cfg.Registry, e.client, e.attester, e.hashes, e.audit).run(e.stopped)
+	}
+
+	e.markLive()
+	return report.finish(nil)
+}
+
+// runNetworking runs the networking of all our TAP devices until the enclave
+// stops, and closes e.ready once all devices are up.  If networking fails
+// for good, the enclave stops.
+func (e *Enclave) runNetworking() {
+	var readyOnce sync.Once
+	markReady := func() { readyOnce.Do(func() { close(e.ready) }) }
+	if err := runDevices(e.netCfg.devices(), e.stop, markReady); err != nil {
+		log.Errorf("Giving up on networking: %v", err)
+		e.Stop(StopNetworkingFailure)
+	}
 }
 
 // startWebServers starts both our public-facing and our enclave-internal Web
 // server in a goroutine.
 func startWebServers(e *Enclave) error {
+	e.pubSrv.Handler = e.publicHandler()
+	if err := configureHTTPVersions(&e.pubSrv, e.cfg.UseHTTP2); err != nil {
+		return fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+
+	l, err := net.Listen("tcp", e.pubSrv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", e.pubSrv.Addr, err)
+	}
+	if e.cfg.ProxyProtocol {
+		l = newProxyProtoListener(l)
+	}
+	if e.cfg.MaxPublicConns > 0 {
+		l = newLimitListener(l, e.cfg.MaxPublicConns, metricPubConns, metricPubConnsRejected)
+	}
+
 	log.Println("Public Web server started")
 	go func() {
-		if err := e.pubSrv.ListenAndServe(); err != nil {
+		var err error
+		if e.certs.loaded() {
+			// Our TLS config provides the certificate, so we don't pass
+			// any files.
+			err = e.pubSrv.ServeTLS(l, "", "")
+		} else {
+			err = e.pubSrv.Serve(l)
+		}
+		if err != nil {
 			log.Errorf("Public Web server terminated: %v", err)
 		}
 	}()
 
+	// Streamed decryption needs a full-duplex connection, so we offer h2c.
+	if e.cfg.KMS != nil {
+		if err := configureHTTP2(&e.intSrv); err != nil {
+			return fmt.Errorf("failed to configure HTTP/2: %w", err)
+		}
+	}
+	il, err := net.Listen("tcp", e.intSrv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", e.intSrv.Addr, err)
+	}
+	if e.cfg.Internal.MaxConns > 0 {
+		il = newLimitListener(il, e.cfg.Internal.MaxConns, metricIntConns, metricIntConnsRejected)
+	}
+	log.Printf("Enclave-internal Web server started on %s", e.intSrv.Addr)
+	go func() {
+		if err := e.intSrv.Serve(il); err != nil {
+			log.Errorf("Enclave-internal Web server terminated: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// configureHTTPVersions enables HTTP/2 on the given server if useHTTP2 is
+// set, and disables it otherwise.  Without the latter, Go's TLS servers would
+// still negotiate HTTP/2 on their own.
+func configureHTTPVersions(srv *http.Server, useHTTP2 bool) error {
+	if useHTTP2 {
+		return configureHTTP2(srv)
+	}
+	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	return nil
+}
+
+// configureHTTP2 enables HTTP/2 on the given server.  Clients that connect via
+// TLS negotiate HTTP/2 by means of ALPN while cleartext clients can either
+// upgrade to h2c or keep using HTTP/1.1.
+func configureHTTP2(srv *http.Server) error {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return err
+	}
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
 	return nil
 }
 
 func helloWorld(e *Enclave) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resp, err := http.Get("https://jsonplaceholder.typicode.com/posts/1")
+		resp, err := e.client.Get("https://jsonplaceholder.typicode.com/posts/1")
 		if err != nil {
 			log.Fatalln(err)
 		}
+		// Closing the body allows the client to reuse the connection.
+		defer resp.Body.Close()
 
 		// We Read the response body on the line below.
 		body, err := io.ReadAll(resp.Body)
@@ -248,7 +687,7 @@ func AutoAttestationHandler() http.HandlerFunc {
 
 		log.Printf("Attestation Document: %s", len(attestationDocument))
 
-		myPCRs, err := verifyAttestation(attestationDocument)
+		myPCRs, err := verifyAttestation(attestationDocument, VerifyOptions{})
 		if err != nil {
 			log.Fatalf("Failed to verify attestation: %v", err)
 		}
@@ -262,7 +701,11 @@ func AutoAttestationHandler() http.HandlerFunc {
 			log.Fatalf("Failed to attest: %v", err)
 		}
 
-		res, err := nitrite.Verify(rawAttDoc, nitrite.VerifyOptions{})
+		roots, err := attestationRoots()
+		if err != nil {
+			log.Fatalf("Failed to load attestation root: %v", err)
+		}
+		res, err := nitrite.Verify(rawAttDoc, nitrite.VerifyOptions{Roots: roots})
 		if err != nil {
 			log.Fatalf("Failed to verify attestation: %v", err)
 		}
@@ -311,11 +754,14 @@ func AutoAttestationHandler() http.HandlerFunc {
 	}
 }
 
-func verifyAttestation(attestation []byte) (map[uint][]byte, error) {
-	res, err := nitrite.Verify(attestation,
-		nitrite.VerifyOptions{
-			CurrentTime: time.Now(),
-		})
+// verifyAttestation verifies the given attestation document as of the time
+// that the given options determine, and returns the document's PCRs.
+func verifyAttestation(attestation []byte, opts VerifyOptions) (map[uint][]byte, error) {
+	nopts, err := opts.nitriteOptions()
+	if err != nil {
+		return nil, err
+	}
+	res, err := nitrite.Verify(attestation, nopts)
 
 	if nil != err {
 		return nil, err
@@ -332,10 +778,6 @@ func verifyAttestation(attestation []byte) (map[uint][]byte, error) {
 		resJSON = string(enc)
 	}
 
-	if nil != err {
-		log.Fatalln("Attestation verification failed with error %v\n", err)
-	}
-
 	log.Printf("%v\n", resJSON)
 
 	return res.Document.PCRs, nil
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brave/nitriding"
+	"golang.org/x/net/http2"
+)
+
+// testConfig returns a valid config that doesn't expose demo routes.
+func testConfig() *Config {
+	return &Config{
+		Config: nitriding.Config{
+			FQDN:          "localhost",
+			ExtPort:       uint16(8443),
+			IntPort:       uint16(8444),
+			HostProxyPort: uint32(1024),
+		},
+	}
+}
+
+// newTestEnclave creates an enclave with the given config, and fails the
+// test if that doesn't work.
+func newTestEnclave(t *testing.T, cfg *Config) *Enclave {
+	t.Helper()
+	e, err := NewEnclave(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create enclave: %v", err)
+	}
+	return e
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	return u
+}
+
+// testCertificatePEM returns a PEM-encoded, self-signed certificate for
+// 127.0.0.1 with the given common name, along with its PEM-encoded key.
+func testCertificatePEM(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serveTLS serves the given server via TLS on a random loopback port, and
+// returns the server's base URL.  The server is closed when the test ends.
+func serveTLS(t *testing.T, srv *http.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() { _ = srv.ServeTLS(l, "", "") }()
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
+
+// get sends a GET request to the given URL and returns the response's status
+// code and body.
+func get(t *testing.T, c *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMountApp(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	e.MountApp("/app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "app:"+r.URL.Path)
+	}))
+	srv := httptest.NewServer(e.publicHandler())
+	defer srv.Close()
+
+	code, body := get(t, srv.Client(), srv.URL+"/app/foo")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, code)
+	}
+	if body != "app:/app/foo" {
+		t.Errorf("Expected mounted app to handle request but got %q.", body)
+	}
+
+	// Our own routes must keep working.
+	if code, _ := get(t, srv.Client(), srv.URL+pathHealthNSM); code == http.StatusNotFound {
+		t.Errorf("Expected %s to remain routed.", pathHealthNSM)
+	}
+}
+
+func TestMountAppWithAppWebSrv(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	e := newTestEnclave(t, cfg)
+	e.MountApp("/app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "app")
+	}))
+	srv := httptest.NewServer(e.publicHandler())
+	defer srv.Close()
+
+	if _, body := get(t, srv.Client(), srv.URL+"/app/foo"); body != "backend" {
+		t.Errorf("Expected reverse proxy to handle request but got %q.", body)
+	}
+}
+
+// newHTTP2TestServer returns our public Web server with a test certificate,
+// configured like startWebServers does, and serves it via TLS.
+func newHTTP2TestServer(t *testing.T, useHTTP2 bool) string {
+	t.Helper()
+	e := newTestEnclave(t, testConfig())
+	if err := e.SetTLSFromPEM(testCertificatePEM(t, "localhost")); err != nil {
+		t.Fatalf("Failed to set certificate: %v", err)
+	}
+	e.MountApp("/proto", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	e.pubSrv.Handler = e.publicHandler()
+	if err := configureHTTPVersions(&e.pubSrv, useHTTP2); err != nil {
+		t.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+	return serveTLS(t, &e.pubSrv)
+}
+
+func TestHTTP2(t *testing.T) {
+	insecure := &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	h1 := &http.Client{Transport: &http.Transport{TLSClientConfig: insecure}}
+	h2 := &http.Client{Transport: &http2.Transport{TLSClientConfig: insecure}}
+
+	url := newHTTP2TestServer(t, true)
+	if code, body := get(t, h2, url+"/proto"); code != http.StatusOK || body != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2 client to get 200 via HTTP/2.0 but got %d via %s.", code, body)
+	}
+	if code, body := get(t, h1, url+"/proto"); code != http.StatusOK || body != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 client to get 200 via HTTP/1.1 but got %d via %s.", code, body)
+	}
+
+	// Without HTTP/2, the server must not negotiate h2.
+	url = newHTTP2TestServer(t, false)
+	if _, err := h2.Get(url + "/proto"); err == nil {
+		t.Error("Expected HTTP/2 client to fail against HTTP/1.1-only server.")
+	}
+	if code, body := get(t, h1, url+"/proto"); code != http.StatusOK || body != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 client to get 200 via HTTP/1.1 but got %d via %s.", code, body)
+	}
+}
+
+// freePort returns a TCP port that was free at the time of the call.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestInternalServer(t *testing.T) {
+	cfg := testConfig()
+	cfg.ExtPort, cfg.IntPort = freePort(t), freePort(t)
+	e := newTestEnclave(t, cfg)
+	if err := startWebServers(e); err != nil {
+		t.Fatalf("Failed to start Web servers: %v", err)
+	}
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	// The internal server only listens on the loopback interface.
+	if want := fmt.Sprintf("127.0.0.1:%d", cfg.IntPort); e.intSrv.Addr != want {
+		t.Errorf("Expected internal server to listen on %s but got %s.", want, e.intSrv.Addr)
+	}
+
+	c := &http.Client{}
+	intURL := fmt.Sprintf("http://127.0.0.1:%d", cfg.IntPort)
+	pubURL := fmt.Sprintf("http://127.0.0.1:%d", cfg.ExtPort)
+	for _, path := range []string{pathMetrics, pathRuntime, pathMeasure} {
+		if code, _ := get(t, c, intURL+path); code != http.StatusOK {
+			t.Errorf("Expected internal server to serve %s but got %d.", path, code)
+		}
+		if code, _ := get(t, c, pubURL+path); code != http.StatusNotFound {
+			t.Errorf("Expected public server to not expose %s but got %d.", path, code)
+		}
+	}
+	// Admin routes are internal, too.
+	if code, _ := get(t, c, pubURL+pathAdminLogLevel); code != http.StatusNotFound {
+		t.Errorf("Expected public server to not expose %s but got %d.", pathAdminLogLevel, code)
+	}
+	if code, _ := get(t, c, pubURL+pathReady); code == http.StatusNotFound {
+		t.Errorf("Expected public server to serve %s.", pathReady)
+	}
+}
+
+func TestInternalServerTimeouts(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		cfg                 InternalServerConfig
+		wantRead, wantWrite time.Duration
+	}{
+		{"defaults", InternalServerConfig{}, defaultIntReadTimeout, defaultIntWriteTimeout},
+		{"custom", InternalServerConfig{ReadTimeout: time.Second, WriteTimeout: 2 * time.Second}, time.Second, 2 * time.Second},
+		{"disabled", InternalServerConfig{ReadTimeout: -1, WriteTimeout: -1}, 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Internal = test.cfg
+			e := newTestEnclave(t, cfg)
+			if e.intSrv.ReadTimeout != test.wantRead || e.intSrv.WriteTimeout != test.wantWrite {
+				t.Errorf("Expected internal timeouts %s and %s but got %s and %s.",
+					test.wantRead, test.wantWrite, e.intSrv.ReadTimeout, e.intSrv.WriteTimeout)
+			}
+			// The public server's timeouts don't follow the internal ones.
+			if e.pubSrv.ReadTimeout != 0 || e.pubSrv.WriteTimeout != 0 {
+				t.Errorf("Expected public server without timeouts but got %s and %s.",
+					e.pubSrv.ReadTimeout, e.pubSrv.WriteTimeout)
+			}
+		})
+	}
+}
+
+func TestInternalServerTimeoutsAreIndependent(t *testing.T) {
+	cfg := testConfig()
+	cfg.ExtPort, cfg.IntPort = freePort(t), freePort(t)
+	cfg.Internal.ReadTimeout = 100 * time.Millisecond
+	e := newTestEnclave(t, cfg)
+	if err := startWebServers(e); err != nil {
+		t.Fatalf("Failed to start Web servers: %v", err)
+	}
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	// stalls returns true if a client that never finishes its request is
+	// still connected after a second.
+	stalls := func(port uint16) bool {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer c.Close()
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\n")
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = c.Read(make([]byte, 1))
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	if stalls(cfg.IntPort) {
+		t.Error("Expected internal server to drop a stalled client after its read timeout.")
+	}
+	if !stalls(cfg.ExtPort) {
+		t.Error("Expected public server to be unaffected by the internal read timeout.")
+	}
+}
+
+func TestInternalServerMaxConns(t *testing.T) {
+	cfg := testConfig()
+	cfg.ExtPort, cfg.IntPort = freePort(t), freePort(t)
+	cfg.Internal.MaxConns = 1
+	e := newTestEnclave(t, cfg)
+	if err := startWebServers(e); err != nil {
+		t.Fatalf("Failed to start Web servers: %v", err)
+	}
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	rejected, pubRejected := metricIntConnsRejected.Value(), metricPubConnsRejected.Value()
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.IntPort)
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer first.Close()
+	// Make sure that the server accepted the first connection.
+	_, _ = io.WriteString(first, "GET "+pathMetrics+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Expected first connection to be served but got %v.", err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected second connection to be closed but got %v.", err)
+	}
+	if got := metricIntConnsRejected.Value(); got != rejected+1 {
+		t.Errorf("Expected %d rejected internal connections but got %d.", rejected+1, got)
+	}
+	if got := metricPubConnsRejected.Value(); got != pubRejected {
+		t.Errorf("Expected public rejections to stay at %d but got %d.", pubRejected, got)
+	}
+}
+
+// headerMiddleware returns middleware that appends the given value to the
+// X-Middleware response header.
+func headerMiddleware(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Middleware", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestUse(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	e.Use(headerMiddleware("first"))
+	e.Use(headerMiddleware("second"))
+	e.MountApp("/app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "app")
+	}))
+	h := e.publicHandler()
+
+	for _, path := range []string{pathReady, pathBootAttestation, "/app/foo", "/does-not-exist"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		got := w.Header().Values("X-Middleware")
+		if len(got) != 2 || got[0] != "first" || got[1] != "second" {
+			t.Errorf("Expected middleware to run in order for %s but got %v.", path, got)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected Use to panic once the public handler is built.")
+		}
+	}()
+	e.Use(headerMiddleware("late"))
+}
+
+// newHookedProxy returns an enclave whose reverse proxy forwards to a backend
+// that reports the path and Via header of the requests it receives.
+func newHookedProxy(t *testing.T, cfg *Config) *Enclave {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Path", r.URL.Path)
+		w.Header().Set("X-Backend-Custom", r.Header.Get("X-Custom"))
+		w.Header().Set("X-Nitriding-Internal", "secret")
+		_, _ = io.WriteString(w, "backend")
+	}))
+	t.Cleanup(backend.Close)
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	return newTestEnclave(t, cfg)
+}
+
+func TestProxyDirector(t *testing.T) {
+	var sawVia, sawHost string
+	cfg := testConfig()
+	cfg.ProxyDirector = func(r *http.Request) {
+		// Our default director already ran.
+		sawVia, sawHost = r.Header.Get("Via"), r.URL.Host
+		r.URL.Path = strings.Replace(r.URL.Path, "/old/", "/new/", 1)
+		r.Header.Set("X-Custom", "directed")
+	}
+	e := newHookedProxy(t, cfg)
+
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/old/foo", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("X-Backend-Path"); got != "/new/foo" {
+		t.Errorf("Expected backend to see rewritten path /new/foo but got %q.", got)
+	}
+	if got := w.Header().Get("X-Backend-Custom"); got != "directed" {
+		t.Errorf("Expected backend to see custom header but got %q.", got)
+	}
+	if sawVia == "" || sawHost != cfg.AppWebSrv.Host {
+		t.Errorf("Expected custom director to run after ours but got Via %q and host %q.", sawVia, sawHost)
+	}
+}
+
+func TestProxyModifyResponse(t *testing.T) {
+	var sawInternal string
+	cfg := testConfig()
+	cfg.ProxyModifyResponse = func(resp *http.Response) error {
+		// Our default modifier already stripped internal headers.
+		sawInternal = resp.Header.Get("X-Nitriding-Internal")
+		resp.Header.Set("X-Injected", "modified")
+		return nil
+	}
+	e := newHookedProxy(t, cfg)
+
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if got := w.Header().Get("X-Injected"); got != "modified" {
+		t.Errorf("Expected client to receive injected header but got %q.", got)
+	}
+	if sawInternal != "" {
+		t.Errorf("Expected custom modifier to run after headers were stripped but saw %q.", sawInternal)
+	}
+	if w.Header().Get("Via") == "" {
+		t.Error("Expected response to carry our Via entry.")
+	}
+}
+
+func TestProxyModifyResponseError(t *testing.T) {
+	cfg := testConfig()
+	cfg.ProxyModifyResponse = func(resp *http.Response) error {
+		return errors.New("rejected by hook")
+	}
+	e := newHookedProxy(t, cfg)
+
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusBadGateway, w.Code)
+	}
+}
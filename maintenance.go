@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	// maxMaintenanceSize caps the size of the maintenance payload, which we
+	// keep in memory.
+	maxMaintenanceSize = 1024 * 1024
+	// defaultMaintenanceType is the content type of the maintenance payload
+	// if the config doesn't specify one.
+	defaultMaintenanceType = "text/plain; charset=utf-8"
+)
+
+var errMaintenanceConflict = errors.New("maintenance response must have either Body or BodyFile, not both")
+
+// MaintenanceConfig configures the response that our reverse proxy sends
+// instead of a bare 502 Bad Gateway while AppWebSrv is unavailable, e.g., a
+// branded page or a JSON error.  It's off if both Body and BodyFile are
+// empty.
+type MaintenanceConfig struct {
+	// Status is the response's status code.  If Status is 0, 503 Service
+	// Unavailable is used.
+	Status int
+	// ContentType is the response's content type.  If ContentType is empty,
+	// defaultMaintenanceType is used.
+	ContentType string
+	// Body is the response's body.
+	Body []byte
+	// BodyFile is the path of a file that holds the response's body.  It's
+	// read once, when the enclave is created.
+	BodyFile string
+}
+
+// maintenancePage is a loaded maintenance response.
+type maintenancePage struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// load returns the configured maintenance response, or nil if it's off.
+func (c MaintenanceConfig) load() (*maintenancePage, error) {
+	if len(c.Body) == 0 && c.BodyFile == "" {
+		return nil, nil
+	}
+	if len(c.Body) > 0 && c.BodyFile != "" {
+		return nil, errMaintenanceConflict
+	}
+	page := &maintenancePage{status: c.Status, contentType: c.ContentType, body: c.Body}
+	if page.status == 0 {
+		page.status = http.StatusServiceUnavailable
+	}
+	if page.status < 100 || page.status > 599 {
+		return nil, fmt.Errorf("invalid maintenance status code %d", page.status)
+	}
+	if page.contentType == "" {
+		page.contentType = defaultMaintenanceType
+	}
+	if c.BodyFile != "" {
+		f, err := os.Open(c.BodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open maintenance page: %w", err)
+		}
+		defer f.Close()
+		if page.body, err = io.ReadAll(newLimitReader(f, maxMaintenanceSize)); err != nil {
+			return nil, fmt.Errorf("failed to read maintenance page: %w", err)
+		}
+	}
+	return page, nil
+}
+
+// write sends the maintenance response.
+func (p *maintenancePage) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", p.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(p.status)
+	_, _ = w.Write(p.body)
+}
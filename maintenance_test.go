@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newDownBackendEnclave returns an enclave whose AppWebSrv doesn't listen,
+// and whose maintenance response is configured as given.
+func newDownBackendEnclave(t *testing.T, m MaintenanceConfig) *Enclave {
+	t.Helper()
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, fmt.Sprintf("http://127.0.0.1:%d", freePort(t)))
+	cfg.Maintenance = m
+	return newTestEnclave(t, cfg)
+}
+
+func TestMaintenancePageBackendDown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(path, []byte("<h1>Back soon</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		cfg      MaintenanceConfig
+		wantCode int
+		wantType string
+		wantBody string
+	}{
+		{"off", MaintenanceConfig{}, http.StatusBadGateway, "", ""},
+		{"JSON body", MaintenanceConfig{
+			Status:      http.StatusServiceUnavailable,
+			ContentType: "application/json",
+			Body:        []byte(`{"error":"maintenance"}`),
+		}, http.StatusServiceUnavailable, "application/json", `{"error":"maintenance"}`},
+		{"defaults", MaintenanceConfig{Body: []byte("down")},
+			http.StatusServiceUnavailable, defaultMaintenanceType, "down"},
+		{"file", MaintenanceConfig{Status: http.StatusOK, ContentType: "text/html", BodyFile: path},
+			http.StatusOK, "text/html", "<h1>Back soon</h1>"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := proxyGet(newDownBackendEnclave(t, c.cfg))
+			if w.Code != c.wantCode {
+				t.Fatalf("Expected status code %d but got %d.", c.wantCode, w.Code)
+			}
+			if c.wantBody == "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != c.wantType {
+				t.Errorf("Expected content type %q but got %q.", c.wantType, got)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Expected maintenance response to not be cached but got %q.", got)
+			}
+			if got := w.Body.String(); got != c.wantBody {
+				t.Errorf("Expected body %q but got %q.", c.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestMaintenancePageBackendUp(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer backend.Close()
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	cfg.Maintenance = MaintenanceConfig{Body: []byte("down")}
+	if w := proxyGet(newTestEnclave(t, cfg)); w.Code != http.StatusOK || w.Body.String() != "app" {
+		t.Fatalf("Expected the app's response while it's up but got %d: %q.", w.Code, w.Body)
+	}
+}
+
+func TestMaintenanceConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+	large := filepath.Join(dir, "large")
+	if err := os.WriteFile(large, bytes.Repeat([]byte("x"), maxMaintenanceSize+1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name    string
+		cfg     MaintenanceConfig
+		wantErr bool
+	}{
+		{"conflict", MaintenanceConfig{Body: []byte("down"), BodyFile: large}, true},
+		{"bad status", MaintenanceConfig{Status: 42, Body: []byte("down")}, true},
+		{"missing file", MaintenanceConfig{BodyFile: filepath.Join(dir, "missing")}, true},
+		{"too large", MaintenanceConfig{BodyFile: large}, true},
+		{"valid", MaintenanceConfig{Body: []byte("down")}, false},
+	} {
+		if _, err := c.cfg.load(); (err != nil) != c.wantErr {
+			t.Errorf("%s: Expected error to be %t but got %v.", c.name, c.wantErr, err)
+		}
+	}
+	if _, err := (MaintenanceConfig{Body: []byte("a"), BodyFile: "b"}).load(); !errors.Is(err, errMaintenanceConflict) {
+		t.Errorf("Expected %v but got %v.", errMaintenanceConflict, err)
+	}
+	// An invalid maintenance response fails enclave creation.
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, "http://127.0.0.1:8080")
+	cfg.Maintenance = MaintenanceConfig{Status: 42, Body: []byte("down")}
+	if _, err := NewEnclave(cfg); err == nil {
+		t.Error("Expected invalid maintenance response to fail enclave creation.")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// expectedPCR0 is the hex-encoded PCR0 that we expect the running EIF to
+// have.  It can be injected at build time via:
+//
+//	go build -ldflags "-X main.expectedPCR0=<hex>"
+//
+// Note that a value embedded in an EIF changes the very EIF's PCR0, so the
+// value must describe a different image, e.g., the previous release.  Config's
+// ExpectedPCR0 takes precedence over this variable.
+var expectedPCR0 string
+
+// measurements holds the expected and actual PCR0 of the running EIF.
+type measurements struct {
+	sync.RWMutex
+	Expected string `json:"expected_pcr0,omitempty"`
+	Actual   string `json:"actual_pcr0,omitempty"`
+	Match    *bool  `json:"match,omitempty"`
+}
+
+// pcr0Matches returns true if the given hex-encoded expected PCR0 matches the
+// given actual PCR0.  Case and surrounding whitespace are ignored.
+func pcr0Matches(expected string, actual []byte) bool {
+	return strings.EqualFold(strings.TrimSpace(expected), hex.EncodeToString(actual))
+}
+
+// check obtains the enclave's actual PCR0 and compares it to the given
+// expected value.  A mismatch results in a prominent warning and is reflected
+// in our metrics.  If no expected value is given, we only record the actual
+// value.
+func (m *measurements) check(expected string) {
+	pcrs, err := getPCRValues()
+	if err != nil {
+		log.Errorf("Failed to obtain PCR values: %v", err)
+		return
+	}
+	actual := pcrs[0]
+
+	m.Lock()
+	defer m.Unlock()
+	m.Expected = expected
+	m.Actual = hex.EncodeToString(actual)
+	if expected == "" {
+		log.Printf("No expected PCR0 configured.  Running with PCR0 %s.", m.Actual)
+		return
+	}
+
+	match := pcr0Matches(expected, actual)
+	m.Match = &match
+	if !match {
+		metricPCR0Mismatch.Set(1)
+		log.Warnf("!!! PCR0 MISMATCH: expected %s but running with %s !!!", expected, m.Actual)
+		return
+	}
+	metricPCR0Mismatch.Set(0)
+	log.Printf("PCR0 matches expected value %s.", expected)
+}
+
+// measurementsHandler returns a HandlerFunc that reports the expected and the
+// actual PCR0 of the running EIF.
+func measurementsHandler(m *measurements) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.RLock()
+		defer m.RUnlock()
+		writeJSON(w, http.StatusOK, m)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// usePCRValues makes getPCRValues return the given PCRs and error for the
+// duration of the test.
+func usePCRValues(t *testing.T, pcrs map[uint][]byte, err error) {
+	t.Helper()
+	orig := getPCRValues
+	getPCRValues = func() (map[uint][]byte, error) { return pcrs, err }
+	t.Cleanup(func() { getPCRValues = orig })
+}
+
+func TestPCR0Matches(t *testing.T) {
+	actual := bytes.Repeat([]byte{0xab}, 48)
+	actualHex := hex.EncodeToString(actual)
+	cases := []struct {
+		expected string
+		match    bool
+	}{
+		{actualHex, true},
+		{" " + actualHex + "\n", true},
+		{actualHex[:10], false},
+		{hex.EncodeToString(bytes.Repeat([]byte{0xcd}, 48)), false},
+	}
+	for _, c := range cases {
+		if got := pcr0Matches(c.expected, actual); got != c.match {
+			t.Errorf("Expected %q to match=%v but got %v.", c.expected, c.match, got)
+		}
+	}
+}
+
+func TestMeasurementsCheck(t *testing.T) {
+	actual := testPCRs(0xab)[0]
+	actualHex := hex.EncodeToString(actual)
+	usePCRValues(t, testPCRs(0xab), nil)
+
+	cases := []struct {
+		name     string
+		expected string
+		match    *bool
+		metric   int64
+	}{
+		{"match", actualHex, boolPtr(true), 0},
+		{"uppercase match", strings.ToUpper(actualHex), boolPtr(true), 0},
+		{"mismatch", hex.EncodeToString(testPCRs(0xcd)[0]), boolPtr(false), 1},
+		{"nothing expected", "", nil, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			metricPCR0Mismatch.Set(0)
+			m := new(measurements)
+			m.check(c.expected)
+
+			if m.Actual != actualHex {
+				t.Errorf("Expected actual PCR0 %s but got %s.", actualHex, m.Actual)
+			}
+			if m.Expected != c.expected {
+				t.Errorf("Expected expected PCR0 %s but got %s.", c.expected, m.Expected)
+			}
+			if (m.Match == nil) != (c.match == nil) || (m.Match != nil && *m.Match != *c.match) {
+				t.Errorf("Expected match %v but got %v.", c.match, m.Match)
+			}
+			if got := metricPCR0Mismatch.Value(); got != c.metric {
+				t.Errorf("Expected mismatch metric %d but got %d.", c.metric, got)
+			}
+		})
+	}
+}
+
+func TestMeasurementsCheckWithoutPCRs(t *testing.T) {
+	usePCRValues(t, nil, errors.New("no NSM"))
+	m := new(measurements)
+	m.check("ab")
+	if m.Actual != "" || m.Match != nil {
+		t.Errorf("Expected no measurements but got %+v.", m)
+	}
+}
+
+func TestMeasurementsHandler(t *testing.T) {
+	usePCRValues(t, testPCRs(0xab), nil)
+	m := new(measurements)
+	expected := hex.EncodeToString(testPCRs(0xcd)[0])
+	m.check(expected)
+	t.Cleanup(func() { metricPCR0Mismatch.Set(0) })
+
+	code, resp := getJSON(t, measurementsHandler(m), pathMeasure)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, code)
+	}
+	if resp["expected_pcr0"] != expected {
+		t.Errorf("Expected expected PCR0 %s but got %v.", expected, resp["expected_pcr0"])
+	}
+	if resp["actual_pcr0"] != hex.EncodeToString(testPCRs(0xab)[0]) {
+		t.Errorf("Expected actual PCR0 %x but got %v.", testPCRs(0xab)[0], resp["actual_pcr0"])
+	}
+	if resp["match"] != false {
+		t.Errorf("Expected match false but got %v.", resp["match"])
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// defaultKeyOverlap determines for how long we keep signing with, and
+	// opening payloads for, the previous metadata key after a rotation, if
+	// the config doesn't specify an overlap.
+	defaultKeyOverlap = 5 * time.Minute
+	// maxSealedPayloadLen caps the size of payloads that we open.
+	maxSealedPayloadLen = 64 * 1024
+)
+
+var (
+	ErrBadMetadataSignature = errors.New("attestation metadata signature is invalid")
+	errUnknownPayloadKey    = errors.New("payload isn't sealed to our current or previous key")
+
+	errFailedOpen = "failed to open payload"
+)
+
+// attestationEnvelope is the JSON representation of our attestation
+// response, which clients request by sending "Accept: application/json".
+// Metadata is contextual information like the enclave's version.  Unlike the
+// hashes in the document's user data, it's not part of the attestation
+// document.  Instead, it's signed by a key whose public half is bound in the
+// document, so clients can still tell that the enclave produced it.  Shortly
+// after a key rotation, the metadata is also signed by the previous key, so
+// clients that are still holding a document that binds the previous key, e.g.,
+// the boot document, can keep verifying it.
+type attestationEnvelope struct {
+	Document                  string          `json:"document"`
+	Metadata                  json.RawMessage `json:"metadata,omitempty"`
+	MetadataSignature         []byte          `json:"metadata_signature,omitempty"`
+	PreviousMetadataSignature []byte          `json:"previous_metadata_signature,omitempty"`
+}
+
+// metadataSigner signs the metadata that we attach to attestation envelopes,
+// using an ephemeral Ed25519 key.  The key can be rotated at runtime; use
+// current to get a consistent snapshot for a document and its metadata.  After
+// a rotation, the previous key is retained until previousUntil.  A nil
+// *metadataSigner attaches no metadata.
+type metadataSigner struct {
+	sync.RWMutex
+	key           ed25519.PrivateKey
+	previous      ed25519.PrivateKey
+	previousUntil time.Time
+	overlap       time.Duration
+	static        map[string]string
+	now           func() time.Time
+}
+
+// newMetadataSigner returns a signer for the given static metadata, or nil if
+// there's no metadata.  After a rotation, the signer retains the previous key
+// for the given overlap.  If the overlap is 0, defaultKeyOverlap is used.
+func newMetadataSigner(static map[string]string, overlap time.Duration) (*metadataSigner, error) {
+	if len(static) == 0 {
+		return nil, nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate metadata key: %w", err)
+	}
+	if overlap == 0 {
+		overlap = defaultKeyOverlap
+	}
+	return &metadataSigner{key: key, overlap: overlap, static: static, now: time.Now}, nil
+}
+
+// current returns a snapshot of the signer whose key doesn't change if the
+// key is rotated, so a document binds the key that signs its metadata.
+func (s *metadataSigner) current() *metadataSigner {
+	if s == nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return &metadataSigner{
+		key:           s.key,
+		previous:      s.previous,
+		previousUntil: s.previousUntil,
+		overlap:       s.overlap,
+		static:        s.static,
+		now:           s.now,
+	}
+}
+
+// rotate replaces the signer's key with a fresh one and returns the new
+// public key.  Documents that bind the previous key remain verifiable,
+// because their metadata was signed when they were issued.  In addition, we
+// keep signing with the previous key for the signer's overlap, so clients
+// that are in the middle of switching to a document that binds the new key
+// don't fail verification.  Likewise, payloads that are still in flight to
+// the previous key can be opened during the overlap.
+func (s *metadataSigner) rotate() (ed25519.PublicKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate metadata key: %w", err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.previous, s.previousUntil = s.key, s.now().Add(s.overlap)
+	s.key = key
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// publicKey returns the public key that attestation documents must bind, so
+// clients can verify metadata signatures.
+func (s *metadataSigner) publicKey() []byte {
+	if s == nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// sign returns the JSON-encoded metadata, including the current time, along
+// with its signature.
+func (s *metadataSigner) sign() (json.RawMessage, []byte, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+	md := make(map[string]string, len(s.static)+1)
+	for k, v := range s.static {
+		md[k] = v
+	}
+	md["timestamp"] = s.now().UTC().Format(time.RFC3339)
+
+	raw, err := json.Marshal(md)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return raw, ed25519.Sign(s.key, raw), nil
+}
+
+// signPrevious returns the signature of the given metadata by the previous
+// key, or nil if there's no previous key or its overlap is over.
+func (s *metadataSigner) signPrevious(raw []byte) []byte {
+	if s == nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if s.previous == nil || s.now().After(s.previousUntil) {
+		return nil
+	}
+	return ed25519.Sign(s.previous, raw)
+}
+
+// boxKeys returns the X25519 key pair that corresponds to the given Ed25519
+// key, like libsodium's crypto_sign_ed25519_sk_to_curve25519 does.  Clients
+// derive the public half from the Ed25519 public key that's bound in our
+// attestation document with crypto_sign_ed25519_pk_to_curve25519.
+func boxKeys(key ed25519.PrivateKey) (pub, priv *[32]byte, err error) {
+	h := sha512.Sum512(key.Seed())
+	priv = new([32]byte)
+	copy(priv[:], h[:32])
+	zero(h[:])
+	p, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub = new([32]byte)
+	copy(pub[:], p)
+	return pub, priv, nil
+}
+
+// encryptionKey returns the X25519 public key to which clients seal the
+// payloads that they send us.
+func (s *metadataSigner) encryptionKey() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	pub, priv, err := boxKeys(s.key)
+	if err != nil {
+		return nil, err
+	}
+	zero(priv[:])
+	return pub[:], nil
+}
+
+// open returns the plaintext of the given payload, which a client sealed to
+// our encryption key in an anonymous box, i.e., with libsodium's
+// crypto_box_seal.  Payloads that were sealed to the previous key are opened
+// until the overlap after a rotation is over, so payloads that were in flight
+// during the rotation aren't lost.
+func (s *metadataSigner) open(sealed []byte) ([]byte, error) {
+	s.RLock()
+	keys := []ed25519.PrivateKey{s.key}
+	if s.previous != nil && !s.now().After(s.previousUntil) {
+		keys = append(keys, s.previous)
+	}
+	s.RUnlock()
+
+	for _, key := range keys {
+		pub, priv, err := boxKeys(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+		zero(priv[:])
+		if ok {
+			return plaintext, nil
+		}
+	}
+	return nil, errUnknownPayloadKey
+}
+
+// openPayloadHandler returns a HandlerFunc that opens the sealed payload in
+// the request body (see metadataSigner.open) and returns its plaintext.  It's
+// meant for the enclave-internal Web server, so the enclave application can
+// open payloads that clients sealed to the key in our attestation document,
+// and the plaintext never leaves the enclave.
+func openPayloadHandler(s *metadataSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s == nil {
+			http.Error(w, errNoEphemeralKey, http.StatusConflict)
+			return
+		}
+		sealed, err := io.ReadAll(newLimitReader(r.Body, maxSealedPayloadLen))
+		if err != nil {
+			http.Error(w, errFailedOpen, http.StatusRequestEntityTooLarge)
+			return
+		}
+		plaintext, err := s.open(sealed)
+		if err != nil {
+			log.Printf("Open payload: %v", err)
+			http.Error(w, errFailedOpen, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(plaintext)
+		zero(plaintext)
+	}
+}
+
+// wantsJSON returns true if the given request asks for a JSON response.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// VerifyMetadata makes sure that the given envelope metadata was signed by
+// the key that's bound in the verified attestation document.
+func VerifyMetadata(res *Result, metadata, sig []byte) error {
+	if len(res.Document.PublicKey) != ed25519.PublicKeySize {
+		return ErrBadMetadataSignature
+	}
+	if !ed25519.Verify(res.Document.PublicKey, metadata, sig) {
+		return ErrBadMetadataSignature
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// requestEnvelope requests a JSON attestation envelope from a handler that's
+// backed by the given test PKI and metadata signer, and returns the decoded
+// envelope.
+func requestEnvelope(t *testing.T, pki *testPKI, meta *metadataSigner) attestationEnvelope {
+	t.Helper()
+	h := attestationHandler(newTestAttester(t, pki), testHashes(), newTokenStore(0), meta, nil, newAuditLog(nil))
+	w := requestAttestation(t, h, "application/json")
+	var env attestationEnvelope
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("Failed to decode envelope %q: %v", w.Body, err)
+	}
+	return env
+}
+
+func TestAttestationEnvelopeMetadata(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	env := requestEnvelope(t, pki, testMetadataSigner())
+
+	var md map[string]string
+	if err := json.Unmarshal(env.Metadata, &md); err != nil {
+		t.Fatalf("Failed to decode metadata %q: %v", env.Metadata, err)
+	}
+	if md["version"] != "1.2.3" || md["timestamp"] != "2023-01-01T00:00:00Z" {
+		t.Errorf("Expected static metadata and timestamp but got %v.", md)
+	}
+
+	// The metadata doesn't interfere with the document, which still
+	// verifies and binds the hashes as user data.
+	rawDoc, err := base64.StdEncoding.DecodeString(env.Document)
+	if err != nil {
+		t.Fatalf("Failed to decode document: %v", err)
+	}
+	nonce, _ := hex.DecodeString(testNonce)
+	res, err := verifyDocument(rawDoc, nonce, pki.opts(testEpoch))
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+	if !bytes.Equal(res.Document.UserData, testHashes().Serialize()) {
+		t.Error("Expected document's user data to be the hashes, not the metadata.")
+	}
+	if bytes.Contains(res.Document.UserData, []byte("1.2.3")) {
+		t.Error("Expected metadata to not be part of the document.")
+	}
+
+	if err := VerifyMetadata(res, env.Metadata, env.MetadataSignature); err != nil {
+		t.Errorf("Expected metadata signature to verify but got %v.", err)
+	}
+	tampered := []byte(strings.Replace(string(env.Metadata), "1.2.3", "6.6.6", 1))
+	if err := VerifyMetadata(res, tampered, env.MetadataSignature); !errors.Is(err, ErrBadMetadataSignature) {
+		t.Errorf("Expected %v for tampered metadata but got %v.", ErrBadMetadataSignature, err)
+	}
+}
+
+func TestAttestationEnvelopeWithoutMetadata(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	env := requestEnvelope(t, pki, nil)
+	if env.Metadata != nil || env.MetadataSignature != nil {
+		t.Errorf("Expected no metadata but got %q.", env.Metadata)
+	}
+
+	rawDoc, _ := base64.StdEncoding.DecodeString(env.Document)
+	nonce, _ := hex.DecodeString(testNonce)
+	res, err := verifyDocument(rawDoc, nonce, pki.opts(testEpoch))
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+	// Without a bound key, no metadata verifies.
+	if err := VerifyMetadata(res, []byte("{}"), nil); !errors.Is(err, ErrBadMetadataSignature) {
+		t.Errorf("Expected %v but got %v.", ErrBadMetadataSignature, err)
+	}
+}
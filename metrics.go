@@ -0,0 +1,41 @@
+package main
+
+import (
+	"expvar"
+)
+
+// The following metrics are published via expvar and served by the
+// enclave-internal Web server.
+var (
+	metricPubConns          = expvar.NewInt("public_conns_active")
+	metricPubConnsRejected  = expvar.NewInt("public_conns_rejected")
+	metricIntConns          = expvar.NewInt("internal_conns_active")
+	metricIntConnsRejected  = expvar.NewInt("internal_conns_rejected")
+	metricBreakerState      = expvar.NewMap("outbound_breaker_state")
+	metricFwdProxyAllowed   = expvar.NewMap("forward_proxy_allowed")
+	metricFwdProxyDenied    = expvar.NewMap("forward_proxy_denied")
+	metricPCR0Mismatch      = expvar.NewInt("pcr0_mismatch")
+	metricTapRetries        = expvar.NewInt("tap_io_retries")
+	metricTapDrops          = expvar.NewInt("tap_write_drops")
+	metricVerifyCacheHits   = expvar.NewInt("verify_cache_hits")
+	metricVerifyCacheMisses = expvar.NewInt("verify_cache_misses")
+	metricProxyRejected     = expvar.NewInt("proxied_requests_rejected")
+	metricRateLimited       = expvar.NewInt("rate_limited_requests")
+	metricBackendRejected   = expvar.NewInt("backend_responses_rejected")
+	metricGoroutines        = expvar.NewInt("goroutines")
+	metricLinkMTU           = expvar.NewInt("link_mtu")
+	metricClockSkew         = expvar.NewInt("clock_skew_ms")
+	metricNetworkingUp      = expvar.NewInt("networking_up")
+	metricTunnelBytesIn     = expvar.NewInt("tunnel_bytes_in")
+	metricTunnelBytesOut    = expvar.NewInt("tunnel_bytes_out")
+	metricReattaches        = expvar.NewInt("tunnel_reattaches")
+	metricAttestations      = expvar.NewInt("attestations")
+	// metricAttestationFailures counts the subset of attestations that
+	// failed.
+	metricAttestationFailures = expvar.NewInt("attestation_failures")
+)
+
+func init() {
+	// Like our other JSON responses, our metrics carry our API version.
+	expvar.Publish("api_version", expvar.Func(func() any { return apiVersion }))
+}
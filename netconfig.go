@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultLinkMTU is the MTU of our TAP interface if the config doesn't
+	// specify one.  It matches the default MTU of the proxy on the EC2 host.
+	defaultLinkMTU = 1500
+	// defaultHandshakeTimeout bounds the handshake with the host if the
+	// config doesn't specify a timeout.
+	defaultHandshakeTimeout = 5 * time.Second
+)
+
+// NetConfig configures the enclave's networking layer, i.e., the TAP
+// interface and the tunnel to the proxy on the EC2 host.  It's independent
+// of nitriding's configuration and is derived from our Config by
+// newNetConfig.
+type NetConfig struct {
+	// ParentCID is the CID of the EC2 host.
+	ParentCID uint32
+	// HostProxyPort is the vsock port of the proxy on the EC2 host.
+	HostProxyPort uint32
+
+	// TapName is the name of the TAP interface.
+	TapName string
+	// TapAddr is the TAP interface's IP address and network in CIDR
+	// notation.
+	TapAddr string
+	// MAC is the TAP interface's MAC address.  If MAC is nil, the kernel
+	// picks an address.
+	MAC net.HardwareAddr
+	// Gateway is the IP address of our default gateway.
+	Gateway string
+	// Nameserver is the IP address of the DNS resolver that we write to
+	// resolv.conf.
+	Nameserver string
+	// MTU is the TAP interface's MTU.  Frame buffers are sized accordingly.
+	MTU int
+	// DiscoverMTU makes us ask the host for its MTU during setup, and fall
+	// back to MTU if the host can't tell us.
+	DiscoverMTU bool
+	// MultiQueue asks for a multi-queue TAP device.  If the kernel doesn't
+	// support multiple queues, we fall back to a single queue.
+	MultiQueue bool
+	// HandshakeTimeout bounds the time we wait for the host to accept our
+	// connection request.
+	HandshakeTimeout time.Duration
+
+	// FramePrefixLen is the length in bytes of each frame's length prefix.
+	FramePrefixLen int
+	// NegotiateProtocol makes us ask the host which framing features it
+	// supports during setup, and fall back to the legacy protocol if the host
+	// can't tell us.
+	NegotiateProtocol bool
+	// FrameCompression is the compression that we ask the host for during
+	// negotiation.  Frames are only compressed if the host agrees.
+	FrameCompression string
+	// DropTapWriteErrors makes us drop frames whose write to the TAP device
+	// fails with a transient error, instead of tearing down networking.
+	DropTapWriteErrors bool
+	// CaptureFile is the path of a pcap file for tunnel frames.  Capturing
+	// is off if CaptureFile is empty.
+	CaptureFile string
+	// CaptureMaxBytes caps the size of the capture file.
+	CaptureMaxBytes int64
+	// LogSampling configures the sampling of per-frame log statements.
+	LogSampling LogSamplingConfig
+	// FrameFlush configures the buffering of frames that we send to the
+	// host.
+	FrameFlush FrameFlushConfig
+	// Socket configures the vsock connection to the host.
+	Socket SocketOptions
+	// MaxFailures is the number of consecutive failures to set up
+	// networking after which we give up.  If MaxFailures is 0, we keep
+	// trying forever.
+	MaxFailures int
+	// Tracer traces the setup of networking.  If Tracer is nil, tracing is
+	// off.
+	Tracer trace.Tracer
+	// ExtraTaps are additional TAP devices, each with its own tunnel to the
+	// host.  See devices.
+	ExtraTaps []TapConfig
+
+	// secondary is set for additional TAP devices, which leave the default
+	// route, resolv.conf, and our networking metrics alone.
+	secondary bool
+}
+
+// newNetConfig derives the networking configuration from the given config.
+// This is the only place that maps our Config to networking settings.
+func newNetConfig(c *Config) *NetConfig {
+	cid := c.ParentCID
+	if cid == 0 {
+		var err error
+		if cid, err = DetectParentCID(); err != nil {
+			log.Warnf("Failed to detect parent CID; falling back to %d: %v", cid, err)
+		} else {
+			log.Printf("Detected parent CID %d.", cid)
+		}
+	}
+
+	handshakeTimeout := c.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+
+	// Our default gateway -- gvproxy -- also operates a DNS resolver.
+	return &NetConfig{
+		ParentCID:          cid,
+		HostProxyPort:      c.HostProxyPort,
+		TapName:            ifaceTap,
+		TapAddr:            addrTap,
+		MAC:                c.mac(),
+		Gateway:            defaultGw,
+		Nameserver:         defaultGw,
+		MTU:                defaultLinkMTU,
+		DiscoverMTU:        c.DiscoverMTU,
+		MultiQueue:         !c.SingleQueueTap,
+		HandshakeTimeout:   handshakeTimeout,
+		FramePrefixLen:     c.framePrefixLen(),
+		NegotiateProtocol:  c.NegotiateProtocol,
+		FrameCompression:   c.FrameCompression,
+		DropTapWriteErrors: c.DropTapWriteErrors,
+		CaptureFile:        c.CaptureFile,
+		CaptureMaxBytes:    c.CaptureMaxBytes,
+		LogSampling:        c.LogSampling,
+		FrameFlush:         c.FrameFlush,
+		Socket:             c.Socket,
+		MaxFailures:        c.MaxNetworkingFailures,
+		ExtraTaps:          c.ExtraTaps,
+	}
+}
+
+// Validate returns an error if the networking configuration is incomplete or
+// malformed.
+func (n *NetConfig) Validate() error {
+	if n.HostProxyPort == 0 {
+		return errors.New("host proxy port must be set")
+	}
+	if n.TapName == "" {
+		return errors.New("TAP interface name must be set")
+	}
+	if _, _, err := net.ParseCIDR(n.TapAddr); err != nil {
+		return fmt.Errorf("bad TAP address: %w", err)
+	}
+	if n.MAC != nil {
+		if err := validMAC(n.MAC); err != nil {
+			return fmt.Errorf("bad MAC address %s: %w", n.MAC, err)
+		}
+	}
+	if !n.secondary && net.ParseIP(n.Gateway) == nil {
+		return fmt.Errorf("bad gateway address: %q", n.Gateway)
+	}
+	if !n.secondary && net.ParseIP(n.Nameserver) == nil {
+		return fmt.Errorf("bad nameserver address: %q", n.Nameserver)
+	}
+	if err := validateTaps(n.ExtraTaps, n.HostProxyPort); err != nil {
+		return err
+	}
+	if n.MTU <= 0 {
+		return fmt.Errorf("bad MTU: %d", n.MTU)
+	}
+	if n.HandshakeTimeout <= 0 {
+		return fmt.Errorf("bad handshake timeout: %s", n.HandshakeTimeout)
+	}
+	return validPrefixLen(n.FramePrefixLen)
+}
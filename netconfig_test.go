@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validNetConfig returns a networking configuration that passes validation.
+func validNetConfig() *NetConfig {
+	cfg := testConfig()
+	cfg.ParentCID = 3
+	return newNetConfig(cfg)
+}
+
+func TestNewNetConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.ParentCID = 16
+	cfg.HostProxyPort = 2048
+	cfg.MAC = "02:00:00:00:00:01"
+	cfg.FramePrefixLen = prefixLen32
+	cfg.SingleQueueTap = true
+	cfg.HandshakeTimeout = time.Minute
+	n := newNetConfig(cfg)
+
+	if n.ParentCID != 16 || n.HostProxyPort != 2048 {
+		t.Errorf("Expected CID 16 and port 2048 but got %d and %d.", n.ParentCID, n.HostProxyPort)
+	}
+	if n.MAC.String() != "02:00:00:00:00:01" {
+		t.Errorf("Expected MAC 02:00:00:00:00:01 but got %s.", n.MAC)
+	}
+	if n.FramePrefixLen != prefixLen32 || n.MultiQueue || n.HandshakeTimeout != time.Minute {
+		t.Errorf("Expected the config's framing, queue, and timeout settings but got %+v.", n)
+	}
+	if err := n.Validate(); err != nil {
+		t.Errorf("Expected valid networking config but got %v.", err)
+	}
+}
+
+func TestNewNetConfigDefaults(t *testing.T) {
+	n := validNetConfig()
+	if n.TapName != ifaceTap || n.TapAddr != addrTap {
+		t.Errorf("Expected TAP device %s with %s but got %s with %s.", ifaceTap, addrTap, n.TapName, n.TapAddr)
+	}
+	// gvproxy is both our default gateway and our resolver.
+	if n.Gateway != defaultGw || n.Nameserver != defaultGw {
+		t.Errorf("Expected gateway and nameserver %s but got %s and %s.", defaultGw, n.Gateway, n.Nameserver)
+	}
+	if n.MTU != defaultLinkMTU || n.HandshakeTimeout != defaultHandshakeTimeout || n.FramePrefixLen != prefixLen16 {
+		t.Errorf("Expected default MTU, handshake timeout, and prefix but got %+v.", n)
+	}
+	if !n.MultiQueue {
+		t.Error("Expected multi-queue TAP device by default.")
+	}
+	if n.MAC.String() != defaultMAC {
+		t.Errorf("Expected MAC %s but got %s.", defaultMAC, n.MAC)
+	}
+}
+
+func TestNetConfigValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		modify  func(n *NetConfig)
+		wantErr string
+	}{
+		{"no host proxy port", func(n *NetConfig) { n.HostProxyPort = 0 }, "host proxy port"},
+		{"no TAP name", func(n *NetConfig) { n.TapName = "" }, "TAP interface name"},
+		{"bad TAP address", func(n *NetConfig) { n.TapAddr = "192.168.127.2" }, "bad TAP address"},
+		{"multicast MAC", func(n *NetConfig) { n.MAC[0] |= 1 }, "bad MAC address"},
+		{"bad gateway", func(n *NetConfig) { n.Gateway = "gateway" }, "bad gateway"},
+		{"bad nameserver", func(n *NetConfig) { n.Nameserver = "" }, "bad nameserver"},
+		{"bad MTU", func(n *NetConfig) { n.MTU = 0 }, "bad MTU"},
+		{"bad handshake timeout", func(n *NetConfig) { n.HandshakeTimeout = -time.Second }, "bad handshake timeout"},
+		{"bad prefix", func(n *NetConfig) { n.FramePrefixLen = 3 }, "unsupported frame length prefix"},
+		{"clashing TAP", func(n *NetConfig) {
+			n.ExtraTaps = []TapConfig{{Name: ifaceTap, Addr: "192.168.128.2/24", HostProxyPort: 1025}}
+		}, "already taken"},
+		{"secondary without gateway", func(n *NetConfig) {
+			n.secondary, n.Gateway, n.Nameserver = true, "", ""
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := validNetConfig()
+			c.modify(n)
+			err := n.Validate()
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error but got %v.", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("Expected error containing %q but got %v.", c.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxNonces caps the number of nonces that a nonceCache remembers.  At the
+// cap, new nonces are turned away until old ones expire, so a flood of
+// requests can't exhaust our memory.
+const maxNonces = 100000
+
+var (
+	errNonceReplayed  = errors.New("nonce was already used")
+	errNonceCacheFull = errors.New("too many recent nonces")
+)
+
+// nonceCache remembers the nonces of recent requests, so a nonce that's
+// replayed within the window can be rejected.  Expired nonces are swept
+// periodically while the cache isn't empty.  A nil *nonceCache remembers
+// nothing.
+type nonceCache struct {
+	sync.Mutex
+	window time.Duration
+	max    int
+	seen   map[string]time.Time
+	// queue holds the nonces in the order in which they were reserved.  All
+	// nonces share the same window, so the oldest nonce is always the first
+	// to expire, and expired nonces can be evicted without scanning the
+	// cache.  Released nonces linger in queue until they expire.
+	queue   []nonceEntry
+	sweeper *time.Timer
+	now     func() time.Time
+}
+
+// nonceEntry is a nonce in a nonceCache's queue.
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// newNonceCache returns a cache that remembers nonces for the given window.
+// If the window is 0 or negative, replay detection is off, in which case nil
+// is returned.
+func newNonceCache(window time.Duration) *nonceCache {
+	if window <= 0 {
+		return nil
+	}
+	return &nonceCache{
+		window: window,
+		max:    maxNonces,
+		seen:   make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// reserve claims the given nonce for a request.  It returns errNonceReplayed
+// if the nonce was already claimed within the window, and errNonceCacheFull
+// if the cache is at its cap.  A request that fails after reserving its nonce
+// must release it, so that only nonces of successful requests are used up.
+func (c *nonceCache) reserve(nonce string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if expires, ok := c.seen[nonce]; ok && !now.After(expires) {
+		return errNonceReplayed
+	}
+	if len(c.seen) >= c.max {
+		c.evictExpired(now)
+		if len(c.seen) >= c.max {
+			return errNonceCacheFull
+		}
+	}
+	c.seen[nonce] = now.Add(c.window)
+	c.queue = append(c.queue, nonceEntry{nonce: nonce, expires: c.seen[nonce]})
+	if c.sweeper == nil {
+		c.sweeper = time.AfterFunc(c.window, c.sweep)
+	}
+	return nil
+}
+
+// release forgets the given nonce, so it can be used again.
+func (c *nonceCache) release(nonce string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.seen, nonce)
+	// Don't let a flood of failing requests grow the queue with released
+	// nonces.  Compacting only once released nonces make up most of the
+	// queue keeps the cost per release constant on average.
+	if len(c.queue) > 2*len(c.seen)+1 {
+		c.compact()
+	}
+}
+
+// sweep evicts expired nonces, and schedules the next sweep if nonces
+// remain.
+func (c *nonceCache) sweep() {
+	c.Lock()
+	defer c.Unlock()
+	c.evictExpired(c.now())
+	if len(c.seen) == 0 {
+		c.sweeper = nil
+		return
+	}
+	c.sweeper.Reset(c.window)
+}
+
+// evictExpired evicts expired nonces from the front of the queue.  It must
+// be called with the lock held.
+func (c *nonceCache) evictExpired(now time.Time) {
+	for len(c.queue) > 0 && now.After(c.queue[0].expires) {
+		e := c.queue[0]
+		// The nonce may have been released, and reserved again since.
+		if expires, ok := c.seen[e.nonce]; ok && expires.Equal(e.expires) {
+			delete(c.seen, e.nonce)
+		}
+		c.queue[0] = nonceEntry{}
+		c.queue = c.queue[1:]
+	}
+	if len(c.queue) == 0 {
+		c.queue = nil
+	}
+}
+
+// compact drops released nonces from the queue.  It must be called with the
+// lock held.
+func (c *nonceCache) compact() {
+	queue := make([]nonceEntry, 0, len(c.seen))
+	for _, e := range c.queue {
+		if expires, ok := c.seen[e.nonce]; ok && expires.Equal(e.expires) {
+			queue = append(queue, e)
+		}
+	}
+	c.queue = queue
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNonceCache(window time.Duration) (*nonceCache, *testClock) {
+	clock := &testClock{t: testEpoch}
+	c := newNonceCache(window)
+	c.now = clock.now
+	return c, clock
+}
+
+// getAttestation requests an attestation document for the given nonce from
+// the given handler and returns the status code.
+func getAttestation(t *testing.T, h http.HandlerFunc, nonce string) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+nonce, nil))
+	return w.Code
+}
+
+func TestNonceCacheOffByDefault(t *testing.T) {
+	if c := newNonceCache(0); c != nil {
+		t.Fatal("Expected no nonce cache for window 0.")
+	}
+	if c := newNonceCache(-time.Minute); c != nil {
+		t.Fatal("Expected no nonce cache for negative window.")
+	}
+	var c *nonceCache
+	for i := 0; i < 2; i++ {
+		if err := c.reserve("nonce"); err != nil {
+			t.Fatalf("Expected nil cache to accept nonces but got %v.", err)
+		}
+	}
+
+	h := attestationHandler(&fakeAttester{doc: []byte("document")}, testHashes(), newTokenStore(0), nil,
+		newNonceCache(testConfig().NonceReplayWindow), newAuditLog(nil))
+	nonce := strings.Repeat("ab", nonceLen)
+	for i := 0; i < 2; i++ {
+		if code := getAttestation(t, h, nonce); code != http.StatusOK {
+			t.Fatalf("Expected status code %d by default but got %d.", http.StatusOK, code)
+		}
+	}
+}
+
+func TestNonceCacheReplay(t *testing.T) {
+	c, clock := newTestNonceCache(time.Minute)
+	if err := c.reserve("a"); err != nil {
+		t.Fatalf("Expected fresh nonce to be accepted but got %v.", err)
+	}
+	clock.advance(time.Minute)
+	if err := c.reserve("a"); !errors.Is(err, errNonceReplayed) {
+		t.Fatalf("Expected %v within window but got %v.", errNonceReplayed, err)
+	}
+	clock.advance(time.Second)
+	if err := c.reserve("a"); err != nil {
+		t.Fatalf("Expected expired nonce to be accepted but got %v.", err)
+	}
+}
+
+func TestNonceCacheRelease(t *testing.T) {
+	c, _ := newTestNonceCache(time.Minute)
+	_ = c.reserve("a")
+	c.release("a")
+	if err := c.reserve("a"); err != nil {
+		t.Fatalf("Expected released nonce to be accepted but got %v.", err)
+	}
+}
+
+func TestNonceCacheCap(t *testing.T) {
+	c, clock := newTestNonceCache(time.Minute)
+	c.max = 2
+	_ = c.reserve("a")
+	_ = c.reserve("b")
+	if err := c.reserve("c"); !errors.Is(err, errNonceCacheFull) {
+		t.Fatalf("Expected %v but got %v.", errNonceCacheFull, err)
+	}
+	clock.advance(2 * time.Minute)
+	if err := c.reserve("c"); err != nil {
+		t.Fatalf("Expected nonce to be accepted once others expired but got %v.", err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.seen) != 1 {
+		t.Fatalf("Expected 1 remembered nonce but got %d.", len(c.seen))
+	}
+}
+
+func TestNonceCacheEvictsOldestFirst(t *testing.T) {
+	c, clock := newTestNonceCache(time.Minute)
+	c.max = 2
+	_ = c.reserve("a")
+	clock.advance(30 * time.Second)
+	_ = c.reserve("b")
+	// A released nonce that's reserved again expires with its new
+	// reservation, not with its old one.
+	clock.advance(10 * time.Second)
+	c.release("a")
+	_ = c.reserve("a")
+
+	clock.advance(21 * time.Second)
+	if err := c.reserve("c"); !errors.Is(err, errNonceCacheFull) {
+		t.Fatalf("Expected %v but got %v.", errNonceCacheFull, err)
+	}
+	clock.advance(30 * time.Second)
+	if err := c.reserve("c"); err != nil {
+		t.Fatalf("Expected oldest nonce to make room but got %v.", err)
+	}
+	if err := c.reserve("a"); !errors.Is(err, errNonceReplayed) {
+		t.Fatalf("Expected %v for nonce that was reserved again but got %v.", errNonceReplayed, err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.queue) != 2 {
+		t.Fatalf("Expected 2 queued nonces but got %d.", len(c.queue))
+	}
+}
+
+func TestNonceCacheReleaseBoundsQueue(t *testing.T) {
+	c, _ := newTestNonceCache(time.Minute)
+	_ = c.reserve("kept")
+	for i := 0; i < 1000; i++ {
+		n := strings.Repeat("x", i)
+		_ = c.reserve(n)
+		c.release(n)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.queue) > 2*len(c.seen)+1 {
+		t.Fatalf("Expected released nonces to be dropped from the queue but got %d for %d nonces.", len(c.queue), len(c.seen))
+	}
+	if _, ok := c.seen["kept"]; !ok {
+		t.Fatal("Expected nonce to be remembered.")
+	}
+}
+
+func TestNonceCacheSweep(t *testing.T) {
+	c, clock := newTestNonceCache(time.Hour)
+	_ = c.reserve("a")
+	clock.advance(30 * time.Minute)
+	_ = c.reserve("b")
+
+	clock.advance(31 * time.Minute)
+	c.sweep()
+	c.Lock()
+	if _, ok := c.seen["a"]; ok || len(c.seen) != 1 || c.sweeper == nil {
+		t.Fatalf("Expected sweep to evict only the expired nonce but got %v.", c.seen)
+	}
+	c.Unlock()
+
+	clock.advance(time.Hour)
+	c.sweep()
+	c.Lock()
+	defer c.Unlock()
+	if len(c.seen) != 0 || c.sweeper != nil {
+		t.Fatalf("Expected empty cache without sweeper but got %v.", c.seen)
+	}
+}
+
+func TestNonceCacheSweepsOnTimer(t *testing.T) {
+	c := newNonceCache(5 * time.Millisecond)
+	for _, n := range []string{"a", "b", "c"} {
+		_ = c.reserve(n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.Lock()
+		n := len(c.seen)
+		c.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected timer to sweep expired nonces but %d remain.", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAttestationRejectsReplayedNonce(t *testing.T) {
+	nonces, clock := newTestNonceCache(time.Minute)
+	a := &fakeAttester{doc: []byte("document")}
+	h := attestationHandler(a, testHashes(), newTokenStore(0), nil, nonces, newAuditLog(nil))
+	nonce := strings.Repeat("ab", nonceLen)
+
+	if code := getAttestation(t, h, nonce); code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, code)
+	}
+	if code := getAttestation(t, h, nonce); code != http.StatusConflict {
+		t.Fatalf("Expected status code %d within window but got %d.", http.StatusConflict, code)
+	}
+	clock.advance(time.Minute + time.Second)
+	if code := getAttestation(t, h, nonce); code != http.StatusOK {
+		t.Fatalf("Expected status code %d after expiry but got %d.", http.StatusOK, code)
+	}
+}
+
+func TestAttestationFailureKeepsNonce(t *testing.T) {
+	nonces, _ := newTestNonceCache(time.Minute)
+	a := &fakeAttester{err: errNSMDown}
+	h := attestationHandler(a, testHashes(), newTokenStore(0), nil, nonces, newAuditLog(nil))
+	nonce := strings.Repeat("ab", nonceLen)
+
+	if code := getAttestation(t, h, nonce); code != http.StatusInternalServerError {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusInternalServerError, code)
+	}
+	a.setErr(nil)
+	a.doc = []byte("document")
+	if code := getAttestation(t, h, nonce); code != http.StatusOK {
+		t.Fatalf("Expected failed request to leave nonce unused but got %d.", code)
+	}
+}
+
+func TestAttestationNonceCacheFull(t *testing.T) {
+	nonces, _ := newTestNonceCache(time.Minute)
+	nonces.max = 1
+	h := attestationHandler(&fakeAttester{doc: []byte("document")}, testHashes(), newTokenStore(0), nil, nonces, newAuditLog(nil))
+
+	_ = getAttestation(t, h, strings.Repeat("ab", nonceLen))
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+strings.Repeat("cd", nonceLen), nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("Expected Retry-After header.")
+	}
+}
@@ -0,0 +1,63 @@
+// Package secrets implements a tiny in-memory store for secrets, e.g., keys
+// that the enclave obtained from KMS.  Secrets never touch the disk, and their
+// memory is zeroed when they're overwritten or removed.
+package secrets
+
+import (
+	"sync"
+)
+
+// Store is a thread-safe key-value store for secrets.
+type Store struct {
+	sync.Mutex
+	secrets map[string][]byte
+}
+
+// New returns a new, empty store.
+func New() *Store {
+	return &Store{secrets: make(map[string][]byte)}
+}
+
+// Put stores a copy of the given value under the given name.  If the name
+// already holds a secret, the old secret is zeroed.
+func (s *Store) Put(name string, value []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	if old, exists := s.secrets[name]; exists {
+		zero(old)
+	}
+	s.secrets[name] = append([]byte(nil), value...)
+}
+
+// Get returns a copy of the secret that's stored under the given name.  The
+// second return value is false if there's no such secret.  Callers should zero
+// the copy once they no longer need it.
+func (s *Store) Get(name string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	value, exists := s.secrets[name]
+	if !exists {
+		return nil, false
+	}
+	return append([]byte(nil), value...), true
+}
+
+// Zeroize zeroes and removes the secret that's stored under the given name.
+func (s *Store) Zeroize(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if value, exists := s.secrets[name]; exists {
+		zero(value)
+		delete(s.secrets, name)
+	}
+}
+
+// zero overwrites the given byte slice with zeroes.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,95 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	s := New()
+	value := []byte("hunter2")
+	s.Put("db", value)
+
+	// Modifying the caller's slice must not affect the stored secret.
+	value[0] = 'X'
+	got, exists := s.Get("db")
+	if !exists {
+		t.Fatal("Expected secret to exist but it doesn't.")
+	}
+	if !bytes.Equal(got, []byte("hunter2")) {
+		t.Fatalf("Expected %q but got %q.", "hunter2", got)
+	}
+
+	// Modifying the returned copy must not affect the stored secret either.
+	got[0] = 'X'
+	if got, _ = s.Get("db"); !bytes.Equal(got, []byte("hunter2")) {
+		t.Fatalf("Expected %q but got %q.", "hunter2", got)
+	}
+
+	if _, exists := s.Get("missing"); exists {
+		t.Fatal("Expected missing secret to not exist but it does.")
+	}
+}
+
+func TestPutZeroesOldValue(t *testing.T) {
+	s := New()
+	s.Put("db", []byte("hunter2"))
+	old := s.secrets["db"]
+
+	s.Put("db", []byte("correct horse"))
+	if !bytes.Equal(old, make([]byte, len(old))) {
+		t.Fatalf("Expected overwritten secret to be zeroed but got %q.", old)
+	}
+	if got, _ := s.Get("db"); !bytes.Equal(got, []byte("correct horse")) {
+		t.Fatalf("Expected %q but got %q.", "correct horse", got)
+	}
+}
+
+func TestZeroize(t *testing.T) {
+	s := New()
+	s.Put("db", []byte("hunter2"))
+	underlying := s.secrets["db"]
+
+	s.Zeroize("db")
+	if !bytes.Equal(underlying, make([]byte, len(underlying))) {
+		t.Fatalf("Expected zeroized secret to be zeroed but got %q.", underlying)
+	}
+	if _, exists := s.Get("db"); exists {
+		t.Fatal("Expected zeroized secret to be removed but it still exists.")
+	}
+
+	// Zeroizing a secret that doesn't exist is a no-op.
+	s.Zeroize("db")
+}
+
+// TestConcurrentAccess is meant to be run with the race detector.
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 1000
+	)
+	var (
+		s  = New()
+		wg sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("secret-%d", i%2)
+			for j := 0; j < iterations; j++ {
+				s.Put(name, []byte{byte(i), byte(j)})
+				if value, exists := s.Get(name); exists && len(value) != 2 {
+					t.Errorf("Expected 2-byte secret but got %d bytes.", len(value))
+				}
+				if j%10 == 0 {
+					s.Zeroize(name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pathHostProtocol is the path at which the proxy on the EC2 host tells
+	// us which framing protocol features it supports.
+	pathHostProtocol = "/protocol"
+	// legacyProtocolVersion is the version of hosts that predate the
+	// negotiation, and only speak the 2-byte length prefix.
+	legacyProtocolVersion = 0
+	// protocolVersion is the latest framing protocol version that we speak.
+	protocolVersion = 1
+)
+
+// protocolCaps is the JSON representation of the framing protocol features
+// that a side of the tunnel supports.  The host serves it at
+// pathHostProtocol.
+type protocolCaps struct {
+	Version     int      `json:"version"`
+	PrefixLens  []int    `json:"prefix_lens"`
+	Compression []string `json:"compression,omitempty"`
+	Batching    bool     `json:"batching,omitempty"`
+}
+
+// framingProtocol is the outcome of the negotiation: the features that both
+// sides of the tunnel use.
+type framingProtocol struct {
+	Version     int
+	PrefixLen   int
+	Compression string
+	Batching    bool
+}
+
+// legacyProtocol is what we speak with hosts that don't negotiate.
+var legacyProtocol = framingProtocol{Version: legacyProtocolVersion, PrefixLen: prefixLen16}
+
+// connectPath returns the given path of the host's connect endpoint along
+// with the framing that we use, so the host knows how to translate our frames
+// for its virtual network.  The host leaves tunnels that use the legacy
+// framing untouched, so we only ask for what deviates from it.
+func connectPath(path string, n *NetConfig) string {
+	q := url.Values{}
+	if n.FramePrefixLen != 0 && n.FramePrefixLen != prefixLen16 {
+		q.Set("prefix_len", strconv.Itoa(n.FramePrefixLen))
+	}
+	if n.FrameCompression != "" {
+		q.Set("compression", n.FrameCompression)
+	}
+	if n.FrameFlush.Batch {
+		q.Set("batch", "1")
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// negotiate returns the framing protocol that we use with a host that
+// supports the given features.  We use the wanted prefix length if the host
+// supports it, and the legacy 2-byte prefix otherwise.  Likewise, we only
+// compress frames if the host supports the wanted compression, and only send
+// batches if we want to and the host supports them.  If host is nil, i.e.,
+// the host didn't tell us what it supports, the legacy protocol is used.
+func negotiate(wantPrefixLen int, wantCompression string, wantBatching bool, host *protocolCaps) framingProtocol {
+	if host == nil || host.Version <= legacyProtocolVersion {
+		return legacyProtocol
+	}
+	p := framingProtocol{Version: host.Version, PrefixLen: prefixLen16}
+	if p.Version > protocolVersion {
+		p.Version = protocolVersion
+	}
+	for _, l := range host.PrefixLens {
+		if l == wantPrefixLen {
+			p.PrefixLen = wantPrefixLen
+		}
+	}
+	for _, c := range host.Compression {
+		if c == wantCompression {
+			p.Compression = wantCompression
+		}
+	}
+	p.Batching = wantBatching && host.Batching
+	return p
+}
+
+// queryHostProtocol asks the proxy on the EC2 host which framing protocol
+// features it supports.
+func queryHostProtocol(n *NetConfig) (*protocolCaps, error) {
+	body, err := queryHost(n, http.MethodGet, pathHostProtocol, 1024)
+	if err != nil {
+		return nil, err
+	}
+	var caps protocolCaps
+	if err := json.Unmarshal(body, &caps); err != nil {
+		return nil, fmt.Errorf("host returned bad protocol capabilities: %w", err)
+	}
+	return &caps, nil
+}
+
+// hostProtocol negotiates the framing protocol with the host, falling back
+// to the legacy protocol if the host doesn't respond.
+func hostProtocol(n *NetConfig) framingProtocol {
+	caps, err := queryHostProtocol(n)
+	if err != nil {
+		log.Warnf("Failed to negotiate framing protocol; using legacy protocol: %v", err)
+	}
+	p := negotiate(n.FramePrefixLen, n.FrameCompression, n.FrameFlush.Batch, caps)
+	if p.PrefixLen != n.FramePrefixLen {
+		log.Warnf("Host doesn't support %d-byte frame length prefix; using %d bytes.", n.FramePrefixLen, p.PrefixLen)
+	}
+	if p.Compression != n.FrameCompression {
+		log.Warnf("Host doesn't support %s frame compression; not compressing frames.", n.FrameCompression)
+	}
+	if p.Batching != n.FrameFlush.Batch {
+		log.Warn("Host doesn't support frame batches; sending frames one by one.")
+	}
+	log.Printf("Using framing protocol version %d with %d-byte length prefix.", p.Version, p.PrefixLen)
+	return p
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// hostProtocolHandler returns a handler that responds to protocol queries
+// like a proxy on the EC2 host that supports the given features.
+func hostProtocolHandler(caps protocolCaps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != pathHostProtocol {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(caps)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		name          string
+		wantPrefixLen int
+		host          *protocolCaps
+		want          framingProtocol
+	}{
+		{"no answer", prefixLen32, nil, legacyProtocol},
+		{"legacy host", prefixLen32, &protocolCaps{Version: legacyProtocolVersion, PrefixLens: []int{prefixLen32}}, legacyProtocol},
+		{"same version, legacy prefix", prefixLen16, &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16, prefixLen32}},
+			framingProtocol{Version: 1, PrefixLen: prefixLen16}},
+		{"same version, wide prefix", prefixLen32, &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16, prefixLen32}},
+			framingProtocol{Version: 1, PrefixLen: prefixLen32}},
+		{"wide prefix unsupported", prefixLen32, &protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}},
+			framingProtocol{Version: 1, PrefixLen: prefixLen16}},
+		{"no prefixes", prefixLen32, &protocolCaps{Version: 1},
+			framingProtocol{Version: 1, PrefixLen: prefixLen16}},
+		{"newer host", prefixLen32, &protocolCaps{Version: protocolVersion + 1, PrefixLens: []int{prefixLen32}},
+			framingProtocol{Version: protocolVersion, PrefixLen: prefixLen32}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := negotiate(c.wantPrefixLen, "", false, c.host); got != c.want {
+				t.Fatalf("Expected %+v but got %+v.", c.want, got)
+			}
+		})
+	}
+}
+
+func TestHostProtocol(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.Handler
+		want    framingProtocol
+	}{
+		{"wide prefix", hostProtocolHandler(protocolCaps{Version: 1, PrefixLens: []int{prefixLen16, prefixLen32}}),
+			framingProtocol{Version: 1, PrefixLen: prefixLen32}},
+		{"legacy prefix only", hostProtocolHandler(protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}}),
+			framingProtocol{Version: 1, PrefixLen: prefixLen16}},
+		{"old host", http.NotFoundHandler(), legacyProtocol},
+		{"garbage", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("not json"))
+		}), legacyProtocol},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeHost(t, c.handler)
+			n := validNetConfig()
+			n.NegotiateProtocol = true
+			n.FramePrefixLen = prefixLen32
+			if got := hostProtocol(n); got != c.want {
+				t.Fatalf("Expected %+v but got %+v.", c.want, got)
+			}
+		})
+	}
+}
+
+func TestQueryHostProtocol(t *testing.T) {
+	want := protocolCaps{Version: 1, PrefixLens: []int{prefixLen16}}
+	useFakeHost(t, hostProtocolHandler(want))
+	caps, err := queryHostProtocol(validNetConfig())
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if caps.Version != want.Version || len(caps.PrefixLens) != 1 || caps.PrefixLens[0] != prefixLen16 {
+		t.Fatalf("Expected %+v but got %+v.", want, caps)
+	}
+}
+
+func TestConnectPath(t *testing.T) {
+	cases := []struct {
+		prefixLen   int
+		compression string
+		want        string
+	}{
+		{0, "", "/connect"},
+		{prefixLen16, "", "/connect"},
+		{prefixLen32, "", "/connect?prefix_len=4"},
+		{prefixLen16, frameCompressionGzip, "/connect?compression=gzip"},
+		{prefixLen32, frameCompressionGzip, "/connect?compression=gzip&prefix_len=4"},
+	}
+	for _, c := range cases {
+		n := validNetConfig()
+		n.FramePrefixLen = c.prefixLen
+		n.FrameCompression = c.compression
+		if got := connectPath("/connect", n); got != c.want {
+			t.Errorf("Expected %q but got %q.", c.want, got)
+		}
+	}
+}
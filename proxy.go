@@ -4,15 +4,17 @@ package main
 // https://github.com/containers/gvisor-tap-vsock/blob/main/cmd/vm/main_linux.go
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/brave/nitriding"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/containers/gvisor-tap-vsock/pkg/transport"
 	log "github.com/sirupsen/logrus"
 	"github.com/songgao/packets/ethernet"
 	"github.com/songgao/water"
@@ -20,20 +22,95 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 )
 
-var (
-	mtu = 4000
+const (
+	// maxTapRetries is the number of consecutive temporary errors after
+	// which we give up on reading from or writing to the TAP device.
+	maxTapRetries = 10
+	// minTapBackoff is the wait before the first retry of a TAP device
+	// operation.  The wait doubles with each retry, up to maxTapBackoff.
+	minTapBackoff = time.Millisecond
+	maxTapBackoff = 100 * time.Millisecond
 )
 
+// tapSleep is a variable pointing to the function that waits between retries
+// of TAP device operations.  Using a variable allows us to easily mock the
+// function in our unit tests.
+var tapSleep = time.Sleep
+
+// newTap is a variable pointing to the function that creates TAP devices.
+// Using a variable allows us to easily mock the function in our unit tests.
+var newTap = water.New
+
+// openTap creates the TAP device with the given name.  If multiQueue is set,
+// we ask for a multi-queue device first and fall back to a single-queue
+// device if the kernel doesn't support multiple queues.
+func openTap(name string, multiQueue bool) (*water.Interface, error) {
+	cfg := water.Config{
+		DeviceType: water.TAP,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name:       name,
+			MultiQueue: multiQueue,
+		},
+	}
+	tap, err := newTap(cfg)
+	if err == nil || !multiQueue {
+		return tap, err
+	}
+
+	cfg.PlatformSpecificParams.MultiQueue = false
+	tap, fallbackErr := newTap(cfg)
+	if fallbackErr != nil {
+		return nil, joinErrors(err, fallbackErr)
+	}
+	log.Printf("Multi-queue TAP device unsupported (%v); fell back to single-queue mode.", err)
+	return tap, nil
+}
+
+// setupDevice is a variable pointing to the function that sets up the
+// networking of a TAP device once.  Using a variable allows us to easily mock
+// the function in our unit tests.
+var setupDevice = setupNetworking
+
 // runNetworking calls the function that sets up our networking environment.
-// If anything fails, we try again after a brief wait period.
-func runNetworking(c *nitriding.Config, stop chan bool) {
+// If anything fails, we try again after a brief wait period.  If maxFailures
+// is positive, we give up and return an error after that many consecutive
+// failures.  runNetworking returns nil once it receives a stop reason.  The
+// given ready function is called whenever networking is up.
+func runNetworking(n *NetConfig, stop chan StopReason, ready func()) error {
+	var capture *frameCapture
+	if n.CaptureFile != "" {
+		var err error
+		if capture, err = newFrameCapture(n.CaptureFile, n.CaptureMaxBytes); err != nil {
+			return err
+		}
+		defer capture.Close()
+		log.Printf("Capturing tunnel frames to %s.", n.CaptureFile)
+	}
+
+	maxFailures := n.MaxFailures
 	var err error
-	for {
-		if err = setupNetworking(c, stop); err == nil {
-			return
+	for failures := 1; ; failures++ {
+		// The span covers the setup of networking, until it's ready or
+		// fails.
+		_, span := startSpan(withTracer(context.Background(), n.Tracer), "networking.setup")
+		var spanOnce sync.Once
+		endSetup := func(err error) { spanOnce.Do(func() { endSpan(span, err) }) }
+		err = setupDevice(n, stop, capture, func() { endSetup(nil); ready() })
+		endSetup(err)
+		if err == nil {
+			return nil
+		}
+		if maxFailures > 0 && failures >= maxFailures {
+			return fmt.Errorf("TAP tunnel to EC2 host failed %d times: %w", failures, err)
 		}
 		log.Printf("TAP tunnel to EC2 host failed: %v.  Restarting.", err)
-		time.Sleep(time.Second)
+		select {
+		case reason := <-stop:
+			log.Printf("Not restarting networking because enclave is stopping: %s.", reason)
+			return nil
+		case <-time.After(time.Second):
+		}
+		recoverAttach(n, err)
 	}
 }
 
@@ -45,37 +122,45 @@ func runNetworking(c *nitriding.Config, stop chan bool) {
 //  3. Establish a connection with the proxy running on the host.
 //  4. Spawn goroutines to forward traffic between the TAP device and the proxy
 //     running on the host.
-func setupNetworking(c *nitriding.Config, stop chan bool) error {
+func setupNetworking(n *NetConfig, stop chan StopReason, capture *frameCapture, ready func()) error {
 	log.Println("Setting up networking between host and enclave.")
 	defer log.Println("Tearing down networking between host and enclave.")
 
+	// The host's MTU and protocol may change between attempts, e.g., after
+	// the host proxy is upgraded, so we discover them anew without touching
+	// the shared config.
+	if n.DiscoverMTU || n.NegotiateProtocol {
+		discovered := *n
+		discovered.MTU = linkMTU(n)
+		if n.NegotiateProtocol {
+			p := hostProtocol(n)
+			discovered.FramePrefixLen = p.PrefixLen
+			discovered.FrameCompression = p.Compression
+			discovered.FrameFlush.Batch = p.Batching
+		}
+		n = &discovered
+	}
+
 	// Establish connection with the proxy running on the EC2 host.
-	endpoint := fmt.Sprintf("vsock://%d:%d/connect", parentCID, c.HostProxyPort)
-	conn, path, err := transport.Dial(endpoint)
+	endpoint := fmt.Sprintf("vsock://%d:%d/connect", n.ParentCID, n.HostProxyPort)
+	conn, path, err := dialHost(endpoint)
 	if err != nil {
 		return fmt.Errorf("failed to connect to host: %w", err)
 	}
 	defer conn.Close()
+	path = connectPath(path, n)
 	log.Println("Established connection with EC2 host.")
-
-	req, err := http.NewRequest(http.MethodPost, path, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create POST request: %w", err)
+	if err := setSocketOptions(conn, n.Socket); err != nil {
+		log.Warnf("Failed to set socket options; keeping defaults: %v", err)
 	}
-	if err := req.Write(conn); err != nil {
-		return fmt.Errorf("failed to send POST request to host: %w", err)
+
+	if err := sendHandshake(conn, path, n.HandshakeTimeout); err != nil {
+		return err
 	}
 	log.Println("Sent HTTP request to EC2 host.")
 
 	// Create a TAP interface.
-	tap, err := water.New(water.Config{
-		DeviceType: water.TAP,
-		PlatformSpecificParams: water.PlatformSpecificParams{
-			Name:       ifaceTap,
-			MultiQueue: true,
-		},
-	})
-
+	tap, err := openTap(n.TapName, n.MultiQueue)
 	if err != nil {
 		return fmt.Errorf("failed to create tap device: %w", err)
 	}
@@ -83,107 +168,178 @@ func setupNetworking(c *nitriding.Config, stop chan bool) error {
 	log.Println("Created TAP device.")
 
 	// Configure IP address, MAC address, MTU, default gateway, and DNS.
-	if err = configureTapIface(); err != nil {
+	if err = configureTapIface(n); err != nil {
 		return fmt.Errorf("failed to configure tap interface: %w", err)
 	}
-	if err = writeResolvconf(); err != nil {
-		return fmt.Errorf("failed to create resolv.conf: %w", err)
+	if n.Nameserver != "" {
+		if err = writeResolvconf(n.Nameserver); err != nil {
+			return fmt.Errorf("failed to create resolv.conf: %w", err)
+		}
 	}
 
 	// Set up networking links.
-	if err := linkUp(); err != nil {
+	if err := linkUp(n.TapName, n.MAC); err != nil {
 		return fmt.Errorf("failed to set MAC address: %w", err)
 	}
 	log.Println("Created networking link.")
 
 	// Spawn goroutines that forward traffic.
 	errCh := make(chan error, 1)
-	go tx(conn, tap, errCh, mtu)
-	go rx(conn, tap, errCh, mtu)
+	out := newFrameWriter(conn, n.FrameFlush)
+	if fw, ok := out.(*frameWriter); ok {
+		defer fw.Close()
+	}
+	go tx(newAttachConn(conn), tap, errCh, n.MTU, n.FramePrefixLen, capture, newLogSampler(n.LogSampling), newTapDropper(n.DropTapWriteErrors), newFrameCodec(n.FrameCompression))
+	go rx(out, tap, errCh, n.MTU, n.FramePrefixLen, capture, newLogSampler(n.LogSampling), newFrameCodec(n.FrameCompression))
 	log.Println("Started goroutines to forward traffic.")
+	if !n.secondary {
+		metricLinkMTU.Set(int64(n.MTU))
+		metricNetworkingUp.Set(1)
+		defer metricNetworkingUp.Set(0)
+	}
+	ready()
 	select {
 	case err := <-errCh:
 		return err
-	case <-stop:
-		log.Printf("Shutting down networking.")
+	case reason := <-stop:
+		log.Printf("Shutting down networking: %s.", reason)
 		return nil
 	}
 }
 
-func linkUp() error {
-	link, err := netlink.LinkByName(ifaceTap)
+// sendHandshake sends our connection request to the proxy on the EC2 host.
+// A host that accepts our connection but stalls must not block us forever,
+// so the request must be written within the given timeout.
+func sendHandshake(conn net.Conn, path string, timeout time.Duration) error {
+	req, err := http.NewRequest(http.MethodPost, path, nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create POST request: %w", err)
 	}
-	if mac == "" {
-		return netlink.LinkSetUp(link)
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set handshake deadline: %w", err)
 	}
-	hw, err := net.ParseMAC(mac)
+	if err := req.Write(conn); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("host didn't accept POST request within %s: %w", timeout, err)
+		}
+		return fmt.Errorf("failed to send POST request to host: %w", err)
+	}
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("failed to clear handshake deadline: %w", err)
+	}
+	return nil
+}
+
+func linkUp(name string, hw net.HardwareAddr) error {
+	link, err := netlink.LinkByName(name)
 	if err != nil {
 		return err
 	}
+	if hw == nil {
+		return netlink.LinkSetUp(link)
+	}
 	if err := netlink.LinkSetHardwareAddr(link, hw); err != nil {
 		return err
 	}
 	return netlink.LinkSetUp(link)
 }
 
-func rx(conn net.Conn, tap *water.Interface, errCh chan error, mtu int) {
+func rx(conn io.Writer, tap io.ReadWriter, errCh chan error, mtu, prefixLen int, capture *frameCapture, sampler *logSampler, codec *frameCodec) {
 	log.Println("Waiting for frames from enclave application.")
 	var frame ethernet.Frame
+	var buf []byte
 	for {
 		frame.Resize(mtu)
-		n, err := tap.Read([]byte(frame))
+		n, err := retryTemporary(func() (int, error) { return tap.Read([]byte(frame)) })
 		if err != nil {
 			errCh <- fmt.Errorf("failed to read packet from TAP device: %w", err)
 			return
 		}
 		frame = frame[:n]
+		capture.write(frame)
 
-		size := make([]byte, 2)
-		binary.LittleEndian.PutUint16(size, uint16(n))
-
-		if _, err := conn.Write(size); err != nil {
-			errCh <- fmt.Errorf("failed to write frame size to connection: %w", err)
+		encoded, err := codec.encode(frame)
+		if err != nil {
+			errCh <- fmt.Errorf("failed to compress frame: %w", err)
+			return
+		}
+		if buf, err = wireFrame(buf, encoded, prefixLen); err != nil {
+			errCh <- fmt.Errorf("failed to encode frame: %w", err)
 			return
 		}
-		if _, err := conn.Write(frame); err != nil {
+		if _, err := conn.Write(buf); err != nil {
 			errCh <- fmt.Errorf("failed to write frame to connection: %w", err)
 			return
 		}
+		metricTunnelBytesOut.Add(int64(len(buf)))
+		if log.IsLevelEnabled(log.DebugLevel) && sampler.allow() {
+			log.Debugf("Forwarded %d-byte frame to host.", n)
+		}
 	}
 }
 
-func tx(conn net.Conn, tap *water.Interface, errCh chan error, mtu int) {
+func tx(conn net.Conn, tap io.ReadWriter, errCh chan error, mtu, prefixLen int, capture *frameCapture, sampler *logSampler, drops *tapDropper, codec *frameCodec) {
 	log.Println("Waiting for frames from host.")
-	sizeBuf := make([]byte, 2)
+	sizeBuf := make([]byte, prefixLen)
 	buf := make([]byte, mtu+header.EthernetMinimumSize)
+	encoded := buf
+	if codec != nil {
+		encoded = make([]byte, len(buf)+codec.overhead())
+	}
 
 	for {
-		n, err := io.ReadFull(conn, sizeBuf)
+		size, err := readFrame(conn, sizeBuf, encoded)
 		if err != nil {
-			errCh <- fmt.Errorf("failed to read frame size from connection: %w", err)
+			errCh <- err
 			return
 		}
-		if n != 2 {
-			errCh <- fmt.Errorf("received unexpected frame size %d", n)
-			return
+		if codec != nil {
+			if size, err = codec.decode(buf, encoded[:size]); err != nil {
+				errCh <- fmt.Errorf("failed to decompress frame: %w", err)
+				return
+			}
 		}
-		size := int(binary.LittleEndian.Uint16(sizeBuf[0:2]))
 
-		n, err = io.ReadFull(conn, buf[:size])
-		if err != nil {
-			errCh <- fmt.Errorf("failed to read frame from connection: %w", err)
+		capture.write(buf[:size])
+		if _, err := retryTemporary(func() (int, error) { return tap.Write(buf[:size]) }); err != nil {
+			if drops.drop(err, size) {
+				continue
+			}
+			errCh <- fmt.Errorf("failed to write frame to TAP device: %w", err)
 			return
 		}
-		if n == 0 || n != size {
-			errCh <- fmt.Errorf("expected frame of size %d but got %d", size, n)
-			return
+		metricTunnelBytesIn.Add(int64(size))
+		if log.IsLevelEnabled(log.DebugLevel) && sampler.allow() {
+			log.Debugf("Forwarded %d-byte frame to enclave application.", size)
 		}
+	}
+}
 
-		if _, err := tap.Write(buf[:size]); err != nil {
-			errCh <- fmt.Errorf("failed to write frame to TAP device: %w", err)
-			return
+// retryTemporary runs the given TAP device operation and retries it for as
+// long as it fails with a temporary error, up to maxTapRetries times.  The
+// wait between retries backs off exponentially, so a device that keeps
+// failing doesn't make us spin.  Persistent errors are returned right away.
+func retryTemporary(op func() (int, error)) (int, error) {
+	backoff := minTapBackoff
+	for retries := 0; ; retries++ {
+		n, err := op()
+		if err == nil || retries >= maxTapRetries || !isTemporary(err) {
+			return n, err
 		}
+		metricTapRetries.Add(1)
+		tapSleep(backoff)
+		if backoff *= 2; backoff > maxTapBackoff {
+			backoff = maxTapBackoff
+		}
+	}
+}
+
+// isTemporary returns true if the given error is worth retrying, e.g.,
+// because a system call was interrupted by a signal.
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
 	}
+	var tempErr interface{ Temporary() bool }
+	return errors.As(err, &tempErr) && tempErr.Temporary()
 }
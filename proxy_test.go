@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/songgao/water"
+)
+
+// fakeTap implements a TAP device.  Reads return the given frames, one per
+// read, followed by io.EOF.  Writes are recorded.
+type fakeTap struct {
+	sync.Mutex
+	reads   [][]byte
+	written [][]byte
+}
+
+func newFakeTap(frames ...[]byte) *fakeTap {
+	return &fakeTap{reads: frames}
+}
+
+func (t *fakeTap) Read(b []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, t.reads[0])
+	t.reads = t.reads[1:]
+	return n, nil
+}
+
+func (t *fakeTap) Write(b []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.written = append(t.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (t *fakeTap) frames() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	return t.written
+}
+
+// flakyTap wraps a fakeTap.  Its reads and writes first fail with the given
+// errors, one per call, before they reach the fakeTap.
+type flakyTap struct {
+	*fakeTap
+	readErrs  []error
+	writeErrs []error
+}
+
+func (t *flakyTap) Read(b []byte) (int, error) {
+	t.Lock()
+	if len(t.readErrs) > 0 {
+		err := t.readErrs[0]
+		t.readErrs = t.readErrs[1:]
+		t.Unlock()
+		return 0, err
+	}
+	t.Unlock()
+	return t.fakeTap.Read(b)
+}
+
+func (t *flakyTap) Write(b []byte) (int, error) {
+	t.Lock()
+	if len(t.writeErrs) > 0 {
+		err := t.writeErrs[0]
+		t.writeErrs = t.writeErrs[1:]
+		t.Unlock()
+		return 0, err
+	}
+	t.Unlock()
+	return t.fakeTap.Write(b)
+}
+
+// useFakeTapSleep records the waits between TAP device retries instead of
+// waiting, for the duration of the test.
+func useFakeTapSleep(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var waits []time.Duration
+	orig := tapSleep
+	tapSleep = func(d time.Duration) { waits = append(waits, d) }
+	t.Cleanup(func() { tapSleep = orig })
+	return &waits
+}
+
+func TestIsTemporary(t *testing.T) {
+	cases := []struct {
+		err  error
+		temp bool
+	}{
+		{syscall.EINTR, true},
+		{syscall.EAGAIN, true},
+		{fmt.Errorf("read: %w", syscall.EINTR), true},
+		{&os.PathError{Op: "read", Path: "/dev/net/tun", Err: syscall.EAGAIN}, true},
+		{syscall.EIO, false},
+		{io.EOF, false},
+		{os.ErrClosed, false},
+	}
+	for _, c := range cases {
+		if got := isTemporary(c.err); got != c.temp {
+			t.Errorf("Expected %v to be temporary=%v but got %v.", c.err, c.temp, got)
+		}
+	}
+}
+
+func TestRetryTemporaryBackoff(t *testing.T) {
+	waits := useFakeTapSleep(t)
+	calls := 0
+	_, err := retryTemporary(func() (int, error) {
+		calls++
+		return 0, syscall.EINTR
+	})
+	if !errors.Is(err, syscall.EINTR) {
+		t.Fatalf("Expected error %v but got %v.", syscall.EINTR, err)
+	}
+	if calls != maxTapRetries+1 {
+		t.Fatalf("Expected %d attempts but got %d.", maxTapRetries+1, calls)
+	}
+
+	want := []time.Duration{
+		time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 8 * time.Millisecond,
+		16 * time.Millisecond, 32 * time.Millisecond, 64 * time.Millisecond,
+		maxTapBackoff, maxTapBackoff, maxTapBackoff,
+	}
+	if len(*waits) != len(want) {
+		t.Fatalf("Expected waits %v but got %v.", want, *waits)
+	}
+	for i := range want {
+		if (*waits)[i] != want[i] {
+			t.Fatalf("Expected waits %v but got %v.", want, *waits)
+		}
+	}
+}
+
+func TestRetryTemporaryPersistentError(t *testing.T) {
+	waits := useFakeTapSleep(t)
+	calls := 0
+	_, err := retryTemporary(func() (int, error) {
+		calls++
+		return 0, syscall.EIO
+	})
+	if !errors.Is(err, syscall.EIO) || calls != 1 || len(*waits) != 0 {
+		t.Fatalf("Expected a persistent error to be returned right away but got %v after %d attempts.", err, calls)
+	}
+}
+
+func TestRxTxRetryTemporaryErrors(t *testing.T) {
+	useFakeTapSleep(t)
+	sent := testFrames()
+	retriesBefore := metricTapRetries.Value()
+
+	// rx reads from a TAP device that's interrupted a few times.
+	tap := &flakyTap{
+		fakeTap:  newFakeTap(sent...),
+		readErrs: []error{syscall.EINTR, syscall.EAGAIN, syscall.EINTR},
+	}
+	errCh := make(chan error, 1)
+	var wire bytes.Buffer
+	rx(&wire, tap, errCh, 1500, prefixLen16, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected rx to only stop at the end of the frames but got %v.", err)
+	}
+
+	// tx writes to a TAP device that's interrupted a few times.
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	go func() {
+		_, _ = hostConn.Write(wire.Bytes())
+		hostConn.Close()
+	}()
+	tap = &flakyTap{
+		fakeTap:   newFakeTap(),
+		writeErrs: []error{syscall.EAGAIN, syscall.EINTR},
+	}
+	tx(enclaveConn, tap, errCh, 1500, prefixLen16, nil, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected tx to only stop at the end of the stream but got %v.", err)
+	}
+
+	received := tap.frames()
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d frames but got %d.", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Errorf("Frame %d differs from the frame that was sent.", i)
+		}
+	}
+	if got := metricTapRetries.Value() - retriesBefore; got != 5 {
+		t.Errorf("Expected 5 retries to be counted but got %d.", got)
+	}
+}
+
+func TestTxPersistentTapError(t *testing.T) {
+	useFakeTapSleep(t)
+	wire, err := wireFrame(nil, testFrames()[0], prefixLen16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	defer hostConn.Close()
+	go func() { _, _ = hostConn.Write(wire) }()
+
+	tap := &flakyTap{fakeTap: newFakeTap(), writeErrs: []error{syscall.EIO}}
+	errCh := make(chan error, 1)
+	tx(enclaveConn, tap, errCh, 1500, prefixLen16, nil, nil, nil, nil)
+	if err := <-errCh; !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected tx to fail with %v but got %v.", syscall.EIO, err)
+	}
+}
+
+func TestSendHandshake(t *testing.T) {
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	defer hostConn.Close()
+
+	reqCh := make(chan *http.Request, 1)
+	go func() {
+		req, err := http.ReadRequest(bufio.NewReader(hostConn))
+		if err != nil {
+			t.Errorf("Expected handshake request but got %v.", err)
+		}
+		reqCh <- req
+	}()
+	if err := sendHandshake(enclaveConn, "/connect", time.Second); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if req := <-reqCh; req == nil || req.Method != http.MethodPost || req.URL.Path != "/connect" {
+		t.Errorf("Expected POST /connect but got %v.", req)
+	}
+}
+
+func TestSendHandshakeTimeout(t *testing.T) {
+	// The host accepts our connection but never reads from it.
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	defer hostConn.Close()
+
+	start := time.Now()
+	err := sendHandshake(enclaveConn, "/connect", 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected error %v but got %v.", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected handshake to time out quickly but it took %s.", elapsed)
+	}
+}
+
+// useFakeNewTap replaces newTap with a fake that fails to create multi-queue
+// devices if multiQueueErr is set, and fails to create single-queue devices
+// if singleQueueErr is set.  It returns the configs that newTap was called
+// with.
+func useFakeNewTap(t *testing.T, multiQueueErr, singleQueueErr error) *[]water.Config {
+	t.Helper()
+	var calls []water.Config
+	orig := newTap
+	newTap = func(cfg water.Config) (*water.Interface, error) {
+		calls = append(calls, cfg)
+		if cfg.MultiQueue && multiQueueErr != nil {
+			return nil, multiQueueErr
+		}
+		if !cfg.MultiQueue && singleQueueErr != nil {
+			return nil, singleQueueErr
+		}
+		return new(water.Interface), nil
+	}
+	t.Cleanup(func() { newTap = orig })
+	return &calls
+}
+
+func TestOpenTap(t *testing.T) {
+	errNoMultiQueue := errors.New("invalid argument")
+	errNoTun := errors.New("no such device")
+	cases := []struct {
+		name           string
+		multiQueue     bool
+		multiQueueErr  error
+		singleQueueErr error
+		wantQueues     []bool
+		wantErrs       []error
+	}{
+		{name: "multi-queue", multiQueue: true, wantQueues: []bool{true}},
+		{name: "single-queue", wantQueues: []bool{false}},
+		{
+			name:          "fallback",
+			multiQueue:    true,
+			multiQueueErr: errNoMultiQueue,
+			wantQueues:    []bool{true, false},
+		},
+		{
+			name:           "fallback fails",
+			multiQueue:     true,
+			multiQueueErr:  errNoMultiQueue,
+			singleQueueErr: errNoTun,
+			wantQueues:     []bool{true, false},
+			wantErrs:       []error{errNoMultiQueue, errNoTun},
+		},
+		{
+			name:           "single-queue fails",
+			singleQueueErr: errNoTun,
+			wantQueues:     []bool{false},
+			wantErrs:       []error{errNoTun},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls := useFakeNewTap(t, c.multiQueueErr, c.singleQueueErr)
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			tap, err := openTap("tap0", c.multiQueue)
+			if len(c.wantErrs) == 0 && (err != nil || tap == nil) {
+				t.Fatalf("Expected a TAP device but got %v.", err)
+			}
+			for _, want := range c.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("Expected error %v but got %v.", want, err)
+				}
+			}
+
+			var queues []bool
+			for _, cfg := range *calls {
+				if cfg.Name != "tap0" || cfg.DeviceType != water.TAP {
+					t.Errorf("Expected TAP device tap0 but got %+v.", cfg)
+				}
+				queues = append(queues, cfg.MultiQueue)
+			}
+			if fmt.Sprint(queues) != fmt.Sprint(c.wantQueues) {
+				t.Errorf("Expected multi-queue settings %v but got %v.", c.wantQueues, queues)
+			}
+
+			fellBack := false
+			for _, entry := range hook.AllEntries() {
+				fellBack = fellBack || strings.Contains(entry.Message, "fell back to single-queue mode")
+			}
+			if want := c.multiQueueErr != nil && c.singleQueueErr == nil; fellBack != want {
+				t.Errorf("Expected fallback to be logged: %v", want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// proxyRetryAfter is the number of seconds that we ask clients to wait
+	// before retrying a proxied request that we rejected.
+	proxyRetryAfter = 1
+	errProxyBusy    = "too many concurrent requests to the enclave application"
+)
+
+// proxyLimiter caps the number of concurrent requests that we proxy to the
+// enclave application.  Requests beyond the cap wait for up to the given
+// queue timeout for a slot.  A nil *proxyLimiter doesn't limit requests.
+type proxyLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newProxyLimiter(max int, queueTimeout time.Duration) *proxyLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &proxyLimiter{
+		slots:        make(chan struct{}, max),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire returns true if the given request got a slot, which the caller must
+// then return via release.
+func (l *proxyLimiter) acquire(r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *proxyLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// limit returns a handler that runs the given handler only if the request
+// gets a slot, and responds with 503 Service Unavailable otherwise.
+func (l *proxyLimiter) limit(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			metricProxyRejected.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(proxyRetryAfter))
+			http.Error(w, errProxyBusy, http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	}
+}
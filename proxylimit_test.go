@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingHandler blocks requests until release is closed.  Started receives
+// a value for each request that entered the handler.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.started <- struct{}{}
+	<-h.release
+}
+
+// fillProxyLimiter sends n concurrent requests to the given handler and waits
+// until all of them are in flight.  The returned WaitGroup is done once the
+// requests finished.
+func fillProxyLimiter(t *testing.T, h http.Handler, b *blockingHandler, n int) *sync.WaitGroup {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-b.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d requests in flight but got %d.", n, i)
+		}
+	}
+	return &wg
+}
+
+func TestProxyLimiterRejects(t *testing.T) {
+	const max = 3
+	b := newBlockingHandler()
+	h := newProxyLimiter(max, 0).limit(b)
+	wg := fillProxyLimiter(t, h, b, max)
+	rejected := metricProxyRejected.Value()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d but got %d.", http.StatusServiceUnavailable, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1 but got %q.", got)
+	}
+	if got := metricProxyRejected.Value() - rejected; got != 1 {
+		t.Errorf("Expected 1 rejected request but got %d.", got)
+	}
+
+	// Once a slot is free, requests get through again.
+	close(b.release)
+	wg.Wait()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status code %d but got %d.", http.StatusOK, rec.Code)
+	}
+}
+
+func TestProxyLimiterQueues(t *testing.T) {
+	const max = 2
+	b := newBlockingHandler()
+	h := newProxyLimiter(max, 5*time.Second).limit(b)
+	wg := fillProxyLimiter(t, h, b, max)
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- rec.Code
+	}()
+	select {
+	case <-b.started:
+		t.Fatal("Expected request beyond the limit to wait for a slot.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(b.release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected status code %d but got %d.", http.StatusOK, code)
+	}
+	wg.Wait()
+}
+
+func TestProxyLimiterQueueTimeout(t *testing.T) {
+	b := newBlockingHandler()
+	h := newProxyLimiter(1, 10*time.Millisecond).limit(b)
+	wg := fillProxyLimiter(t, h, b, 1)
+	defer wg.Wait()
+	defer close(b.release)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d but got %d.", http.StatusServiceUnavailable, rec.Code)
+	}
+}
+
+func TestNilProxyLimiter(t *testing.T) {
+	if l := newProxyLimiter(0, time.Second); l != nil {
+		t.Fatal("Expected no limiter for a limit of 0.")
+	}
+	b := newBlockingHandler()
+	close(b.release)
+	rec := httptest.NewRecorder()
+	(*proxyLimiter)(nil).limit(b).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status code %d but got %d.", http.StatusOK, rec.Code)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// proxyHeaderTimeout bounds the time we wait for a PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the maximum length of a v1 header, including CRLF.
+	proxyV1MaxLen = 107
+	proxyV2HdrLen = 16
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader  = errors.New("connection didn't start with a PROXY protocol header")
+	errBadProxyHeader = errors.New("malformed PROXY protocol header")
+)
+
+// proxyProtoListener wraps a net.Listener and expects every accepted
+// connection to start with a PROXY protocol (v1 or v2) header, as prepended
+// by load balancers like AWS's NLB.  The header's source address becomes the
+// connection's remote address, so our Web server sees the real client.
+// Connections without a valid header are closed.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func newProxyProtoListener(l net.Listener) *proxyProtoListener {
+	return &proxyProtoListener{Listener: l}
+}
+
+// Accept returns the next connection.  The header is parsed lazily, on the
+// first call to Read or RemoteAddr, so a slow client can't stall Accept.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn is a connection whose PROXY protocol header gets stripped.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Rejecting connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header.  If
+// the header carries no address, e.g., for health checks by the load
+// balancer, the address of the peer is returned.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from the given
+// reader and returns the source address that it contains, or nil if the
+// header carries no address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if prefix, err := r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 parses a human-readable header like:
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long or not terminated", errBadProxyHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: unexpected v1 fields", errBadProxyHeader)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: bad v1 source address", errBadProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header.  We only extract TCP source addresses
+// and skip all TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadProxyHeader, err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errBadProxyHeader, verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadProxyHeader, err)
+	}
+
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL, e.g., health checks by the load balancer.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command", errBadProxyHeader)
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4.
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", errBadProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6.
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", errBadProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		// Other protocols carry no address that makes sense to us.
+		return nil, nil
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a v2 PROXY header with the given command, address
+// family, and address block.
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	cases := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    error
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324", nil},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", nil},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v2 IPv4", proxyV2Header(0x1, 0x11, v4), "192.0.2.1:56324", nil},
+		{"v2 IPv6", proxyV2Header(0x1, 0x21, v6), "[2001:db8::1]:56324", nil},
+		{"v2 LOCAL", proxyV2Header(0x0, 0x00, nil), "", nil},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", errNoProxyHeader},
+		{"v1 bad address", []byte("PROXY TCP4 nope 192.0.2.2 56324 443\r\n"), "", errBadProxyHeader},
+		{"v1 unterminated", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen)), "", errBadProxyHeader},
+		{"v2 short IPv4", proxyV2Header(0x1, 0x11, v4[:8]), "", errBadProxyHeader},
+		{"v2 truncated", proxyV2Header(0x1, 0x11, v4)[:20], "", errBadProxyHeader},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(c.header)))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Expected error %v but got %v.", c.err, err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != c.addr {
+				t.Errorf("Expected address %q but got %q.", c.addr, got)
+			}
+		})
+	}
+}
+
+// newProxyProtoServer starts a Web server behind a proxyProtoListener that
+// responds with each request's remote address, and returns its address.
+func newProxyProtoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go func() { _ = srv.Serve(newProxyProtoListener(l)) }()
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// sendRaw writes the given bytes to a new connection to addr and returns
+// everything that the server sends back.
+func sendRaw(t *testing.T, addr string, raw string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	addr := newProxyProtoServer(t)
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+
+	resp := sendRaw(t, addr, "PROXY TCP4 198.51.100.7 192.0.2.2 40000 443\r\n"+req)
+	if !strings.HasSuffix(resp, "198.51.100.7:40000") {
+		t.Errorf("Expected client address 198.51.100.7:40000 but got response %q.", resp)
+	}
+
+	// The load balancer's health checks carry no address, so we fall back
+	// to the peer's address.
+	resp = sendRaw(t, addr, "PROXY UNKNOWN\r\n"+req)
+	if !strings.Contains(resp, "\r\n\r\n127.0.0.1:") {
+		t.Errorf("Expected peer address but got response %q.", resp)
+	}
+
+	if resp = sendRaw(t, addr, req); resp != "" {
+		t.Errorf("Expected connection without header to be closed but got %q.", resp)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRateLimitIdle is how long a client's bucket may go unused before
+	// we evict it.
+	defaultRateLimitIdle = 5 * time.Minute
+	// defaultRateLimitClients is the maximum number of client buckets that
+	// we hold on to.
+	defaultRateLimitClients = 10000
+	// ipv6ClientBits is the length of the IPv6 prefix that we key buckets
+	// by.  A single IPv6 client typically controls a whole /64, so keying by
+	// address would give it billions of budgets.
+	ipv6ClientBits = 64
+	errRateLimited = "too many requests from your address"
+)
+
+// RateLimitConfig configures the per-client rate limit of the public Web
+// server.  Each client IP address gets a token bucket that holds up to Burst
+// requests and refills at Rate requests per second.  Requests beyond the
+// limit are rejected with 429 Too Many Requests.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second that a client may sustain.
+	// If Rate is 0, requests aren't rate-limited.
+	Rate float64
+	// Burst is the number of requests that a client may send at once.  If
+	// Burst is 0, it's Rate, rounded up.
+	Burst int
+	// TrustForwardedFor makes us key buckets by the last address in the
+	// X-Forwarded-For header, which is the one that the load balancer in
+	// front of us added.  Only set it if such a load balancer exists;
+	// otherwise, clients pick their own key.  With ProxyProtocol, the
+	// connection's address already is the client's, so there's no need for
+	// TrustForwardedFor.
+	TrustForwardedFor bool
+	// IdleTimeout is how long a client's bucket may go unused before it's
+	// evicted, which bounds our memory use.  If IdleTimeout is 0,
+	// defaultRateLimitIdle is used.
+	IdleTimeout time.Duration
+	// MaxClients is the maximum number of client buckets that we hold on
+	// to.  Once we hold that many, a new client's bucket replaces the
+	// least recently used bucket, whose client has had the longest time to
+	// refill it anyway.  If MaxClients is 0, defaultRateLimitClients is
+	// used.
+	MaxClients int
+}
+
+// validate returns an error if the rate limit is malformed.
+func (c RateLimitConfig) validate() error {
+	if c.Rate < 0 || math.IsNaN(c.Rate) || math.IsInf(c.Rate, 0) {
+		return fmt.Errorf("bad rate limit: %v requests per second", c.Rate)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("bad rate limit burst: %d", c.Burst)
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("bad rate limit client count: %d", c.MaxClients)
+	}
+	return nil
+}
+
+// rateLimiter holds a token bucket per client IPv4 address and IPv6 /64
+// prefix.  A nil *rateLimiter doesn't limit requests.
+type rateLimiter struct {
+	sync.Mutex
+	cfg     RateLimitConfig
+	buckets map[string]*list.Element
+	// lru holds the buckets, most recently used first, so both eviction at
+	// the cap and sweeps take time that doesn't grow with the number of
+	// clients.
+	lru       *list.List
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultRateLimitIdle
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = defaultRateLimitClients
+	}
+	return &rateLimiter{
+		cfg:     cfg,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the given client's bucket.  If the bucket is
+// empty, allow returns false along with the time until the next token.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	var b *tokenBucket
+	if e, ok := l.buckets[client]; ok {
+		b = e.Value.(*tokenBucket)
+		l.lru.MoveToFront(e)
+	} else {
+		if len(l.buckets) >= l.cfg.MaxClients {
+			l.evict(l.lru.Back())
+		}
+		b = &tokenBucket{client: client, tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[client] = l.lru.PushFront(b)
+	}
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep evicts buckets that went unused for the idle timeout and are full
+// again, so evicting them doesn't change their clients' budgets.  We sweep
+// at most once per idle timeout, and only visit idle buckets: they're at the
+// back of the LRU list.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for e := l.lru.Back(); e != nil; {
+		b, prev := e.Value.(*tokenBucket), e.Prev()
+		idle := now.Sub(b.last)
+		if idle < l.cfg.IdleTimeout {
+			break
+		}
+		if b.tokens+idle.Seconds()*l.cfg.Rate >= float64(l.cfg.Burst) {
+			l.evict(e)
+		}
+		e = prev
+	}
+}
+
+// evict removes the bucket in the given element of the LRU list.
+func (l *rateLimiter) evict(e *list.Element) {
+	delete(l.buckets, l.lru.Remove(e).(*tokenBucket).client)
+}
+
+// client returns the key of the bucket of the given request's client.
+func (l *rateLimiter) client(r *http.Request) string {
+	if l.cfg.TrustForwardedFor {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			addrs := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+				return clientKey(ip)
+			}
+		}
+	}
+	return hostKey(clientIP(r))
+}
+
+// hostKey returns the bucket key of the client with the given host, which is
+// usually an IP address.
+func hostKey(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return clientKey(ip)
+	}
+	return host
+}
+
+// clientKey returns the bucket key of the given IP address: the address
+// itself for IPv4, and its /64 prefix for IPv6.
+func clientKey(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	mask := net.CIDRMask(ipv6ClientBits, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// middleware returns middleware that rejects requests of clients that
+// exceed their rate limit with 429 Too Many Requests.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(l.client(r)); !ok {
+			metricRateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, errRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock returns a clock for the given limiter that only moves when the
+// test advances it.
+func fakeClock(l *rateLimiter) *time.Time {
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	return &now
+}
+
+// sendFrom sends a request from the given remote address through the given
+// limiter's middleware, and returns the response.
+func sendFrom(l *rateLimiter, addr string) *httptest.ResponseRecorder {
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitPerClient(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 2})
+	fakeClock(l)
+	before := metricRateLimited.Value()
+
+	for i := 0; i < 2; i++ {
+		if w := sendFrom(l, "192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the burst to succeed but got %d.", i, w.Code)
+		}
+	}
+	w := sendFrom(l, "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusTooManyRequests, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("Expected Retry-After %q but got %q.", "1", got)
+	}
+	if got := metricRateLimited.Value() - before; got != 1 {
+		t.Errorf("Expected rate limit metric to grow by 1 but got %d.", got)
+	}
+
+	// Another client's budget is unaffected.
+	for i := 0; i < 2; i++ {
+		if w := sendFrom(l, "192.0.2.2:1234"); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d of other client to succeed but got %d.", i, w.Code)
+		}
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1})
+	now := fakeClock(l)
+	if ok, _ := l.allow("client"); !ok {
+		t.Fatal("Expected first request to be allowed.")
+	}
+	if ok, wait := l.allow("client"); ok || wait != time.Second {
+		t.Fatalf("Expected to wait %s but got %t and %s.", time.Second, ok, wait)
+	}
+	*now = now.Add(time.Second)
+	if ok, _ := l.allow("client"); !ok {
+		t.Fatal("Expected request to be allowed after the bucket refilled.")
+	}
+}
+
+func TestRateLimitIPv6Prefix(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1})
+	fakeClock(l)
+	if w := sendFrom(l, "[2001:db8:1:2::1]:1234"); w.Code != http.StatusOK {
+		t.Fatalf("Expected first request to succeed but got %d.", w.Code)
+	}
+	// Another address in the same /64 shares the budget.
+	if w := sendFrom(l, "[2001:db8:1:2:ffff::2]:1234"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected same /64 to be limited but got %d.", w.Code)
+	}
+	// Another /64 has its own budget.
+	if w := sendFrom(l, "[2001:db8:1:3::1]:1234"); w.Code != http.StatusOK {
+		t.Fatalf("Expected other /64 to succeed but got %d.", w.Code)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, TrustForwardedFor: true})
+	for _, c := range []struct {
+		remote, forwarded, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::/64"},
+		{"[::ffff:192.0.2.1]:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1, 198.51.100.2", "198.51.100.2"},
+		{"192.0.2.1:1234", "2001:db8:a:b:c:d:e:f", "2001:db8:a:b::/64"},
+		{"192.0.2.1:1234", "garbage", "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := l.client(r); got != c.want {
+			t.Errorf("Expected key %q for %q and %q but got %q.", c.want, c.remote, c.forwarded, got)
+		}
+	}
+}
+
+func TestRateLimitEvictsIdleClients(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1, IdleTimeout: time.Minute})
+	now := fakeClock(l)
+	l.allow("idle")
+	*now = now.Add(time.Minute)
+	l.allow("active")
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("Expected idle bucket to be evicted.")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("Expected 1 bucket but got %d.", len(l.buckets))
+	}
+}
+
+func TestRateLimitMaxClients(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 2, MaxClients: 2})
+	now := fakeClock(l)
+	l.allow("stale")
+	*now = now.Add(time.Second)
+	l.allow("recent")
+
+	// A new client replaces the least recently used bucket.
+	l.allow("new")
+	if len(l.buckets) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("Expected %d buckets but got %d.", 2, len(l.buckets))
+	}
+	if _, ok := l.buckets["stale"]; ok {
+		t.Fatal("Expected the least recently used bucket to be evicted.")
+	}
+
+	// Using a bucket makes it the most recently used one.
+	l.allow("recent")
+	l.allow("newer")
+	if _, ok := l.buckets["recent"]; !ok {
+		t.Fatal("Expected the recently used bucket to be kept.")
+	}
+	if _, ok := l.buckets["new"]; ok {
+		t.Fatal("Expected the least recently used bucket to be evicted.")
+	}
+}
+
+func TestRateLimitSweepKeepsDrainedClients(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{Rate: 0.01, Burst: 1, IdleTimeout: time.Minute})
+	now := fakeClock(l)
+	// The drained bucket is idle but not full again, so it's kept.
+	l.allow("drained")
+	*now = now.Add(time.Minute)
+	l.allow("active")
+	if _, ok := l.buckets["drained"]; !ok {
+		t.Fatal("Expected drained bucket to be kept.")
+	}
+	if len(l.buckets) != l.lru.Len() {
+		t.Fatalf("Expected %d buckets in the LRU list but got %d.", len(l.buckets), l.lru.Len())
+	}
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		cfg   RateLimitConfig
+		valid bool
+	}{
+		{RateLimitConfig{}, true},
+		{RateLimitConfig{Rate: 10, Burst: 20, MaxClients: 100}, true},
+		{RateLimitConfig{Rate: -1}, false},
+		{RateLimitConfig{Rate: 1, Burst: -1}, false},
+		{RateLimitConfig{Rate: 1, MaxClients: -1}, false},
+	} {
+		if err := c.cfg.validate(); (err == nil) != c.valid {
+			t.Errorf("Expected %+v to be valid=%t but got %v.", c.cfg, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRegistryInterval determines how often we publish our
+	// attestation if the config doesn't specify an interval.
+	defaultRegistryInterval = 5 * time.Minute
+	// registryTimeout bounds a single publication.
+	registryTimeout = 10 * time.Second
+	// minRegistryBackoff is the wait before the first retry of a failed
+	// publication.  The wait doubles with each failure, up to the interval.
+	minRegistryBackoff = time.Second
+	// registryClient identifies published documents in the audit log.
+	registryClient = "registry"
+)
+
+// RegistryConfig configures the publication of our attestation document to
+// a registry, so peers can discover the enclave and verify it.  Publication
+// is off if URL is empty.
+type RegistryConfig struct {
+	// URL is the registry endpoint to which we POST our attestation, as
+	// JSON of the form {"document": "<Base64-encoded document>"}.
+	URL string
+	// Interval determines how often we publish a fresh document.  If
+	// Interval is 0, defaultRegistryInterval is used.
+	Interval time.Duration
+}
+
+// validate returns an error if publication is on but the URL isn't an
+// absolute HTTP(S) URL.
+func (c RegistryConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid registry URL %q", c.URL)
+	}
+	return nil
+}
+
+// registryPublisher publishes fresh attestation documents to a registry,
+// via the enclave's outbound client.  The documents carry no nonce, so
+// peers judge their freshness by their timestamp.
+type registryPublisher struct {
+	cfg      RegistryConfig
+	client   *http.Client
+	attester Attester
+	hashes   *AttestationHashes
+	audit    *auditLog
+}
+
+func newRegistryPublisher(cfg RegistryConfig, client *http.Client, a Attester, hashes *AttestationHashes, audit *auditLog) *registryPublisher {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultRegistryInterval
+	}
+	return &registryPublisher{cfg: cfg, client: client, attester: a, hashes: hashes, audit: audit}
+}
+
+// run publishes right away and then once per interval, until the given
+// channel is closed.  Failed publications are retried with exponential
+// backoff.
+func (p *registryPublisher) run(done <-chan struct{}) {
+	backoff := minRegistryBackoff
+	for {
+		wait := p.cfg.Interval
+		if err := p.publish(); err != nil {
+			log.Warnf("Failed to publish attestation to registry; retrying in %s: %v", backoff, err)
+			wait = backoff
+			if backoff *= 2; backoff > p.cfg.Interval {
+				backoff = p.cfg.Interval
+			}
+		} else {
+			backoff = minRegistryBackoff
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// publish asks for a fresh attestation document and POSTs it to the
+// registry.
+func (p *registryPublisher) publish() error {
+	userData := p.hashes.Serialize()
+	rawDoc, err := p.attester.Attest(nil, userData, nil)
+	p.audit.attestation(registryClient, nil, userData, rawDoc, err)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(attestationEnvelope{Document: base64.StdEncoding.EncodeToString(rawDoc)})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, newLimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("registry returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
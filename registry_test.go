@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubRegistry records the attestation documents that are published to it.
+type stubRegistry struct {
+	sync.Mutex
+	docs  []string
+	times []time.Time
+	code  int
+}
+
+func newStubRegistry(t *testing.T, code int) (*stubRegistry, *httptest.Server) {
+	t.Helper()
+	reg := &stubRegistry{code: code}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env attestationEnvelope
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected JSON POST request but got %s with %q.", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+			t.Errorf("Failed to decode published attestation: %v", err)
+		}
+		reg.Lock()
+		reg.docs = append(reg.docs, env.Document)
+		reg.times = append(reg.times, time.Now())
+		reg.Unlock()
+		w.WriteHeader(reg.code)
+	}))
+	t.Cleanup(srv.Close)
+	return reg, srv
+}
+
+func (r *stubRegistry) published() ([]string, []time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.docs...), append([]time.Time(nil), r.times...)
+}
+
+func TestRegistryPublishesAtInterval(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	reg, srv := newStubRegistry(t, http.StatusCreated)
+	p := newRegistryPublisher(RegistryConfig{URL: srv.URL, Interval: interval}, srv.Client(),
+		&fakeAttester{doc: []byte("document")}, testHashes(), newAuditLog(nil))
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		p.run(done)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if docs, _ := reg.published(); len(docs) >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected 3 publications in time.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-stopped
+
+	docs, times := reg.published()
+	want := base64.StdEncoding.EncodeToString([]byte("document"))
+	for i, doc := range docs {
+		if doc != want {
+			t.Errorf("Expected publication %d to contain %q but got %q.", i, want, doc)
+		}
+		if i > 0 && times[i].Sub(times[i-1]) < interval {
+			t.Errorf("Expected publications at least %s apart but got %s.", interval, times[i].Sub(times[i-1]))
+		}
+	}
+	// Nothing is published once we're done.
+	time.Sleep(2 * interval)
+	if after, _ := reg.published(); len(after) != len(docs) {
+		t.Fatalf("Expected no publications after stopping but got %d more.", len(after)-len(docs))
+	}
+}
+
+func TestRegistryPublishFailure(t *testing.T) {
+	_, srv := newStubRegistry(t, http.StatusServiceUnavailable)
+	p := newRegistryPublisher(RegistryConfig{URL: srv.URL}, srv.Client(),
+		&fakeAttester{doc: []byte("document")}, testHashes(), newAuditLog(nil))
+	if err := p.publish(); err == nil {
+		t.Fatal("Expected error for registry's 503 response.")
+	}
+
+	p.attester = &fakeAttester{err: errNSMDown}
+	if err := p.publish(); err != errNSMDown {
+		t.Fatalf("Expected %v but got %v.", errNSMDown, err)
+	}
+}
+
+func TestRegistryDefaultInterval(t *testing.T) {
+	p := newRegistryPublisher(RegistryConfig{URL: "https://registry.example.com"}, nil, nil, nil, nil)
+	if p.cfg.Interval != defaultRegistryInterval {
+		t.Fatalf("Expected interval %s but got %s.", defaultRegistryInterval, p.cfg.Interval)
+	}
+}
+
+func TestRegistryConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"https://registry.example.com/enclaves", true},
+		{"http://10.0.0.1:8080", true},
+		{"registry.example.com", false},
+		{"ftp://registry.example.com", false},
+		{"https://", false},
+		{"://bad", false},
+	} {
+		if err := (RegistryConfig{URL: c.url}).validate(); (err == nil) != c.valid {
+			t.Errorf("Expected %q to be valid=%t but got %v.", c.url, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// nitroRootPEM is the PEM-encoded root certificate of the AWS Nitro Enclaves
+// PKI, as published at:
+// https://aws-nitro-enclaves.amazonaws.com/AWS_NitroEnclaves_Root-G1.zip
+//
+//go:embed aws_nitro_root_g1.pem
+var nitroRootPEM []byte
+
+var errNoRootCert = errors.New("no attestation root certificate found")
+
+var roots struct {
+	sync.Mutex
+	pool   *x509.CertPool
+	err    error
+	loaded bool
+}
+
+// attestationRoots returns the certificate pool that attestation documents
+// must chain up to.  Unless a root file was loaded, the pool is parsed from
+// the embedded root certificate once.  Callers must refuse to verify
+// documents if an error is returned instead of falling back to a different
+// (or no) root.
+func attestationRoots() (*x509.CertPool, error) {
+	roots.Lock()
+	defer roots.Unlock()
+	if !roots.loaded {
+		roots.pool, roots.err = parseRoots(nitroRootPEM)
+		roots.loaded = true
+	}
+	return roots.pool, roots.err
+}
+
+// loadRootFile replaces the embedded root certificate with the PEM-encoded
+// certificates in the given file, e.g., for regions or air-gapped
+// deployments whose root differs.  If the file is unreadable or contains no
+// valid certificate, an error is returned and the roots remain unchanged.
+func loadRootFile(path string) error {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read attestation root file: %w", err)
+	}
+	pool, err := parseRoots(pemData)
+	if err != nil {
+		return fmt.Errorf("bad attestation root file %s: %w", path, err)
+	}
+	roots.Lock()
+	defer roots.Unlock()
+	roots.pool, roots.err, roots.loaded = pool, nil, true
+	return nil
+}
+
+// parseRoots parses the given PEM-encoded certificates and returns them as
+// certificate pool.
+func parseRoots(pemData []byte) (*x509.CertPool, error) {
+	pool, n := x509.NewCertPool(), 0
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse attestation root certificate: %w", err)
+		}
+		pool.AddCert(cert)
+		n++
+	}
+	if n == 0 {
+		return nil, errNoRootCert
+	}
+	return pool, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// useEmbeddedRoot replaces the embedded root certificate with the given PEM
+// data for the duration of the test, and makes sure that it's parsed anew.
+func useEmbeddedRoot(t *testing.T, pemData []byte) {
+	t.Helper()
+	roots.Lock()
+	origPEM, pool, err, loaded := nitroRootPEM, roots.pool, roots.err, roots.loaded
+	nitroRootPEM, roots.pool, roots.err, roots.loaded = pemData, nil, nil, false
+	roots.Unlock()
+	t.Cleanup(func() {
+		roots.Lock()
+		defer roots.Unlock()
+		nitroRootPEM, roots.pool, roots.err, roots.loaded = origPEM, pool, err, loaded
+	})
+}
+
+// keepRoots restores our attestation roots once the test is done.
+func keepRoots(t *testing.T) {
+	t.Helper()
+	roots.Lock()
+	pool, err, loaded := roots.pool, roots.err, roots.loaded
+	roots.Unlock()
+	t.Cleanup(func() {
+		roots.Lock()
+		defer roots.Unlock()
+		roots.pool, roots.err, roots.loaded = pool, err, loaded
+	})
+}
+
+// writeRootBundle writes the roots of the given PKIs to a PEM file and
+// returns the file's path.
+func writeRootBundle(t *testing.T, pkis ...*testPKI) string {
+	t.Helper()
+	var bundle []byte
+	for _, pki := range pkis {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.rootDER})...)
+	}
+	path := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(path, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// corruptRootPEM is a PEM block whose content isn't a certificate.
+var corruptRootPEM = []byte("-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydGlmaWNhdGU=\n-----END CERTIFICATE-----\n")
+
+func TestEmbeddedRoot(t *testing.T) {
+	pool, err := attestationRoots()
+	if err != nil || pool == nil {
+		t.Fatalf("Expected embedded root to parse but got %v.", err)
+	}
+}
+
+func TestParseRoots(t *testing.T) {
+	if _, err := parseRoots(nil); !errors.Is(err, errNoRootCert) {
+		t.Errorf("Expected error %v but got %v.", errNoRootCert, err)
+	}
+	if _, err := parseRoots([]byte("garbage")); !errors.Is(err, errNoRootCert) {
+		t.Errorf("Expected error %v but got %v.", errNoRootCert, err)
+	}
+	if _, err := parseRoots(corruptRootPEM); err == nil {
+		t.Error("Expected corrupted root to fail parsing.")
+	}
+}
+
+func TestLoadRootFileKeepsRootsOnError(t *testing.T) {
+	useEmbeddedRoot(t, nitroRootPEM)
+	before, _ := attestationRoots()
+
+	path := filepath.Join(t.TempDir(), "root.pem")
+	if err := os.WriteFile(path, corruptRootPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRootFile(path); err == nil {
+		t.Fatal("Expected corrupted root file to be rejected.")
+	}
+	if after, err := attestationRoots(); err != nil || after != before {
+		t.Fatalf("Expected roots to remain unchanged but got %v.", err)
+	}
+}
+
+func TestStartWithCorruptedRoot(t *testing.T) {
+	useStuckNetworking(t)
+	useFakeLoIface(t)
+
+	for _, c := range []struct {
+		name         string
+		allowInvalid bool
+	}{
+		{"fail closed", false},
+		{"fail open", true},
+	} {
+		allowInvalid := c.allowInvalid
+		t.Run(c.name, func(t *testing.T) {
+			useEmbeddedRoot(t, corruptRootPEM)
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			cfg := testConfig()
+			cfg.AllowInvalidRoot = allowInvalid
+			cfg.StartupTimeout = 100 * time.Millisecond
+			e := newTestEnclave(t, cfg)
+			t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+			err := e.Start()
+			if err == nil {
+				t.Fatal("Expected Start to fail.")
+			}
+			if !allowInvalid {
+				// We fail before we get to the startup phases.
+				if errors.Is(err, ErrStartupTimeout) || !strings.Contains(err.Error(), "attestation root") {
+					t.Fatalf("Expected Start to fail because of the root but got %v.", err)
+				}
+				return
+			}
+			// With a fail-open config, we get as far as the startup
+			// phases, which time out because networking is stuck.
+			if !errors.Is(err, ErrStartupTimeout) {
+				t.Fatalf("Expected Start to get past the root but got %v.", err)
+			}
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "failed to load attestation root") {
+					warned = true
+				}
+			}
+			if !warned {
+				t.Fatal("Expected a warning about the attestation root.")
+			}
+		})
+	}
+}
+
+func TestVerifyWithRootFile(t *testing.T) {
+	pki, other, untrusted := newNSMTestPKI(t), newNSMTestPKI(t), newNSMTestPKI(t)
+	useRootFile(t, writeRootBundle(t, other, pki))
+
+	// VerifyOptions without Roots use the loaded bundle.
+	opts := VerifyOptions{Now: func() time.Time { return testEpoch }}
+	for name, p := range map[string]*testPKI{"first root": other, "second root": pki} {
+		doc := p.sign(t, nitrite.Document{Nonce: testNonceBytes})
+		if _, err := verifyDocument(doc, testNonceBytes, opts); err != nil {
+			t.Errorf("Expected document of the bundle's %s to verify but got %v.", name, err)
+		}
+	}
+	doc := untrusted.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	if _, err := verifyDocument(doc, testNonceBytes, opts); err == nil {
+		t.Error("Expected document of a root outside the bundle to fail verification.")
+	}
+}
+
+func TestNewEnclaveWithRootFile(t *testing.T) {
+	keepRoots(t)
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.pem")
+	if err := os.WriteFile(corrupt, corruptRootPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"valid", writeRootBundle(t, newNSMTestPKI(t)), false},
+		{"missing", filepath.Join(dir, "missing.pem"), true},
+		{"corrupt", corrupt, true},
+		{"empty", empty, true},
+	} {
+		cfg := testConfig()
+		cfg.AttestationRootFile = c.path
+		if _, err := NewEnclave(cfg); (err != nil) != c.wantErr {
+			t.Errorf("%s: Expected error to be %t but got %v.", c.name, c.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// rotateKey asks the given enclave's internal Web server to rotate the
+// ephemeral key, authenticating with the given token.
+func rotateKey(e *Enclave, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, pathAdminRotateKey, nil)
+	if token != "" {
+		r.Header.Set("Authorization", bearerPrefix+token)
+	}
+	e.intSrv.Handler.ServeHTTP(w, r)
+	return w
+}
+
+// sealPayload seals the given message to the given X25519 key like a client
+// does.
+func sealPayload(t *testing.T, key []byte, msg string) []byte {
+	t.Helper()
+	var recipient [32]byte
+	copy(recipient[:], key)
+	sealed, err := box.SealAnonymous(nil, []byte(msg), &recipient, rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to seal payload: %v", err)
+	}
+	return sealed
+}
+
+// openPayload asks the given enclave's internal Web server to open the given
+// sealed payload.
+func openPayload(e *Enclave, sealed []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	e.intSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, pathOpenPayload, bytes.NewReader(sealed)))
+	return w
+}
+
+func TestRotateKeyHandler(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminToken = "token"
+	cfg.AttestationMetadata = map[string]string{"version": "1.2.3"}
+	e := newTestEnclave(t, cfg)
+	e.attester = DeterministicAttester{Seed: []byte("rotate")}
+	if err := e.renewBootAttestation(); err != nil {
+		t.Fatalf("Failed to obtain boot document: %v", err)
+	}
+	oldKey := e.meta.publicKey()
+	oldDigest := bootDigest(e)
+	oldEncKey, err := e.meta.encryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to get encryption key: %v", err)
+	}
+	inFlight := sealPayload(t, oldEncKey, "in flight")
+
+	if w := rotateKey(e, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d without token but got %d.", http.StatusUnauthorized, w.Code)
+	}
+	if !bytes.Equal(e.meta.publicKey(), oldKey) {
+		t.Fatal("Expected unauthenticated request to not rotate the key.")
+	}
+
+	w := rotateKey(e, cfg.AdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var resp rotateKeyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", w.Body, err)
+	}
+	newKey, err := base64.StdEncoding.DecodeString(resp.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to decode public key: %v", err)
+	}
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("Expected published public key to change after rotation.")
+	}
+	if !bytes.Equal(e.meta.publicKey(), newKey) {
+		t.Error("Expected response to contain the signer's new public key.")
+	}
+	if len(resp.KeyID) != 16 {
+		t.Errorf("Expected 16-digit key ID but got %q.", resp.KeyID)
+	}
+
+	// The boot document now binds the new key.
+	if bootDigest(e) == oldDigest {
+		t.Error("Expected digest header to change after rotation.")
+	}
+	if doc := bootDocument(t, e); !bytes.Contains(doc, newKey) || bytes.Contains(doc, oldKey) {
+		t.Error("Expected boot document to bind the new key only.")
+	}
+
+	// Payloads that were sealed to the old key are still opened, and so are
+	// payloads that are sealed to the new key.
+	newEncKey, err := base64.StdEncoding.DecodeString(resp.EncryptionKey)
+	if err != nil || bytes.Equal(newEncKey, oldEncKey) {
+		t.Fatalf("Expected new encryption key but got %q (%v).", resp.EncryptionKey, err)
+	}
+	for msg, sealed := range map[string][]byte{
+		"in flight": inFlight,
+		"fresh":     sealPayload(t, newEncKey, "fresh"),
+	} {
+		if w := openPayload(e, sealed); w.Code != http.StatusOK || w.Body.String() != msg {
+			t.Errorf("Expected %q to be opened but got %d: %s", msg, w.Code, w.Body)
+		}
+	}
+	if w := openPayload(e, []byte("garbage")); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for garbage but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRotateKeyHandlerWithoutKey(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminToken = "token"
+	if w := rotateKey(newTestEnclave(t, cfg), cfg.AdminToken); w.Code != http.StatusConflict {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusConflict, w.Code)
+	}
+}
+
+func TestRotateKeyOverlap(t *testing.T) {
+	const overlap = time.Minute
+	pki := newNSMTestPKI(t)
+	now := testEpoch
+	meta := testMetadataSigner()
+	meta.overlap = overlap
+	meta.now = func() time.Time { return now }
+
+	if env := requestEnvelope(t, pki, meta); env.PreviousMetadataSignature != nil {
+		t.Fatal("Expected no previous signature before the first rotation.")
+	}
+	oldKey := ed25519.PublicKey(meta.publicKey())
+	newKey, err := meta.rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		elapsed    time.Duration
+		wantOldSig bool
+	}{
+		{"right after rotation", 0, true},
+		{"end of overlap", overlap, true},
+		{"after overlap", overlap + time.Second, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now = testEpoch.Add(c.elapsed)
+			env := requestEnvelope(t, pki, meta)
+			if !ed25519.Verify(newKey, env.Metadata, env.MetadataSignature) {
+				t.Error("Expected metadata signature by the new key.")
+			}
+			gotOldSig := env.PreviousMetadataSignature != nil
+			if gotOldSig != c.wantOldSig {
+				t.Fatalf("Expected previous signature to be %t but got %t.", c.wantOldSig, gotOldSig)
+			}
+			if gotOldSig && !ed25519.Verify(oldKey, env.Metadata, env.PreviousMetadataSignature) {
+				t.Error("Expected previous signature to verify with the old key.")
+			}
+		})
+	}
+}
+
+func TestRotateKeyOldKeyDecryption(t *testing.T) {
+	const overlap = time.Minute
+	now := testEpoch
+	meta := testMetadataSigner()
+	meta.overlap = overlap
+	meta.now = func() time.Time { return now }
+
+	oldEncKey, err := meta.encryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to get encryption key: %v", err)
+	}
+	inFlight := sealPayload(t, oldEncKey, "in flight")
+	if _, err := meta.rotate(); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+	newEncKey, err := meta.encryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to get encryption key: %v", err)
+	}
+	fresh := sealPayload(t, newEncKey, "fresh")
+
+	cases := []struct {
+		name       string
+		elapsed    time.Duration
+		wantOldKey bool
+	}{
+		{"right after rotation", 0, true},
+		{"end of overlap", overlap, true},
+		{"after overlap", overlap + time.Second, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now = testEpoch.Add(c.elapsed)
+			if got, err := meta.open(fresh); err != nil || string(got) != "fresh" {
+				t.Fatalf("Expected payload for the new key to be opened but got %q (%v).", got, err)
+			}
+			got, err := meta.open(inFlight)
+			if c.wantOldKey && (err != nil || string(got) != "in flight") {
+				t.Fatalf("Expected payload for the old key to be opened but got %q (%v).", got, err)
+			}
+			if !c.wantOldKey && !errors.Is(err, errUnknownPayloadKey) {
+				t.Fatalf("Expected %v for the old key but got %v.", errUnknownPayloadKey, err)
+			}
+		})
+	}
+}
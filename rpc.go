@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// rpcClient identifies RPC clients whose address we don't know.
+	rpcClient = "rpc"
+	// rpcAttestMethod is the full name of our gRPC attestation method.
+	rpcAttestMethod = "/nitriding.Attestation/Attest"
+)
+
+var ErrBadNonce = fmt.Errorf("nonce must be %d bytes long", nonceLen)
+
+// AttestationService issues attestation documents independent of a
+// transport, so our gRPC server can offer the same attestation as our HTTP
+// API.  Documents contain the given nonce and our attestation hashes,
+// exactly like the documents of our HTTP API.  Nonces share the replay
+// window of our HTTP API, so a nonce can't be replayed via the other
+// transport.
+type AttestationService struct {
+	attester Attester
+	hashes   *AttestationHashes
+	nonces   *nonceCache
+	audit    *auditLog
+}
+
+// Attest returns a raw attestation document that contains the given nonce.
+func (s *AttestationService) Attest(ctx context.Context, nonce []byte) ([]byte, error) {
+	if len(nonce) != nonceLen {
+		return nil, ErrBadNonce
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Our HTTP API keys nonces by their hex encoding.
+	key := hex.EncodeToString(nonce)
+	if err := s.nonces.reserve(key); err != nil {
+		return nil, err
+	}
+	userData := s.hashes.Serialize()
+	doc, err := s.attester.Attest(nonce, userData, nil)
+	s.audit.attestation(rpcPeer(ctx), nonce, userData, doc, err)
+	if err != nil {
+		// The client never got a document for this nonce, so it may try
+		// again with the same nonce.
+		s.nonces.release(key)
+	}
+	return doc, err
+}
+
+// rpcPeer returns the address of the RPC client of the given context.
+func rpcPeer(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return rpcClient
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// rpcRateLimit returns an interceptor that subjects RPC clients to the given
+// rate limit, which our public HTTP API shares.
+func rpcRateLimit(l *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if ok, _ := l.allow(hostKey(rpcPeer(ctx))); !ok {
+			metricRateLimited.Add(1)
+			return nil, status.Error(codes.ResourceExhausted, errRateLimited)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// attestationServer is implemented by AttestationService.  gRPC uses it to
+// make sure that registered services implement our methods.
+type attestationServer interface {
+	Attest(ctx context.Context, nonce []byte) ([]byte, error)
+}
+
+// attestationServiceDesc describes our gRPC service.  It corresponds to the
+// following protobuf definition, whose messages are the well-known
+// BytesValue, so we don't need generated code:
+//
+//	service Attestation {
+//	  // Attest takes a nonce and returns a raw attestation document.
+//	  rpc Attest(google.protobuf.BytesValue) returns (google.protobuf.BytesValue);
+//	}
+var attestationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nitriding.Attestation",
+	HandlerType: (*attestationServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Attest",
+		Handler:    rpcAttestHandler,
+	}},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "attestation.proto",
+}
+
+func rpcAttestHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(wrapperspb.BytesValue)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	attest := func(ctx context.Context, req any) (any, error) {
+		doc, err := srv.(attestationServer).Attest(ctx, req.(*wrapperspb.BytesValue).GetValue())
+		if err != nil {
+			return nil, rpcError(err)
+		}
+		return wrapperspb.Bytes(doc), nil
+	}
+	if interceptor == nil {
+		return attest(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: rpcAttestMethod}
+	return interceptor(ctx, req, info, attest)
+}
+
+// rpcError maps the given attestation error to a gRPC status.
+func rpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrBadNonce):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errNonceReplayed):
+		return status.Error(codes.AlreadyExists, errReplayedNonce)
+	case errors.Is(err, errNonceCacheFull):
+		return status.Error(codes.Unavailable, errTooManyNonces)
+	case errors.Is(err, ErrAttestationTimeout), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, errTimeoutAttestation)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		log.Printf("RPC: Failed to obtain attestation document from hypervisor: %v", err)
+		return status.Error(codes.Internal, errFailedAttestation)
+	}
+}
+
+// AttestRPC asks the gRPC server behind the given connection for an
+// attestation document that contains the given nonce.  Verify the returned
+// document like documents of our HTTP API.
+func AttestRPC(ctx context.Context, cc grpc.ClientConnInterface, nonce []byte) ([]byte, error) {
+	resp := new(wrapperspb.BytesValue)
+	if err := cc.Invoke(ctx, rpcAttestMethod, wrapperspb.Bytes(nonce), resp); err != nil {
+		return nil, err
+	}
+	return resp.GetValue(), nil
+}
+
+// newRPCServer returns a gRPC server that exposes the given attestation
+// service to clients within the given rate limit.
+func newRPCServer(svc *AttestationService, limiter *rateLimiter) *grpc.Server {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(rpcRateLimit(limiter)))
+	srv.RegisterService(&attestationServiceDesc, svc)
+	return srv
+}
+
+// startRPCServer serves our gRPC server on the configured port.  It does
+// nothing if no port is configured.  The server is stopped along with the
+// enclave.  Like our public HTTP API, it's reachable from outside the
+// enclave, so it shares the API's rate limit and nonce replay window.
+func startRPCServer(e *Enclave) error {
+	if e.cfg.RPCPort == 0 {
+		return nil
+	}
+
+	svc := &AttestationService{attester: e.attester, hashes: e.hashes, nonces: e.nonces, audit: e.audit}
+	srv := newRPCServer(svc, e.limiter)
+	addr := net.JoinHostPort("", strconv.Itoa(int(e.cfg.RPCPort)))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	log.Printf("gRPC server started on %s", addr)
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Errorf("gRPC server terminated: %v", err)
+		}
+	}()
+	e.OnShutdown(func(context.Context) error {
+		srv.GracefulStop()
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestRPCConn serves the given attester over an in-process gRPC server
+// and returns a client connection to it.
+func newTestRPCConn(t *testing.T, attester Attester) *grpc.ClientConn {
+	t.Helper()
+	return dialTestRPCServer(t, &AttestationService{attester: attester, hashes: testHashes(), audit: newAuditLog(nil)}, nil)
+}
+
+// dialTestRPCServer serves the given service within the given rate limit
+// over an in-process gRPC server and returns a client connection to it.
+func dialTestRPCServer(t *testing.T, svc *AttestationService, limiter *rateLimiter) *grpc.ClientConn {
+	t.Helper()
+
+	l := bufconn.Listen(1 << 20)
+	srv := newRPCServer(svc, limiter)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial gRPC server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAttestRPC(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	conn := newTestRPCConn(t, newTestAttester(t, pki))
+	nonce := bytes.Repeat([]byte{0x42}, nonceLen)
+
+	doc, err := AttestRPC(context.Background(), conn, nonce)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	res, err := verifyDocument(doc, nonce, pki.opts(testEpoch))
+	if err != nil {
+		t.Fatalf("Expected a valid document but got %v.", err)
+	}
+	if want := testHashes().Serialize(); !bytes.Equal(res.Document.UserData, want) {
+		t.Errorf("Expected user data %q but got %q.", want, res.Document.UserData)
+	}
+}
+
+func TestAttestRPCErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		attester Attester
+		nonce    []byte
+		code     codes.Code
+	}{
+		{
+			name:     "short nonce",
+			attester: &fakeAttester{doc: []byte("document")},
+			nonce:    []byte("short"),
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "timeout",
+			attester: &fakeAttester{err: ErrAttestationTimeout},
+			nonce:    make([]byte, nonceLen),
+			code:     codes.DeadlineExceeded,
+		},
+		{
+			name:     "hypervisor error",
+			attester: &fakeAttester{err: errors.New("nsm unavailable")},
+			nonce:    make([]byte, nonceLen),
+			code:     codes.Internal,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := newTestRPCConn(t, c.attester)
+			_, err := AttestRPC(context.Background(), conn, c.nonce)
+			if got := status.Code(err); got != c.code {
+				t.Errorf("Expected code %s but got %s (%v).", c.code, got, err)
+			}
+		})
+	}
+}
+
+func TestAttestRPCRateLimit(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{Rate: 1, Burst: 1})
+	fakeClock(limiter)
+	svc := &AttestationService{attester: &fakeAttester{doc: []byte("doc")}, hashes: testHashes(), audit: newAuditLog(nil)}
+	conn := dialTestRPCServer(t, svc, limiter)
+
+	if _, err := AttestRPC(context.Background(), conn, make([]byte, nonceLen)); err != nil {
+		t.Fatalf("Expected first request to succeed but got %v.", err)
+	}
+	_, err := AttestRPC(context.Background(), conn, make([]byte, nonceLen))
+	if got := status.Code(err); got != codes.ResourceExhausted {
+		t.Fatalf("Expected code %s but got %s (%v).", codes.ResourceExhausted, got, err)
+	}
+}
+
+func TestAttestRPCNonceReplay(t *testing.T) {
+	nonces := newNonceCache(time.Minute)
+	svc := &AttestationService{attester: &fakeAttester{doc: []byte("doc")}, hashes: testHashes(), nonces: nonces, audit: newAuditLog(nil)}
+	conn := dialTestRPCServer(t, svc, nil)
+	nonce := bytes.Repeat([]byte{0x01}, nonceLen)
+
+	if _, err := AttestRPC(context.Background(), conn, nonce); err != nil {
+		t.Fatalf("Expected first request to succeed but got %v.", err)
+	}
+	_, err := AttestRPC(context.Background(), conn, nonce)
+	if got := status.Code(err); got != codes.AlreadyExists {
+		t.Fatalf("Expected code %s for replayed nonce but got %s (%v).", codes.AlreadyExists, got, err)
+	}
+
+	// A nonce that was used via our HTTP API can't be replayed via RPC.
+	h := attestationHandler(&fakeAttester{doc: []byte("doc")}, testHashes(), newTokenStore(0), nil, nonces, newAuditLog(io.Discard))
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, pathAttestation+"?nonce="+testNonce, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	rawNonce, _ := hex.DecodeString(testNonce)
+	_, err = AttestRPC(context.Background(), conn, rawNonce)
+	if got := status.Code(err); got != codes.AlreadyExists {
+		t.Fatalf("Expected code %s for nonce of HTTP API but got %s (%v).", codes.AlreadyExists, got, err)
+	}
+}
+
+func TestAttestRPCFailureReleasesNonce(t *testing.T) {
+	svc := &AttestationService{attester: &fakeAttester{err: errors.New("nsm unavailable")}, hashes: testHashes(), nonces: newNonceCache(time.Minute), audit: newAuditLog(nil)}
+	conn := dialTestRPCServer(t, svc, nil)
+	nonce := bytes.Repeat([]byte{0x02}, nonceLen)
+	for i := 0; i < 2; i++ {
+		_, err := AttestRPC(context.Background(), conn, nonce)
+		if got := status.Code(err); got != codes.Internal {
+			t.Fatalf("Expected code %s for attempt %d but got %s (%v).", codes.Internal, i, got, err)
+		}
+	}
+}
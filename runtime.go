@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runtimeInfo describes the resources that are available to the enclave's Go
+// runtime.
+type runtimeInfo struct {
+	NumCPU     int         `json:"num_cpu"`
+	GoMaxProcs int         `json:"gomaxprocs"`
+	Memory     memoryInfo  `json:"memory"`
+	FdLimit    fdLimitInfo `json:"fd_limit"`
+}
+
+// memoryInfo contains the highlights of runtime.MemStats, in bytes.
+type memoryInfo struct {
+	Sys       uint64 `json:"sys"`
+	HeapAlloc uint64 `json:"heap_alloc"`
+	HeapSys   uint64 `json:"heap_sys"`
+	HeapInuse uint64 `json:"heap_inuse"`
+	NumGC     uint32 `json:"num_gc"`
+}
+
+// fdLimitInfo contains both the configured and the effective file descriptor
+// limit.
+type fdLimitInfo struct {
+	ConfiguredCur uint64 `json:"configured_cur"`
+	ConfiguredMax uint64 `json:"configured_max"`
+	Cur           uint64 `json:"cur"`
+	Max           uint64 `json:"max"`
+}
+
+// runtimeHandler returns a HandlerFunc that reports the CPU, memory, and file
+// descriptor limits that are in effect inside the enclave.
+func runtimeHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		info := runtimeInfo{
+			NumCPU:     runtime.NumCPU(),
+			GoMaxProcs: runtime.GOMAXPROCS(0),
+			Memory: memoryInfo{
+				Sys:       m.Sys,
+				HeapAlloc: m.HeapAlloc,
+				HeapSys:   m.HeapSys,
+				HeapInuse: m.HeapInuse,
+				NumGC:     m.NumGC,
+			},
+			FdLimit: fdLimitInfo{
+				ConfiguredCur: cfg.FdCur,
+				ConfiguredMax: cfg.FdMax,
+			},
+		}
+
+		var rLimit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err == nil {
+			info.FdLimit.Cur, info.FdLimit.Max = rLimit.Cur, rLimit.Max
+		}
+
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+const (
+	pathCPUOnline = "/sys/devices/system/cpu/online"
+	pathCgroupCPU = "/sys/fs/cgroup/cpu.max"
+)
+
+// allocatedCPUs is a variable pointing to a function that returns the number
+// of vCPUs that were allocated to the enclave.  Using a variable allows us to
+// easily mock the function in our unit tests.
+var allocatedCPUs = func() (int, error) { return _allocatedCPUs() }
+
+// _allocatedCPUs determines the number of vCPUs that were allocated to the
+// enclave.  A cgroup CPU quota takes precedence over the list of online CPUs.
+func _allocatedCPUs() (int, error) {
+	if quota, err := os.ReadFile(pathCgroupCPU); err == nil {
+		if n, ok := parseCPUQuota(string(quota)); ok {
+			return n, nil
+		}
+	}
+
+	online, err := os.ReadFile(pathCPUOnline)
+	if err != nil {
+		return 0, err
+	}
+	return parseCPUList(string(online))
+}
+
+// parseCPUQuota parses a cgroup v2 cpu.max file, e.g., "200000 100000", and
+// returns the number of CPUs that the quota amounts to, rounded up.  The
+// second return value is false if no quota is set.
+func parseCPUQuota(s string) (int, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	quota, err1 := strconv.Atoi(fields[0])
+	period, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0, false
+	}
+	return (quota + period - 1) / period, true
+}
+
+// parseCPUList parses a CPU list like "0-3,5" and returns the number of CPUs
+// in the list.
+func parseCPUList(s string) (int, error) {
+	n := 0
+	for _, r := range strings.Split(strings.TrimSpace(s), ",") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		if !isRange {
+			hi = lo
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return 0, fmt.Errorf("bad CPU list %q: %w", s, err)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil {
+			return 0, fmt.Errorf("bad CPU list %q: %w", s, err)
+		}
+		if last < first {
+			return 0, fmt.Errorf("bad CPU range %q", r)
+		}
+		n += last - first + 1
+	}
+	return n, nil
+}
+
+// setGoMaxProcs sets GOMAXPROCS according to the given value.  A positive
+// value is used as is; 0 means that we set GOMAXPROCS to the number of vCPUs
+// that were allocated to the enclave; a negative value keeps Go's default.
+// Detected values are clamped to [1, runtime.NumCPU()].
+func setGoMaxProcs(procs int) {
+	if procs < 0 {
+		return
+	}
+	if procs == 0 {
+		n, err := allocatedCPUs()
+		if err != nil {
+			log.Printf("Failed to detect allocated vCPUs; keeping GOMAXPROCS at %d: %v",
+				runtime.GOMAXPROCS(0), err)
+			return
+		}
+		procs = clampProcs(n, runtime.NumCPU())
+	}
+	prev := runtime.GOMAXPROCS(procs)
+	log.Printf("Set GOMAXPROCS to %d (was %d).", procs, prev)
+}
+
+// clampProcs clamps the given number of processors to [1, max].
+func clampProcs(n, max int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
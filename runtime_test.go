@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeHandler(t *testing.T) {
+	cfg := testConfig()
+	cfg.FdCur, cfg.FdMax = 1024, 4096
+
+	w := httptest.NewRecorder()
+	runtimeHandler(cfg)(w, httptest.NewRequest(http.MethodGet, pathRuntime, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type but got %q.", ct)
+	}
+
+	var info runtimeInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", w.Body, err)
+	}
+	if info.NumCPU != runtime.NumCPU() {
+		t.Errorf("Expected %d CPUs but got %d.", runtime.NumCPU(), info.NumCPU)
+	}
+	if info.GoMaxProcs < 1 || info.GoMaxProcs != runtime.GOMAXPROCS(0) {
+		t.Errorf("Implausible GOMAXPROCS: %d", info.GoMaxProcs)
+	}
+	if info.Memory.Sys == 0 || info.Memory.HeapSys == 0 || info.Memory.HeapAlloc > info.Memory.Sys {
+		t.Errorf("Implausible memory stats: %+v", info.Memory)
+	}
+	if info.FdLimit.ConfiguredCur != cfg.FdCur || info.FdLimit.ConfiguredMax != cfg.FdMax {
+		t.Errorf("Expected configured FD limits %d/%d but got %+v.", cfg.FdCur, cfg.FdMax, info.FdLimit)
+	}
+	if info.FdLimit.Cur == 0 || info.FdLimit.Cur > info.FdLimit.Max {
+		t.Errorf("Implausible effective FD limits: %+v", info.FdLimit)
+	}
+}
+
+// useAllocatedCPUs makes allocatedCPUs return the given values for the
+// duration of the test, and restores GOMAXPROCS afterwards.
+func useAllocatedCPUs(t *testing.T, n int, err error) {
+	origFunc, origProcs := allocatedCPUs, runtime.GOMAXPROCS(0)
+	allocatedCPUs = func() (int, error) { return n, err }
+	t.Cleanup(func() {
+		allocatedCPUs = origFunc
+		runtime.GOMAXPROCS(origProcs)
+	})
+}
+
+func TestSetGoMaxProcs(t *testing.T) {
+	numCPU := runtime.NumCPU()
+	for _, test := range []struct {
+		name      string
+		procs     int
+		allocated int
+		err       error
+		expected  int
+	}{
+		{"detected", 0, 1, nil, 1},
+		{"detected beyond host CPUs", 0, numCPU + 4, nil, numCPU},
+		{"detected zero", 0, 0, nil, 1},
+		{"override", 3, 1, nil, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useAllocatedCPUs(t, test.allocated, test.err)
+			setGoMaxProcs(test.procs)
+			if got := runtime.GOMAXPROCS(0); got != test.expected {
+				t.Errorf("Expected GOMAXPROCS %d but got %d.", test.expected, got)
+			}
+		})
+	}
+
+	t.Run("detection fails", func(t *testing.T) {
+		useAllocatedCPUs(t, 0, errors.New("no sysfs"))
+		before := runtime.GOMAXPROCS(0)
+		setGoMaxProcs(0)
+		if got := runtime.GOMAXPROCS(0); got != before {
+			t.Errorf("Expected GOMAXPROCS to remain %d but got %d.", before, got)
+		}
+	})
+
+	t.Run("keep default", func(t *testing.T) {
+		useAllocatedCPUs(t, 1, nil)
+		before := runtime.GOMAXPROCS(0)
+		setGoMaxProcs(-1)
+		if got := runtime.GOMAXPROCS(0); got != before {
+			t.Errorf("Expected GOMAXPROCS to remain %d but got %d.", before, got)
+		}
+	})
+}
+
+func TestParseCPUQuota(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		n     int
+		quota bool
+	}{
+		{"200000 100000\n", 2, true},
+		{"150000 100000", 2, true},
+		{"50000 100000", 1, true},
+		{"max 100000", 0, false},
+		{"", 0, false},
+		{"-1 100000", 0, false},
+		{"foo bar", 0, false},
+	} {
+		n, ok := parseCPUQuota(test.in)
+		if n != test.n || ok != test.quota {
+			t.Errorf("parseCPUQuota(%q) = %d, %v; expected %d, %v", test.in, n, ok, test.n, test.quota)
+		}
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		n       int
+		wantErr bool
+	}{
+		{"0\n", 1, false},
+		{"0-3", 4, false},
+		{"0-3,5", 5, false},
+		{"0,2,4-5", 4, false},
+		{"3-1", 0, true},
+		{"a-b", 0, true},
+		{"", 0, true},
+	} {
+		n, err := parseCPUList(test.in)
+		if n != test.n || (err != nil) != test.wantErr {
+			t.Errorf("parseCPUList(%q) = %d, %v; expected %d, error: %v", test.in, n, err, test.n, test.wantErr)
+		}
+	}
+}
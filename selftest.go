@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// selfTestStep is the outcome of one step of the self-test.
+type selfTestStep struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// selfTestReport is the JSON representation of the self-test's outcome.
+type selfTestReport struct {
+	URL        string         `json:"url"`
+	Passed     bool           `json:"passed"`
+	DurationMs int64          `json:"duration_ms"`
+	Steps      []selfTestStep `json:"steps"`
+	Warnings   []string       `json:"warnings,omitempty"`
+}
+
+// step runs the given step, records its outcome, and returns its error.
+func (r *selfTestReport) step(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	s := selfTestStep{Name: name, Passed: err == nil, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+	return err
+}
+
+// newNonce returns a random nonce for an attestation request.
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// selfTest runs the attestation round-trip against the enclave that's
+// reachable at the given base URL: it asks for a document that contains a
+// random nonce, verifies the document according to the given options, which
+// default to the AWS root, and makes sure that the nonce made it back.
+// Steps after a failed step are skipped.
+func selfTest(baseURL string, opts VerifyOptions) *selfTestReport {
+	report := &selfTestReport{URL: baseURL}
+	start := time.Now()
+	defer func() { report.DurationMs = time.Since(start).Milliseconds() }()
+
+	var nonce []byte
+	if err := report.step("generate nonce", func() (err error) {
+		nonce, err = newNonce()
+		return err
+	}); err != nil {
+		return report
+	}
+
+	var res *Result
+	if err := report.step("fetch and verify attestation", func() (err error) {
+		res, err = VerifyRemote(baseURL, nonce, opts)
+		return err
+	}); err != nil {
+		return report
+	}
+	report.Warnings = res.Warnings
+
+	if err := report.step("check nonce", func() error {
+		if !bytes.Equal(res.Document.Nonce, nonce) {
+			return errors.New("document doesn't contain our nonce")
+		}
+		return nil
+	}); err != nil {
+		return report
+	}
+
+	report.Passed = true
+	return report
+}
+
+// runSelfTest runs the self-test against the enclave that's reachable at the
+// given base URL, writes the JSON report to the given writer, and returns
+// the process's exit code.
+func runSelfTest(baseURL string, w io.Writer) int {
+	report := selfTest(baseURL, VerifyOptions{})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		fmt.Fprintf(w, "Failed to encode report: %v\n", err)
+		return 1
+	}
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stepNames returns the names of the given report's steps.
+func stepNames(r *selfTestReport) []string {
+	var names []string
+	for _, s := range r.Steps {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestSelfTest(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	srv := newAttestationServer(t, newTestAttester(t, pki))
+
+	report := selfTest(srv.URL, pki.opts(testEpoch))
+	if !report.Passed {
+		t.Fatalf("Expected self-test to pass but got %+v.", report.Steps)
+	}
+	if report.URL != srv.URL {
+		t.Errorf("Expected URL %q but got %q.", srv.URL, report.URL)
+	}
+	if got := stepNames(report); len(got) != 3 {
+		t.Fatalf("Expected 3 steps but got %v.", got)
+	}
+	for _, s := range report.Steps {
+		if !s.Passed || s.Error != "" {
+			t.Errorf("Expected step %q to pass but got %q.", s.Name, s.Error)
+		}
+	}
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	cases := []struct {
+		name string
+		srv  *httptest.Server
+		opts VerifyOptions
+	}{
+		{"untrusted enclave", newAttestationServer(t, newTestAttester(t, pki)), newNSMTestPKI(t).opts(testEpoch)},
+		{"failing enclave", httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no attestation", http.StatusServiceUnavailable)
+		})), pki.opts(testEpoch)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			defer c.srv.Close()
+			report := selfTest(c.srv.URL, c.opts)
+			if report.Passed {
+				t.Fatal("Expected self-test to fail.")
+			}
+			// The nonce check is skipped after the failed verification.
+			if got := stepNames(report); len(got) != 2 {
+				t.Fatalf("Expected 2 steps but got %v.", got)
+			}
+			if last := report.Steps[1]; last.Passed || last.Error == "" {
+				t.Fatalf("Expected step %q to fail with an error but got %+v.", last.Name, last)
+			}
+		})
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	// The stub enclave's documents don't chain up to the AWS root, which
+	// runSelfTest verifies against.
+	srv := newAttestationServer(t, newTestAttester(t, newNSMTestPKI(t)))
+	var out bytes.Buffer
+	if code := runSelfTest(srv.URL, &out); code != 1 {
+		t.Fatalf("Expected exit code 1 but got %d.", code)
+	}
+	var report selfTestReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report %q: %v", out.String(), err)
+	}
+	if report.Passed || report.URL != srv.URL {
+		t.Fatalf("Expected failed report for %q but got %+v.", srv.URL, report)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pathSharedAttestation = "/enclave/attestation/shared"
+	sharedNonceLabel      = "nitriding shared nonce"
+	// sharedClient identifies shared documents in the audit log.  They're
+	// issued for all clients of a window rather than for one client.
+	sharedClient = "shared"
+)
+
+var ErrStaleWindow = errors.New("shared attestation is from an unexpected rotation window")
+
+// sharedAttestation is the JSON response of the shared attestation endpoint.
+type sharedAttestation struct {
+	Nonce       string    `json:"nonce"`
+	Document    string    `json:"document"`
+	WindowStart time.Time `json:"window_start"`
+	Expires     time.Time `json:"expires"`
+
+	// etag identifies the document in conditional requests.
+	etag string
+	// validUntil is the end of the window or the expiry of the document's
+	// certificate, whichever comes first.
+	validUntil time.Time
+}
+
+// sharedNonce returns the nonce of the rotation window that starts at the
+// given time.  The nonce is derived from the window's start, so clients can
+// compute it on their own instead of trusting the nonce that we send them.
+func sharedNonce(windowStart time.Time) []byte {
+	h := sha256.New()
+	h.Write([]byte(sharedNonceLabel))
+	_ = binary.Write(h, binary.BigEndian, windowStart.Unix())
+	return h.Sum(nil)[:nonceLen]
+}
+
+// windowStart returns the start of the rotation window that contains the
+// given time.
+func windowStart(t time.Time, interval time.Duration) time.Time {
+	return t.Truncate(interval).UTC()
+}
+
+// sharedAttester issues a single attestation document per rotation window,
+// which contains the window's shared nonce.  All clients in a window get the
+// same document, which amortizes the cost of asking the NSM over a fleet of
+// clients.  The document is rotated lazily, by the first request of each
+// window.
+type sharedAttester struct {
+	sync.Mutex
+	attester Attester
+	hashes   *AttestationHashes
+	audit    *auditLog
+	interval time.Duration
+	now      func() time.Time
+	current  *sharedAttestation
+}
+
+func newSharedAttester(a Attester, hashes *AttestationHashes, audit *auditLog, interval time.Duration) *sharedAttester {
+	return &sharedAttester{
+		attester: a,
+		hashes:   hashes,
+		audit:    audit,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// get returns the attestation of the current window, and asks the NSM for a
+// new one if the window has rotated.
+func (s *sharedAttester) get() (*sharedAttestation, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	start := windowStart(s.now(), s.interval)
+	if s.current != nil && s.current.WindowStart.Equal(start) {
+		return s.current, nil
+	}
+	nonce := sharedNonce(start)
+	userData := s.hashes.Serialize()
+	rawDoc, err := s.attester.Attest(nonce, userData, nil)
+	s.audit.attestation(sharedClient, nonce, userData, rawDoc, err)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(rawDoc)
+	s.current = &sharedAttestation{
+		Nonce:       hex.EncodeToString(nonce),
+		Document:    base64.StdEncoding.EncodeToString(rawDoc),
+		WindowStart: start,
+		Expires:     start.Add(s.interval),
+		etag:        `"` + hex.EncodeToString(digest[:16]) + `"`,
+		validUntil:  docValidUntil(rawDoc, start.Add(s.interval)),
+	}
+	log.Printf("Rotated shared attestation for window starting at %s.", start)
+	return s.current, nil
+}
+
+// sharedAttestationHandler returns a HandlerFunc that serves the attestation
+// document of the current rotation window.  The document's nonce is fixed
+// for the window, so clients and intermediaries may cache the response until
+// the window ends or the document's certificate expires.  The ETag is
+// derived from the document's digest, so conditional requests get 304 Not
+// Modified until the document rotates.
+func sharedAttestationHandler(s *sharedAttester) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		att, err := s.get()
+		if errors.Is(err, ErrAttestationTimeout) {
+			log.Println("Shared attestation: Timed out while waiting for attestation document from hypervisor")
+			http.Error(w, errTimeoutAttestation, http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			log.Println("Shared attestation: Failed to obtain attestation document from hypervisor:", err)
+			http.Error(w, errFailedAttestation, http.StatusInternalServerError)
+			return
+		}
+		maxAge := int(att.validUntil.Sub(s.now()).Seconds())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		w.Header().Set("ETag", att.etag)
+		if etagMatches(r.Header.Get("If-None-Match"), att.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, att)
+	}
+}
+
+// docValidUntil returns the expiry of the given document's certificate, or
+// the given window end if it comes first or the certificate can't be parsed.
+func docValidUntil(rawDoc []byte, windowEnd time.Time) time.Time {
+	payload, err := decodePayload(rawDoc)
+	if err != nil {
+		return windowEnd
+	}
+	cert, err := x509.ParseCertificate(payload.Certificate)
+	if err != nil || cert.NotAfter.After(windowEnd) {
+		return windowEnd
+	}
+	return cert.NotAfter
+}
+
+// etagMatches returns true if the given If-None-Match header value contains
+// the given entity tag, or is "*".  Weak tags match their strong version.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyShared fetches the shared attestation document of the enclave that's
+// reachable at the given base URL, and verifies it according to the given
+// options.  The enclave must rotate its document at the given interval.  We
+// accept documents of the current and the previous window, to tolerate clock
+// skew and requests that straddle a rotation, and we derive the expected
+// nonce from the window ourselves.
+func VerifyShared(baseURL string, interval time.Duration, opts VerifyOptions) (*Result, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	u.Path = pathSharedAttestation
+
+	client := http.Client{Timeout: verifyTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch shared attestation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	maxBodyLen := base64.StdEncoding.EncodedLen(opts.maxDocumentSize()) + 1024
+	body, err := io.ReadAll(newLimitReader(resp.Body, maxBodyLen))
+	if errors.Is(err, errTooMuchToRead) {
+		return nil, ErrDocumentTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enclave returned status code %d: %s", resp.StatusCode, body)
+	}
+
+	var att sharedAttestation
+	if err := json.Unmarshal(body, &att); err != nil {
+		return nil, fmt.Errorf("failed to decode shared attestation: %w", err)
+	}
+	current := windowStart(opts.now(), interval)
+	if !att.WindowStart.Equal(current) && !att.WindowStart.Equal(current.Add(-interval)) {
+		return nil, fmt.Errorf("%w: %s", ErrStaleWindow, att.WindowStart)
+	}
+	rawDoc, err := base64.StdEncoding.DecodeString(att.Document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Base64-encoded document: %w", err)
+	}
+	return verifyDocument(rawDoc, sharedNonce(att.WindowStart), opts)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSharedInterval = 10 * time.Minute
+
+// countingAttester counts the documents that the wrapped attester issues.
+type countingAttester struct {
+	Attester
+	sync.Mutex
+	calls int
+}
+
+func (a *countingAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	a.Lock()
+	a.calls++
+	a.Unlock()
+	return a.Attester.Attest(nonce, userData, publicKey)
+}
+
+func (a *countingAttester) numCalls() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.calls
+}
+
+// newTestSharedAttester returns a shared attester whose documents are signed
+// by the given PKI and whose clock starts at testEpoch.
+func newTestSharedAttester(t *testing.T, pki *testPKI) (*sharedAttester, *countingAttester, *testClock) {
+	t.Helper()
+	clock := &testClock{t: testEpoch}
+	ta := newTestAttester(t, pki)
+	ta.now = clock.now
+	a := &countingAttester{Attester: ta}
+	s := newSharedAttester(a, testHashes(), newAuditLog(nil), testSharedInterval)
+	s.now = clock.now
+	return s, a, clock
+}
+
+// getShared requests the shared attestation from the given handler.
+func getShared(t *testing.T, h http.Handler, ifNoneMatch string) (*httptest.ResponseRecorder, sharedAttestation) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, pathSharedAttestation, nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	h.ServeHTTP(w, r)
+	var att sharedAttestation
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &att); err != nil {
+			t.Fatalf("Failed to decode shared attestation %q: %v", w.Body, err)
+		}
+	}
+	return w, att
+}
+
+func TestSharedAttestationRotation(t *testing.T) {
+	s, a, clock := newTestSharedAttester(t, newNSMTestPKI(t))
+	h := sharedAttestationHandler(s)
+
+	// All clients of a window get the same document.
+	_, first := getShared(t, h, "")
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Minute)
+		if _, att := getShared(t, h, ""); att.Document != first.Document {
+			t.Fatalf("Expected client %d to get the window's document.", i)
+		}
+	}
+	if n := a.numCalls(); n != 1 {
+		t.Fatalf("Expected 1 attestation per window but got %d.", n)
+	}
+
+	// The next window gets a new document with a new nonce.
+	clock.advance(testSharedInterval)
+	_, next := getShared(t, h, "")
+	if next.Document == first.Document || next.Nonce == first.Nonce {
+		t.Fatal("Expected a new document after rotation.")
+	}
+	if !next.WindowStart.Equal(first.WindowStart.Add(testSharedInterval)) {
+		t.Errorf("Expected window to start at %s but got %s.", first.WindowStart.Add(testSharedInterval), next.WindowStart)
+	}
+	if n := a.numCalls(); n != 2 {
+		t.Errorf("Expected 2 attestations but got %d.", n)
+	}
+}
+
+func TestSharedAttestationCaching(t *testing.T) {
+	s, _, clock := newTestSharedAttester(t, newNSMTestPKI(t))
+	h := sharedAttestationHandler(s)
+
+	clock.advance(4 * time.Minute)
+	w, _ := getShared(t, h, "")
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=360" {
+		t.Errorf("Expected caching until the end of the window but got %q.", got)
+	}
+	etag := w.Header().Get("ETag")
+	if w, _ = getShared(t, h, etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected status code %d but got %d.", http.StatusNotModified, w.Code)
+	}
+	if w, _ = getShared(t, h, "W/"+etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected weak tag to match but got %d.", w.Code)
+	}
+
+	clock.advance(testSharedInterval)
+	if w, _ = getShared(t, h, etag); w.Code != http.StatusOK {
+		t.Errorf("Expected rotated document to not match the old tag but got %d.", w.Code)
+	}
+}
+
+func TestSharedAttestationCachingCertExpiry(t *testing.T) {
+	// The document's certificate expires two minutes into the window, so
+	// it must not be cached for the rest of the window.
+	pki := newTestPKI(t, testEpoch.Add(-time.Hour), testEpoch.Add(2*time.Minute))
+	s, _, clock := newTestSharedAttester(t, pki)
+	h := sharedAttestationHandler(s)
+
+	clock.advance(30 * time.Second)
+	w, _ := getShared(t, h, "")
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=90" {
+		t.Errorf("Expected caching until the certificate expires but got %q.", got)
+	}
+
+	clock.advance(5 * time.Minute)
+	w, _ = getShared(t, h, "")
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=0" {
+		t.Errorf("Expected no caching past the certificate's expiry but got %q.", got)
+	}
+}
+
+func TestDocValidUntil(t *testing.T) {
+	windowEnd := testEpoch.Add(testSharedInterval)
+	attest := func(pki *testPKI) []byte {
+		doc, _ := newTestAttester(t, pki).Attest(nil, nil, nil)
+		return doc
+	}
+	for _, c := range []struct {
+		name string
+		doc  []byte
+		want time.Time
+	}{
+		{"cert outlives window", attest(newNSMTestPKI(t)), windowEnd},
+		{"cert expires first", attest(newTestPKI(t, testEpoch, testEpoch.Add(time.Minute))), testEpoch.Add(time.Minute)},
+		{"garbage", []byte("garbage"), windowEnd},
+	} {
+		if got := docValidUntil(c.doc, windowEnd); !got.Equal(c.want) {
+			t.Errorf("%s: Expected %s but got %s.", c.name, c.want, got)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc"`
+	for _, c := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz"`, false},
+		{`"xyz", "abc"`, true},
+		{"*", true},
+		{"abc", false},
+	} {
+		if got := etagMatches(c.ifNoneMatch, etag); got != c.want {
+			t.Errorf("Expected %t for %q but got %t.", c.want, c.ifNoneMatch, got)
+		}
+	}
+}
+
+func TestSharedAttestationFailure(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{ErrAttestationTimeout, http.StatusGatewayTimeout},
+		{errNSMDown, http.StatusInternalServerError},
+	} {
+		s := newSharedAttester(&fakeAttester{err: c.err}, testHashes(), newAuditLog(nil), testSharedInterval)
+		if w, _ := getShared(t, sharedAttestationHandler(s), ""); w.Code != c.code {
+			t.Errorf("Expected status code %d for %v but got %d.", c.code, c.err, w.Code)
+		}
+	}
+}
+
+func TestVerifyShared(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	s, _, clock := newTestSharedAttester(t, pki)
+	srv := httptest.NewServer(sharedAttestationHandler(s))
+	defer srv.Close()
+
+	res, err := VerifyShared(srv.URL, testSharedInterval, pki.opts(clock.now()))
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if want := sharedNonce(windowStart(clock.now(), testSharedInterval)); !bytes.Equal(res.Document.Nonce, want) {
+		t.Errorf("Expected the window's nonce but got %x.", res.Document.Nonce)
+	}
+
+	// Clients that are a window ahead still accept the document.
+	if _, err := VerifyShared(srv.URL, testSharedInterval, pki.opts(clock.now().Add(testSharedInterval))); err != nil {
+		t.Errorf("Expected document of the previous window to verify but got %v.", err)
+	}
+	// Older windows are rejected.
+	opts := pki.opts(clock.now().Add(2 * testSharedInterval))
+	if _, err := VerifyShared(srv.URL, testSharedInterval, opts); !errors.Is(err, ErrStaleWindow) {
+		t.Errorf("Expected error %v but got %v.", ErrStaleWindow, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoSyscallConn = errors.New("connection doesn't expose its socket")
+
+// SocketOptions configures the vsock connection to the EC2 host.  Fields
+// that are 0 leave the kernel's defaults alone.
+//
+// Note that vsock has no equivalent to Nagle's algorithm -- writes are sent
+// right away -- so there's no TCP_NODELAY to set.  The option that matters
+// most for throughput is BufferSize: it determines how much data the host may
+// send before it has to wait for us to read.  The vsock transport largely
+// ignores SendBuffer and RecvBuffer, which we only set for completeness,
+// e.g., for Unix domain sockets in tests.
+type SocketOptions struct {
+	// BufferSize sets SO_VM_SOCKETS_BUFFER_SIZE, the size of the vsock
+	// stream's receive buffer.  The kernel caps it at
+	// SO_VM_SOCKETS_BUFFER_MAX_SIZE, which is 256 KiB by default.
+	BufferSize uint64
+	// SendBuffer sets SO_SNDBUF.
+	SendBuffer int
+	// RecvBuffer sets SO_RCVBUF.
+	RecvBuffer int
+}
+
+func (o SocketOptions) isSet() bool {
+	return o.BufferSize != 0 || o.SendBuffer != 0 || o.RecvBuffer != 0
+}
+
+// syscallConn is implemented by connections that expose their socket, like
+// *vsock.Conn and *net.UnixConn.
+type syscallConn interface {
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// setSocketOptions applies the given options to the given connection.
+func setSocketOptions(conn net.Conn, o SocketOptions) error {
+	if !o.isSet() {
+		return nil
+	}
+	sc, ok := conn.(syscallConn)
+	if !ok {
+		return errNoSyscallConn
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		optErr = applySocketOptions(int(fd), o, unix.SetsockoptInt, unix.SetsockoptUint64)
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+// applySocketOptions sets the given options on the given socket via the
+// given setters, which tests can replace.
+func applySocketOptions(
+	fd int,
+	o SocketOptions,
+	setInt func(fd, level, opt, value int) error,
+	setUint64 func(fd, level, opt int, value uint64) error,
+) error {
+	if o.BufferSize != 0 {
+		if err := setUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE, o.BufferSize); err != nil {
+			return fmt.Errorf("failed to set vsock buffer size: %w", err)
+		}
+	}
+	if o.SendBuffer != 0 {
+		if err := setInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set send buffer: %w", err)
+		}
+	}
+	if o.RecvBuffer != 0 {
+		if err := setInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %w", err)
+		}
+	}
+	return nil
+}
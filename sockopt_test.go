@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockopt is a socket option that was set via a fake setter.
+type sockopt struct {
+	level, opt int
+	value      uint64
+}
+
+// recordSetters returns setters that record the options that they're asked
+// to set, and fail with the given error.
+func recordSetters(set *[]sockopt, err error) (func(int, int, int, int) error, func(int, int, int, uint64) error) {
+	return func(fd, level, opt, value int) error {
+			*set = append(*set, sockopt{level, opt, uint64(value)})
+			return err
+		}, func(fd, level, opt int, value uint64) error {
+			*set = append(*set, sockopt{level, opt, value})
+			return err
+		}
+}
+
+func TestApplySocketOptions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts SocketOptions
+		want []sockopt
+	}{
+		{"defaults", SocketOptions{}, nil},
+		{
+			"all options",
+			SocketOptions{BufferSize: 1 << 20, SendBuffer: 4096, RecvBuffer: 8192},
+			[]sockopt{
+				{unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE, 1 << 20},
+				{unix.SOL_SOCKET, unix.SO_SNDBUF, 4096},
+				{unix.SOL_SOCKET, unix.SO_RCVBUF, 8192},
+			},
+		},
+		{
+			"receive buffer only",
+			SocketOptions{RecvBuffer: 8192},
+			[]sockopt{{unix.SOL_SOCKET, unix.SO_RCVBUF, 8192}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var set []sockopt
+			setInt, setUint64 := recordSetters(&set, nil)
+			if err := applySocketOptions(3, test.opts, setInt, setUint64); err != nil {
+				t.Fatalf("Expected no error but got %v.", err)
+			}
+			if !reflect.DeepEqual(set, test.want) {
+				t.Fatalf("Expected options %v but got %v.", test.want, set)
+			}
+		})
+	}
+}
+
+func TestApplySocketOptionsError(t *testing.T) {
+	var set []sockopt
+	setInt, setUint64 := recordSetters(&set, unix.ENOPROTOOPT)
+	err := applySocketOptions(3, SocketOptions{BufferSize: 1, SendBuffer: 1}, setInt, setUint64)
+	if !errors.Is(err, unix.ENOPROTOOPT) {
+		t.Fatalf("Expected error to wrap %v but got %v.", unix.ENOPROTOOPT, err)
+	}
+	if len(set) != 1 {
+		t.Fatalf("Expected to stop after the first failure but set %d options.", len(set))
+	}
+}
+
+// unixConnPair returns a connected pair of Unix domain sockets, which expose
+// their socket like vsock connections do.
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	client, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	server, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		os.Remove(path)
+	})
+	return client, server
+}
+
+func getsockopt(t *testing.T, conn *net.UnixConn, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	conn, _ := unixConnPair(t)
+	const size = 64 * 1024
+	if err := setSocketOptions(conn, SocketOptions{SendBuffer: size, RecvBuffer: size}); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	// Linux doubles the requested sizes to leave room for bookkeeping.
+	for name, opt := range map[string]int{"send": unix.SO_SNDBUF, "receive": unix.SO_RCVBUF} {
+		if got := getsockopt(t, conn, opt); got < size {
+			t.Errorf("Expected %s buffer of at least %d but got %d.", name, size, got)
+		}
+	}
+
+	// Unix domain sockets have no vsock options.
+	if err := setSocketOptions(conn, SocketOptions{BufferSize: size}); err == nil {
+		t.Error("Expected vsock buffer size to fail on a Unix domain socket.")
+	}
+}
+
+func TestSetSocketOptionsDefaults(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := setSocketOptions(c1, SocketOptions{}); err != nil {
+		t.Fatalf("Expected default options to leave the connection alone but got %v.", err)
+	}
+	if err := setSocketOptions(c1, SocketOptions{SendBuffer: 1}); !errors.Is(err, errNoSyscallConn) {
+		t.Fatalf("Expected error %v but got %v.", errNoSyscallConn, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+var errPortsExhausted = errors.New("no free source port in configured range")
+
+// PortRange is an inclusive range of TCP ports.  The zero value means "any
+// port".
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (r PortRange) isSet() bool {
+	return r.Min != 0 || r.Max != 0
+}
+
+func (r PortRange) size() int {
+	return int(r.Max) - int(r.Min) + 1
+}
+
+// validate returns an error if the range is set but malformed.
+func (r PortRange) validate() error {
+	if !r.isSet() {
+		return nil
+	}
+	if r.Min == 0 || r.Max < r.Min {
+		return fmt.Errorf("invalid source port range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+// portRangeDialer binds outbound connections to a local port within a given
+// range, e.g., so the EC2 host's firewall can tell enclave traffic apart.
+// Ports are handed out round robin.  If a port is taken, the next one is
+// tried, until we've tried the entire range.
+type portRangeDialer struct {
+	dialer *net.Dialer
+	ports  PortRange
+	next   uint32
+}
+
+func (d *portRangeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for i := 0; i < d.ports.size(); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		offset := int(atomic.AddUint32(&d.next, 1)-1) % d.ports.size()
+		dialer := *d.dialer
+		dialer.LocalAddr = &net.TCPAddr{Port: int(d.ports.Min) + offset}
+		c, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %v", errPortsExhausted, lastErr)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// newPortReporter starts a listener that reports the source port of every
+// connection that it accepts.
+func newPortReporter(t *testing.T) (string, chan int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ports := make(chan int, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ports <- c.RemoteAddr().(*net.TCPAddr).Port
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), ports
+}
+
+func TestPortRangeValidate(t *testing.T) {
+	for _, c := range []struct {
+		r     PortRange
+		valid bool
+	}{
+		{PortRange{}, true},
+		{PortRange{Min: 40000, Max: 40000}, true},
+		{PortRange{Min: 40000, Max: 40100}, true},
+		{PortRange{Min: 0, Max: 40000}, false},
+		{PortRange{Min: 40100, Max: 40000}, false},
+	} {
+		if err := c.r.validate(); (err == nil) != c.valid {
+			t.Errorf("Expected range %d-%d to be valid: %v, but got %v.", c.r.Min, c.r.Max, c.valid, err)
+		}
+	}
+}
+
+func TestOutboundSourcePorts(t *testing.T) {
+	addr, ports := newPortReporter(t)
+	min := freePort(t)
+	if min > 65535-4 {
+		t.Skip("Free port too close to the end of the port range.")
+	}
+	r := PortRange{Min: min, Max: min + 4}
+	dial := newOutboundDialer(OutboundConfig{SourcePorts: r})
+
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		c, err := dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Expected no error but got %v.", err)
+		}
+		c.Close()
+		port := <-ports
+		if port < int(r.Min) || port > int(r.Max) {
+			t.Errorf("Expected source port in %d-%d but got %d.", r.Min, r.Max, port)
+		}
+		seen[port] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected source ports to rotate but got %v.", seen)
+	}
+}
+
+func TestOutboundSourcePortsExhausted(t *testing.T) {
+	addr, _ := newPortReporter(t)
+	// Our only source port is taken.
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := uint16(taken.Addr().(*net.TCPAddr).Port)
+
+	dial := newOutboundDialer(OutboundConfig{SourcePorts: PortRange{Min: port, Max: port}})
+	if _, err := dial(context.Background(), "tcp", addr); !errors.Is(err, errPortsExhausted) {
+		t.Errorf("Expected error %v but got %v.", errPortsExhausted, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultStartupTimeout bounds the duration of Start if the config doesn't
+// specify a timeout.
+const defaultStartupTimeout = 30 * time.Second
+
+var ErrStartupTimeout = errors.New("enclave startup timed out")
+
+// startupPhase is a named step of the enclave's startup sequence.  Its run
+// function must return once the given context is done.
+type startupPhase struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runPhases runs the given phases in order and returns the first error that a
+// phase returns.  If the phases don't complete within the given timeout,
+// runPhases cancels the context of the running phase, doesn't start the
+// remaining phases, and returns ErrStartupTimeout along with the names of all
+// phases that didn't complete.
+func runPhases(timeout time.Duration, phases []startupPhase) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var completed int32
+	done := make(chan error, 1)
+	go func() {
+		for i, p := range phases {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := p.run(ctx); err != nil {
+				done <- fmt.Errorf("%s: %w", p.name, err)
+				return
+			}
+			atomic.StoreInt32(&completed, int32(i+1))
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		var pending []string
+		for _, p := range phases[atomic.LoadInt32(&completed):] {
+			pending = append(pending, p.name)
+		}
+		return fmt.Errorf("%w after %s; incomplete phases: %s",
+			ErrStartupTimeout, timeout, strings.Join(pending, ", "))
+	}
+}
+
+// startupReport collects the problems that we run into while starting the
+// enclave, so all of them are surfaced at once instead of only the first.
+// Warnings are problems that we can live with, e.g., a file descriptor limit
+// that couldn't be raised.
+type startupReport struct {
+	warnings []error
+}
+
+func (r *startupReport) warn(err error) {
+	log.Warn(err)
+	r.warnings = append(r.warnings, err)
+}
+
+// finish logs a summary of startup and returns nil if the given fatal error
+// is nil.  Otherwise, it returns the fatal error joined with all warnings.
+func (r *startupReport) finish(fatal error) error {
+	if fatal == nil {
+		if len(r.warnings) > 0 {
+			log.Warnf("Enclave started with %d warning(s):\n%v", len(r.warnings), joinErrors(r.warnings...))
+		}
+		return nil
+	}
+	err := joinErrors(append([]error{fatal}, r.warnings...)...)
+	log.Errorf("Enclave failed to start:\n%v", err)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useStuckNetworking replaces runDevice with a fake whose devices never come
+// up, for the duration of the test.
+func useStuckNetworking(t *testing.T) {
+	t.Helper()
+	orig := runDevice
+	runDevice = func(n *NetConfig, stop chan StopReason, ready func()) error {
+		<-stop
+		return nil
+	}
+	t.Cleanup(func() { runDevice = orig })
+}
+
+// useFakeLoIface makes configureLoIface a no-op for the duration of the
+// test, so Start can run outside an enclave.
+func useFakeLoIface(t *testing.T) {
+	t.Helper()
+	orig := configureLoIface
+	configureLoIface = func() error { return nil }
+	t.Cleanup(func() { configureLoIface = orig })
+}
+
+func TestRunPhases(t *testing.T) {
+	var ran []string
+	phase := func(name string, err error) startupPhase {
+		return startupPhase{name, func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+
+	if err := runPhases(time.Second, []startupPhase{phase("a", nil), phase("b", nil)}); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if got := strings.Join(ran, ","); got != "a,b" {
+		t.Fatalf("Expected phases a,b to run but got %s.", got)
+	}
+
+	ran = nil
+	errFailed := errors.New("failed")
+	err := runPhases(time.Second, []startupPhase{phase("a", errFailed), phase("b", nil)})
+	if !errors.Is(err, errFailed) || !strings.HasPrefix(err.Error(), "a: ") {
+		t.Fatalf("Expected error of phase a but got %v.", err)
+	}
+	if got := strings.Join(ran, ","); got != "a" {
+		t.Fatalf("Expected only phase a to run but got %s.", got)
+	}
+}
+
+func TestRunPhasesTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	canceled := make(chan struct{})
+	laterRan := make(chan struct{}, 1)
+	phases := []startupPhase{
+		{"quick", func(context.Context) error { return nil }},
+		{"stuck", func(ctx context.Context) error {
+			<-ctx.Done()
+			close(canceled)
+			return ctx.Err()
+		}},
+		{"later", func(context.Context) error {
+			laterRan <- struct{}{}
+			return nil
+		}},
+	}
+
+	start := time.Now()
+	err := runPhases(timeout, phases)
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("Expected runPhases to return within %s but took %s.", timeout, elapsed)
+	}
+	if !errors.Is(err, ErrStartupTimeout) {
+		t.Fatalf("Expected error %v but got %v.", ErrStartupTimeout, err)
+	}
+	if !strings.HasSuffix(err.Error(), "incomplete phases: stuck, later") {
+		t.Fatalf("Expected error to name the incomplete phases but got %v.", err)
+	}
+
+	// The stuck phase must learn about the timeout, and the remaining phase
+	// must not run.
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected stuck phase's context to be canceled.")
+	}
+	select {
+	case <-laterRan:
+		t.Fatal("Expected phase after the timeout to not run.")
+	case <-time.After(10 * timeout):
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	useStuckNetworking(t)
+	useFakeLoIface(t)
+
+	const timeout = 100 * time.Millisecond
+	cfg := testConfig()
+	cfg.StartupTimeout = timeout
+	e := newTestEnclave(t, cfg)
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	start := time.Now()
+	err := e.Start()
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("Expected Start to return within %s but took %s.", timeout, elapsed)
+	}
+	if !errors.Is(err, ErrStartupTimeout) {
+		t.Fatalf("Expected error %v but got %v.", ErrStartupTimeout, err)
+	}
+	if !strings.Contains(err.Error(), "incomplete phases: networking, servers, readiness") {
+		t.Fatalf("Expected error to name the incomplete phases but got %v.", err)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	errFd := errors.New("fd limit")
+	errRoot := errors.New("bad root")
+	errFatal := errors.New("no networking")
+
+	r := new(startupReport)
+	if err := r.finish(nil); err != nil {
+		t.Fatalf("Expected no error without problems but got %v.", err)
+	}
+	r.warn(errFd)
+	r.warn(errRoot)
+	if err := r.finish(nil); err != nil {
+		t.Fatalf("Expected warnings not to fail startup but got %v.", err)
+	}
+	err := r.finish(errFatal)
+	for _, want := range []error{errFatal, errFd, errRoot} {
+		if !errors.Is(err, want) {
+			t.Errorf("Expected error to contain %v but got %v.", want, err)
+		}
+	}
+}
+
+func TestStartSurfacesAllProblems(t *testing.T) {
+	useStuckNetworking(t)
+	useFakeLoIface(t)
+	useEmbeddedRoot(t, corruptRootPEM)
+
+	cfg := testConfig()
+	cfg.AllowInvalidRoot = true
+	// A soft limit above the hard limit can't be set.
+	cfg.FdCur, cfg.FdMax = 2048, 1024
+	cfg.StartupTimeout = 100 * time.Millisecond
+	e := newTestEnclave(t, cfg)
+	t.Cleanup(func() { _ = e.Stop(StopSignal) })
+
+	err := e.Start()
+	if !errors.Is(err, ErrStartupTimeout) {
+		t.Fatalf("Expected error %v but got %v.", ErrStartupTimeout, err)
+	}
+	for _, want := range []string{"failed to load attestation root", "failed to set new file descriptor limit"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q but got %v.", want, err)
+		}
+	}
+}
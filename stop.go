@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout bounds the time we give our Web servers to finish in-flight
+// requests when the enclave stops.
+const shutdownTimeout = 10 * time.Second
+
+// StopReason describes why the enclave stopped.
+type StopReason string
+
+const (
+	// StopSignal means that the process received a termination signal.
+	StopSignal StopReason = "signal"
+	// StopNetworkingFailure means that we gave up on setting up networking.
+	StopNetworkingFailure StopReason = "networking-failure"
+	// StopAdminRequest means that an operator asked the enclave to stop.
+	StopAdminRequest StopReason = "admin-request"
+)
+
+// OnShutdown registers the given function to be called when the enclave
+// stops, after our Web servers have shut down.  Functions are called in the
+// reverse order of their registration, so resources are released in the
+// opposite order in which they were acquired.  The given context expires
+// when the shutdown timeout is up.
+func (e *Enclave) OnShutdown(fn func(context.Context) error) {
+	e.Lock()
+	defer e.Unlock()
+	e.shutdownHooks = append(e.shutdownHooks, fn)
+}
+
+// runShutdownHooks calls all registered shutdown hooks in LIFO order and
+// returns their aggregated errors.
+func (e *Enclave) runShutdownHooks(ctx context.Context) error {
+	e.RLock()
+	hooks := e.shutdownHooks
+	e.RUnlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		errs = append(errs, hooks[i](ctx))
+	}
+	return joinErrors(errs...)
+}
+
+// Stop stops the enclave for the given reason: it tears down networking,
+// shuts down our Web servers, and runs the shutdown hooks.  It's safe to
+// call Stop repeatedly and concurrently, e.g., on a signal while an operator
+// asks the enclave to stop.  Only the first call has an effect; later calls
+// wait for the shutdown to complete.  All calls return the aggregated errors
+// of the shutdown hooks.
+func (e *Enclave) Stop(reason StopReason) error {
+	first := false
+	e.stopOnce.Do(func() {
+		first = true
+		log.WithFields(log.Fields{
+			"reason": reason,
+			"uptime": time.Since(e.started).Round(time.Second).String(),
+		}).Info("Enclave shutting down.")
+
+		// The channel is buffered, so this doesn't block if networking is
+		// already gone.
+		e.stop <- reason
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := e.pubSrv.Shutdown(ctx); err != nil {
+			log.Errorf("Failed to shut down public Web server: %v", err)
+		}
+		if err := e.intSrv.Shutdown(ctx); err != nil {
+			log.Errorf("Failed to shut down enclave-internal Web server: %v", err)
+		}
+		if e.stopErr = e.runShutdownHooks(ctx); e.stopErr != nil {
+			log.Errorf("Shutdown hooks failed: %v", e.stopErr)
+		}
+		close(e.stopped)
+	})
+	if !first {
+		log.Debugf("Ignoring stop reason %q because the enclave already stopped.", reason)
+	}
+	return e.stopErr
+}
+
+// stopHandler returns a HandlerFunc that stops the enclave on behalf of an
+// operator.  It responds with 202 Accepted before the shutdown begins,
+// because the shutdown closes the connection that the request came in on.
+func stopHandler(e *Enclave) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Admin: Stop requested by %s.", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "stopping"})
+		go e.Stop(StopAdminRequest)
+	}
+}
+
+// Done returns a channel that's closed once the enclave has stopped.
+func (e *Enclave) Done() <-chan struct{} {
+	return e.stopped
+}
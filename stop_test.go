@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeNetworking replaces runDevice with a fake for the duration of the
+// test.  Unless fail is set, each device comes up right away and then
+// records the stop reason that it receives.  If fail is set, each device
+// fails with it instead.
+type fakeNetworking struct {
+	sync.Mutex
+	fail    error
+	reasons []StopReason
+}
+
+func useFakeNetworking(t *testing.T, fail error) *fakeNetworking {
+	f := &fakeNetworking{fail: fail}
+	orig := runDevice
+	runDevice = f.run
+	t.Cleanup(func() { runDevice = orig })
+	return f
+}
+
+func (f *fakeNetworking) run(n *NetConfig, stop chan StopReason, ready func()) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	ready()
+	reason := <-stop
+	f.Lock()
+	defer f.Unlock()
+	f.reasons = append(f.reasons, reason)
+	return nil
+}
+
+func (f *fakeNetworking) stopReasons() []StopReason {
+	f.Lock()
+	defer f.Unlock()
+	return append([]StopReason(nil), f.reasons...)
+}
+
+// waitDone waits for the enclave to stop, and fails the test if it doesn't.
+func waitDone(t *testing.T, e *Enclave) {
+	t.Helper()
+	select {
+	case <-e.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for enclave to stop.")
+	}
+}
+
+// loggedStopReason returns the stop reason of the given hook's shutdown log
+// entry.
+func loggedStopReason(t *testing.T, hook *logtest.Hook) StopReason {
+	t.Helper()
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Enclave shutting down." {
+			if _, ok := entry.Data["uptime"]; !ok {
+				t.Error("Expected shutdown log entry to contain the uptime.")
+			}
+			return entry.Data["reason"].(StopReason)
+		}
+	}
+	t.Fatal("Found no shutdown log entry.")
+	return ""
+}
+
+func TestStopReasons(t *testing.T) {
+	for _, test := range []struct {
+		reason  StopReason
+		trigger func(t *testing.T, e *Enclave)
+	}{
+		{StopSignal, func(t *testing.T, e *Enclave) {
+			_ = e.DrainAndStop(0, StopSignal)
+		}},
+		{StopAdminRequest, func(t *testing.T, e *Enclave) {
+			r := httptest.NewRequest(http.MethodPost, pathAdminStop, nil)
+			r.Header.Set("Authorization", bearerPrefix+"token")
+			w := httptest.NewRecorder()
+			e.intSrv.Handler.ServeHTTP(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Errorf("Expected status code %d but got %d.", http.StatusAccepted, w.Code)
+			}
+		}},
+	} {
+		t.Run(string(test.reason), func(t *testing.T) {
+			net := useFakeNetworking(t, nil)
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+			cfg := testConfig()
+			cfg.AdminToken = "token"
+			e := newTestEnclave(t, cfg)
+			go e.runNetworking()
+			<-e.ready
+
+			test.trigger(t, e)
+			waitDone(t, e)
+			if got := loggedStopReason(t, hook); got != test.reason {
+				t.Errorf("Expected logged reason %q but got %q.", test.reason, got)
+			}
+			// Networking must learn about the reason, too.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(net.stopReasons()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := net.stopReasons(); len(got) != 1 || got[0] != test.reason {
+				t.Errorf("Expected networking to stop for %q but got %q.", test.reason, got)
+			}
+		})
+	}
+}
+
+func TestStopOnNetworkingFailure(t *testing.T) {
+	useFakeNetworking(t, errors.New("tunnel collapsed"))
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	e := newTestEnclave(t, testConfig())
+
+	go e.runNetworking()
+	waitDone(t, e)
+	if got := loggedStopReason(t, hook); got != StopNetworkingFailure {
+		t.Errorf("Expected logged reason %q but got %q.", StopNetworkingFailure, got)
+	}
+	if got := <-e.stop; got != StopNetworkingFailure {
+		t.Errorf("Expected stop reason %q but got %q.", StopNetworkingFailure, got)
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	e := newTestEnclave(t, testConfig())
+
+	var wg sync.WaitGroup
+	for _, reason := range []StopReason{StopSignal, StopAdminRequest, StopSignal} {
+		wg.Add(1)
+		go func(reason StopReason) {
+			defer wg.Done()
+			_ = e.Stop(reason)
+		}(reason)
+	}
+	wg.Wait()
+	if n := len(e.stop); n != 1 {
+		t.Errorf("Expected 1 stop reason but got %d.", n)
+	}
+	loggedStopReason(t, hook)
+}
+
+// TestStopConcurrently stops a running enclave from many goroutines at once.
+// Run it with -race.
+func TestStopConcurrently(t *testing.T) {
+	net := useFakeNetworking(t, nil)
+	e := newTestEnclave(t, testConfig())
+	errHook := errors.New("hook failed")
+	release := make(chan struct{})
+	e.OnShutdown(func(context.Context) error {
+		<-release
+		return errHook
+	})
+	go e.runNetworking()
+	<-e.ready
+
+	const numCallers = 50
+	reasons := []StopReason{StopSignal, StopAdminRequest, StopNetworkingFailure}
+	errs := make(chan error, numCallers)
+	for i := 0; i < numCallers; i++ {
+		go func(reason StopReason) {
+			errs <- e.Stop(reason)
+		}(reasons[i%len(reasons)])
+	}
+	// No call returns before the shutdown is complete.
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected Stop to wait for the shutdown hooks but it returned %v.", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < numCallers; i++ {
+		if err := <-errs; !errors.Is(err, errHook) {
+			t.Fatalf("Expected every call to return the hooks' error but got %v.", err)
+		}
+	}
+	waitDone(t, e)
+
+	// Networking learns about exactly one reason.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(net.stopReasons()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := net.stopReasons(); len(got) != 1 {
+		t.Fatalf("Expected networking to stop once but got %q.", got)
+	}
+	// Stopping a stopped enclave is harmless.
+	if err := e.Stop(StopSignal); !errors.Is(err, errHook) {
+		t.Fatalf("Expected the hooks' error but got %v.", err)
+	}
+}
+
+func TestShutdownHooks(t *testing.T) {
+	e := newTestEnclave(t, testConfig())
+	errFirst, errThird := errors.New("first hook failed"), errors.New("third hook failed")
+	var order []int
+	for i, err := range []error{errFirst, nil, errThird} {
+		i, err := i, err
+		e.OnShutdown(func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("Expected shutdown hook context to have a deadline.")
+			}
+			order = append(order, i)
+			return err
+		})
+	}
+
+	err := e.Stop(StopSignal)
+	if len(order) != 3 || order[0] != 2 || order[1] != 1 || order[2] != 0 {
+		t.Errorf("Expected hooks to run in reverse order but got %v.", order)
+	}
+	if !errors.Is(err, errFirst) || !errors.Is(err, errThird) {
+		t.Errorf("Expected aggregated hook errors but got %v.", err)
+	}
+	// Later calls return the same errors without running the hooks again.
+	if err := e.Stop(StopSignal); !errors.Is(err, errFirst) || len(order) != 3 {
+		t.Errorf("Expected hooks to run once but got %v and %v.", order, err)
+	}
+}
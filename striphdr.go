@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	// defaultStripRequestHeaders are headers that clients could use to
+	// spoof their address or the original request.  Our reverse proxy sets
+	// X-Forwarded-For itself, after the headers are stripped.
+	defaultStripRequestHeaders = []string{"X-Forwarded-*", "Forwarded", "X-Real-Ip"}
+	// defaultStripResponseHeaders are our internal headers, which must not
+	// leave the enclave.
+	defaultStripResponseHeaders = []string{"X-Nitriding-*"}
+)
+
+// stripHeaders removes the given headers from h.  A name that ends in "*"
+// removes all headers with the given prefix, e.g., "X-Forwarded-*".  Names
+// are case-insensitive.
+func stripHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		prefix := strings.TrimSuffix(name, "*")
+		if prefix == name {
+			h.Del(name)
+			continue
+		}
+		for key := range h {
+			if len(key) >= len(prefix) && strings.EqualFold(key[:len(prefix)], prefix) {
+				delete(h, key)
+			}
+		}
+	}
+}
+
+// orDefault returns the given header list, or def if the list is nil.
+func orDefault(names, def []string) []string {
+	if names == nil {
+		return def
+	}
+	return names
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func headerNames(h http.Header) []string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStripHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		strip []string
+		want  []string
+	}{
+		{"nothing", nil, []string{"Forwarded", "X-Custom", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-Ip"}},
+		{"exact", []string{"Forwarded"}, []string{"X-Custom", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-Ip"}},
+		{"case-insensitive", []string{"x-real-ip"}, []string{"Forwarded", "X-Custom", "X-Forwarded-For", "X-Forwarded-Host"}},
+		{"prefix", []string{"x-forwarded-*"}, []string{"Forwarded", "X-Custom", "X-Real-Ip"}},
+		{"defaults", defaultStripRequestHeaders, []string{"X-Custom"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, name := range []string{"Forwarded", "X-Custom", "X-Forwarded-For", "X-Forwarded-Host", "X-Real-Ip"} {
+				h.Set(name, "value")
+			}
+			stripHeaders(h, test.strip)
+			if got := headerNames(h); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("Expected headers %q but got %q.", test.want, got)
+			}
+		})
+	}
+}
+
+func TestOrDefault(t *testing.T) {
+	def := []string{"X-Default"}
+	if got := orDefault(nil, def); !reflect.DeepEqual(got, def) {
+		t.Errorf("Expected defaults for nil list but got %q.", got)
+	}
+	if got := orDefault([]string{}, def); len(got) != 0 {
+		t.Errorf("Expected empty list to disable stripping but got %q.", got)
+	}
+}
+
+// newStrippingProxy returns an enclave whose reverse proxy forwards to a
+// backend that echoes the request headers that it sees, prefixed with
+// "Seen-", and sets internal response headers.
+func newStrippingProxy(t *testing.T, stripReq, stripResp []string) *Enclave {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.Header {
+			w.Header()["Seen-"+name] = values
+		}
+		w.Header().Set(backendSecretHeader, "s3cret")
+		w.Header().Set("X-Nitriding-Debug", "internal")
+		w.Header().Set("X-Internal-Auth", "token")
+		w.Header().Set("X-App", "public")
+	}))
+	t.Cleanup(backend.Close)
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	cfg.StripRequestHeaders, cfg.StripResponseHeaders = stripReq, stripResp
+	return newTestEnclave(t, cfg)
+}
+
+// spoofingRequest sends a request whose client tries to spoof its address.
+func spoofingRequest(e *Enclave) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.RemoteAddr = "203.0.113.9:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("X-Forwarded-Host", "admin.internal")
+	r.Header.Set("Forwarded", "for=10.0.0.1")
+	r.Header.Set("X-Real-Ip", "10.0.0.1")
+	r.Header.Set("X-Custom", "kept")
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyStripsRequestHeaders(t *testing.T) {
+	w := spoofingRequest(newStrippingProxy(t, nil, nil))
+	for _, name := range []string{"Seen-X-Forwarded-Host", "Seen-Forwarded", "Seen-X-Real-Ip"} {
+		if got := w.Header().Get(name); got != "" {
+			t.Errorf("Expected %s to be stripped but backend saw %q.", name, got)
+		}
+	}
+	// The reverse proxy sets X-Forwarded-For itself.
+	if got := w.Header().Get("Seen-X-Forwarded-For"); got != "203.0.113.9" {
+		t.Errorf("Expected backend to see only the client's address but got %q.", got)
+	}
+	if got := w.Header().Get("Seen-X-Custom"); got != "kept" {
+		t.Errorf("Expected other headers to be forwarded but got %q.", got)
+	}
+}
+
+func TestProxyStripsCustomRequestHeaders(t *testing.T) {
+	w := spoofingRequest(newStrippingProxy(t, []string{"X-Custom"}, nil))
+	if got := w.Header().Get("Seen-X-Custom"); got != "" {
+		t.Errorf("Expected X-Custom to be stripped but backend saw %q.", got)
+	}
+	if got := w.Header().Get("Seen-X-Real-Ip"); got != "10.0.0.1" {
+		t.Errorf("Expected custom list to replace the defaults but got %q.", got)
+	}
+}
+
+func TestProxyStripsResponseHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		stripResp []string
+		gone      []string
+		kept      []string
+	}{
+		{"defaults", nil, []string{backendSecretHeader, "X-Nitriding-Debug"}, []string{"X-Internal-Auth", "X-App"}},
+		{"custom", []string{"X-Internal-*"}, []string{"X-Internal-Auth"}, []string{"X-Nitriding-Debug", "X-App"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := spoofingRequest(newStrippingProxy(t, nil, test.stripResp))
+			for _, name := range test.gone {
+				if got := w.Header().Get(name); got != "" {
+					t.Errorf("Expected %s to be stripped but client got %q.", name, got)
+				}
+			}
+			for _, name := range test.kept {
+				if w.Header().Get(name) == "" {
+					t.Errorf("Expected %s to reach the client.", name)
+				}
+			}
+		})
+	}
+}
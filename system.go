@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"os"
 	"syscall"
 )
 
@@ -12,7 +13,37 @@ const (
 	defaultFdMax = 65536
 )
 
-var errTooMuchToRead = errors.New("reached read limit")
+var (
+	errTooMuchToRead = errors.New("reached read limit")
+
+	// sysFS points to the file system that we modify when setting up the
+	// enclave.  Using a variable allows us to easily mock the file system in
+	// our unit tests.
+	sysFS fileSystem = osFS{}
+)
+
+// fileSystem abstracts the file system operations that we need to configure
+// the enclave.
+type fileSystem interface {
+	MkdirAll(path string, perm os.FileMode) error
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldPath, newPath string) error
+	Remove(name string) error
+	BindMount(source, target string) error
+	// BindMounted returns true if source is already bind-mounted over
+	// target.
+	BindMounted(source, target string) (bool, error)
+}
+
+// osFS implements fileSystem by means of the os package.
+type osFS struct{}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (osFS) Rename(oldPath, newPath string) error { return os.Rename(oldPath, newPath) }
+func (osFS) Remove(name string) error             { return os.Remove(name) }
 
 // limitReader behaves like a Reader but it returns errTooMuchToRead if the
 // given read limit was exceeded.
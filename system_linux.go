@@ -1,24 +1,84 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"syscall"
 
 	"github.com/milosgajdos/tenus"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
-	defaultGw = "192.168.127.1"
-	addrLo    = "127.0.0.1/8"
-	addrTap   = "192.168.127.2/24"
-	mac       = "ba:aa:ad:c0:ff:ee"
-	ifaceLo   = "lo"
-	ifaceTap  = "tap0"
+	defaultGw  = "192.168.127.1"
+	addrLo     = "127.0.0.1/8"
+	addrTap    = "192.168.127.2/24"
+	defaultMAC = "ba:aa:ad:c0:ff:ee"
+	ifaceLo    = "lo"
+	ifaceTap   = "tap0"
+
+	// A Nitro Enclave's /etc/resolv.conf is a symlink to
+	// /run/resolvconf/resolv.conf.  As of 2022-11-21, the /run/ directory
+	// exists but not its resolvconf/ subdirectory.
+	resolvconfDir = "/run/resolvconf/"
+	// resolvconfLink is where the resolver looks for its config.
+	resolvconfLink = "/etc/resolv.conf"
+	// resolvconfFallback is where we write our resolv.conf if the usual
+	// location is read-only.  It's then bind-mounted over resolvconfLink.
+	resolvconfFallback = "/tmp/nitriding-resolv.conf"
 )
 
-// configureLoIface assigns an IP address to the loopback interface.
-func configureLoIface() error {
+var errResolvconfReadOnly = errors.New("resolv.conf is read-only")
+
+// mountInfoFile lists the mounts in our mount namespace.
+const mountInfoFile = "/proc/self/mountinfo"
+
+func (osFS) BindMount(source, target string) error {
+	return syscall.Mount(source, target, "", syscall.MS_BIND, "")
+}
+
+func (osFS) BindMounted(source, target string) (bool, error) {
+	f, err := os.Open(mountInfoFile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return bindMountedIn(f, source, target)
+}
+
+// bindMountedIn returns true if the given mount table, which has the format
+// of /proc/self/mountinfo, contains a bind mount of source over target.  The
+// table only tells us the source's path relative to the root of its file
+// system, so we compare that with the end of source.
+func bindMountedIn(mountInfo io.Reader, source, target string) (bool, error) {
+	s := bufio.NewScanner(mountInfo)
+	for s.Scan() {
+		// ID parentID major:minor root mountPoint options ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[4] != target {
+			continue
+		}
+		if root := fields[3]; root != "/" && strings.HasSuffix(source, root) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// isReadOnly returns true if the given error means that we aren't allowed to
+// write a file, as opposed to, e.g., a full disk.
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission)
+}
+
+// configureLoIface assigns an IP address to the loopback interface.  Using a
+// variable allows us to easily mock the function in our unit tests.
+var configureLoIface = func() error {
 	l, err := tenus.NewLinkFrom(ifaceLo)
 	if err != nil {
 		return err
@@ -36,13 +96,13 @@ func configureLoIface() error {
 // configureTapIface configures our TAP interface by assigning it a MAC
 // address, IP address, and link MTU.  We could have used DHCP instead but that
 // brings with it unnecessary complexity and attack surface.
-func configureTapIface() error {
-	l, err := tenus.NewLinkFrom(ifaceTap)
+func configureTapIface(n *NetConfig) error {
+	l, err := tenus.NewLinkFrom(n.TapName)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve link: %w", err)
 	}
 
-	addr, network, err := net.ParseCIDR(addrTap)
+	addr, network, err := net.ParseCIDR(n.TapAddr)
 	if err != nil {
 		return fmt.Errorf("failed to parse CIDR: %w", err)
 	}
@@ -50,19 +110,25 @@ func configureTapIface() error {
 		return fmt.Errorf("failed to set link address: %w", err)
 	}
 
-	if err := l.SetLinkMTU(1500); err != nil {
+	if err := l.SetLinkMTU(n.MTU); err != nil {
 		return fmt.Errorf("failed to set link MTU: %w", err)
 	}
 
-	if err := l.SetLinkMacAddress(mac); err != nil {
-		return fmt.Errorf("failed to set MAC address: %w", err)
+	if n.MAC != nil {
+		if err := l.SetLinkMacAddress(n.MAC.String()); err != nil {
+			return fmt.Errorf("failed to set MAC address: %w", err)
+		}
 	}
 
 	if err := l.SetLinkUp(); err != nil {
 		return fmt.Errorf("failed to bring up link: %w", err)
 	}
 
-	gw := net.ParseIP(defaultGw)
+	// Additional TAP devices have no gateway.
+	if n.Gateway == "" {
+		return nil
+	}
+	gw := net.ParseIP(n.Gateway)
 	if err := l.SetLinkDefaultGw(&gw); err != nil {
 		return fmt.Errorf("failed to set default gateway: %w", err)
 	}
@@ -70,22 +136,55 @@ func configureTapIface() error {
 	return nil
 }
 
-// writeResolvconf creates our resolv.conf and adds a nameserver.
-func writeResolvconf() error {
-	// A Nitro Enclave's /etc/resolv.conf is a symlink to
-	// /run/resolvconf/resolv.conf.  As of 2022-11-21, the /run/ directory
-	// exists but not its resolvconf/ subdirectory.
-	dir := "/run/resolvconf/"
-	file := dir + "resolv.conf"
+// writeResolvconf creates our resolv.conf and adds the given nameserver.  If
+// the usual location is read-only, e.g., because the enclave image mounts it
+// that way, we write the file elsewhere and bind-mount it over
+// /etc/resolv.conf.  If that fails too, the returned error wraps
+// errResolvconfReadOnly.
+func writeResolvconf(nameserver string) error {
+	c := []byte(fmt.Sprintf("nameserver %s\n", nameserver))
+	err := writeResolvconfFile(c)
+	if err == nil || !isReadOnly(err) {
+		return err
+	}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	log.Warnf("Failed to write resolv.conf; bind-mounting %s over %s instead: %v",
+		resolvconfFallback, resolvconfLink, err)
+	if fbErr := sysFS.WriteFile(resolvconfFallback, c, 0644); fbErr != nil {
+		return fmt.Errorf("%w: %v; failed to write fallback: %v", errResolvconfReadOnly, err, fbErr)
+	}
+	// The fallback may already be mounted, e.g., if networking was set up
+	// before.  Its new content is then visible without another mount, and
+	// stacking mounts would leak one per setup.
+	if mounted, fbErr := sysFS.BindMounted(resolvconfFallback, resolvconfLink); fbErr != nil {
+		log.Warnf("Failed to check for existing mount of %s: %v", resolvconfFallback, fbErr)
+	} else if mounted {
+		return nil
+	}
+	if fbErr := sysFS.BindMount(resolvconfFallback, resolvconfLink); fbErr != nil {
+		return fmt.Errorf("%w: %v; failed to bind-mount fallback (make %s writable or "+
+			"mount a writable %s): %v", errResolvconfReadOnly, err, resolvconfDir, resolvconfLink, fbErr)
+	}
+	return nil
+}
+
+// writeResolvconfFile writes the given resolv.conf to its usual location.
+// The file is first written to a temporary file and then renamed into place,
+// so concurrent DNS lookups never see a partially-written file.
+func writeResolvconfFile(c []byte) error {
+	file := resolvconfDir + "resolv.conf"
+	tmpFile := file + ".tmp"
+
+	if err := sysFS.MkdirAll(resolvconfDir, 0755); err != nil {
 		return fmt.Errorf("failed to create directories: %w", err)
 	}
 
-	// Our default gateway -- gvproxy -- also operates a DNS resolver.
-	c := fmt.Sprintf("nameserver %s\n", defaultGw)
-	if err := os.WriteFile(file, []byte(c), 0644); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	if err := sysFS.WriteFile(tmpFile, c, 0644); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := sysFS.Rename(tmpFile, file); err != nil {
+		_ = sysFS.Remove(tmpFile)
+		return fmt.Errorf("failed to rename temporary file: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeFS implements fileSystem in memory and records all operations.  Paths
+// in failOn make the operations that touch them fail with the mapped error.
+type fakeFS struct {
+	files  map[string][]byte
+	perms  map[string]os.FileMode
+	mounts map[string]string
+	ops    []string
+	failOn map[string]error
+}
+
+func newFakeFS() *fakeFS {
+	return &fakeFS{
+		files:  make(map[string][]byte),
+		perms:  make(map[string]os.FileMode),
+		mounts: make(map[string]string),
+		failOn: make(map[string]error),
+	}
+}
+
+// useFakeFS swaps in the given file system for the duration of the test.
+func useFakeFS(t *testing.T, fs *fakeFS) {
+	orig := sysFS
+	sysFS = fs
+	t.Cleanup(func() { sysFS = orig })
+}
+
+func (f *fakeFS) record(op, path string) error {
+	f.ops = append(f.ops, fmt.Sprintf("%s %s", op, path))
+	return f.failOn[path]
+}
+
+func (f *fakeFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.record("mkdir", path)
+}
+
+func (f *fakeFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := f.record("write", name); err != nil {
+		return err
+	}
+	f.files[name] = append([]byte(nil), data...)
+	f.perms[name] = perm
+	return nil
+}
+
+func (f *fakeFS) Rename(oldPath, newPath string) error {
+	if err := f.record("rename", oldPath+" "+newPath); err != nil {
+		return err
+	}
+	if err := f.failOn[newPath]; err != nil {
+		return err
+	}
+	f.files[newPath], f.perms[newPath] = f.files[oldPath], f.perms[oldPath]
+	delete(f.files, oldPath)
+	delete(f.perms, oldPath)
+	return nil
+}
+
+func (f *fakeFS) Remove(name string) error {
+	delete(f.files, name)
+	return f.record("remove", name)
+}
+
+func (f *fakeFS) BindMount(source, target string) error {
+	if err := f.record("bindmount", source+" "+target); err != nil {
+		return err
+	}
+	f.mounts[target] = source
+	return nil
+}
+
+func (f *fakeFS) BindMounted(source, target string) (bool, error) {
+	return f.mounts[target] == source, nil
+}
+
+func TestWriteResolvconfFile(t *testing.T) {
+	fs := newFakeFS()
+	useFakeFS(t, fs)
+
+	if err := writeResolvconf("192.168.127.1"); err != nil {
+		t.Fatalf("Failed to write resolv.conf: %v", err)
+	}
+	file, tmpFile := resolvconfDir+"resolv.conf", resolvconfDir+"resolv.conf.tmp"
+	expectedOps := []string{
+		"mkdir " + resolvconfDir,
+		"write " + tmpFile,
+		"rename " + tmpFile + " " + file,
+	}
+	if !reflect.DeepEqual(fs.ops, expectedOps) {
+		t.Errorf("Expected operations %q but got %q.", expectedOps, fs.ops)
+	}
+	if got := string(fs.files[file]); got != "nameserver 192.168.127.1\n" {
+		t.Errorf("Unexpected resolv.conf: %q", got)
+	}
+	if fs.perms[file] != 0644 {
+		t.Errorf("Expected permissions 0644 but got %o.", fs.perms[file])
+	}
+	if _, exists := fs.files[tmpFile]; exists {
+		t.Error("Expected temporary file to be gone.")
+	}
+}
+
+func TestWriteResolvconfFileErrors(t *testing.T) {
+	file, tmpFile := resolvconfDir+"resolv.conf", resolvconfDir+"resolv.conf.tmp"
+	errDisk := errors.New("disk on fire")
+
+	for _, test := range []struct {
+		failOn  string
+		wantErr string
+	}{
+		{resolvconfDir, "failed to create directories: disk on fire"},
+		{tmpFile, "failed to write temporary file: disk on fire"},
+		{file, "failed to rename temporary file: disk on fire"},
+	} {
+		fs := newFakeFS()
+		fs.failOn[test.failOn] = errDisk
+		useFakeFS(t, fs)
+
+		err := writeResolvconfFile([]byte("nameserver 192.168.127.1\n"))
+		if !errors.Is(err, errDisk) {
+			t.Errorf("Expected error to wrap %v but got %v.", errDisk, err)
+		}
+		if err != nil && err.Error() != test.wantErr {
+			t.Errorf("Expected error %q but got %q.", test.wantErr, err)
+		}
+		if _, exists := fs.files[tmpFile]; exists {
+			t.Error("Expected temporary file to be cleaned up.")
+		}
+	}
+}
+
+func TestWriteResolvconfReadOnly(t *testing.T) {
+	fs := newFakeFS()
+	fs.failOn[resolvconfDir+"resolv.conf.tmp"] = syscall.EROFS
+	useFakeFS(t, fs)
+
+	if err := writeResolvconf("192.168.127.1"); err != nil {
+		t.Fatalf("Expected fallback to succeed but got %v.", err)
+	}
+	if got := string(fs.files[resolvconfFallback]); got != "nameserver 192.168.127.1\n" {
+		t.Errorf("Unexpected fallback resolv.conf: %q", got)
+	}
+	if fs.mounts[resolvconfLink] != resolvconfFallback {
+		t.Errorf("Expected %s to be bind-mounted over %s.", resolvconfFallback, resolvconfLink)
+	}
+}
+
+func TestWriteResolvconfDoesNotStackMounts(t *testing.T) {
+	fs := newFakeFS()
+	fs.failOn[resolvconfDir+"resolv.conf.tmp"] = os.ErrPermission
+	useFakeFS(t, fs)
+
+	for _, ns := range []string{"192.168.127.1", "10.0.0.2"} {
+		if err := writeResolvconf(ns); err != nil {
+			t.Fatalf("Expected fallback to succeed but got %v.", err)
+		}
+	}
+	numMounts := 0
+	for _, op := range fs.ops {
+		if strings.HasPrefix(op, "bindmount ") {
+			numMounts++
+		}
+	}
+	if numMounts != 1 {
+		t.Errorf("Expected 1 bind mount but got %d.", numMounts)
+	}
+	if got := string(fs.files[resolvconfFallback]); got != "nameserver 10.0.0.2\n" {
+		t.Errorf("Expected the mounted file to be updated but got %q.", got)
+	}
+}
+
+func TestWriteResolvconfReadOnlyErrors(t *testing.T) {
+	errDisk := errors.New("disk on fire")
+	for name, test := range map[string]struct {
+		failOn  map[string]error
+		wantErr error
+	}{
+		"not read-only": {
+			failOn:  map[string]error{resolvconfDir + "resolv.conf.tmp": errDisk},
+			wantErr: errDisk,
+		},
+		"fallback not writable": {
+			failOn: map[string]error{
+				resolvconfDir + "resolv.conf.tmp": syscall.EROFS,
+				resolvconfFallback:                syscall.EROFS,
+			},
+			wantErr: errResolvconfReadOnly,
+		},
+		"bind mount fails": {
+			failOn: map[string]error{
+				resolvconfDir + "resolv.conf.tmp":         syscall.EROFS,
+				resolvconfFallback + " " + resolvconfLink: syscall.EPERM,
+			},
+			wantErr: errResolvconfReadOnly,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := newFakeFS()
+			fs.failOn = test.failOn
+			useFakeFS(t, fs)
+			if err := writeResolvconf("192.168.127.1"); !errors.Is(err, test.wantErr) {
+				t.Fatalf("Expected error to wrap %v but got %v.", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBindMountedIn(t *testing.T) {
+	const mountInfo = `22 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+25 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw
+31 25 0:27 / /tmp rw,nosuid,nodev shared:14 - tmpfs tmpfs rw
+`
+	for _, test := range []struct {
+		name      string
+		mountInfo string
+		want      bool
+	}{
+		{"not mounted", mountInfo, false},
+		{"mounted from tmpfs", mountInfo + "40 25 0:27 /nitriding-resolv.conf /etc/resolv.conf rw - tmpfs tmpfs rw\n", true},
+		{"mounted from root file system", mountInfo + "40 25 259:1 /tmp/nitriding-resolv.conf /etc/resolv.conf rw - ext4 /dev/nvme0n1p1 rw\n", true},
+		{"other mount", mountInfo + "40 25 259:1 /run/host-resolv.conf /etc/resolv.conf ro - ext4 /dev/nvme0n1p1 rw\n", false},
+		{"empty table", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := bindMountedIn(strings.NewReader(test.mountInfo), resolvconfFallback, resolvconfLink)
+			if err != nil {
+				t.Fatalf("Expected no error but got %v.", err)
+			}
+			if got != test.want {
+				t.Fatalf("Expected %v but got %v.", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tapDropper decides if a frame whose write to the TAP device failed is
+// dropped, so networking survives, or if the failure tears networking down.
+// Only errors that are likely to go away on their own are droppable.  A nil
+// *tapDropper drops nothing.
+type tapDropper struct {
+	warn *logSampler
+}
+
+// newTapDropper returns a dropper if the given flag is set, and nil
+// otherwise.  We warn at most once per second about dropped frames.
+func newTapDropper(enabled bool) *tapDropper {
+	if !enabled {
+		return nil
+	}
+	return &tapDropper{warn: newLogSampler(LogSamplingConfig{Every: -1, PerSecond: 1})}
+}
+
+// drop returns true if the frame that failed with the given error should be
+// dropped, and counts the drop.
+func (d *tapDropper) drop(err error, size int) bool {
+	if d == nil || !isDroppable(err) {
+		return false
+	}
+	metricTapDrops.Add(1)
+	if d.warn.allow() {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"size":    size,
+			"dropped": metricTapDrops.Value(),
+		}).Warn("Dropped frame that we failed to write to TAP device.")
+	}
+	return true
+}
+
+// isDroppable returns true if the given TAP write error is transient, e.g.,
+// because the kernel is short of buffers.
+func isDroppable(err error) bool {
+	return isTemporary(err) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// txThroughFlakyTap sends the given frames through tx to a TAP device whose
+// writes first fail with the given errors, and returns the TAP device along
+// with the error that stopped tx.
+func txThroughFlakyTap(t *testing.T, frames [][]byte, writeErrs []error, drops *tapDropper) (*flakyTap, error) {
+	t.Helper()
+	var wire []byte
+	for _, f := range frames {
+		w, err := wireFrame(nil, f, prefixLen16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire = append(wire, w...)
+	}
+	enclaveConn, hostConn := net.Pipe()
+	defer enclaveConn.Close()
+	go func() {
+		_, _ = hostConn.Write(wire)
+		hostConn.Close()
+	}()
+
+	tap := &flakyTap{fakeTap: newFakeTap(), writeErrs: writeErrs}
+	errCh := make(chan error, 1)
+	tx(enclaveConn, tap, errCh, 1500, prefixLen16, nil, nil, drops, nil)
+	return tap, <-errCh
+}
+
+func TestTxDropsTransientTapErrors(t *testing.T) {
+	useFakeTapSleep(t)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	before := metricTapDrops.Value()
+
+	sent := testFrames()
+	tap, err := txThroughFlakyTap(t, sent, []error{syscall.ENOBUFS, syscall.ENOMEM}, newTapDropper(true))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected tx to survive the failed writes but got %v.", err)
+	}
+	// The first two frames were dropped.
+	received := tap.frames()
+	if len(received) != 1 || !bytes.Equal(received[0], sent[2]) {
+		t.Fatalf("Expected only the last frame to arrive but got %d frames.", len(received))
+	}
+	if got := metricTapDrops.Value() - before; got != 2 {
+		t.Fatalf("Expected 2 drops to be counted but got %d.", got)
+	}
+
+	// Warnings are rate-limited, so two drops in a row result in one.
+	var warnings int
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && entry.Message == "Dropped frame that we failed to write to TAP device." {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("Expected 1 warning but got %d.", warnings)
+	}
+}
+
+func TestTxTapErrorsFatalByDefault(t *testing.T) {
+	useFakeTapSleep(t)
+	before := metricTapDrops.Value()
+
+	_, err := txThroughFlakyTap(t, testFrames(), []error{syscall.ENOBUFS}, newTapDropper(false))
+	if !errors.Is(err, syscall.ENOBUFS) {
+		t.Fatalf("Expected tx to fail with %v but got %v.", syscall.ENOBUFS, err)
+	}
+	if got := metricTapDrops.Value() - before; got != 0 {
+		t.Fatalf("Expected no drops to be counted but got %d.", got)
+	}
+}
+
+func TestTxPersistentTapErrorFatalInDropMode(t *testing.T) {
+	useFakeTapSleep(t)
+
+	_, err := txThroughFlakyTap(t, testFrames(), []error{syscall.EIO}, newTapDropper(true))
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Expected tx to fail with %v but got %v.", syscall.EIO, err)
+	}
+}
+
+func TestIsDroppable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{syscall.ENOBUFS, true},
+		{syscall.ENOMEM, true},
+		{syscall.EAGAIN, true},
+		{syscall.EIO, false},
+		{syscall.EBADF, false},
+		{io.ErrClosedPipe, false},
+	} {
+		if got := isDroppable(c.err); got != c.want {
+			t.Errorf("Expected %v to be droppable: %t, but got %t.", c.err, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runDevice is a variable pointing to the function that runs the networking
+// of a single TAP device.  Using a variable allows us to easily mock
+// networking in our unit tests.
+var runDevice = runNetworking
+
+// TapConfig configures an additional TAP device, e.g., to keep control-plane
+// traffic apart from data-plane traffic.  Each device has its own tunnel to
+// the EC2 host, which must run a proxy on the device's port.  Additional
+// devices carry no default route and no DNS resolver; the enclave
+// application reaches the host via their subnet.
+type TapConfig struct {
+	// Name is the name of the TAP interface, e.g., "tap1".
+	Name string
+	// Addr is the interface's IP address and network in CIDR notation.
+	Addr string
+	// HostProxyPort is the vsock port of the device's proxy on the EC2 host.
+	HostProxyPort uint32
+	// MAC is the interface's MAC address.  If MAC is empty, the kernel picks
+	// an address.
+	MAC string
+}
+
+// validateTaps returns an error if any of the given additional TAP devices
+// is malformed or clashes with another device, including the default
+// device, which uses the given host proxy port.
+func validateTaps(taps []TapConfig, hostProxyPort uint32) error {
+	names := map[string]bool{ifaceLo: true, ifaceTap: true}
+	ports := map[uint32]bool{hostProxyPort: true}
+	for _, t := range taps {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("TAP device name %q is empty or already taken", t.Name)
+		}
+		names[t.Name] = true
+		if t.HostProxyPort == 0 || ports[t.HostProxyPort] {
+			return fmt.Errorf("host proxy port %d of TAP device %q is unset or already taken", t.HostProxyPort, t.Name)
+		}
+		ports[t.HostProxyPort] = true
+		if _, _, err := net.ParseCIDR(t.Addr); err != nil {
+			return fmt.Errorf("bad address of TAP device %q: %w", t.Name, err)
+		}
+		if t.MAC != "" {
+			if _, err := parseMAC(t.MAC); err != nil {
+				return fmt.Errorf("TAP device %q: %w", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// devices returns the networking configuration of each of our TAP devices,
+// starting with the default device.  Additional devices share the default
+// device's settings, except for their interface, tunnel port, and MAC
+// address.  They don't touch the default route, resolv.conf, or the
+// networking metrics, and frames aren't captured.
+func (n *NetConfig) devices() []*NetConfig {
+	devs := []*NetConfig{n}
+	for _, t := range n.ExtraTaps {
+		d := *n
+		d.ExtraTaps = nil
+		d.secondary = true
+		d.TapName = t.Name
+		d.TapAddr = t.Addr
+		d.HostProxyPort = t.HostProxyPort
+		d.MAC = nil
+		if t.MAC != "" {
+			d.MAC, _ = parseMAC(t.MAC)
+		}
+		d.Gateway = ""
+		d.Nameserver = ""
+		d.CaptureFile = ""
+		devs = append(devs, &d)
+	}
+	return devs
+}
+
+// runDevices runs the networking of all given TAP devices, each with its own
+// tunnel and forwarding loops.  The given stop reason is passed on to all
+// devices, and the given ready function is called once all devices are up.
+// If any device gives up, runDevices stops the others and returns the
+// device's error.
+func runDevices(devs []*NetConfig, stop chan StopReason, ready func()) error {
+	if len(devs) == 1 {
+		return runDevice(devs[0], stop, ready)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		pending = len(devs)
+		errCh   = make(chan error, len(devs))
+		stops   = make([]chan StopReason, len(devs))
+	)
+	for i, d := range devs {
+		stops[i] = make(chan StopReason, 1)
+		var once sync.Once
+		devReady := func() {
+			once.Do(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if pending--; pending == 0 {
+					ready()
+				}
+			})
+		}
+		wg.Add(1)
+		go func(d *NetConfig, stop chan StopReason) {
+			defer wg.Done()
+			if err := runDevice(d, stop, devReady); err != nil {
+				errCh <- fmt.Errorf("TAP device %s: %w", d.TapName, err)
+			}
+		}(d, stops[i])
+	}
+
+	var err error
+	var reason StopReason
+	select {
+	case reason = <-stop:
+	case err = <-errCh:
+		reason = StopNetworkingFailure
+	}
+	log.Printf("Stopping networking of %d TAP devices: %s.", len(devs), reason)
+	for _, s := range stops {
+		s <- reason
+	}
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDevice is the fake networking of a single TAP device.  The device
+// reports its config on started, calls its ready function once ready is
+// closed, fails with the error that's sent on fail, and reports the stop
+// reason that it receives on stopped.
+type fakeDevice struct {
+	started chan *NetConfig
+	ready   chan struct{}
+	fail    chan error
+	stopped chan StopReason
+}
+
+// useFakeDevices replaces runDevice with a fake that runs the fake device of
+// the given TAP devices' names.
+func useFakeDevices(t *testing.T, names ...string) map[string]*fakeDevice {
+	t.Helper()
+	devs := make(map[string]*fakeDevice)
+	for _, name := range names {
+		devs[name] = &fakeDevice{
+			started: make(chan *NetConfig, 1),
+			ready:   make(chan struct{}),
+			fail:    make(chan error, 1),
+			stopped: make(chan StopReason, 1),
+		}
+	}
+	orig := runDevice
+	runDevice = func(n *NetConfig, stop chan StopReason, ready func()) error {
+		d, ok := devs[n.TapName]
+		if !ok {
+			t.Errorf("Unexpected TAP device %q.", n.TapName)
+			return errors.New("unexpected device")
+		}
+		d.started <- n
+		readyCh := d.ready
+		for {
+			select {
+			case <-readyCh:
+				ready()
+				readyCh = nil
+			case err := <-d.fail:
+				return err
+			case reason := <-stop:
+				d.stopped <- reason
+				return nil
+			}
+		}
+	}
+	t.Cleanup(func() { runDevice = orig })
+	return devs
+}
+
+// twoDevices returns the networking config of the default TAP device and one
+// additional device.
+func twoDevices() []*NetConfig {
+	n := validNetConfig()
+	n.ExtraTaps = []TapConfig{{Name: "tap1", Addr: "192.168.128.2/24", HostProxyPort: 1025}}
+	return n.devices()
+}
+
+func expectStarted(t *testing.T, d *fakeDevice) *NetConfig {
+	t.Helper()
+	select {
+	case n := <-d.started:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for device to start.")
+	}
+	return nil
+}
+
+func expectStopped(t *testing.T, d *fakeDevice, want StopReason) {
+	t.Helper()
+	select {
+	case got := <-d.stopped:
+		if got != want {
+			t.Fatalf("Expected stop reason %q but got %q.", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for device to stop.")
+	}
+}
+
+func TestRunDevicesFanOut(t *testing.T) {
+	devs := useFakeDevices(t, ifaceTap, "tap1")
+	stop := make(chan StopReason, 1)
+	var numReady int32
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runDevices(twoDevices(), stop, func() { atomic.AddInt32(&numReady, 1) })
+	}()
+
+	// Each device brings up its own tunnel.
+	tap0, tap1 := expectStarted(t, devs[ifaceTap]), expectStarted(t, devs["tap1"])
+	if tap0.HostProxyPort != 1024 || tap1.HostProxyPort != 1025 {
+		t.Fatalf("Expected host proxy ports 1024 and 1025 but got %d and %d.", tap0.HostProxyPort, tap1.HostProxyPort)
+	}
+
+	// We're only ready once all devices are.
+	close(devs["tap1"].ready)
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&numReady); n != 0 {
+		t.Fatal("Expected to not be ready while a device isn't.")
+	}
+	close(devs[ifaceTap].ready)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&numReady) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for readiness.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The stop reason reaches all devices.
+	stop <- StopSignal
+	expectStopped(t, devs[ifaceTap], StopSignal)
+	expectStopped(t, devs["tap1"], StopSignal)
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if n := atomic.LoadInt32(&numReady); n != 1 {
+		t.Fatalf("Expected ready to be called once but got %d.", n)
+	}
+}
+
+func TestRunDevicesTeardown(t *testing.T) {
+	devs := useFakeDevices(t, ifaceTap, "tap1")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runDevices(twoDevices(), make(chan StopReason), func() {})
+	}()
+	expectStarted(t, devs[ifaceTap])
+	expectStarted(t, devs["tap1"])
+
+	// A device that gives up takes the others down with it.
+	errTunnel := errors.New("tunnel broke")
+	devs["tap1"].fail <- errTunnel
+	expectStopped(t, devs[ifaceTap], StopNetworkingFailure)
+	err := <-errCh
+	if !errors.Is(err, errTunnel) || !strings.Contains(err.Error(), "tap1") {
+		t.Fatalf("Expected error of tap1 but got %v.", err)
+	}
+}
+
+func TestRunDevicesSingle(t *testing.T) {
+	devs := useFakeDevices(t, ifaceTap)
+	stop := make(chan StopReason, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runDevices(validNetConfig().devices(), stop, func() {})
+	}()
+	expectStarted(t, devs[ifaceTap])
+	stop <- StopAdminRequest
+	expectStopped(t, devs[ifaceTap], StopAdminRequest)
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+}
+
+func TestNetConfigDevices(t *testing.T) {
+	n := validNetConfig()
+	n.CaptureFile = "/tmp/frames.pcap"
+	n.ExtraTaps = []TapConfig{
+		{Name: "tap1", Addr: "192.168.128.2/24", HostProxyPort: 1025, MAC: "02-00-00-00-00-01"},
+		{Name: "tap2", Addr: "192.168.129.2/24", HostProxyPort: 1026},
+	}
+	devs := n.devices()
+	if len(devs) != 3 || devs[0] != n {
+		t.Fatalf("Expected the default device followed by 2 more but got %d devices.", len(devs))
+	}
+	tap1 := devs[1]
+	if tap1.TapName != "tap1" || tap1.TapAddr != "192.168.128.2/24" || tap1.HostProxyPort != 1025 {
+		t.Errorf("Expected tap1's own interface and port but got %+v.", tap1)
+	}
+	if tap1.MAC.String() != "02:00:00:00:00:01" || devs[2].MAC != nil {
+		t.Errorf("Expected configured MAC and no MAC but got %s and %s.", tap1.MAC, devs[2].MAC)
+	}
+	if !tap1.secondary || tap1.Gateway != "" || tap1.Nameserver != "" || tap1.CaptureFile != "" || tap1.ExtraTaps != nil {
+		t.Errorf("Expected additional device to leave routes, DNS, and capture alone but got %+v.", tap1)
+	}
+	if tap1.MTU != n.MTU || tap1.FramePrefixLen != n.FramePrefixLen {
+		t.Error("Expected additional device to share the default device's settings.")
+	}
+}
+
+func TestValidateTaps(t *testing.T) {
+	valid := TapConfig{Name: "tap1", Addr: "192.168.128.2/24", HostProxyPort: 1025}
+	for _, c := range []struct {
+		name    string
+		taps    []TapConfig
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"valid", []TapConfig{valid}, ""},
+		{"no name", []TapConfig{{Addr: valid.Addr, HostProxyPort: 1025}}, "already taken"},
+		{"loopback name", []TapConfig{{Name: ifaceLo, Addr: valid.Addr, HostProxyPort: 1025}}, "already taken"},
+		{"duplicate name", []TapConfig{valid, {Name: "tap1", Addr: valid.Addr, HostProxyPort: 1026}}, "already taken"},
+		{"default port", []TapConfig{{Name: "tap1", Addr: valid.Addr, HostProxyPort: 1024}}, "already taken"},
+		{"no port", []TapConfig{{Name: "tap1", Addr: valid.Addr}}, "unset"},
+		{"bad address", []TapConfig{{Name: "tap1", Addr: "192.168.128.2", HostProxyPort: 1025}}, "bad address"},
+		{"bad MAC", []TapConfig{{Name: "tap1", Addr: valid.Addr, HostProxyPort: 1025, MAC: "nope"}}, "MAC"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateTaps(c.taps, 1024)
+			if c.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error but got %v.", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("Expected error containing %q but got %v.", c.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hf/nitrite"
+)
+
+// testEpoch is the time at which our test PKI issues attestation documents,
+// unless a test says otherwise.
+var testEpoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	// fixtureDocPath and fixtureRootPath are the paths of a pinned
+	// attestation document and the PEM-encoded root that it chains up to.
+	// The document was created at testEpoch and contains fixtureNonce.  Run
+	// the tests with -update to regenerate both.
+	fixtureDocPath  = filepath.Join("testdata", "attestation.cbor")
+	fixtureRootPath = filepath.Join("testdata", "attestation_root.pem")
+	fixtureNonce    = []byte("fixture nonce")
+	fixtureOnce     sync.Once
+)
+
+// testPKI mimics the NSM's PKI: a P-384 root certificate and a short-lived
+// leaf certificate whose key signs attestation documents.  Unlike the
+// deterministic attester's documents, the documents of testPKI pass
+// verification if the verifier trusts the root.
+type testPKI struct {
+	rootDER []byte
+	leafDER []byte
+	leafKey *ecdsa.PrivateKey
+	roots   *x509.CertPool
+}
+
+// newTestPKI creates a PKI whose leaf certificate is valid for the given
+// period.  The root certificate is valid a day before and a year after.
+func newTestPKI(t testing.TB, notBefore, notAfter time.Time) *testPKI {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate root key: %v", err)
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test.nitro-enclaves"},
+		NotBefore:             notBefore.Add(-24 * time.Hour),
+		NotAfter:              notAfter.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.ECDSAWithSHA384,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("Failed to create root certificate: %v", err)
+	}
+	if root, err = x509.ParseCertificate(rootDER); err != nil {
+		t.Fatalf("Failed to parse root certificate: %v", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate leaf key: %v", err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "i-test-enc0123456789abcdef"},
+		NotBefore:          notBefore,
+		NotAfter:           notAfter,
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		SignatureAlgorithm: x509.ECDSAWithSHA384,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, root, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatalf("Failed to create leaf certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &testPKI{rootDER: rootDER, leafDER: leafDER, leafKey: leafKey, roots: roots}
+}
+
+// newNSMTestPKI returns a PKI whose leaf certificate is valid for three hours
+// around testEpoch, like the NSM's.
+func newNSMTestPKI(t testing.TB) *testPKI {
+	t.Helper()
+	return newTestPKI(t, testEpoch.Add(-time.Hour), testEpoch.Add(2*time.Hour))
+}
+
+// testPCRs returns PCRs that are filled with the given byte.
+func testPCRs(b byte) map[uint][]byte {
+	pcrs := make(map[uint][]byte, detNumPCRs)
+	for i := uint(0); i < detNumPCRs; i++ {
+		pcr := make([]byte, sha512.Size384)
+		for j := range pcr {
+			pcr[j] = b
+		}
+		pcrs[i] = pcr
+	}
+	return pcrs
+}
+
+// sign fills in the certificates of the given document and returns the
+// document as signed COSE_Sign1 structure.  Fields that nitrite requires
+// are filled in if the document lacks them.
+func (p *testPKI) sign(t testing.TB, doc nitrite.Document) []byte {
+	t.Helper()
+	if doc.ModuleID == "" {
+		doc.ModuleID = "i-test-enc0123456789abcdef"
+	}
+	if doc.Timestamp == 0 {
+		doc.Timestamp = uint64(testEpoch.UnixMilli())
+	}
+	if doc.PCRs == nil {
+		doc.PCRs = testPCRs(0)
+	}
+	doc.Digest = "SHA384"
+	doc.Certificate = p.leafDER
+	doc.CABundle = [][]byte{p.rootDER}
+
+	payload, err := cbor.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Failed to encode document: %v", err)
+	}
+	protected, err := cbor.Marshal(map[int]int{1: -35})
+	if err != nil {
+		t.Fatalf("Failed to encode protected header: %v", err)
+	}
+	sigStruct, err := cbor.Marshal([]any{"Signature1", protected, []byte{}, payload})
+	if err != nil {
+		t.Fatalf("Failed to encode signature structure: %v", err)
+	}
+	digest := sha512.Sum384(sigStruct)
+	r, s, err := ecdsa.Sign(rand.Reader, p.leafKey, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign document: %v", err)
+	}
+	sig := make([]byte, 2*sha512.Size384)
+	r.FillBytes(sig[:sha512.Size384])
+	s.FillBytes(sig[sha512.Size384:])
+
+	cose, err := cbor.Marshal([]any{protected, map[int]any{}, payload, sig})
+	if err != nil {
+		t.Fatalf("Failed to encode COSE_Sign1: %v", err)
+	}
+	return cose
+}
+
+// opts returns verification options that trust the PKI's root and whose
+// clock is pinned to the given time.
+func (p *testPKI) opts(now time.Time) VerifyOptions {
+	return VerifyOptions{Roots: p.roots, Now: func() time.Time { return now }}
+}
+
+// testAttester implements Attester by signing documents with a test PKI.
+// Its documents are created at the time that now returns.
+type testAttester struct {
+	t   testing.TB
+	pki *testPKI
+	now func() time.Time
+}
+
+func newTestAttester(t testing.TB, pki *testPKI) *testAttester {
+	return &testAttester{t: t, pki: pki, now: func() time.Time { return testEpoch }}
+}
+
+func (a *testAttester) Attest(nonce, userData, publicKey []byte) ([]byte, error) {
+	// Like the NSM, we omit empty fields, which nitrite would reject.
+	if len(nonce) == 0 {
+		nonce = nil
+	}
+	if len(userData) == 0 {
+		userData = nil
+	}
+	if len(publicKey) == 0 {
+		publicKey = nil
+	}
+	return a.pki.sign(a.t, nitrite.Document{
+		Timestamp: uint64(a.now().UnixMilli()),
+		Nonce:     nonce,
+		UserData:  userData,
+		PublicKey: publicKey,
+	}), nil
+}
+
+// fixtureDocument returns our pinned attestation document along with
+// verification options that trust its root and whose clock is pinned to the
+// document's creation time.
+func fixtureDocument(t testing.TB) ([]byte, VerifyOptions) {
+	t.Helper()
+	fixtureOnce.Do(func() {
+		if !*update {
+			return
+		}
+		pki := newNSMTestPKI(t)
+		doc := pki.sign(t, nitrite.Document{Nonce: fixtureNonce})
+		root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.rootDER})
+		if err := os.WriteFile(fixtureDocPath, doc, 0o644); err != nil {
+			t.Fatalf("Failed to update fixture document: %v", err)
+		}
+		if err := os.WriteFile(fixtureRootPath, root, 0o644); err != nil {
+			t.Fatalf("Failed to update fixture root: %v", err)
+		}
+	})
+
+	doc, err := os.ReadFile(fixtureDocPath)
+	if err != nil {
+		t.Fatalf("Failed to read fixture document (run with -update to create it): %v", err)
+	}
+	rootPEM, err := os.ReadFile(fixtureRootPath)
+	if err != nil {
+		t.Fatalf("Failed to read fixture root: %v", err)
+	}
+	roots, err := parseRoots(rootPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse fixture root: %v", err)
+	}
+	return doc, VerifyOptions{Roots: roots, Now: func() time.Time { return testEpoch }}
+}
+
+// useRootFile replaces our attestation roots with the roots in the given file
+// for the duration of the test.
+func useRootFile(t *testing.T, path string) {
+	t.Helper()
+	keepRoots(t)
+	if err := loadRootFile(path); err != nil {
+		t.Fatalf("Failed to load root file: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// attestationTokenHeader carries attestation tokens, both when we issue
+	// them and when clients present them.
+	attestationTokenHeader = "X-Attestation-Token"
+	// defaultTokenTTL determines for how long an attestation token remains
+	// valid if the config doesn't specify a TTL.
+	defaultTokenTTL = time.Minute
+	tokenLen        = 16
+)
+
+var (
+	errNoToken      = errors.New("no attestation token")
+	errUnknownToken = errors.New("unknown or already used attestation token")
+	errExpiredToken = errors.New("expired attestation token")
+	errTokenClient  = errors.New("attestation token was issued to a different client")
+)
+
+// tokenEntry is an attestation token that we issued, along with the nonce of
+// the attestation request that it was issued for.
+type tokenEntry struct {
+	client  string
+	nonce   string
+	expires time.Time
+}
+
+// tokenNonceKey is the context key under which our middleware stores the
+// nonce that a redeemed token was issued for.
+type tokenNonceKey struct{}
+
+// tokenStore issues and redeems attestation tokens.  A client obtains a token
+// by completing the nonce-attestation handshake and must then present it to
+// access sensitive routes.  Tokens are short-lived, single-use, and bound to
+// the client that requested them.
+type tokenStore struct {
+	sync.Mutex
+	ttl       time.Duration
+	tokens    map[string]tokenEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newTokenStore(ttl time.Duration) *tokenStore {
+	if ttl == 0 {
+		ttl = defaultTokenTTL
+	}
+	return &tokenStore{
+		ttl:    ttl,
+		tokens: make(map[string]tokenEntry),
+		now:    time.Now,
+	}
+}
+
+// issue returns a new token for the given client, which is bound to the given
+// nonce of the client's attestation request.
+func (s *tokenStore) issue(client, nonce string) (string, error) {
+	raw := make([]byte, tokenLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	s.sweep(now)
+	s.tokens[token] = tokenEntry{client: client, nonce: nonce, expires: now.Add(s.ttl)}
+	return token, nil
+}
+
+// sweep evicts expired tokens, so clients that never redeem their tokens
+// can't make us run out of memory.  We sweep at most once per TTL, so a
+// sweep's cost is spread across all tokens that were issued since the last
+// one, and no token outlives twice the TTL.
+func (s *tokenStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+	for t, entry := range s.tokens {
+		if now.After(entry.expires) {
+			delete(s.tokens, t)
+		}
+	}
+}
+
+// redeem consumes the given token on behalf of the given client, and returns
+// the nonce that the token was issued for.  It returns an error if the token
+// is unknown, already used, expired, or was issued to somebody else.
+func (s *tokenStore) redeem(token, client string) (string, error) {
+	if token == "" {
+		return "", errNoToken
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	entry, exists := s.tokens[token]
+	if !exists {
+		return "", errUnknownToken
+	}
+	delete(s.tokens, token)
+
+	if s.now().After(entry.expires) {
+		return "", errExpiredToken
+	}
+	if entry.client != client {
+		return "", errTokenClient
+	}
+	return entry.nonce, nil
+}
+
+// middleware returns middleware that rejects requests without a valid
+// attestation token with 401 Unauthorized.  The nonce that the token was
+// issued for is available to the next handler via tokenNonce.
+func (s *tokenStore) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := s.redeem(r.Header.Get(attestationTokenHeader), clientIP(r))
+		if err != nil {
+			log.Printf("Rejecting request to %s: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenNonceKey{}, nonce)))
+	})
+}
+
+// tokenNonce returns the nonce that the attestation token of the request with
+// the given context was issued for, or the empty string if the request didn't
+// go through our middleware.
+func tokenNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(tokenNonceKey{}).(string)
+	return nonce
+}
+
+// clientIP returns the IP address of the client that sent the given request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestTokenStore(ttl time.Duration) (*tokenStore, *testClock) {
+	clock := &testClock{t: testEpoch}
+	s := newTokenStore(ttl)
+	s.now = clock.now
+	return s, clock
+}
+
+func TestTokenRedeem(t *testing.T) {
+	const (
+		ttl    = time.Minute
+		client = "192.0.2.1"
+	)
+	cases := []struct {
+		name    string
+		token   func(t *testing.T, s *tokenStore, clock *testClock) string
+		client  string
+		wantErr error
+	}{
+		{"valid", func(t *testing.T, s *tokenStore, clock *testClock) string {
+			return mustIssue(t, s, client)
+		}, client, nil},
+		{"missing", func(*testing.T, *tokenStore, *testClock) string {
+			return ""
+		}, client, errNoToken},
+		{"unknown", func(*testing.T, *tokenStore, *testClock) string {
+			return "00112233445566778899aabbccddeeff"
+		}, client, errUnknownToken},
+		{"expired", func(t *testing.T, s *tokenStore, clock *testClock) string {
+			token := mustIssue(t, s, client)
+			clock.advance(ttl + time.Second)
+			return token
+		}, client, errExpiredToken},
+		{"reused", func(t *testing.T, s *tokenStore, clock *testClock) string {
+			token := mustIssue(t, s, client)
+			if _, err := s.redeem(token, client); err != nil {
+				t.Fatalf("Expected first redemption to succeed but got %v.", err)
+			}
+			return token
+		}, client, errUnknownToken},
+		{"other client", func(t *testing.T, s *tokenStore, clock *testClock) string {
+			return mustIssue(t, s, client)
+		}, "192.0.2.2", errTokenClient},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, clock := newTestTokenStore(ttl)
+			token := c.token(t, s, clock)
+			if _, err := s.redeem(token, c.client); err != c.wantErr {
+				t.Fatalf("Expected error %v but got %v.", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func mustIssue(t *testing.T, s *tokenStore, client string) string {
+	t.Helper()
+	token, err := s.issue(client, testNonce)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	return token
+}
+
+func TestTokenSweep(t *testing.T) {
+	const ttl = time.Minute
+	s, clock := newTestTokenStore(ttl)
+
+	mustIssue(t, s, "192.0.2.1")
+	clock.advance(ttl / 2)
+	mustIssue(t, s, "192.0.2.1")
+	clock.advance(ttl)
+	// The first token expired and the last sweep is more than a TTL ago.
+	mustIssue(t, s, "192.0.2.1")
+	if n := len(s.tokens); n != 2 {
+		t.Fatalf("Expected 2 tokens after sweep but got %d.", n)
+	}
+
+	// The second token expired too, but we don't sweep again until a TTL
+	// has passed since the last sweep.
+	clock.advance(ttl / 2)
+	mustIssue(t, s, "192.0.2.1")
+	if n := len(s.tokens); n != 3 {
+		t.Fatalf("Expected 3 tokens before next sweep but got %d.", n)
+	}
+	clock.advance(ttl)
+	mustIssue(t, s, "192.0.2.1")
+	if n := len(s.tokens); n != 2 {
+		t.Fatalf("Expected 2 tokens after sweep but got %d.", n)
+	}
+}
+
+func TestTokenMiddleware(t *testing.T) {
+	s, _ := newTestTokenStore(time.Minute)
+	h := s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, pathDecrypt, nil)
+		if token != "" {
+			r.Header.Set(attestationTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// httptest.NewRequest uses 192.0.2.1 as the client's address.
+	token := mustIssue(t, s, "192.0.2.1")
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{token, http.StatusNoContent},
+		{token, http.StatusUnauthorized},
+	} {
+		if got := request(c.token); got != c.code {
+			t.Errorf("Expected status code %d but got %d.", c.code, got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+)
+
+// topology describes where the enclave sits in its vsock network, which helps
+// with debugging setups that run several enclaves on one host.
+type topology struct {
+	LocalCID      *uint32 `json:"local_cid,omitempty"`
+	LocalCIDError string  `json:"local_cid_error,omitempty"`
+	ParentCID     uint32  `json:"parent_cid"`
+	HostProxyPort uint32  `json:"host_proxy_port"`
+	TapName       string  `json:"tap_name"`
+	// MTU is the MTU of our TAP interface.  It's 0 until networking is up.
+	MTU int64 `json:"mtu"`
+}
+
+// topologyHandler returns a HandlerFunc that reports our local CID and the
+// networking settings that are in use: the parent's CID, the port of the
+// proxy on the host, and the MTU that we ended up with.
+func topologyHandler(n *NetConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := topology{
+			ParentCID:     n.ParentCID,
+			HostProxyPort: n.HostProxyPort,
+			TapName:       n.TapName,
+			MTU:           metricLinkMTU.Value(),
+		}
+		if cid, err := localCID(); err != nil {
+			t.LocalCIDError = err.Error()
+		} else {
+			t.LocalCID = &cid
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mdlayher/vsock"
+)
+
+// getTopology queries the topology endpoint of the given enclave's internal
+// Web server.
+func getTopology(t *testing.T, e *Enclave) topology {
+	t.Helper()
+	w := httptest.NewRecorder()
+	e.intSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathTopology, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	var topo topology
+	if err := json.Unmarshal(w.Body.Bytes(), &topo); err != nil {
+		t.Fatalf("Failed to decode topology: %v", err)
+	}
+	return topo
+}
+
+// useLinkMTU sets the MTU metric for the duration of the test.
+func useLinkMTU(t *testing.T, mtu int64) {
+	t.Helper()
+	orig := metricLinkMTU.Value()
+	metricLinkMTU.Set(mtu)
+	t.Cleanup(func() { metricLinkMTU.Set(orig) })
+}
+
+func TestTopology(t *testing.T) {
+	useFakeCIDSource(t, nil, true)
+	useLinkMTU(t, 9001)
+	cfg := testConfig()
+	cfg.ParentCID = 5
+	cfg.HostProxyPort = 2048
+
+	topo := getTopology(t, newTestEnclave(t, cfg))
+	if topo.LocalCID == nil || *topo.LocalCID != 16 || topo.LocalCIDError != "" {
+		t.Errorf("Expected local CID 16 but got %v (%q).", topo.LocalCID, topo.LocalCIDError)
+	}
+	if topo.ParentCID != 5 || topo.HostProxyPort != 2048 {
+		t.Errorf("Expected parent CID 5 and port 2048 but got %d and %d.", topo.ParentCID, topo.HostProxyPort)
+	}
+	if topo.TapName != ifaceTap {
+		t.Errorf("Expected TAP device %s but got %s.", ifaceTap, topo.TapName)
+	}
+	if topo.MTU != 9001 {
+		t.Errorf("Expected MTU 9001 but got %d.", topo.MTU)
+	}
+}
+
+func TestTopologyDetectedParentCID(t *testing.T) {
+	// Outside of an enclave, the parent is the host.
+	useFakeCIDSource(t, nil, false)
+	useLinkMTU(t, 0)
+
+	topo := getTopology(t, newTestEnclave(t, testConfig()))
+	if topo.ParentCID != vsock.Host {
+		t.Errorf("Expected detected parent CID %d but got %d.", vsock.Host, topo.ParentCID)
+	}
+	if topo.MTU != 0 {
+		t.Errorf("Expected MTU 0 before networking is up but got %d.", topo.MTU)
+	}
+}
+
+func TestTopologyLocalCIDError(t *testing.T) {
+	useFakeCIDSource(t, errors.New("no vsock device"), true)
+
+	topo := getTopology(t, newTestEnclave(t, testConfig()))
+	if topo.LocalCID != nil || topo.LocalCIDError == "" {
+		t.Fatalf("Expected local CID error but got CID %v.", topo.LocalCID)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies our instrumentation in exported spans.
+const tracerName = "network-test"
+
+// noopTracer is used if tracing is off.
+var noopTracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+
+type tracerKey struct{}
+
+// newTracerProvider returns the tracer provider that the given config asks
+// for, or nil if tracing is off.  If the config specifies a collector
+// endpoint, the returned provider exports spans to it via OTLP over gRPC, in
+// batches.  The returned function then shuts the provider down and flushes
+// pending spans; it's nil for providers that we didn't create.
+func newTracerProvider(c *Config) (trace.TracerProvider, func(context.Context) error, error) {
+	if c.TracerProvider != nil {
+		return c.TracerProvider, nil, nil
+	}
+	if c.TracingEndpoint == "" {
+		return nil, nil, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.TracingEndpoint)}
+	if c.TracingInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// The exporter connects lazily, so an unreachable collector doesn't
+	// keep the enclave from starting.
+	exp, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracerName))),
+	)
+	return tp, tp.Shutdown, nil
+}
+
+// withTracer returns a copy of the given context that carries the given
+// tracer, so code further down the call stack can start child spans.
+func withTracer(ctx context.Context, t trace.Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span with the given name, using the tracer that the given
+// context carries.  If the context carries no tracer, a no-op span is
+// returned.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	t, ok := ctx.Value(tracerKey{}).(trace.Tracer)
+	if !ok {
+		t = noopTracer
+	}
+	return t.Start(ctx, name)
+}
+
+// endSpan records the given error, if any, and ends the given span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingMiddleware returns middleware that starts a span for each request,
+// which records the request's method, path, status code, and latency.  The
+// request's context carries the tracer, so handlers can start child spans.
+func tracingMiddleware(t trace.Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := t.Start(withTracer(r.Context(), t), "HTTP "+r.Method,
+				trace.WithSpanKind(trace.SpanKindServer))
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			defer func() {
+				span.SetAttributes(
+					attribute.String("http.method", r.Method),
+					attribute.String("http.target", r.URL.Path),
+					attribute.Int("http.status_code", sw.status),
+					attribute.Int64("http.duration_ms", time.Since(start).Milliseconds()),
+				)
+				if sw.status >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, http.StatusText(sw.status))
+				}
+				span.End()
+			}()
+			next.ServeHTTP(sw, r.WithContext(ctx))
+		})
+	}
+}
+
+// statusWriter records the status code of a response.  It passes through
+// flushing and hijacking, which our proxies rely on.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
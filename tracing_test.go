@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// newTestTracerProvider returns a tracer provider that records spans in
+// memory.
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	return tp, rec
+}
+
+// spanAttrs returns the attributes of the given span as a map.
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	tp, rec := newTestTracerProvider(t)
+	h := tracingMiddleware(tp.Tracer(tracerName))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "kms.decrypt")
+		endSpan(span, errors.New("denied"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, pathDecrypt, nil))
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans but got %d.", len(spans))
+	}
+	child, parent := spans[0], spans[1]
+	if parent.Name() != "HTTP GET" || child.Name() != "kms.decrypt" {
+		t.Fatalf("Expected spans %q and %q but got %q and %q.", "HTTP GET", "kms.decrypt", parent.Name(), child.Name())
+	}
+	if child.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("Expected KMS span to be a child of the request's span.")
+	}
+	if child.Status().Code != codes.Error || len(child.Events()) != 1 {
+		t.Errorf("Expected KMS span to record its error but got %+v.", child.Status())
+	}
+
+	attrs := spanAttrs(parent)
+	if got := attrs["http.method"].AsString(); got != http.MethodGet {
+		t.Errorf("Expected method %q but got %q.", http.MethodGet, got)
+	}
+	if got := attrs["http.target"].AsString(); got != pathDecrypt {
+		t.Errorf("Expected target %q but got %q.", pathDecrypt, got)
+	}
+	if got := attrs["http.status_code"].AsInt64(); got != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d but got %d.", http.StatusServiceUnavailable, got)
+	}
+	if _, ok := attrs["http.duration_ms"]; !ok {
+		t.Error("Expected span to record the request's latency.")
+	}
+	if parent.Status().Code != codes.Error {
+		t.Errorf("Expected server error to mark the span as failed but got %+v.", parent.Status())
+	}
+}
+
+func TestStartSpanWithoutTracer(t *testing.T) {
+	_, span := startSpan(context.Background(), "attestation")
+	if span.IsRecording() {
+		t.Error("Expected a no-op span without a tracer.")
+	}
+	endSpan(span, errors.New("ignored"))
+}
+
+func TestEnclaveTracing(t *testing.T) {
+	tp, rec := newTestTracerProvider(t)
+	cfg := testConfig()
+	cfg.TracerProvider = tp
+	e := newTestEnclave(t, cfg)
+	if e.netCfg.Tracer == nil {
+		t.Error("Expected networking to be traced.")
+	}
+
+	e.pubSrv.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, pathReady, nil))
+	e.intSrv.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, pathMetrics, nil))
+
+	var targets []string
+	for _, span := range rec.Ended() {
+		targets = append(targets, spanAttrs(span)["http.target"].AsString())
+	}
+	if len(targets) != 2 || targets[0] != pathReady || targets[1] != pathMetrics {
+		t.Errorf("Expected spans for %s and %s but got %v.", pathReady, pathMetrics, targets)
+	}
+}
+
+// fakeCollector implements OTLP's trace service and records the names of the
+// spans that it receives.
+type fakeCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+	sync.Mutex
+	names []string
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.Lock()
+	defer c.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.names = append(c.names, span.Name)
+			}
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (c *fakeCollector) spanNames() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.names...)
+}
+
+func TestOTLPExport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := new(fakeCollector)
+	srv := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(srv, collector)
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Stop()
+
+	cfg := testConfig()
+	cfg.TracingEndpoint = l.Addr().String()
+	cfg.TracingInsecure = true
+	tp, shutdown, err := newTracerProvider(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	h := tracingMiddleware(tp.Tracer(tracerName))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, pathDecrypt, nil))
+
+	// Shutting down flushes pending spans.
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected no error but got %v.", err)
+	}
+	if names := collector.spanNames(); len(names) != 1 || names[0] != "HTTP POST" {
+		t.Errorf("Expected collector to receive span %q but got %v.", "HTTP POST", names)
+	}
+}
+
+func TestNoTracerProvider(t *testing.T) {
+	tp, shutdown, err := newTracerProvider(testConfig())
+	if tp != nil || shutdown != nil || err != nil {
+		t.Errorf("Expected tracing to be off by default but got %v, %v.", tp, err)
+	}
+}
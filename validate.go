@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// validateConfig runs all checks that NewEnclave runs on the given config,
+// without setting up networking or talking to the NSM, and returns all
+// problems that it finds.
+func validateConfig(c *Config) error {
+	// Detecting the parent CID requires VM sockets, so we assume the CID of
+	// Nitro Enclaves' parent instead.
+	probe := *c
+	if probe.ParentCID == 0 {
+		probe.ParentCID = parentCID
+	}
+	return joinErrors(probe.Validate(), newNetConfig(&probe).Validate())
+}
+
+// runValidate validates the given config, reports the result to the given
+// writer, and returns the process's exit code.
+func runValidate(c *Config, w io.Writer) int {
+	if err := validateConfig(c); err != nil {
+		fmt.Fprintf(w, "Config is invalid:\n%v\n", err)
+		return 1
+	}
+	fmt.Fprintln(w, "Config is valid.")
+	return 0
+}
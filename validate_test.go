@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		modify    func(c *Config)
+		wantCode  int
+		wantInOut []string
+	}{
+		{
+			name:      "default config",
+			modify:    func(c *Config) {},
+			wantCode:  0,
+			wantInOut: []string{"Config is valid."},
+		},
+		{
+			name:      "missing FQDN",
+			modify:    func(c *Config) { c.FQDN = "" },
+			wantCode:  1,
+			wantInOut: []string{"Config is invalid", "FQDN"},
+		},
+		{
+			name:      "missing port",
+			modify:    func(c *Config) { c.ExtPort = 0 },
+			wantCode:  1,
+			wantInOut: []string{"port"},
+		},
+		{
+			name:      "bad handshake timeout",
+			modify:    func(c *Config) { c.HandshakeTimeout = -time.Second },
+			wantCode:  1,
+			wantInOut: []string{"bad handshake timeout"},
+		},
+		{
+			name: "several problems",
+			modify: func(c *Config) {
+				c.IntIface = "eth0"
+				c.HandshakeTimeout = -time.Second
+			},
+			wantCode:  1,
+			wantInOut: []string{"unsupported interface", "bad handshake timeout"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			c.modify(cfg)
+			var out bytes.Buffer
+			if code := runValidate(cfg, &out); code != c.wantCode {
+				t.Fatalf("Expected exit code %d but got %d: %s", c.wantCode, code, out.String())
+			}
+			for _, want := range c.wantInOut {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Expected output to contain %q but got %q.", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfigSkipsCIDDetection(t *testing.T) {
+	origLocalCID := localCID
+	t.Cleanup(func() { localCID = origLocalCID })
+	localCID = func() (uint32, error) {
+		t.Error("Expected validation not to query VM sockets.")
+		return 0, errors.New("no vsock device")
+	}
+	if err := validateConfig(defaultConfig()); err != nil {
+		t.Fatalf("Expected default config to be valid but got %v.", err)
+	}
+}
+
+// TestValidateSubcommand runs the test binary's main function with the
+// validate subcommand in a child process, and checks its exit code.
+func TestValidateSubcommand(t *testing.T) {
+	if os.Getenv("NETWORK_TEST_RUN_MAIN") == "1" {
+		os.Args = []string{"network-test", "validate"}
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestValidateSubcommand$")
+	cmd.Env = append(os.Environ(), "NETWORK_TEST_RUN_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected validate to exit with code 0 but got %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "Config is valid.") {
+		t.Fatalf("Expected validate to report a valid config but got %q.", out)
+	}
+}
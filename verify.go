@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+const (
+	// defaultMaxAge is the maximum age of an attestation document that we
+	// tolerate if the caller doesn't specify one.  The value is generous
+	// because the enclave's clock may drift.
+	defaultMaxAge = 10 * time.Minute
+	// defaultMaxDocSize is the maximum size of a raw attestation document
+	// that we're willing to parse if the caller doesn't specify one.
+	defaultMaxDocSize = 64 * 1024
+	// verifyTimeout bounds the time VerifyRemote waits for a remote enclave.
+	verifyTimeout = 10 * time.Second
+	// defaultExpiryWarning is how close to its expiry a document must be for
+	// us to warn about it, if the caller doesn't specify a threshold.
+	defaultExpiryWarning = 2 * time.Minute
+	// defaultMaxDocumentValidity is the longest validity window of a signing
+	// certificate that our verification endpoint accepts if the config
+	// doesn't specify one.  The NSM's certificates are valid for a few hours.
+	defaultMaxDocumentValidity = 24 * time.Hour
+)
+
+var (
+	ErrStaleDocument     = errors.New("attestation document is older than the maximum age")
+	ErrNonceMismatch     = errors.New("attestation document does not contain our nonce")
+	ErrPCRMismatch       = errors.New("attestation document matches none of the expected PCR sets")
+	ErrDocumentTooLarge  = errors.New("attestation document exceeds the maximum size")
+	ErrPublicKeyMismatch = errors.New("attestation document does not contain the expected public key")
+	ErrValidityTooLong   = errors.New("attestation document's certificate is valid for implausibly long")
+)
+
+// PCRSet is a named set of expected PCR values.  The name identifies the set
+// when reporting verification results, e.g., "stable" or "canary".
+type PCRSet struct {
+	Name string
+	PCRs map[uint][]byte
+}
+
+// Result is the result of a successful verification.
+type Result struct {
+	*nitrite.Result
+	// MatchedPCRSet is the name of the expected PCR set that the document
+	// matched.  It's empty if no PCR sets were expected.
+	MatchedPCRSet string
+	// Warnings describes problems that don't fail verification, e.g., a
+	// document that's about to expire, so clients can refresh it early.
+	Warnings []string
+}
+
+// PublicKeyEquals returns true if the attestation document binds the given
+// public key.  The comparison takes constant time.
+func (r *Result) PublicKeyEquals(key []byte) bool {
+	return subtle.ConstantTimeCompare(r.Document.PublicKey, key) == 1
+}
+
+// VerifyOptions specifies how attestation documents are verified.
+type VerifyOptions struct {
+	// MaxAge is the maximum age of an attestation document, as determined by
+	// the timestamp in the document.  Older documents are rejected with
+	// ErrStaleDocument, even if their signature and nonce are valid.  If
+	// MaxAge is 0, defaultMaxAge is used.
+	MaxAge time.Duration
+	// ExpectedPCRs contains the PCR sets that we accept.  A document passes
+	// verification if its PCRs match any of the sets, which allows clients to
+	// accept both the previous and the new build during a rolling upgrade.
+	// If ExpectedPCRs is empty, PCRs aren't checked.
+	ExpectedPCRs []PCRSet
+	// PCRIndices restricts the comparison of PCRs to the given indices.
+	// Some PCRs are meaningless for comparisons, e.g., PCR4, which contains
+	// the parent instance's ID and differs per instance.  If PCRIndices is
+	// empty, all expected PCRs are compared.
+	PCRIndices []uint
+	// ExpectedPublicKey is the public key that the document must bind, e.g.,
+	// because the client is about to encrypt data to it.  If
+	// ExpectedPublicKey is nil, the public key isn't checked.
+	ExpectedPublicKey []byte
+	// MaxDocumentSize is the maximum size in bytes of a raw attestation
+	// document.  Larger documents are rejected with ErrDocumentTooLarge before
+	// we attempt to parse them.  If MaxDocumentSize is 0, defaultMaxDocSize
+	// is used.
+	MaxDocumentSize int
+	// Now returns the current time, which determines if certificates are
+	// valid and documents are fresh.  Tests can pin time by setting Now.  If
+	// Now is nil, time.Now is used, corrected by the clock skew that the
+	// enclave measured at startup if Config.CorrectClockSkew is set.
+	Now func() time.Time
+	// Roots is the pool of root certificates that documents must chain up
+	// to.  If Roots is nil, the roots of Config.AttestationRootFile are
+	// used, or the embedded AWS Nitro Enclaves root if no file was loaded.
+	Roots *x509.CertPool
+	// Cache caches the results of signature and certificate chain
+	// verification across calls.  If Cache is nil, every document is fully
+	// verified.
+	Cache *VerifyCache
+	// ExpiryWarning is how close to its expiry a document must be for the
+	// result to carry a warning.  A document expires once it exceeds MaxAge
+	// or its certificate chain expires, whichever comes first.  If
+	// ExpiryWarning is 0, defaultExpiryWarning is used.  If it's negative,
+	// there are no expiry warnings.
+	ExpiryWarning time.Duration
+	// MaxValidity is the longest validity window, i.e., not-after minus
+	// not-before, that we accept for a document's signing certificate.  The
+	// NSM issues certificates that are valid for a few hours, so a much
+	// longer window suggests a misbehaving or malicious peer.  Such documents
+	// are rejected with ErrValidityTooLong.  If MaxValidity is 0, the window
+	// isn't checked.
+	MaxValidity time.Duration
+}
+
+// nitriteOptions returns the options for nitrite's verification.  It fails if
+// no root certificates are available.
+func (o *VerifyOptions) nitriteOptions() (nitrite.VerifyOptions, error) {
+	roots := o.Roots
+	if roots == nil {
+		var err error
+		if roots, err = attestationRoots(); err != nil {
+			return nitrite.VerifyOptions{}, err
+		}
+	}
+	return nitrite.VerifyOptions{Roots: roots, CurrentTime: o.now()}, nil
+}
+
+func (o *VerifyOptions) now() time.Time {
+	if o.Now == nil {
+		return time.Now().Add(-time.Duration(atomic.LoadInt64(&clockOffset)))
+	}
+	return o.Now()
+}
+
+func (o *VerifyOptions) maxAge() time.Duration {
+	if o.MaxAge == 0 {
+		return defaultMaxAge
+	}
+	return o.MaxAge
+}
+
+func (o *VerifyOptions) expiryWarning() time.Duration {
+	if o.ExpiryWarning == 0 {
+		return defaultExpiryWarning
+	}
+	return o.ExpiryWarning
+}
+
+// expiryWarnings returns a warning if the given expiry is within the
+// options' warning threshold of the given time.
+func (o *VerifyOptions) expiryWarnings(now, expires time.Time) []string {
+	threshold := o.expiryWarning()
+	if threshold < 0 {
+		return nil
+	}
+	if left := expires.Sub(now); left < threshold {
+		return []string{fmt.Sprintf("document expires in %s, at %s",
+			left.Round(time.Second), expires.UTC().Format(time.RFC3339))}
+	}
+	return nil
+}
+
+func (o *VerifyOptions) maxDocumentSize() int {
+	if o.MaxDocumentSize == 0 {
+		return defaultMaxDocSize
+	}
+	return o.MaxDocumentSize
+}
+
+// VerifyRemote asks the enclave that's reachable at the given base URL for an
+// attestation document containing the given nonce.  The document is then
+// verified according to the given options and returned to the caller.
+func VerifyRemote(baseURL string, nonce []byte, opts VerifyOptions) (*Result, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	u.Path = pathAttestation
+	u.RawQuery = url.Values{"nonce": {hex.EncodeToString(nonce)}}.Encode()
+
+	client := http.Client{Timeout: verifyTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attestation document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The document is Base64-encoded and followed by a newline.
+	maxBodyLen := base64.StdEncoding.EncodedLen(opts.maxDocumentSize()) + 2
+	body, err := io.ReadAll(newLimitReader(resp.Body, maxBodyLen))
+	if errors.Is(err, errTooMuchToRead) {
+		return nil, ErrDocumentTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enclave returned status code %d: %s", resp.StatusCode, body)
+	}
+
+	rawDoc, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Base64-encoded document: %w", err)
+	}
+
+	return verifyDocument(rawDoc, nonce, opts)
+}
+
+// verifyDocument verifies the given raw attestation document and makes sure
+// that it contains the given nonce, isn't stale, and has the expected PCRs.
+func verifyDocument(rawDoc, nonce []byte, opts VerifyOptions) (*Result, error) {
+	if len(rawDoc) > opts.maxDocumentSize() {
+		return nil, ErrDocumentTooLarge
+	}
+
+	nopts, err := opts.nitriteOptions()
+	if err != nil {
+		return nil, err
+	}
+	now := nopts.CurrentTime
+	res, ok := opts.Cache.get(rawDoc, now)
+	if !ok {
+		if res, err = nitrite.Verify(rawDoc, nopts); err != nil {
+			return nil, err
+		}
+		opts.Cache.put(rawDoc, res)
+	}
+
+	if !bytes.Equal(res.Document.Nonce, nonce) {
+		return nil, ErrNonceMismatch
+	}
+
+	created := time.UnixMilli(int64(res.Document.Timestamp))
+	if now.Sub(created) > opts.maxAge() {
+		return nil, fmt.Errorf("%w: created at %s", ErrStaleDocument, created)
+	}
+	if err := checkValidity(res.Certificates, opts.MaxValidity); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Result: res}
+	expires := created.Add(opts.maxAge())
+	if len(res.Certificates) > 0 {
+		if notAfter := certsExpiry(res.Certificates); notAfter.Before(expires) {
+			expires = notAfter
+		}
+	}
+	result.Warnings = opts.expiryWarnings(now, expires)
+	if len(opts.ExpectedPCRs) > 0 {
+		set, ok := matchPCRSets(opts.ExpectedPCRs, res.Document.PCRs, opts.PCRIndices)
+		if !ok {
+			return nil, ErrPCRMismatch
+		}
+		result.MatchedPCRSet = set.Name
+	}
+	if opts.ExpectedPublicKey != nil && !result.PublicKeyEquals(opts.ExpectedPublicKey) {
+		return nil, ErrPublicKeyMismatch
+	}
+
+	return result, nil
+}
+
+// matchPCRSets returns the first of the given PCR sets that matches the given
+// PCRs.  If indices is non-empty, only the PCRs at the given indices are
+// compared.  The second return value is false if no set matches.
+func matchPCRSets(sets []PCRSet, pcrs map[uint][]byte, indices []uint) (PCRSet, bool) {
+	for _, set := range sets {
+		var diffs []uint
+		if len(indices) > 0 {
+			diffs = CompareSelectedPCRs(set.PCRs, pcrs, indices)
+		} else {
+			diffs = ComparePCRs(set.PCRs, pcrs)
+		}
+		if len(diffs) == 0 {
+			return set, true
+		}
+	}
+	return PCRSet{}, false
+}
+
+// ComparePCRs compares the expected PCRs to the actual PCRs and returns the
+// sorted indices of all expected PCRs whose actual value differs or is
+// missing.  PCRs that aren't expected are ignored.
+func ComparePCRs(expected, actual map[uint][]byte) []uint {
+	var diffs []uint
+	for pcr, expValue := range expected {
+		actValue, exists := actual[pcr]
+		if !exists || !bytes.Equal(expValue, actValue) {
+			diffs = append(diffs, pcr)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+	return diffs
+}
+
+// CompareSelectedPCRs compares the PCRs at the given indices and returns the
+// sorted indices whose values differ, including indices that are present in
+// only one of the maps.  All other PCRs are ignored.
+func CompareSelectedPCRs(expected, actual map[uint][]byte, indices []uint) []uint {
+	var diffs []uint
+	seen := make(map[uint]bool, len(indices))
+	for _, pcr := range indices {
+		if seen[pcr] {
+			continue
+		}
+		seen[pcr] = true
+		expValue, expExists := expected[pcr]
+		actValue, actExists := actual[pcr]
+		if expExists != actExists || !bytes.Equal(expValue, actValue) {
+			diffs = append(diffs, pcr)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+	return diffs
+}
+
+// checkValidity makes sure that the validity window of the given signing
+// certificate chain's leaf doesn't exceed the given maximum.  A maximum of 0
+// disables the check.
+func checkValidity(certs []*x509.Certificate, max time.Duration) error {
+	if max == 0 || len(certs) == 0 {
+		return nil
+	}
+	// Nitrite puts the document's signing certificate first.
+	leaf := certs[0]
+	if window := leaf.NotAfter.Sub(leaf.NotBefore); window > max {
+		return fmt.Errorf("%w: %s exceeds %s", ErrValidityTooLong, window, max)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+// The following benchmarks measure the cost of verifying attestation
+// documents.  They verify our pinned fixture document against its pinned
+// root and creation time, so they don't need an NSM and are reproducible.
+
+func BenchmarkVerify(b *testing.B) {
+	doc, opts := fixtureDocument(b)
+	if _, err := verifyDocument(doc, fixtureNonce, opts); err != nil {
+		b.Fatalf("Failed to verify fixture document: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := verifyDocument(doc, fixtureNonce, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyCached(b *testing.B) {
+	doc, opts := fixtureDocument(b)
+	opts.Cache = NewVerifyCache(0)
+	if _, err := verifyDocument(doc, fixtureNonce, opts); err != nil {
+		b.Fatalf("Failed to verify fixture document: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := verifyDocument(doc, fixtureNonce, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkVerifyAndComparePCRs measures the full flow of verifying a
+// document and matching its PCRs against a list of expected sets, the last
+// of which matches.
+func BenchmarkVerifyAndComparePCRs(b *testing.B) {
+	doc, opts := fixtureDocument(b)
+	opts.ExpectedPCRs = []PCRSet{
+		{Name: "old", PCRs: testPCRs(1)},
+		{Name: "older", PCRs: testPCRs(2)},
+		{Name: "current", PCRs: testPCRs(0)},
+	}
+	res, err := verifyDocument(doc, fixtureNonce, opts)
+	if err != nil {
+		b.Fatalf("Failed to verify fixture document: %v", err)
+	}
+	if res.MatchedPCRSet != "current" {
+		b.Fatalf("Expected PCR set %q to match but got %q.", "current", res.MatchedPCRSet)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := verifyDocument(doc, fixtureNonce, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComparePCRs(b *testing.B) {
+	expected, actual := testPCRs(0), testPCRs(0)
+	actual[4] = testPCRs(1)[4]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if diffs := ComparePCRs(expected, actual); len(diffs) != 1 {
+			b.Fatalf("Expected 1 differing PCR but got %v.", diffs)
+		}
+	}
+}
+
+func BenchmarkGenerateNonce(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := newNonce(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
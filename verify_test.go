@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+var testNonceBytes = []byte("nonce of the verifier")
+
+func TestVerifyDocument(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+
+	res, err := verifyDocument(doc, testNonceBytes, pki.opts(testEpoch))
+	if err != nil {
+		t.Fatalf("Failed to verify valid document: %v", err)
+	}
+	if !res.SignatureOK {
+		t.Error("Expected valid signature.")
+	}
+	if _, err := verifyDocument(doc, []byte("other nonce"), pki.opts(testEpoch)); !errors.Is(err, ErrNonceMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrNonceMismatch, err)
+	}
+	// A document from a different PKI must not verify.
+	if _, err := verifyDocument(doc, testNonceBytes, newNSMTestPKI(t).opts(testEpoch)); err == nil {
+		t.Error("Expected document of untrusted PKI to fail verification.")
+	}
+}
+
+func TestVerifyMaxValidity(t *testing.T) {
+	// The leaf is valid from an hour before to 30 days after testEpoch.
+	pki := newTestPKI(t, testEpoch.Add(-time.Hour), testEpoch.Add(30*24*time.Hour))
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+
+	for _, test := range []struct {
+		name        string
+		maxValidity time.Duration
+		wantErr     error
+	}{
+		{"unchecked", 0, nil},
+		{"within bound", 31 * 24 * time.Hour, nil},
+		{"overlong", 24 * time.Hour, ErrValidityTooLong},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := pki.opts(testEpoch)
+			opts.MaxValidity = test.maxValidity
+			if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, test.wantErr) {
+				t.Fatalf("Expected %v but got %v.", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyMaxAge(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+
+	for _, test := range []struct {
+		name   string
+		maxAge time.Duration
+		age    time.Duration
+		stale  bool
+	}{
+		{"fresh", time.Minute, 0, false},
+		{"at max age", time.Minute, time.Minute, false},
+		{"just past max age", time.Minute, time.Minute + time.Millisecond, true},
+		{"default at max age", 0, defaultMaxAge, false},
+		{"default past max age", 0, defaultMaxAge + time.Millisecond, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := pki.opts(testEpoch.Add(test.age))
+			opts.MaxAge = test.maxAge
+			_, err := verifyDocument(doc, testNonceBytes, opts)
+			if test.stale && !errors.Is(err, ErrStaleDocument) {
+				t.Errorf("Expected %v but got %v.", ErrStaleDocument, err)
+			}
+			if !test.stale && err != nil {
+				t.Errorf("Expected no error but got %v.", err)
+			}
+		})
+	}
+}
+
+// newAttestationServer returns a test server that serves our attestation
+// endpoint with the given attester.
+func newAttestationServer(t *testing.T, a Attester) *httptest.Server {
+	t.Helper()
+	h := attestationHandler(a, testHashes(), newTokenStore(0), nil, nil, newAuditLog(nil))
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVerifyPCRSets(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes, PCRs: testPCRs(2)})
+
+	opts := pki.opts(testEpoch)
+	opts.ExpectedPCRs = []PCRSet{
+		{Name: "stable", PCRs: testPCRs(1)},
+		{Name: "canary", PCRs: testPCRs(2)},
+	}
+	res, err := verifyDocument(doc, testNonceBytes, opts)
+	if err != nil {
+		t.Fatalf("Expected document to match second PCR set but got %v.", err)
+	}
+	if res.MatchedPCRSet != "canary" {
+		t.Errorf("Expected matched set %q but got %q.", "canary", res.MatchedPCRSet)
+	}
+
+	opts.ExpectedPCRs = opts.ExpectedPCRs[:1]
+	if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, ErrPCRMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrPCRMismatch, err)
+	}
+}
+
+func TestVerifyRemotePCRSets(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	srv := newAttestationServer(t, newTestAttester(t, pki))
+	nonce := make([]byte, nonceLen)
+
+	opts := pki.opts(testEpoch)
+	opts.ExpectedPCRs = []PCRSet{
+		{Name: "stable", PCRs: testPCRs(1)},
+		{Name: "canary", PCRs: testPCRs(0)},
+	}
+	res, err := VerifyRemote(srv.URL, nonce, opts)
+	if err != nil {
+		t.Fatalf("Failed to verify remote enclave: %v", err)
+	}
+	if res.MatchedPCRSet != "canary" {
+		t.Errorf("Expected matched set %q but got %q.", "canary", res.MatchedPCRSet)
+	}
+}
+
+func TestComparePCRs(t *testing.T) {
+	expected := map[uint][]byte{0: {1}, 1: {2}, 4: {3}}
+	actual := map[uint][]byte{0: {1}, 1: {9}, 2: {7}}
+	if diffs := ComparePCRs(expected, actual); len(diffs) != 2 || diffs[0] != 1 || diffs[1] != 4 {
+		t.Errorf("Expected PCRs 1 and 4 to differ but got %v.", diffs)
+	}
+	if diffs := ComparePCRs(expected, expected); len(diffs) != 0 {
+		t.Errorf("Expected no differences but got %v.", diffs)
+	}
+}
+
+func TestCompareSelectedPCRs(t *testing.T) {
+	expected := map[uint][]byte{0: {1}, 1: {2}, 4: {3}}
+	actual := map[uint][]byte{0: {1}, 1: {9}, 2: {7}}
+	cases := []struct {
+		indices []uint
+		diffs   []uint
+	}{
+		{[]uint{0}, nil},
+		{[]uint{0, 1}, []uint{1}},
+		{[]uint{4, 2, 1, 4}, []uint{1, 2, 4}},
+		{[]uint{7}, nil},
+	}
+	for _, c := range cases {
+		diffs := CompareSelectedPCRs(expected, actual, c.indices)
+		if fmt.Sprint(diffs) != fmt.Sprint(c.diffs) {
+			t.Errorf("Expected differences %v for indices %v but got %v.", c.diffs, c.indices, diffs)
+		}
+	}
+}
+
+func TestVerifySelectedPCRs(t *testing.T) {
+	// Two instances of the same image differ only in PCR4, which contains
+	// the parent instance's ID.
+	pki := newNSMTestPKI(t)
+	pcrs := testPCRs(1)
+	pcrs[4] = bytes.Repeat([]byte{0xee}, len(pcrs[4]))
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes, PCRs: pcrs})
+
+	opts := pki.opts(testEpoch)
+	opts.ExpectedPCRs = []PCRSet{{Name: "build", PCRs: testPCRs(1)}}
+	if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, ErrPCRMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrPCRMismatch, err)
+	}
+
+	opts.PCRIndices = []uint{0, 1, 2, 3}
+	res, err := verifyDocument(doc, testNonceBytes, opts)
+	if err != nil {
+		t.Fatalf("Expected PCR4 to be ignored but got %v.", err)
+	}
+	if res.MatchedPCRSet != "build" {
+		t.Errorf("Expected matched set %q but got %q.", "build", res.MatchedPCRSet)
+	}
+
+	// Selected PCRs must still match.
+	pcrs[0] = pcrs[4]
+	doc = pki.sign(t, nitrite.Document{Nonce: testNonceBytes, PCRs: pcrs})
+	if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, ErrPCRMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrPCRMismatch, err)
+	}
+}
+
+func TestVerifyDocumentTooLarge(t *testing.T) {
+	pki := newNSMTestPKI(t)
+
+	// Garbage beyond the default limit must be rejected before it's parsed.
+	blob := bytes.Repeat([]byte{0xff}, defaultMaxDocSize+1)
+	if _, err := verifyDocument(blob, testNonceBytes, pki.opts(testEpoch)); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected %v but got %v.", ErrDocumentTooLarge, err)
+	}
+
+	// A valid document is rejected if it exceeds a configured limit.
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	opts := pki.opts(testEpoch)
+	opts.MaxDocumentSize = len(doc) - 1
+	if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected %v but got %v.", ErrDocumentTooLarge, err)
+	}
+	opts.MaxDocumentSize = len(doc)
+	if _, err := verifyDocument(doc, testNonceBytes, opts); err != nil {
+		t.Errorf("Expected document at the limit to pass but got %v.", err)
+	}
+}
+
+func TestVerifyRemoteTooLarge(t *testing.T) {
+	// The enclave sends a body that's far larger than what we're willing to
+	// read.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("A"), 64*1024)
+		for i := 0; i < 256; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	_, err := VerifyRemote(srv.URL, make([]byte, nonceLen), VerifyOptions{MaxDocumentSize: 1024})
+	if !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected %v but got %v.", ErrDocumentTooLarge, err)
+	}
+}
+
+func TestVerifyCertificateValidityWithFixedClock(t *testing.T) {
+	notBefore, notAfter := testEpoch.Add(-time.Hour), testEpoch.Add(2*time.Hour)
+	pki := newTestPKI(t, notBefore, notAfter)
+	// The document was created right when the certificate became valid.
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes, Timestamp: uint64(notBefore.UnixMilli())})
+
+	for _, test := range []struct {
+		name  string
+		now   time.Time
+		valid bool
+	}{
+		{"before not-before", notBefore.Add(-time.Second), false},
+		{"at not-before", notBefore, true},
+		{"at not-after", notAfter, true},
+		{"after not-after", notAfter.Add(time.Second), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := pki.opts(test.now)
+			opts.MaxAge = 24 * time.Hour
+			_, err := verifyDocument(doc, testNonceBytes, opts)
+			if test.valid && err != nil {
+				t.Errorf("Expected document to verify but got %v.", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("Expected verification to fail.")
+			}
+
+			_, err = verifyAttestation(doc, opts)
+			if test.valid != (err == nil) {
+				t.Errorf("Expected verifyAttestation to agree with verifyDocument but got %v.", err)
+			}
+		})
+	}
+}
+
+func TestVerifyPublicKey(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes, PublicKey: key})
+
+	res, err := verifyDocument(doc, testNonceBytes, pki.opts(testEpoch))
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+	if !res.PublicKeyEquals(key) {
+		t.Error("Expected document's public key to match.")
+	}
+	for _, other := range [][]byte{nil, key[:31], bytes.Repeat([]byte{0x43}, 32)} {
+		if res.PublicKeyEquals(other) {
+			t.Errorf("Expected public key %x not to match.", other)
+		}
+	}
+
+	opts := pki.opts(testEpoch)
+	opts.ExpectedPublicKey = key
+	if _, err := verifyDocument(doc, testNonceBytes, opts); err != nil {
+		t.Errorf("Expected matching public key to pass but got %v.", err)
+	}
+	opts.ExpectedPublicKey = bytes.Repeat([]byte{0x43}, 32)
+	if _, err := verifyDocument(doc, testNonceBytes, opts); !errors.Is(err, ErrPublicKeyMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrPublicKeyMismatch, err)
+	}
+}
+
+func TestVerifyRemotePublicKey(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	meta := testMetadataSigner()
+	h := attestationHandler(newTestAttester(t, pki), testHashes(), newTokenStore(0), meta, nil, newAuditLog(nil))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	opts := pki.opts(testEpoch)
+	opts.ExpectedPublicKey = meta.publicKey()
+	if _, err := VerifyRemote(srv.URL, make([]byte, nonceLen), opts); err != nil {
+		t.Errorf("Expected enclave to bind its metadata key but got %v.", err)
+	}
+	opts.ExpectedPublicKey = bytes.Repeat([]byte{1}, len(opts.ExpectedPublicKey))
+	if _, err := VerifyRemote(srv.URL, make([]byte, nonceLen), opts); !errors.Is(err, ErrPublicKeyMismatch) {
+		t.Errorf("Expected %v but got %v.", ErrPublicKeyMismatch, err)
+	}
+}
+
+func TestVerifyExpiryWarnings(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	// The document expires once it exceeds the default max age.
+	expires := testEpoch.Add(defaultMaxAge)
+
+	for _, test := range []struct {
+		name      string
+		threshold time.Duration
+		now       time.Time
+		warn      bool
+	}{
+		{"fresh", 0, testEpoch, false},
+		{"at threshold", 0, expires.Add(-defaultExpiryWarning), false},
+		{"just within threshold", 0, expires.Add(-defaultExpiryWarning + time.Millisecond), true},
+		{"at expiry", 0, expires, true},
+		{"custom threshold", 5 * time.Minute, expires.Add(-4 * time.Minute), true},
+		{"outside custom threshold", 5 * time.Minute, expires.Add(-6 * time.Minute), false},
+		{"warnings off", -1, expires, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := pki.opts(test.now)
+			opts.ExpiryWarning = test.threshold
+			res, err := verifyDocument(doc, testNonceBytes, opts)
+			if err != nil {
+				t.Fatalf("Expected document to verify despite warnings but got %v.", err)
+			}
+			if warned := len(res.Warnings) > 0; warned != test.warn {
+				t.Fatalf("Expected warning to be %t but got %q.", test.warn, res.Warnings)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiryWarningCertificate(t *testing.T) {
+	// The certificate expires long before the document's max age.
+	notAfter := testEpoch.Add(5 * time.Minute)
+	pki := newTestPKI(t, testEpoch.Add(-time.Hour), notAfter)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+
+	opts := pki.opts(notAfter.Add(-time.Minute))
+	opts.MaxAge = time.Hour
+	res, err := verifyDocument(doc, testNonceBytes, opts)
+	if err != nil {
+		t.Fatalf("Expected document to verify but got %v.", err)
+	}
+	want := "document expires in 1m0s, at " + notAfter.Format(time.RFC3339)
+	if len(res.Warnings) != 1 || res.Warnings[0] != want {
+		t.Fatalf("Expected warning %q but got %q.", want, res.Warnings)
+	}
+}
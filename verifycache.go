@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+// defaultVerifyCacheSize is the number of verification results that a
+// VerifyCache holds if the caller doesn't specify a size.
+const defaultVerifyCacheSize = 128
+
+// VerifyCache is an LRU cache of successful signature and certificate chain
+// verifications, keyed by the SHA-256 hash of the raw attestation document.
+// It spares clients that poll the same enclave the CPU-heavy chain
+// verification.  Checks that depend on VerifyOptions (nonce, age, PCRs, and
+// public key) still run for every call.  A cache must not be shared between
+// options with different Roots.
+type VerifyCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type verifyCacheEntry struct {
+	key    [sha256.Size]byte
+	result *nitrite.Result
+	// The document's certificates are all valid within [notBefore,
+	// notAfter].
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// NewVerifyCache returns a new cache that holds up to the given number of
+// verification results.  If size is 0, defaultVerifyCacheSize is used.
+func NewVerifyCache(size int) *VerifyCache {
+	if size <= 0 {
+		size = defaultVerifyCacheSize
+	}
+	return &VerifyCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// get returns the cached result for the given raw document if all of its
+// certificates are valid at the given time.  A nil *VerifyCache always
+// misses.
+func (c *VerifyCache) get(rawDoc []byte, now time.Time) (*nitrite.Result, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[sha256.Sum256(rawDoc)]
+	if !ok {
+		metricVerifyCacheMisses.Add(1)
+		return nil, false
+	}
+	entry := elem.Value.(*verifyCacheEntry)
+	if now.After(entry.notAfter) {
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		metricVerifyCacheMisses.Add(1)
+		return nil, false
+	}
+	if now.Before(entry.notBefore) {
+		// The chain isn't valid yet at the caller's time, so we leave it to
+		// nitrite to reject it.  Callers with a later time may still hit.
+		metricVerifyCacheMisses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	metricVerifyCacheHits.Add(1)
+	return entry.result, true
+}
+
+// put caches the given result for the given raw document for as long as all
+// of the document's certificates are valid.
+func (c *VerifyCache) put(rawDoc []byte, res *nitrite.Result) {
+	if c == nil || len(res.Certificates) == 0 {
+		return
+	}
+	notAfter := certsExpiry(res.Certificates)
+
+	c.Lock()
+	defer c.Unlock()
+
+	key := sha256.Sum256(rawDoc)
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&verifyCacheEntry{
+		key:       key,
+		result:    res,
+		notBefore: certsStart(res.Certificates),
+		notAfter:  notAfter,
+	})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*verifyCacheEntry).key)
+	}
+}
+
+// certsExpiry returns the time at which the first of the given certificates
+// expires.  The given slice must not be empty.
+func certsExpiry(certs []*x509.Certificate) time.Time {
+	notAfter := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return notAfter
+}
+
+// certsStart returns the time at which the last of the given certificates
+// becomes valid.  The given slice must not be empty.
+func certsStart(certs []*x509.Certificate) time.Time {
+	notBefore := certs[0].NotBefore
+	for _, cert := range certs[1:] {
+		if cert.NotBefore.After(notBefore) {
+			notBefore = cert.NotBefore
+		}
+	}
+	return notBefore
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+// cacheStats returns the number of cache hits and misses since the given
+// baseline, which was returned by an earlier call.
+func cacheStats(base [2]int64) (hits, misses int64) {
+	return metricVerifyCacheHits.Value() - base[0], metricVerifyCacheMisses.Value() - base[1]
+}
+
+func cacheBaseline() [2]int64 {
+	return [2]int64{metricVerifyCacheHits.Value(), metricVerifyCacheMisses.Value()}
+}
+
+func TestVerifyCache(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	otherDoc := pki.sign(t, nitrite.Document{Nonce: []byte("other nonce")})
+	opts := pki.opts(testEpoch)
+	opts.Cache = NewVerifyCache(0)
+
+	base := cacheBaseline()
+	first, err := verifyDocument(doc, testNonceBytes, opts)
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+	if hits, misses := cacheStats(base); hits != 0 || misses != 1 {
+		t.Fatalf("Expected first verification to miss but got %d hits and %d misses.", hits, misses)
+	}
+
+	// Re-verifying the identical document hits the cache.
+	second, err := verifyDocument(doc, testNonceBytes, opts)
+	if err != nil {
+		t.Fatalf("Failed to re-verify document: %v", err)
+	}
+	if hits, misses := cacheStats(base); hits != 1 || misses != 1 {
+		t.Fatalf("Expected re-verification to hit but got %d hits and %d misses.", hits, misses)
+	}
+	if first.Result.Document != second.Result.Document {
+		t.Error("Expected re-verification to return the cached result.")
+	}
+
+	// A different document misses.
+	if _, err := verifyDocument(otherDoc, []byte("other nonce"), opts); err != nil {
+		t.Fatalf("Failed to verify other document: %v", err)
+	}
+	if hits, misses := cacheStats(base); hits != 1 || misses != 2 {
+		t.Fatalf("Expected different document to miss but got %d hits and %d misses.", hits, misses)
+	}
+
+	// Checks that depend on the options still run on a hit.
+	if _, err := verifyDocument(doc, []byte("wrong nonce"), opts); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("Expected cached document to fail the nonce check but got %v.", err)
+	}
+}
+
+func TestVerifyCacheExpiry(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	res, err := nitrite.Verify(doc, nitrite.VerifyOptions{Roots: pki.roots, CurrentTime: testEpoch})
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+
+	c := NewVerifyCache(0)
+	c.put(doc, res)
+	notAfter := certsExpiry(res.Certificates)
+	if _, ok := c.get(doc, notAfter); !ok {
+		t.Fatal("Expected hit while the certificates are valid.")
+	}
+	if _, ok := c.get(doc, notAfter.Add(time.Second)); ok {
+		t.Fatal("Expected miss once a certificate expired.")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Fatal("Expected expired entry to be evicted.")
+	}
+}
+
+func TestVerifyCacheNotYetValid(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	res, err := nitrite.Verify(doc, nitrite.VerifyOptions{Roots: pki.roots, CurrentTime: testEpoch})
+	if err != nil {
+		t.Fatalf("Failed to verify document: %v", err)
+	}
+
+	c := NewVerifyCache(0)
+	c.put(doc, res)
+	notBefore := certsStart(res.Certificates)
+	if _, ok := c.get(doc, notBefore.Add(-time.Second)); ok {
+		t.Fatal("Expected miss before a certificate became valid.")
+	}
+	// The entry stays for callers whose time is within the validity.
+	if _, ok := c.get(doc, notBefore); !ok {
+		t.Fatal("Expected hit once all certificates are valid.")
+	}
+
+	// Verifying with an early clock must fail like it does without cache.
+	opts := pki.opts(notBefore.Add(-time.Second))
+	opts.Cache = c
+	if _, err := verifyDocument(doc, testNonceBytes, opts); err == nil {
+		t.Fatal("Expected document to fail verification before its certificates are valid.")
+	}
+}
+
+func TestVerifyCacheEviction(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	docs := [][]byte{
+		pki.sign(t, nitrite.Document{Nonce: []byte("a")}),
+		pki.sign(t, nitrite.Document{Nonce: []byte("b")}),
+		pki.sign(t, nitrite.Document{Nonce: []byte("c")}),
+	}
+	c := NewVerifyCache(2)
+	for _, doc := range docs[:2] {
+		res, err := nitrite.Verify(doc, nitrite.VerifyOptions{Roots: pki.roots, CurrentTime: testEpoch})
+		if err != nil {
+			t.Fatalf("Failed to verify document: %v", err)
+		}
+		c.put(doc, res)
+	}
+	// Using the first document makes the second one the least recently
+	// used.
+	if _, ok := c.get(docs[0], testEpoch); !ok {
+		t.Fatal("Expected hit for first document.")
+	}
+	res, _ := nitrite.Verify(docs[2], nitrite.VerifyOptions{Roots: pki.roots, CurrentTime: testEpoch})
+	c.put(docs[2], res)
+
+	for i, want := range []bool{true, false, true} {
+		if _, ok := c.get(docs[i], testEpoch); ok != want {
+			t.Errorf("Expected document %d to be cached=%v but got %v.", i, want, ok)
+		}
+	}
+}
+
+func TestNilVerifyCache(t *testing.T) {
+	var c *VerifyCache
+	c.put([]byte("doc"), &nitrite.Result{})
+	if _, ok := c.get([]byte("doc"), testEpoch); ok {
+		t.Error("Expected nil cache to miss.")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hf/nitrite"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultVerifyRateLimit is the number of verifications per second that a
+// client of our public Web server may sustain if no rate limit is
+// configured.
+const defaultVerifyRateLimit = 5
+
+var (
+	errBadVerifyTime = "failed to parse time; must be RFC 3339"
+	errDocTooLarge   = "attestation document too large"
+	errBadDocBody    = "failed to read attestation document"
+)
+
+// verifyResponse is the response body of the verification endpoint.
+type verifyResponse struct {
+	Valid     bool              `json:"valid"`
+	Error     string            `json:"error,omitempty"`
+	ModuleID  string            `json:"module_id,omitempty"`
+	Digest    string            `json:"digest,omitempty"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Expires   *time.Time        `json:"expires,omitempty"`
+	PCRs      map[string]string `json:"pcrs,omitempty"`
+	Nonce     string            `json:"nonce,omitempty"`
+	UserData  string            `json:"user_data,omitempty"`
+	PublicKey string            `json:"public_key,omitempty"`
+	Warnings  []string          `json:"warnings,omitempty"`
+}
+
+// verifyHandler returns a HandlerFunc that verifies the attestation document
+// in the request body, e.g., one that audit tooling archived earlier.  The
+// document may be raw CBOR or Base64-encoded.  It's verified against our
+// attestation roots, i.e., those of Config.AttestationRootFile or the
+// embedded AWS Nitro Enclaves root, as of the time in the "at" query
+// parameter, or as of now if "at" is absent.  Archived documents are
+// typically verified as of their creation, because their certificates
+// expire after a few hours.  Documents that fail verification result in a
+// 200 response whose "valid" field is false; only malformed requests result
+// in an error status code.  Documents whose signing certificate is valid for
+// longer than the given maximum are invalid; if the maximum is 0,
+// defaultMaxDocumentValidity is used, and if it's negative, the validity
+// window isn't checked.
+func verifyHandler(maxValidity time.Duration) http.HandlerFunc {
+	maxBodyLen := base64.StdEncoding.EncodedLen(defaultMaxDocSize) + 2
+	switch {
+	case maxValidity == 0:
+		maxValidity = defaultMaxDocumentValidity
+	case maxValidity < 0:
+		maxValidity = 0
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := VerifyOptions{MaxValidity: maxValidity}
+		if at := r.URL.Query().Get("at"); at != "" {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				http.Error(w, errBadVerifyTime, http.StatusBadRequest)
+				return
+			}
+			opts.Now = func() time.Time { return t }
+		}
+
+		body, err := io.ReadAll(newLimitReader(r.Body, maxBodyLen))
+		if errors.Is(err, errTooMuchToRead) {
+			http.Error(w, errDocTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("Verify: Failed to read request body: %v", err)
+			http.Error(w, errBadDocBody, http.StatusBadRequest)
+			return
+		}
+		rawDoc := decodeDocument(body)
+		if len(rawDoc) > opts.maxDocumentSize() {
+			http.Error(w, errDocTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, verifyStored(rawDoc, opts))
+	}
+}
+
+// decodeDocument returns the raw attestation document in the given body,
+// which is either the raw document or its Base64 encoding.
+func decodeDocument(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if raw, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil {
+		return raw
+	}
+	return body
+}
+
+// verifyStored verifies the signature and certificate chain of the given
+// attestation document and describes the result.  Unlike verifyDocument, it
+// doesn't check a nonce or the document's age because stored documents are
+// verified long after they were requested.
+func verifyStored(rawDoc []byte, opts VerifyOptions) verifyResponse {
+	nopts, err := opts.nitriteOptions()
+	if err != nil {
+		return verifyResponse{Error: err.Error()}
+	}
+	res, err := nitrite.Verify(rawDoc, nopts)
+	if err != nil {
+		return verifyResponse{Error: err.Error()}
+	}
+	if err := checkValidity(res.Certificates, opts.MaxValidity); err != nil {
+		return verifyResponse{Error: err.Error()}
+	}
+
+	doc := res.Document
+	created := time.UnixMilli(int64(doc.Timestamp)).UTC()
+	resp := verifyResponse{
+		Valid:     true,
+		ModuleID:  doc.ModuleID,
+		Digest:    doc.Digest,
+		Timestamp: &created,
+		PCRs:      make(map[string]string, len(doc.PCRs)),
+		Nonce:     hex.EncodeToString(doc.Nonce),
+		UserData:  base64.StdEncoding.EncodeToString(doc.UserData),
+		PublicKey: base64.StdEncoding.EncodeToString(doc.PublicKey),
+	}
+	if len(res.Certificates) > 0 {
+		expires := certsExpiry(res.Certificates).UTC()
+		resp.Expires = &expires
+		resp.Warnings = opts.expiryWarnings(opts.now(), expires)
+	}
+	for i, pcr := range doc.PCRs {
+		resp.PCRs[strconv.FormatUint(uint64(i), 10)] = hex.EncodeToString(pcr)
+	}
+	return resp
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hf/nitrite"
+)
+
+// postVerify posts the given body to the verification endpoint of the given
+// handler and returns the decoded response.
+func postVerify(t *testing.T, h http.Handler, target string, body []byte) verifyResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var resp verifyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp
+}
+
+func TestVerifyHandlerTooLarge(t *testing.T) {
+	body := bytes.Repeat([]byte{0xff}, 2*defaultMaxDocSize)
+	w := httptest.NewRecorder()
+	verifyHandler(0)(w, httptest.NewRequest(http.MethodPost, pathVerify, bytes.NewReader(body)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d but got %d.", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestVerifyHandlerFixture(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	useRootFile(t, fixtureRootPath)
+	e := newTestEnclave(t, testConfig())
+	target := pathVerify + "?at=" + testEpoch.Format(time.RFC3339)
+
+	for name, body := range map[string][]byte{
+		"raw":    doc,
+		"base64": []byte(base64.StdEncoding.EncodeToString(doc) + "\n"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := postVerify(t, e.pubSrv.Handler, target, body)
+			if !resp.Valid {
+				t.Fatalf("Expected valid document but got error %q.", resp.Error)
+			}
+			if resp.Nonce != hex.EncodeToString(fixtureNonce) {
+				t.Errorf("Expected nonce %x but got %s.", fixtureNonce, resp.Nonce)
+			}
+			if resp.Timestamp == nil || !resp.Timestamp.Equal(testEpoch) {
+				t.Errorf("Expected timestamp %s but got %v.", testEpoch, resp.Timestamp)
+			}
+			if resp.Expires == nil || !resp.Expires.After(testEpoch) {
+				t.Errorf("Expected expiry after %s but got %v.", testEpoch, resp.Expires)
+			}
+			if len(resp.PCRs) == 0 || resp.PCRs["0"] == "" {
+				t.Errorf("Expected PCRs but got %v.", resp.PCRs)
+			}
+			if resp.ModuleID == "" || resp.Digest == "" {
+				t.Errorf("Expected module ID and digest but got %q and %q.", resp.ModuleID, resp.Digest)
+			}
+		})
+	}
+}
+
+func TestVerifyHandlerExpiryWarning(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	useRootFile(t, fixtureRootPath)
+	h := verifyHandler(0)
+
+	// The fixture's certificate expires two hours after testEpoch.
+	for _, c := range []struct {
+		at   time.Time
+		warn bool
+	}{
+		{testEpoch, false},
+		{testEpoch.Add(2*time.Hour - time.Minute), true},
+	} {
+		resp := postVerify(t, h, pathVerify+"?at="+c.at.Format(time.RFC3339), doc)
+		if !resp.Valid {
+			t.Fatalf("Expected valid document at %s but got error %q.", c.at, resp.Error)
+		}
+		if warned := len(resp.Warnings) > 0; warned != c.warn {
+			t.Errorf("Expected warning at %s to be %t but got %q.", c.at, c.warn, resp.Warnings)
+		}
+	}
+}
+
+func TestVerifyHandlerInvalid(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	useRootFile(t, fixtureRootPath)
+	tampered := append([]byte(nil), doc...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	cases := []struct {
+		name   string
+		target string
+		body   []byte
+	}{
+		{"expired certificates", pathVerify, doc},
+		{"tampered signature", pathVerify + "?at=" + testEpoch.Format(time.RFC3339), tampered},
+		{"garbage", pathVerify, []byte("not a document")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := postVerify(t, verifyHandler(0), c.target, c.body)
+			if resp.Valid || resp.Error == "" {
+				t.Fatalf("Expected invalid document with error but got %+v.", resp)
+			}
+			if resp.PCRs != nil || resp.Nonce != "" {
+				t.Fatalf("Expected no document fields for invalid document but got %+v.", resp)
+			}
+		})
+	}
+}
+
+func TestVerifyHandlerBadTime(t *testing.T) {
+	w := httptest.NewRecorder()
+	verifyHandler(0)(w, httptest.NewRequest(http.MethodPost, pathVerify+"?at=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
+
+// postVerifyCode posts the given document to the verification endpoint of
+// the given handler, and returns the status code.
+func postVerifyCode(h http.Handler, doc []byte) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, pathVerify, bytes.NewReader(doc)))
+	return w.Code
+}
+
+func TestVerifyHandlerPlacement(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	for _, internal := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.InternalVerify = internal
+		e := newTestEnclave(t, cfg)
+		pub, in := postVerifyCode(e.pubSrv.Handler, doc), postVerifyCode(e.intSrv.Handler, doc)
+		if internal && (pub == http.StatusOK || in != http.StatusOK) {
+			t.Errorf("Expected internal-only endpoint but got %d publicly and %d internally.", pub, in)
+		}
+		if !internal && (pub != http.StatusOK || in == http.StatusOK) {
+			t.Errorf("Expected public endpoint but got %d publicly and %d internally.", pub, in)
+		}
+	}
+}
+
+func TestVerifyHandlerRateLimit(t *testing.T) {
+	doc, _ := fixtureDocument(t)
+	for name, cfg := range map[string]*Config{
+		"default limit":    testConfig(),
+		"public API limit": func() *Config { c := testConfig(); c.RateLimit.Rate = 1; return c }(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := newTestEnclave(t, cfg)
+			limited := false
+			for i := 0; i < 2*defaultVerifyRateLimit && !limited; i++ {
+				limited = postVerifyCode(e.pubSrv.Handler, doc) == http.StatusTooManyRequests
+			}
+			if !limited {
+				t.Fatal("Expected a flood of verifications to be rate-limited.")
+			}
+		})
+	}
+}
+
+func TestVerifyHandlerMaxValidity(t *testing.T) {
+	short := newNSMTestPKI(t)
+	long := newTestPKI(t, testEpoch.Add(-time.Hour), testEpoch.Add(30*24*time.Hour))
+	keepRoots(t)
+	if err := loadRootFile(writeRootBundle(t, short, long)); err != nil {
+		t.Fatalf("Failed to load root file: %v", err)
+	}
+	target := pathVerify + "?at=" + testEpoch.Format(time.RFC3339)
+
+	cases := []struct {
+		name        string
+		pki         *testPKI
+		maxValidity time.Duration
+		wantValid   bool
+	}{
+		{"default accepts NSM window", short, 0, true},
+		{"default rejects overlong window", long, 0, false},
+		{"configured bound rejects", short, time.Hour, false},
+		{"configured bound accepts", long, 40 * 24 * time.Hour, true},
+		{"disabled", long, -1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc := c.pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+			resp := postVerify(t, verifyHandler(c.maxValidity), target, doc)
+			if resp.Valid != c.wantValid {
+				t.Fatalf("Expected valid to be %t but got %t: %q", c.wantValid, resp.Valid, resp.Error)
+			}
+			if !c.wantValid && !strings.Contains(resp.Error, ErrValidityTooLong.Error()) {
+				t.Errorf("Expected error %q but got %q.", ErrValidityTooLong, resp.Error)
+			}
+		})
+	}
+}
+
+func TestVerifyHandlerMaxValidityConfig(t *testing.T) {
+	pki := newNSMTestPKI(t)
+	keepRoots(t)
+	if err := loadRootFile(writeRootBundle(t, pki)); err != nil {
+		t.Fatalf("Failed to load root file: %v", err)
+	}
+	cfg := testConfig()
+	cfg.MaxDocumentValidity = time.Hour
+	e := newTestEnclave(t, cfg)
+
+	doc := pki.sign(t, nitrite.Document{Nonce: testNonceBytes})
+	resp := postVerify(t, e.pubSrv.Handler, pathVerify+"?at="+testEpoch.Format(time.RFC3339), doc)
+	if resp.Valid || !strings.Contains(resp.Error, ErrValidityTooLong.Error()) {
+		t.Fatalf("Expected error %q but got %+v.", ErrValidityTooLong, resp)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// viaPseudonym identifies our reverse proxy in Via headers.
+const viaPseudonym = "nitriding"
+
+// appendVia appends our entry to the Via header of a message with the given
+// protocol version, keeping the entries of previous hops, as RFC 9110
+// requires of proxies.  Note that httputil.ReverseProxy already appends the
+// client's address to X-Forwarded-For, after any client-supplied value was
+// stripped (see Config.StripRequestHeaders).
+func appendVia(h http.Header, major, minor int) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprintf("%d", major)
+	}
+	h.Add("Via", version+" "+viaPseudonym)
+}
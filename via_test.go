@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAppendVia(t *testing.T) {
+	for _, test := range []struct {
+		major, minor int
+		want         []string
+	}{
+		{1, 0, []string{"1.1 edge", "1.0 nitriding"}},
+		{1, 1, []string{"1.1 edge", "1.1 nitriding"}},
+		{2, 0, []string{"1.1 edge", "2 nitriding"}},
+	} {
+		h := http.Header{"Via": {"1.1 edge"}}
+		appendVia(h, test.major, test.minor)
+		if got := h.Values("Via"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Expected Via %q but got %q.", test.want, got)
+		}
+	}
+}
+
+// newChainedProxy returns an enclave whose reverse proxy forwards to a
+// backend that reports the Via and X-Forwarded-For headers that it sees.
+func newChainedProxy(t *testing.T, strip []string) *Enclave {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Via", strings.Join(r.Header.Values("Via"), ", "))
+		w.Header().Set("X-Seen-Forwarded-For", strings.Join(r.Header.Values("X-Forwarded-For"), ", "))
+		w.Header().Set("Via", "1.1 app")
+	}))
+	t.Cleanup(backend.Close)
+	cfg := testConfig()
+	cfg.AppWebSrv = mustParseURL(t, backend.URL)
+	cfg.StripRequestHeaders = strip
+	return newTestEnclave(t, cfg)
+}
+
+// proxyChainRequest sends a request that already passed through another
+// proxy.
+func proxyChainRequest(e *Enclave) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.RemoteAddr = "203.0.113.9:1234"
+	r.Header.Set("Via", "1.1 edge")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	w := httptest.NewRecorder()
+	e.pubSrv.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyChainAppendsHops(t *testing.T) {
+	// Behind a trusted proxy, forwarding headers are kept.
+	w := proxyChainRequest(newChainedProxy(t, []string{}))
+	if got, want := w.Header().Get("X-Seen-Via"), "1.1 edge, 1.1 nitriding"; got != want {
+		t.Errorf("Expected backend to see Via %q but got %q.", want, got)
+	}
+	if got, want := w.Header().Get("X-Seen-Forwarded-For"), "198.51.100.1, 203.0.113.9"; got != want {
+		t.Errorf("Expected backend to see X-Forwarded-For %q but got %q.", want, got)
+	}
+	if got, want := w.Header().Values("Via"), []string{"1.1 app", "1.1 nitriding"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected client to see Via %q but got %q.", want, got)
+	}
+}
+
+func TestProxyChainStripsSpoofedForwardedFor(t *testing.T) {
+	w := proxyChainRequest(newChainedProxy(t, nil))
+	if got, want := w.Header().Get("X-Seen-Forwarded-For"), "203.0.113.9"; got != want {
+		t.Errorf("Expected backend to see X-Forwarded-For %q but got %q.", want, got)
+	}
+	// Via isn't security-relevant, so earlier hops are always kept.
+	if got, want := w.Header().Get("X-Seen-Via"), "1.1 edge, 1.1 nitriding"; got != want {
+		t.Errorf("Expected backend to see Via %q but got %q.", want, got)
+	}
+}